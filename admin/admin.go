@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/dialer"
+	"github.com/sequring/chameleon/events"
+	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/session"
+	"github.com/sequring/chameleon/upgrade"
+	"github.com/sequring/chameleon/usage"
+)
+
+// Deps are the components the admin API operates on
+type Deps struct {
+	Pool *proxypool.Pool
+	// Pools are the named pools besides Pool
+	Pools       map[string]*proxypool.Pool
+	Definitions *config.ProxyDefinitionsManager
+	Users       *auth.MultiAuth
+	UsersFile   string
+	Sessions    *session.Registry
+	Dialer      *dialer.Dialer
+	// Usage is the monthly traffic store; nil when accounting is disabled
+	Usage *usage.Store
+	// Config and Version are included in diagnostics bundles (secrets redacted)
+	Config  *config.App
+	Version string
+	// Events feeds the event stream; nil disables it
+	Events *events.Hub
+}
+
+// Server is the administrative HTTP API
+type Server struct {
+	pool          *proxypool.Pool
+	pools         map[string]*proxypool.Pool
+	definitions   *config.ProxyDefinitionsManager
+	users         *auth.MultiAuth
+	usersFile     string
+	sessions      *session.Registry
+	dialer        *dialer.Dialer
+	usage         *usage.Store
+	config        *config.App
+	version       string
+	events        *events.Hub
+	listenAddress string
+	token         string
+	listener      net.Listener
+	server        *http.Server
+	stopping      chan struct{} // closed when the server shuts down, ending event streams
+	mu            sync.Mutex
+
+	ready              atomic.Bool  // reported by /readyz
+	requireActiveProxy atomic.Bool  // /readyz also requires an active proxy
+	userDebugDuration  atomic.Int64 // default debug mode duration in ns, set by SetUserDebugDuration
+}
+
+// New creates an admin API server. The server refuses to start if token is empty.
+func New(listenAddress, token string, deps Deps) *Server {
+	s := &Server{
+		pool:          deps.Pool,
+		pools:         deps.Pools,
+		definitions:   deps.Definitions,
+		users:         deps.Users,
+		usersFile:     deps.UsersFile,
+		sessions:      deps.Sessions,
+		dialer:        deps.Dialer,
+		usage:         deps.Usage,
+		config:        deps.Config,
+		version:       deps.Version,
+		events:        deps.Events,
+		listenAddress: listenAddress,
+		token:         token,
+	}
+	s.requireActiveProxy.Store(true)
+	return s
+}
+
+// Listen opens the admin API listener, adopting the previous process's socket
+// after an upgrade. Start calls it unless it was called before.
+func (s *Server) Listen() error {
+	if s.listenAddress == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+	if s.token == "" {
+		return fmt.Errorf("refusing to start admin API server on %s without server.admin_token", s.listenAddress)
+	}
+	l, err := upgrade.Listen("tcp", s.listenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to start admin API server: %w", err)
+	}
+	s.listener = l
+	return nil
+}
+
+// Start starts the admin HTTP server and blocks until it is stopped.
+// If the listen address is empty, it returns immediately with no error.
+func (s *Server) Start() error {
+	if s.listenAddress == "" {
+		log.Println("Admin API is disabled (no listen address specified).")
+		return nil
+	}
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.server != nil {
+		s.mu.Unlock()
+		log.Println("Admin API server is already running")
+		return nil
+	}
+	l := s.listener
+	s.server = &http.Server{
+		Addr:    s.listenAddress,
+		Handler: s.routes(),
+	}
+	stopping := make(chan struct{})
+	s.stopping = stopping
+	s.server.RegisterOnShutdown(func() { close(stopping) })
+	srv := s.server
+	s.mu.Unlock()
+
+	log.Printf("Starting admin API HTTP server on %s", s.listenAddress)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("failed to start admin API server: %w", err)
+	}
+	return nil
+}
+
+// Stop gracefully shuts down the admin HTTP server
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+
+	log.Println("Shutting down admin API server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	s.server = nil
+	s.listener = nil
+	return err
+}
+
+// routes builds the admin API request multiplexer. The health endpoints are
+// served without the admin token so orchestrators can probe them.
+func (s *Server) routes() http.Handler {
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", s.handleHealthz)
+	root.HandleFunc("GET /readyz", s.handleReadyz)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/proxies", s.handleListProxies)
+	mux.HandleFunc("POST /api/v1/proxies", s.handleCreateProxy)
+	mux.HandleFunc("GET /api/v1/proxies/{addr}", s.handleGetProxy)
+	mux.HandleFunc("PUT /api/v1/proxies/{addr}", s.handleUpdateProxy)
+	mux.HandleFunc("PATCH /api/v1/proxies/{addr}", s.handlePatchProxy)
+	mux.HandleFunc("DELETE /api/v1/proxies/{addr}", s.handleDeleteProxy)
+	mux.HandleFunc("POST /api/v1/proxies/import", s.handleImportProxies)
+	mux.HandleFunc("PUT /api/v1/proxies:import", s.handleReplaceProxies)
+	mux.HandleFunc("GET /api/v1/proxies/duplicates", s.handleListDuplicates)
+	mux.HandleFunc("GET /api/v1/proxies/rotation", s.handleRotationStatus)
+	mux.HandleFunc("POST /api/v1/proxies/check", s.handleCheckAll)
+	mux.HandleFunc("POST /api/v1/proxies/{addr}/check", s.handleCheckProxy)
+	mux.HandleFunc("GET /api/v1/pools", s.handleListPools)
+	mux.HandleFunc("GET /api/v1/users", s.handleListUsers)
+	mux.HandleFunc("GET /api/v1/users/{name}", s.handleGetUser)
+	mux.HandleFunc("PUT /api/v1/users/{name}", s.handlePutUser)
+	mux.HandleFunc("DELETE /api/v1/users/{name}", s.handleDeleteUser)
+	mux.HandleFunc("POST /api/v1/users/{name}/rotate", s.handleRotateUserPassword)
+	mux.HandleFunc("GET /api/v1/users/{name}/debug", s.handleGetUserDebug)
+	mux.HandleFunc("PUT /api/v1/users/{name}/debug", s.handleEnableUserDebug)
+	mux.HandleFunc("DELETE /api/v1/users/{name}/debug", s.handleDisableUserDebug)
+	mux.HandleFunc("GET /api/v1/debug/users", s.handleListUserDebug)
+	mux.HandleFunc("GET /api/v1/auth/failures", s.handleListAuthFailures)
+	mux.HandleFunc("GET /api/v1/auth/cache", s.handleListCredentialCache)
+	mux.HandleFunc("DELETE /api/v1/auth/cache", s.handleClearCredentialCache)
+	mux.HandleFunc("DELETE /api/v1/auth/cache/{name}", s.handleInvalidateCredentials)
+	mux.HandleFunc("GET /api/v1/sessions", s.handleListSessions)
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}", s.handleKillSession)
+	mux.HandleFunc("POST /api/route-test", s.handleRouteTest)
+	mux.HandleFunc("GET /api/v1/destinations/blacklist", s.handleListBlacklistedDestinations)
+	mux.HandleFunc("DELETE /api/v1/destinations/blacklist", s.handleClearBlacklistedDestinations)
+	mux.HandleFunc("POST "+reloadPath, s.handleReload)
+	mux.HandleFunc("POST /api/v1/reload/token", s.handleRotateReloadToken)
+	mux.HandleFunc("GET /api/v1/diagnostics", s.handleDiagnostics)
+	mux.HandleFunc("POST /api/v1/config/validate", s.handleValidateConfig)
+	mux.HandleFunc("GET /api/v1/usage", s.handleUsage)
+	mux.HandleFunc("GET /api/v1/events", s.handleEvents)
+	registerDebug(mux)
+	root.Handle("/", s.requireToken(mux))
+	return root
+}
+
+// requireToken rejects requests without a valid bearer token. The reload
+// endpoint also accepts the reload token in the X-Reload-Token header.
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isReloadRequest(r) {
+			provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(s.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "missing or invalid admin token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Admin API: failed to encode response: %v", err)
+	}
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
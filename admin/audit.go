@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// auditEvent is the audit record of an admin action on credentials
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Username string    `json:"username"`
+	SourceIP string    `json:"source_ip"`
+}
+
+// audit logs action on the credentials of username as a JSON line, like the
+// authentication audit does
+func audit(r *http.Request, action, username string) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ev := auditEvent{Time: time.Now(), Action: action, Username: username, SourceIP: ip}
+	if data, err := json.Marshal(ev); err == nil {
+		log.Printf("Admin audit: %s", data)
+	}
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"log"
+	"net/http"
+)
+
+// handleListBlacklistedDestinations returns the proxies currently avoided per destination
+func (s *Server) handleListBlacklistedDestinations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.dialer.BlacklistedDestinations())
+}
+
+// handleClearBlacklistedDestinations forgets all per-destination failure statistics
+func (s *Server) handleClearBlacklistedDestinations(w http.ResponseWriter, r *http.Request) {
+	cleared := s.dialer.ClearDestinationBlacklist()
+	log.Printf("Admin API: destination blacklist cleared (%d entries)", cleared)
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": cleared})
+}
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// diagnostics is the support bundle returned by GET /api/v1/diagnostics
+type diagnostics struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Version     string       `json:"version,omitempty"`
+	Runtime     runtimeStats `json:"runtime"`
+	Pool        poolStats    `json:"pool"`
+	Sessions    int          `json:"sessions"`
+	Config      *config.App  `json:"config,omitempty"`
+	Goroutines  string       `json:"goroutine_stacks"`
+}
+
+type runtimeStats struct {
+	GoVersion    string `json:"go_version"`
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+	NumCPU       int    `json:"num_cpu"`
+	Goroutines   int    `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	PendingDials int64  `json:"pending_dials"`
+	ActiveRelays int64  `json:"relay_goroutines"`
+}
+
+type poolStats struct {
+	Proxies          int         `json:"proxies"`
+	ActiveProxies    int         `json:"active_proxies"`
+	HealthCheckLoops int64       `json:"health_check_loops"`
+	Snapshot         []proxyView `json:"snapshot"`
+}
+
+// registerDebug adds the pprof and expvar handlers to mux, behind the admin token
+func registerDebug(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+}
+
+// handleDiagnostics returns goroutine stacks, runtime statistics, a pool snapshot
+// and the configuration with secrets redacted, as a downloadable JSON bundle
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	bundle := diagnostics{
+		GeneratedAt: now.UTC(),
+		Version:     s.version,
+		Runtime: runtimeStats{
+			GoVersion:  runtime.Version(),
+			GOMAXPROCS: runtime.GOMAXPROCS(0),
+			NumCPU:     runtime.NumCPU(),
+			Goroutines: runtime.NumGoroutine(),
+		},
+		Pool: poolStats{
+			Proxies:          s.pool.ProxyCount(),
+			ActiveProxies:    s.pool.ActiveProxyCount(),
+			HealthCheckLoops: s.pool.HealthLoopCount(),
+		},
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	bundle.Runtime.HeapAlloc = mem.HeapAlloc
+	bundle.Runtime.Sys = mem.Sys
+	bundle.Runtime.NumGC = mem.NumGC
+	if s.dialer != nil {
+		bundle.Runtime.PendingDials = s.dialer.PendingDials()
+		bundle.Runtime.ActiveRelays = s.dialer.ActiveRelays()
+	}
+
+	proxies := s.pool.GetProxiesSnapshot()
+	bundle.Pool.Snapshot = make([]proxyView, 0, len(proxies))
+	for _, proxy := range proxies {
+		bundle.Pool.Snapshot = append(bundle.Pool.Snapshot, newProxyView(proxy))
+	}
+
+	if s.sessions != nil {
+		bundle.Sessions = s.sessions.Count()
+	}
+	if s.config != nil {
+		redacted := s.config.Redacted()
+		bundle.Config = &redacted
+	}
+
+	var stacks bytes.Buffer
+	if err := rpprof.Lookup("goroutine").WriteTo(&stacks, 2); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to dump goroutines: %v", err))
+		return
+	}
+	bundle.Goroutines = stacks.String()
+
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="chameleon-diagnostics-%s.json"`, now.UTC().Format("20060102T150405Z")))
+	writeJSON(w, http.StatusOK, bundle)
+}
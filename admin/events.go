@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventBufferSize is how many events a slow event stream client may lag behind before events are dropped
+const eventBufferSize = 64
+
+// eventKeepalive is how often an idle event stream gets a comment line, so
+// that proxies and clients do not time the connection out
+const eventKeepalive = 15 * time.Second
+
+// handleEvents streams events as server-sent events until the client
+// disconnects or the server shuts down. ?types= limits the stream to a
+// comma-separated list of event types; a Last-Event-ID header (or
+// ?last_event_id=) replays the remembered events after that ID.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusNotFound, "event streaming is disabled")
+		return
+	}
+	var types map[string]bool
+	if param := r.URL.Query().Get("types"); param != "" {
+		types = make(map[string]bool)
+		for _, typ := range strings.Split(param, ",") {
+			if typ = strings.TrimSpace(typ); typ != "" {
+				types[typ] = true
+			}
+		}
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var after uint64
+	if lastID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid last event ID: "+lastID)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	stopping := s.stopping
+	s.mu.Unlock()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("Admin API: event stream does not support flushing: %v", err)
+		return
+	}
+
+	evs, cancel := s.events.Subscribe(eventBufferSize, after)
+	defer cancel()
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-evs:
+			if !ok {
+				return
+			}
+			if types != nil && !types[ev.Type] {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("Admin API: failed to encode event %s: %v", ev.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
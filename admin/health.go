@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// SetReady marks whether the process is ready to serve SOCKS traffic. It is set
+// once the configuration is loaded and the SOCKS listener is open, and cleared
+// on shutdown.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// SetRequireActiveProxy sets whether /readyz also requires at least one active,
+// enabled upstream proxy
+func (s *Server) SetRequireActiveProxy(require bool) {
+	s.requireActiveProxy.Store(require)
+}
+
+// handleHealthz reports liveness: the process is up and serving HTTP
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports readiness for new SOCKS connections
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	active := s.pool.ActiveProxyCount()
+	resp := map[string]any{
+		"status":         "ready",
+		"active_proxies": active,
+	}
+	switch {
+	case !s.ready.Load():
+		resp["status"] = "not ready"
+		resp["reason"] = "starting up or shutting down"
+	case active == 0 && s.requireActiveProxy.Load():
+		resp["status"] = "not ready"
+		resp["reason"] = "no active upstream proxies"
+	default:
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	writeJSON(w, http.StatusServiceUnavailable, resp)
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// poolView is the admin API representation of a proxy pool
+type poolView struct {
+	Name              string `json:"name"`
+	DefinitionsFile   string `json:"definitions_file,omitempty"`
+	HealthCheckTarget string `json:"health_check_target,omitempty"`
+	// HealthCheckTargets, when set, are checked instead of HealthCheckTarget
+	HealthCheckTargets []string `json:"health_check_targets,omitempty"`
+	Strategy           string   `json:"strategy"`
+	ListenAddr         string   `json:"listen_addr,omitempty"`
+	Proxies            int      `json:"proxies"`
+	ActiveProxies      int      `json:"active_proxies"`
+}
+
+func newPoolView(name string, pool *proxypool.Pool) poolView {
+	return poolView{Name: name, Strategy: string(pool.Strategy()), Proxies: pool.ProxyCount(), ActiveProxies: pool.ActiveProxyCount()}
+}
+
+// handleListPools returns the default pool followed by the named pools in
+// configuration order
+func (s *Server) handleListPools(w http.ResponseWriter, r *http.Request) {
+	def := newPoolView(config.DefaultPoolName, s.pool)
+	if s.config != nil {
+		def.DefinitionsFile = s.config.Proxies.ConfigFilePath
+		def.HealthCheckTarget = s.config.Proxies.HealthCheckTarget
+		def.HealthCheckTargets = s.config.Proxies.HealthCheckTargets
+		def.ListenAddr = s.config.Server.SocksPort
+	}
+	views := []poolView{def}
+	if s.config != nil {
+		for _, cfg := range s.config.Pools {
+			pool, ok := s.pools[cfg.Name]
+			if !ok {
+				continue
+			}
+			view := newPoolView(cfg.Name, pool)
+			view.DefinitionsFile = cfg.ConfigFilePath
+			view.HealthCheckTarget = cfg.HealthCheckTarget
+			view.HealthCheckTargets = cfg.HealthCheckTargets
+			view.ListenAddr = cfg.ListenAddr
+			views = append(views, view)
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,40 @@
+package admin
+
+import (
+	"log"
+	"net/http"
+)
+
+// reloadPath is the endpoint that also accepts the reload token
+const reloadPath = "/api/v1/reload"
+
+// handleReload re-reads the proxy definitions file and reconciles the pool with it
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if name, ok := s.definitions.MatchReloadToken(r.Header.Get("X-Reload-Token")); ok {
+		log.Printf("Admin API: reload requested with reload token '%s'", name)
+	}
+	if err := s.definitions.TriggerReload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"status":  "reloading",
+		"proxies": len(s.definitions.GetDefinitions()),
+	})
+}
+
+// handleRotateReloadToken replaces the reload token and returns the new one
+func (s *Server) handleRotateReloadToken(w http.ResponseWriter, r *http.Request) {
+	token, err := s.definitions.RotateReloadToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"reload_token": token})
+}
+
+// isReloadRequest reports whether r is a reload call authorized by the reload token
+func (s *Server) isReloadRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == reloadPath &&
+		s.definitions.CheckReloadToken(r.Header.Get("X-Reload-Token"))
+}
@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+type routeTestRequest struct {
+	Username    string `json:"username"`
+	Destination string `json:"destination"`
+}
+
+// handleRouteTest reports how a connection would be routed without dialing anything
+func (s *Server) handleRouteTest(w http.ResponseWriter, r *http.Request) {
+	var req routeTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Destination == "" {
+		writeError(w, http.StatusBadRequest, "destination is required")
+		return
+	}
+	if _, _, err := net.SplitHostPort(req.Destination); err != nil {
+		writeError(w, http.StatusBadRequest, "destination must be host:port: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.dialer.ExplainRoute(req.Username, req.Destination))
+}
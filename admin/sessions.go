@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/sequring/chameleon/session"
+)
+
+// handleListSessions returns all active SOCKS sessions
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.sessions.List())
+}
+
+// handleKillSession forcibly terminates a session, closing both connection ends
+func (s *Server) handleKillSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := s.sessions.Kill(id)
+	if errors.Is(err, session.ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, "session "+id+" not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: session %s terminated", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sequring/chameleon/usage"
+)
+
+// handleUsage exports the per-user traffic of a month (?month=2024-06, default
+// the current one) as JSON or, with ?format=csv, as CSV for billing
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if s.usage == nil {
+		writeError(w, http.StatusNotFound, "usage accounting is disabled (usage.enabled)")
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = s.usage.CurrentMonth()
+	} else if _, err := time.Parse(usage.MonthLayout, month); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid month '"+month+"', expected YYYY-MM")
+		return
+	}
+	report := s.usage.Report(month)
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage-`+month+`.csv"`)
+		_ = report.WriteCSV(w)
+	default:
+		writeError(w, http.StatusBadRequest, "invalid format '"+format+"', expected 'json' or 'csv'")
+	}
+}
@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultUserDebugDuration is how long a user's debug mode lasts unless
+// SetUserDebugDuration or the request sets another duration
+const DefaultUserDebugDuration = 15 * time.Minute
+
+// maxUserDebugDuration caps the duration a request may ask for
+const maxUserDebugDuration = 24 * time.Hour
+
+// SetUserDebugDuration sets how long a user's debug mode lasts when the
+// request enabling it does not say
+func (s *Server) SetUserDebugDuration(d time.Duration) {
+	s.userDebugDuration.Store(int64(d))
+}
+
+// userDebugView is the debug mode state of a user
+type userDebugView struct {
+	Username string     `json:"username"`
+	Enabled  bool       `json:"enabled"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// handleGetUserDebug reports whether a user's connections are logged in detail
+func (s *Server) handleGetUserDebug(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	view := userDebugView{Username: name}
+	if until, ok := s.dialer.UserDebugUntil(name); ok {
+		view.Enabled, view.Until = true, &until
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleEnableUserDebug logs a user's connection lifecycle in detail until the
+// optional duration_seconds of the body, or the default duration, has passed
+func (s *Server) handleEnableUserDebug(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var body struct {
+		DurationSecs int `json:"duration_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	duration := time.Duration(s.userDebugDuration.Load())
+	if duration <= 0 {
+		duration = DefaultUserDebugDuration
+	}
+	if body.DurationSecs != 0 {
+		duration = time.Duration(body.DurationSecs) * time.Second
+		if duration <= 0 || duration > maxUserDebugDuration {
+			writeError(w, http.StatusBadRequest, "duration_seconds must be between 1 and 86400")
+			return
+		}
+	}
+	until := s.dialer.EnableUserDebug(name, duration)
+	audit(r, "user_debug_enabled", name)
+	writeJSON(w, http.StatusOK, userDebugView{Username: name, Enabled: true, Until: &until})
+}
+
+// handleDisableUserDebug ends a user's debug mode before it expires
+func (s *Server) handleDisableUserDebug(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.dialer.DisableUserDebug(name) {
+		writeError(w, http.StatusNotFound, "debug mode is not enabled for user "+name)
+		return
+	}
+	audit(r, "user_debug_disabled", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListUserDebug lists the users in debug mode
+func (s *Server) handleListUserDebug(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.dialer.DebugUsers())
+}
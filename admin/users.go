@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/secrets"
+	"github.com/sequring/chameleon/utils"
+)
+
+// userView is the admin API representation of a SOCKS user. Passwords are never returned.
+type userView struct {
+	Username         string               `json:"username"`
+	Allowed          bool                 `json:"allowed"`
+	Tags             []string             `json:"tags,omitempty"`
+	UpstreamUsername string               `json:"upstream_username,omitempty"`
+	Country          string               `json:"country,omitempty"`
+	PinnedProxy      string               `json:"pinned_proxy,omitempty"`
+	PinFailover      string               `json:"pin_failover,omitempty"`
+	RotateExit       bool                 `json:"rotate_exit,omitempty"`
+	MaxSessions      int                  `json:"max_sessions,omitempty"`
+	Pool             string               `json:"pool,omitempty"`
+	PasswordFile     string               `json:"password_file,omitempty"`
+	Schedule         []auth.ScheduledTags `json:"schedule,omitempty"`
+}
+
+func newUserView(c auth.ClientConfig) userView {
+	return userView{Username: c.Username, Allowed: c.Allowed, Tags: c.Tags, UpstreamUsername: c.UpstreamUsername, Country: c.Country,
+		PinnedProxy: c.PinnedProxy, PinFailover: c.PinFailover, RotateExit: c.RotateExit, MaxSessions: c.MaxSessions, Pool: c.Pool, PasswordFile: c.PasswordFile,
+		Schedule: c.Schedule}
+}
+
+// persistUsers writes the current user set back to the users file
+func (s *Server) persistUsers() error {
+	return s.saveUsers(s.users.ListClients())
+}
+
+// saveUsers writes users to the users file, if there is one
+func (s *Server) saveUsers(users []auth.ClientConfig) error {
+	if s.usersFile == "" {
+		return nil
+	}
+	return auth.SaveUsersToFile(s.usersFile, users)
+}
+
+// errPasswordFromFile is returned when rotating a password read from a file
+var errPasswordFromFile = errors.New("the password is read from")
+
+// handleListUsers returns every configured SOCKS user
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	clients := s.users.ListClients()
+	views := make([]userView, 0, len(clients))
+	for _, c := range clients {
+		views = append(views, newUserView(c))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleGetUser returns a single SOCKS user
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	c, err := s.users.GetClient(r.PathValue("name"))
+	if errors.Is(err, auth.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserView(c))
+}
+
+// handlePutUser creates or replaces a SOCKS user and persists the users file.
+// An empty password or upstream_password keeps the existing one of an existing user.
+func (s *Server) handlePutUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var c auth.ClientConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	c.Username = name
+	if err := c.ValidatePin(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.ValidateTags(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.ValidateSchedule(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.ValidatePasswords(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	existing, err := s.users.GetClient(name)
+	switch {
+	case c.PasswordFile != "":
+		if err := secrets.LoadFile(&c.Password, c.PasswordFile); err != nil {
+			writeError(w, http.StatusBadRequest, "password_file: "+err.Error())
+			return
+		}
+	case c.Password == "":
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "password is required for new users")
+			return
+		}
+		c.Password, c.PasswordFile = existing.Password, existing.PasswordFile
+	}
+	if c.UpstreamUsername != "" && c.UpstreamPassword == "" && err == nil {
+		c.UpstreamPassword = existing.UpstreamPassword
+	}
+	s.users.UpsertClient(c)
+	if err := s.persistUsers(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: user %s saved", name)
+	saved, _ := s.users.GetClient(name)
+	writeJSON(w, http.StatusOK, newUserView(saved))
+}
+
+// handleDeleteUser removes a SOCKS user and persists the users file
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.users.RemoveClient(name); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := s.persistUsers(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Admin API: user %s removed", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRotateUserPassword replaces the password of a SOCKS user with a random
+// one, persists the users file and returns the new password. It is not shown again.
+func (s *Server) handleRotateUserPassword(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	password, err := utils.GenerateRandomSecurePassword()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the new password is only used once it is saved
+	c, err := s.users.UpdateClient(name, func(c *auth.ClientConfig) error {
+		if c.PasswordFile != "" {
+			return fmt.Errorf("user %s: %w %s; rotate that file instead", name, errPasswordFromFile, c.PasswordFile)
+		}
+		c.Password = password
+		return nil
+	}, s.saveUsers)
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, errPasswordFromFile):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "failed to save the users file, the password is unchanged: "+err.Error())
+		return
+	}
+	audit(r, "password_rotated", name)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"username": c.Username, "password": password})
+}
+
+// handleListAuthFailures returns the source IPs with failed SOCKS logins within
+// the failure window, most failures first. ?min=N lists only IPs with at least N.
+func (s *Server) handleListAuthFailures(w http.ResponseWriter, r *http.Request) {
+	min := 1
+	if v := r.URL.Query().Get("min"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "min must be a positive integer")
+			return
+		}
+		min = n
+	}
+	failing := s.users.Auditor().FailingIPs(min)
+	if failing == nil {
+		failing = []auth.IPFailures{}
+	}
+	writeJSON(w, http.StatusOK, failing)
+}
+
+// handleListCredentialCache returns the cached logins of users admitted by an
+// external backend (the directory or an access token)
+func (s *Server) handleListCredentialCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.users.CredentialCache().Logins())
+}
+
+// handleClearCredentialCache forgets all cached logins, so every external
+// user is checked against its backend again on its next connection
+func (s *Server) handleClearCredentialCache(w http.ResponseWriter, r *http.Request) {
+	cleared := s.users.CredentialCache().Clear()
+	log.Printf("Admin API: credential cache cleared (%d logins)", cleared)
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": cleared})
+}
+
+// handleInvalidateCredentials forgets the cached login of one user
+func (s *Server) handleInvalidateCredentials(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.users.CredentialCache().Invalidate(name) {
+		writeError(w, http.StatusNotFound, "no cached login for user "+name)
+		return
+	}
+	log.Printf("Admin API: cached login of user '%s' invalidated", name)
+	w.WriteHeader(http.StatusNoContent)
+}
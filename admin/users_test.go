@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sequring/chameleon/auth"
+)
+
+const testToken = "admin-token"
+
+// newTestServer returns the routes of an admin API serving users, saved to usersFile
+func newTestServer(t *testing.T, usersFile string, users ...auth.ClientConfig) (http.Handler, *auth.MultiAuth) {
+	t.Helper()
+	store := auth.New()
+	for _, c := range users {
+		store.UpsertClient(c)
+	}
+	s := New("127.0.0.1:0", testToken, Deps{Users: store, UsersFile: usersFile})
+	return s.routes(), store
+}
+
+// do sends an authenticated request to h and returns the response
+func do(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRotateUserPassword(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	h, store := newTestServer(t, usersFile, auth.ClientConfig{Username: "alice", Password: "old", Allowed: true})
+
+	rec := do(t, h, http.MethodPost, "/api/v1/users/alice/rotate", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var rotated struct{ Username, Password string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &rotated); err != nil || rotated.Password == "" || rotated.Password == "old" {
+		t.Fatalf("rotate response = %s, %v; want a new password", rec.Body, err)
+	}
+	if c, _ := store.GetClient("alice"); c.Password != rotated.Password {
+		t.Errorf("stored password = %q, want the returned one", c.Password)
+	}
+	data, err := os.ReadFile(usersFile)
+	if err != nil || !strings.Contains(string(data), rotated.Password) {
+		t.Errorf("users file = %s, %v; want the new password saved", data, err)
+	}
+
+	if rec := do(t, h, http.MethodPost, "/api/v1/users/bob/rotate", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("rotate of an unknown user = %d, want 404", rec.Code)
+	}
+}
+
+func TestRotateUserPasswordSaveFailure(t *testing.T) {
+	// the users file cannot be written into a directory that does not exist
+	usersFile := filepath.Join(t.TempDir(), "missing", "users.json")
+	h, store := newTestServer(t, usersFile, auth.ClientConfig{Username: "alice", Password: "old", Allowed: true})
+
+	rec := do(t, h, http.MethodPost, "/api/v1/users/alice/rotate", "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("rotate = %d %s, want 500", rec.Code, rec.Body)
+	}
+	if c, _ := store.GetClient("alice"); c.Password != "old" {
+		t.Fatalf("stored password = %q after a failed save, want the old one kept", c.Password)
+	}
+}
+
+func TestRotateUserPasswordFromFile(t *testing.T) {
+	h, store := newTestServer(t, "", auth.ClientConfig{Username: "alice", Password: "from-file", PasswordFile: "/run/secrets/alice", Allowed: true})
+	rec := do(t, h, http.MethodPost, "/api/v1/users/alice/rotate", "")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "/run/secrets/alice") {
+		t.Fatalf("rotate = %d %s, want 409 naming the password file", rec.Code, rec.Body)
+	}
+	if c, _ := store.GetClient("alice"); c.Password != "from-file" {
+		t.Fatalf("stored password = %q, want it unchanged", c.Password)
+	}
+}
+
+func TestUserScheduleReadBack(t *testing.T) {
+	h, _ := newTestServer(t, filepath.Join(t.TempDir(), "users.json"))
+	const body = `{"password": "secret", "allowed": true, "tags": ["residential"],
+		"schedule": [{"when": "* 0-7 * * *", "tags": ["datacenter"]}]}`
+
+	type view struct {
+		Username string
+		Schedule []auth.ScheduledTags
+	}
+	decodeOK := func(name string, rec *httptest.ResponseRecorder, decoded any) {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s = %d %s, want 200", name, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), decoded); err != nil {
+			t.Fatalf("%s response %s: %v", name, rec.Body, err)
+		}
+	}
+	wantSchedule := func(name string, v view) {
+		t.Helper()
+		if len(v.Schedule) != 1 || v.Schedule[0].When != "* 0-7 * * *" || strings.Join(v.Schedule[0].Tags, ",") != "datacenter" {
+			t.Errorf("%s schedule = %+v, want the schedule that was set", name, v.Schedule)
+		}
+	}
+
+	var put view
+	decodeOK("PUT", do(t, h, http.MethodPut, "/api/v1/users/alice", body), &put)
+	wantSchedule("PUT", put)
+	var got view
+	decodeOK("GET", do(t, h, http.MethodGet, "/api/v1/users/alice", ""), &got)
+	wantSchedule("GET", got)
+	var list []view
+	decodeOK("list", do(t, h, http.MethodGet, "/api/v1/users", ""), &list)
+	if len(list) != 1 {
+		t.Fatalf("list = %+v, want alice only", list)
+	}
+	wantSchedule("list", list[0])
+
+	if rec := do(t, h, http.MethodPut, "/api/v1/users/bob", `{"password": "secret", "schedule": [{"when": "not a window", "tags": ["x"]}]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT with an invalid schedule = %d, want 400", rec.Code)
+	}
+}
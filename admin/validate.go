@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/config"
+)
+
+// validateResult is the response of a validation dry run
+type validateResult struct {
+	Kind   string                   `json:"kind"`
+	Valid  bool                     `json:"valid"`
+	Errors []config.ValidationError `json:"errors"`
+}
+
+// handleValidateConfig checks a candidate proxies file (?kind=proxies) or users
+// file (?kind=users) from the request body and reports every problem with its
+// line and column. The candidate is YAML if the configured file is. Nothing is
+// applied or written.
+func (s *Server) handleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	if kind != "proxies" && kind != "users" {
+		writeError(w, http.StatusBadRequest, "kind must be 'proxies' or 'users'")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+		return
+	}
+	var errs []config.ValidationError
+	if kind == "proxies" {
+		errs = s.definitions.ValidateData(data)
+	} else {
+		errs = auth.ValidateUsersData(data, config.IsYAMLFile(s.usersFile))
+	}
+	if errs == nil {
+		errs = []config.ValidationError{}
+	}
+	writeJSON(w, http.StatusOK, validateResult{Kind: kind, Valid: len(errs) == 0, Errors: errs})
+}
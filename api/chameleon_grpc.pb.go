@@ -0,0 +1,581 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: api/chameleon.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ChameleonAdmin_ListProxies_FullMethodName  = "/chameleon.v1.ChameleonAdmin/ListProxies"
+	ChameleonAdmin_GetProxy_FullMethodName     = "/chameleon.v1.ChameleonAdmin/GetProxy"
+	ChameleonAdmin_CreateProxy_FullMethodName  = "/chameleon.v1.ChameleonAdmin/CreateProxy"
+	ChameleonAdmin_UpdateProxy_FullMethodName  = "/chameleon.v1.ChameleonAdmin/UpdateProxy"
+	ChameleonAdmin_DeleteProxy_FullMethodName  = "/chameleon.v1.ChameleonAdmin/DeleteProxy"
+	ChameleonAdmin_CheckProxy_FullMethodName   = "/chameleon.v1.ChameleonAdmin/CheckProxy"
+	ChameleonAdmin_ListUsers_FullMethodName    = "/chameleon.v1.ChameleonAdmin/ListUsers"
+	ChameleonAdmin_GetUser_FullMethodName      = "/chameleon.v1.ChameleonAdmin/GetUser"
+	ChameleonAdmin_PutUser_FullMethodName      = "/chameleon.v1.ChameleonAdmin/PutUser"
+	ChameleonAdmin_DeleteUser_FullMethodName   = "/chameleon.v1.ChameleonAdmin/DeleteUser"
+	ChameleonAdmin_ListSessions_FullMethodName = "/chameleon.v1.ChameleonAdmin/ListSessions"
+	ChameleonAdmin_KillSession_FullMethodName  = "/chameleon.v1.ChameleonAdmin/KillSession"
+	ChameleonAdmin_WatchEvents_FullMethodName  = "/chameleon.v1.ChameleonAdmin/WatchEvents"
+)
+
+// ChameleonAdminClient is the client API for ChameleonAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChameleonAdminClient interface {
+	ListProxies(ctx context.Context, in *ListProxiesRequest, opts ...grpc.CallOption) (*ListProxiesResponse, error)
+	GetProxy(ctx context.Context, in *GetProxyRequest, opts ...grpc.CallOption) (*Proxy, error)
+	CreateProxy(ctx context.Context, in *CreateProxyRequest, opts ...grpc.CallOption) (*Proxy, error)
+	UpdateProxy(ctx context.Context, in *UpdateProxyRequest, opts ...grpc.CallOption) (*Proxy, error)
+	DeleteProxy(ctx context.Context, in *DeleteProxyRequest, opts ...grpc.CallOption) (*DeleteProxyResponse, error)
+	CheckProxy(ctx context.Context, in *CheckProxyRequest, opts ...grpc.CallOption) (*Proxy, error)
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error)
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error)
+	PutUser(ctx context.Context, in *PutUserRequest, opts ...grpc.CallOption) (*User, error)
+	DeleteUser(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*DeleteUserResponse, error)
+	ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error)
+	KillSession(ctx context.Context, in *KillSessionRequest, opts ...grpc.CallOption) (*KillSessionResponse, error)
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type chameleonAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChameleonAdminClient(cc grpc.ClientConnInterface) ChameleonAdminClient {
+	return &chameleonAdminClient{cc}
+}
+
+func (c *chameleonAdminClient) ListProxies(ctx context.Context, in *ListProxiesRequest, opts ...grpc.CallOption) (*ListProxiesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListProxiesResponse)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_ListProxies_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) GetProxy(ctx context.Context, in *GetProxyRequest, opts ...grpc.CallOption) (*Proxy, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Proxy)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_GetProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) CreateProxy(ctx context.Context, in *CreateProxyRequest, opts ...grpc.CallOption) (*Proxy, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Proxy)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_CreateProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) UpdateProxy(ctx context.Context, in *UpdateProxyRequest, opts ...grpc.CallOption) (*Proxy, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Proxy)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_UpdateProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) DeleteProxy(ctx context.Context, in *DeleteProxyRequest, opts ...grpc.CallOption) (*DeleteProxyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteProxyResponse)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_DeleteProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) CheckProxy(ctx context.Context, in *CheckProxyRequest, opts ...grpc.CallOption) (*Proxy, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Proxy)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_CheckProxy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListUsersResponse)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_ListUsers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(User)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_GetUser_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) PutUser(ctx context.Context, in *PutUserRequest, opts ...grpc.CallOption) (*User, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(User)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_PutUser_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) DeleteUser(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*DeleteUserResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteUserResponse)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_DeleteUser_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) ListSessions(ctx context.Context, in *ListSessionsRequest, opts ...grpc.CallOption) (*ListSessionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSessionsResponse)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_ListSessions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) KillSession(ctx context.Context, in *KillSessionRequest, opts ...grpc.CallOption) (*KillSessionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(KillSessionResponse)
+	err := c.cc.Invoke(ctx, ChameleonAdmin_KillSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chameleonAdminClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChameleonAdmin_ServiceDesc.Streams[0], ChameleonAdmin_WatchEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchEventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChameleonAdmin_WatchEventsClient = grpc.ServerStreamingClient[Event]
+
+// ChameleonAdminServer is the server API for ChameleonAdmin service.
+// All implementations must embed UnimplementedChameleonAdminServer
+// for forward compatibility.
+type ChameleonAdminServer interface {
+	ListProxies(context.Context, *ListProxiesRequest) (*ListProxiesResponse, error)
+	GetProxy(context.Context, *GetProxyRequest) (*Proxy, error)
+	CreateProxy(context.Context, *CreateProxyRequest) (*Proxy, error)
+	UpdateProxy(context.Context, *UpdateProxyRequest) (*Proxy, error)
+	DeleteProxy(context.Context, *DeleteProxyRequest) (*DeleteProxyResponse, error)
+	CheckProxy(context.Context, *CheckProxyRequest) (*Proxy, error)
+	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
+	GetUser(context.Context, *GetUserRequest) (*User, error)
+	PutUser(context.Context, *PutUserRequest) (*User, error)
+	DeleteUser(context.Context, *DeleteUserRequest) (*DeleteUserResponse, error)
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	KillSession(context.Context, *KillSessionRequest) (*KillSessionResponse, error)
+	WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedChameleonAdminServer()
+}
+
+// UnimplementedChameleonAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedChameleonAdminServer struct{}
+
+func (UnimplementedChameleonAdminServer) ListProxies(context.Context, *ListProxiesRequest) (*ListProxiesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListProxies not implemented")
+}
+func (UnimplementedChameleonAdminServer) GetProxy(context.Context, *GetProxyRequest) (*Proxy, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetProxy not implemented")
+}
+func (UnimplementedChameleonAdminServer) CreateProxy(context.Context, *CreateProxyRequest) (*Proxy, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateProxy not implemented")
+}
+func (UnimplementedChameleonAdminServer) UpdateProxy(context.Context, *UpdateProxyRequest) (*Proxy, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateProxy not implemented")
+}
+func (UnimplementedChameleonAdminServer) DeleteProxy(context.Context, *DeleteProxyRequest) (*DeleteProxyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteProxy not implemented")
+}
+func (UnimplementedChameleonAdminServer) CheckProxy(context.Context, *CheckProxyRequest) (*Proxy, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckProxy not implemented")
+}
+func (UnimplementedChameleonAdminServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedChameleonAdminServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedChameleonAdminServer) PutUser(context.Context, *PutUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutUser not implemented")
+}
+func (UnimplementedChameleonAdminServer) DeleteUser(context.Context, *DeleteUserRequest) (*DeleteUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUser not implemented")
+}
+func (UnimplementedChameleonAdminServer) ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSessions not implemented")
+}
+func (UnimplementedChameleonAdminServer) KillSession(context.Context, *KillSessionRequest) (*KillSessionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KillSession not implemented")
+}
+func (UnimplementedChameleonAdminServer) WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedChameleonAdminServer) mustEmbedUnimplementedChameleonAdminServer() {}
+func (UnimplementedChameleonAdminServer) testEmbeddedByValue()                        {}
+
+// UnsafeChameleonAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChameleonAdminServer will
+// result in compilation errors.
+type UnsafeChameleonAdminServer interface {
+	mustEmbedUnimplementedChameleonAdminServer()
+}
+
+func RegisterChameleonAdminServer(s grpc.ServiceRegistrar, srv ChameleonAdminServer) {
+	// If the following call pancis, it indicates UnimplementedChameleonAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ChameleonAdmin_ServiceDesc, srv)
+}
+
+func _ChameleonAdmin_ListProxies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListProxiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).ListProxies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_ListProxies_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).ListProxies(ctx, req.(*ListProxiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_GetProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).GetProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_GetProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).GetProxy(ctx, req.(*GetProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_CreateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).CreateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_CreateProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).CreateProxy(ctx, req.(*CreateProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_UpdateProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).UpdateProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_UpdateProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).UpdateProxy(ctx, req.(*UpdateProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_DeleteProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).DeleteProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_DeleteProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).DeleteProxy(ctx, req.(*DeleteProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_CheckProxy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckProxyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).CheckProxy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_CheckProxy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).CheckProxy(ctx, req.(*CheckProxyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_ListUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).ListUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_ListUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).ListUsers(ctx, req.(*ListUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_GetUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_PutUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).PutUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_PutUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).PutUser(ctx, req.(*PutUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_DeleteUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).DeleteUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_DeleteUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).DeleteUser(ctx, req.(*DeleteUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_ListSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).ListSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_ListSessions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).ListSessions(ctx, req.(*ListSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_KillSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KillSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChameleonAdminServer).KillSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChameleonAdmin_KillSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChameleonAdminServer).KillSession(ctx, req.(*KillSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChameleonAdmin_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChameleonAdminServer).WatchEvents(m, &grpc.GenericServerStream[WatchEventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChameleonAdmin_WatchEventsServer = grpc.ServerStreamingServer[Event]
+
+// ChameleonAdmin_ServiceDesc is the grpc.ServiceDesc for ChameleonAdmin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChameleonAdmin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chameleon.v1.ChameleonAdmin",
+	HandlerType: (*ChameleonAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListProxies",
+			Handler:    _ChameleonAdmin_ListProxies_Handler,
+		},
+		{
+			MethodName: "GetProxy",
+			Handler:    _ChameleonAdmin_GetProxy_Handler,
+		},
+		{
+			MethodName: "CreateProxy",
+			Handler:    _ChameleonAdmin_CreateProxy_Handler,
+		},
+		{
+			MethodName: "UpdateProxy",
+			Handler:    _ChameleonAdmin_UpdateProxy_Handler,
+		},
+		{
+			MethodName: "DeleteProxy",
+			Handler:    _ChameleonAdmin_DeleteProxy_Handler,
+		},
+		{
+			MethodName: "CheckProxy",
+			Handler:    _ChameleonAdmin_CheckProxy_Handler,
+		},
+		{
+			MethodName: "ListUsers",
+			Handler:    _ChameleonAdmin_ListUsers_Handler,
+		},
+		{
+			MethodName: "GetUser",
+			Handler:    _ChameleonAdmin_GetUser_Handler,
+		},
+		{
+			MethodName: "PutUser",
+			Handler:    _ChameleonAdmin_PutUser_Handler,
+		},
+		{
+			MethodName: "DeleteUser",
+			Handler:    _ChameleonAdmin_DeleteUser_Handler,
+		},
+		{
+			MethodName: "ListSessions",
+			Handler:    _ChameleonAdmin_ListSessions_Handler,
+		},
+		{
+			MethodName: "KillSession",
+			Handler:    _ChameleonAdmin_KillSession_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _ChameleonAdmin_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/chameleon.proto",
+}
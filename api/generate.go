@@ -0,0 +1,8 @@
+// Package api implements the gRPC admin/control API.
+//
+// The generated code in chameleon.pb.go and chameleon_grpc.pb.go is produced
+// from chameleon.proto; regenerate it with `go generate ./api` after editing
+// the schema.
+package api
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative --proto_path=.. api/chameleon.proto
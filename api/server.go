@@ -0,0 +1,459 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/session"
+	"github.com/sequring/chameleon/upgrade"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventBufferSize is how many pool events a slow WatchEvents client may lag behind before events are dropped
+const eventBufferSize = 64
+
+// shutdownTimeout bounds how long Stop waits for in-flight calls
+const shutdownTimeout = 5 * time.Second
+
+// Deps are the components the gRPC API operates on
+type Deps struct {
+	Pool        *proxypool.Pool
+	Definitions *config.ProxyDefinitionsManager
+	Users       *auth.MultiAuth
+	UsersFile   string
+	Sessions    *session.Registry
+}
+
+// Server is the gRPC admin/control API
+type Server struct {
+	UnimplementedChameleonAdminServer
+
+	pool          *proxypool.Pool
+	definitions   *config.ProxyDefinitionsManager
+	users         *auth.MultiAuth
+	usersFile     string
+	sessions      *session.Registry
+	listenAddress string
+	token         string
+	listener      net.Listener
+	server        *grpc.Server
+	mu            sync.Mutex
+}
+
+// New creates a gRPC API server. The server refuses to start if token is empty.
+func New(listenAddress, token string, deps Deps) *Server {
+	return &Server{
+		pool:          deps.Pool,
+		definitions:   deps.Definitions,
+		users:         deps.Users,
+		usersFile:     deps.UsersFile,
+		sessions:      deps.Sessions,
+		listenAddress: listenAddress,
+		token:         token,
+	}
+}
+
+// Listen opens the gRPC API listener, adopting the previous process's socket
+// after an upgrade. Start calls it unless it was called before.
+func (s *Server) Listen() error {
+	if s.listenAddress == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return nil
+	}
+	if s.token == "" {
+		return fmt.Errorf("refusing to start gRPC API server on %s without server.admin_token", s.listenAddress)
+	}
+	l, err := upgrade.Listen("tcp", s.listenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for gRPC API: %w", s.listenAddress, err)
+	}
+	s.listener = l
+	return nil
+}
+
+// Start starts the gRPC server and blocks until it is stopped.
+// If the listen address is empty, it returns immediately with no error.
+func (s *Server) Start() error {
+	if s.listenAddress == "" {
+		log.Println("gRPC API is disabled (no listen address specified).")
+		return nil
+	}
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.server != nil {
+		s.mu.Unlock()
+		log.Println("gRPC API server is already running")
+		return nil
+	}
+	l := s.listener
+	s.server = grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
+	)
+	RegisterChameleonAdminServer(s.server, s)
+	srv := s.server
+	s.mu.Unlock()
+
+	log.Printf("Starting gRPC API server on %s", s.listenAddress)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("failed to start gRPC API server: %w", err)
+	}
+	return nil
+}
+
+// Stop gracefully shuts down the gRPC server. Open event streams never finish on
+// their own, so they are cut off once the shutdown timeout expires.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.server == nil {
+		return
+	}
+
+	log.Println("Shutting down gRPC API server...")
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		s.server.Stop()
+	}
+	s.server = nil
+	s.listener = nil
+}
+
+// authorize checks the bearer token in the "authorization" metadata of ctx
+func (s *Server) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		provided, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && s.token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+func (s *Server) unaryAuth(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuth(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// proxyMessage converts a pool proxy to its API message; the password is never returned
+func proxyMessage(proxy proxypool.ProxySnapshot) *Proxy {
+	msg := &Proxy{
+		Id:             proxy.ID,
+		Address:        proxy.Address,
+		Username:       proxy.Username,
+		Tags:           proxy.Tags,
+		Description:    proxy.Description,
+		State:          string(proxy.State),
+		ResponseTimeMs: proxy.ResponseTime.Milliseconds(),
+		Enabled:        proto.Bool(!proxy.Disabled),
+	}
+	if !proxy.LastCheck.IsZero() {
+		msg.LastCheck = timestamppb.New(proxy.LastCheck)
+	}
+	return msg
+}
+
+// messageForDefinition converts def to its API message, including runtime state if it is in the pool
+func (s *Server) messageForDefinition(def config.ProxyDefinition) *Proxy {
+	if proxy, err := s.pool.FindProxy(def.Address); err == nil {
+		return proxyMessage(proxy.Snapshot())
+	}
+	return &Proxy{
+		Id:          def.ID,
+		Address:     def.Address,
+		Username:    def.Username,
+		Tags:        def.Tags,
+		Description: def.Description,
+		Enabled:     proto.Bool(def.IsEnabled()),
+	}
+}
+
+// definitionFromMessage converts an API proxy message to a definition
+func definitionFromMessage(msg *Proxy) config.ProxyDefinition {
+	if msg == nil {
+		return config.ProxyDefinition{}
+	}
+	return config.ProxyDefinition{
+		ID:          msg.GetId(),
+		Address:     msg.GetAddress(),
+		Username:    msg.GetUsername(),
+		Password:    msg.GetPassword(),
+		Tags:        msg.GetTags(),
+		Description: msg.GetDescription(),
+		Enabled:     msg.Enabled,
+	}
+}
+
+// definitionError maps definitions manager errors to gRPC status codes
+func definitionError(err error) error {
+	switch {
+	case errors.Is(err, config.ErrDefinitionNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, config.ErrDuplicateAddress):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, config.ErrTextProxyList):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
+
+// reconcile applies definition changes to the running pool
+func (s *Server) reconcile() {
+	if err := s.pool.Reconcile(); err != nil {
+		log.Printf("gRPC API: failed to reconcile proxy pool: %v", err)
+	}
+}
+
+// ListProxies returns every defined proxy with its health state
+func (s *Server) ListProxies(ctx context.Context, _ *ListProxiesRequest) (*ListProxiesResponse, error) {
+	defs := s.definitions.GetDefinitions()
+	resp := &ListProxiesResponse{Proxies: make([]*Proxy, 0, len(defs))}
+	for _, def := range defs {
+		resp.Proxies = append(resp.Proxies, s.messageForDefinition(def))
+	}
+	return resp, nil
+}
+
+// GetProxy returns a single proxy referenced by address or ID
+func (s *Server) GetProxy(ctx context.Context, req *GetProxyRequest) (*Proxy, error) {
+	def, err := s.definitions.FindDefinition(req.GetRef())
+	if err != nil {
+		return nil, definitionError(err)
+	}
+	return s.messageForDefinition(def), nil
+}
+
+// CreateProxy adds a proxy definition, persists it and starts its health check
+func (s *Server) CreateProxy(ctx context.Context, req *CreateProxyRequest) (*Proxy, error) {
+	created, err := s.definitions.AddDefinition(definitionFromMessage(req.GetProxy()))
+	if err != nil {
+		return nil, definitionError(err)
+	}
+	s.reconcile()
+	log.Printf("gRPC API: proxy %s added", created.Address)
+	return s.messageForDefinition(created), nil
+}
+
+// UpdateProxy replaces a proxy definition referenced by address or ID
+func (s *Server) UpdateProxy(ctx context.Context, req *UpdateProxyRequest) (*Proxy, error) {
+	updated, err := s.definitions.UpdateDefinition(req.GetRef(), definitionFromMessage(req.GetProxy()))
+	if err != nil {
+		return nil, definitionError(err)
+	}
+	s.reconcile()
+	log.Printf("gRPC API: proxy %s updated", updated.Address)
+	return s.messageForDefinition(updated), nil
+}
+
+// DeleteProxy removes a proxy definition referenced by address or ID
+func (s *Server) DeleteProxy(ctx context.Context, req *DeleteProxyRequest) (*DeleteProxyResponse, error) {
+	if err := s.definitions.RemoveDefinition(req.GetRef()); err != nil {
+		return nil, definitionError(err)
+	}
+	s.reconcile()
+	log.Printf("gRPC API: proxy %s removed", req.GetRef())
+	return &DeleteProxyResponse{}, nil
+}
+
+// CheckProxy runs an immediate health check for a single proxy and returns its new state
+func (s *Server) CheckProxy(ctx context.Context, req *CheckProxyRequest) (*Proxy, error) {
+	if _, err := s.pool.CheckNow(req.GetRef()); err != nil {
+		if errors.Is(err, proxypool.ErrProxyNotFound) {
+			return nil, status.Errorf(codes.NotFound, "proxy %s not found", req.GetRef())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	proxy, err := s.pool.FindProxy(req.GetRef())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "proxy %s not found", req.GetRef())
+	}
+	return proxyMessage(proxy.Snapshot()), nil
+}
+
+// userMessage converts a client to its API message; the password is never returned
+func userMessage(c auth.ClientConfig) *User {
+	return &User{Username: c.Username, Allowed: c.Allowed, Tags: c.Tags, UpstreamUsername: c.UpstreamUsername, Country: c.Country}
+}
+
+// persistUsers writes the current user set back to the users file
+func (s *Server) persistUsers() error {
+	if s.usersFile == "" {
+		return nil
+	}
+	if err := auth.SaveUsersToFile(s.usersFile, s.users.ListClients()); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// ListUsers returns every configured SOCKS user
+func (s *Server) ListUsers(ctx context.Context, _ *ListUsersRequest) (*ListUsersResponse, error) {
+	clients := s.users.ListClients()
+	resp := &ListUsersResponse{Users: make([]*User, 0, len(clients))}
+	for _, c := range clients {
+		resp.Users = append(resp.Users, userMessage(c))
+	}
+	return resp, nil
+}
+
+// GetUser returns a single SOCKS user
+func (s *Server) GetUser(ctx context.Context, req *GetUserRequest) (*User, error) {
+	c, err := s.users.GetClient(req.GetUsername())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return userMessage(c), nil
+}
+
+// PutUser creates or replaces a SOCKS user and persists the users file.
+// An empty password or upstream_password keeps the existing one of an existing user.
+func (s *Server) PutUser(ctx context.Context, req *PutUserRequest) (*User, error) {
+	msg := req.GetUser()
+	if msg.GetUsername() == "" {
+		return nil, status.Error(codes.InvalidArgument, "username is required")
+	}
+	c := auth.ClientConfig{
+		Username:         msg.GetUsername(),
+		Password:         msg.GetPassword(),
+		Allowed:          msg.GetAllowed(),
+		Tags:             msg.GetTags(),
+		UpstreamUsername: msg.GetUpstreamUsername(),
+		UpstreamPassword: msg.GetUpstreamPassword(),
+		Country:          msg.GetCountry(),
+	}
+	if err := c.ValidatePasswords(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	existing, err := s.users.GetClient(c.Username)
+	if c.Password == "" {
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "password is required for new users")
+		}
+		c.Password, c.PasswordFile = existing.Password, existing.PasswordFile
+	}
+	if c.UpstreamUsername != "" && c.UpstreamPassword == "" && err == nil {
+		c.UpstreamPassword = existing.UpstreamPassword
+	}
+	// the User message has no pinning, rotation, session limit, pool or schedule fields, so keep the existing ones
+	c.PinnedProxy, c.PinFailover = existing.PinnedProxy, existing.PinFailover
+	c.RotateExit, c.MaxSessions = existing.RotateExit, existing.MaxSessions
+	c.Pool, c.Schedule = existing.Pool, existing.Schedule
+	s.users.UpsertClient(c)
+	if err := s.persistUsers(); err != nil {
+		return nil, err
+	}
+	log.Printf("gRPC API: user %s saved", c.Username)
+	saved, _ := s.users.GetClient(c.Username)
+	return userMessage(saved), nil
+}
+
+// DeleteUser removes a SOCKS user and persists the users file
+func (s *Server) DeleteUser(ctx context.Context, req *DeleteUserRequest) (*DeleteUserResponse, error) {
+	if err := s.users.RemoveClient(req.GetUsername()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err := s.persistUsers(); err != nil {
+		return nil, err
+	}
+	log.Printf("gRPC API: user %s removed", req.GetUsername())
+	return &DeleteUserResponse{}, nil
+}
+
+// ListSessions returns all active SOCKS sessions
+func (s *Server) ListSessions(ctx context.Context, _ *ListSessionsRequest) (*ListSessionsResponse, error) {
+	infos := s.sessions.List()
+	resp := &ListSessionsResponse{Sessions: make([]*Session, 0, len(infos))}
+	for _, info := range infos {
+		resp.Sessions = append(resp.Sessions, &Session{
+			Id:           info.ID,
+			Username:     info.Username,
+			ClientAddr:   info.ClientAddr,
+			Destination:  info.Destination,
+			Upstream:     info.Upstream,
+			BytesUp:      info.BytesUp,
+			BytesDown:    info.BytesDown,
+			StartedAt:    timestamppb.New(info.StartedAt),
+			LastActivity: timestamppb.New(info.LastActivity),
+		})
+	}
+	return resp, nil
+}
+
+// KillSession forcibly terminates a session, closing both connection ends
+func (s *Server) KillSession(ctx context.Context, req *KillSessionRequest) (*KillSessionResponse, error) {
+	if err := s.sessions.Kill(req.GetId()); err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			return nil, status.Errorf(codes.NotFound, "session %s not found", req.GetId())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Printf("gRPC API: session %s terminated", req.GetId())
+	return &KillSessionResponse{}, nil
+}
+
+// WatchEvents streams pool events to the client until it disconnects or the server stops
+func (s *Server) WatchEvents(_ *WatchEventsRequest, stream grpc.ServerStreamingServer[Event]) error {
+	events, cancel := s.pool.SubscribeEvents(eventBufferSize)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			err := stream.Send(&Event{
+				Type:         string(ev.Type),
+				Severity:     string(ev.Severity),
+				ProxyAddress: ev.ProxyAddress,
+				Message:      ev.Message,
+				Time:         timestamppb.New(ev.Time),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Authentication outcomes (AuthEvent.Reason)
+const (
+	ReasonOK              = "ok"
+	ReasonAnonymous       = "anonymous"        // admitted without credentials from an anonymous CIDR
+	ReasonUnknownUser     = "unknown_user"     // no user with this name
+	ReasonUserDisabled    = "user_disabled"    // the user exists but is not allowed
+	ReasonInvalidPassword = "invalid_password" // the password did not match
+	ReasonNoCredentials   = "no_credentials"   // the client offered no credentials and is not admitted anonymously
+	ReasonToken           = "token"            // admitted by a valid access token
+	ReasonInvalidToken    = "invalid_token"    // the access token was rejected
+	ReasonDirectory       = "ldap"             // admitted by the LDAP directory
+	ReasonDirectoryDown   = "ldap_unavailable" // the LDAP directory could not be asked
+	ReasonSocks4          = "socks4"           // a SOCKS4 client was admitted by source address
+	ReasonSocks4Denied    = "socks4_denied"    // a SOCKS4 client's source address is not allowed
+)
+
+// DefaultFailureWindow is the period over which failures per source IP are counted
+const DefaultFailureWindow = 10 * time.Minute
+
+// AuthEvent is the audit record of a SOCKS5 authentication attempt
+type AuthEvent struct {
+	Time     time.Time `json:"time"`
+	Success  bool      `json:"success"`
+	Username string    `json:"username,omitempty"`
+	SourceIP string    `json:"source_ip"`
+	Reason   string    `json:"reason"`
+	// RecentFailures is the number of failures from SourceIP within the failure
+	// window, including this one. It is only set on failures.
+	RecentFailures int `json:"recent_failures,omitempty"`
+}
+
+// IPFailures is the failure count of a source IP within the failure window
+type IPFailures struct {
+	SourceIP string `json:"source_ip"`
+	Failures int    `json:"failures"`
+}
+
+// failureCount approximates a sliding window with the counts of the current
+// and the previous fixed window, so memory stays constant per IP under attack
+type failureCount struct {
+	windowStart time.Time
+	current     int
+	previous    int
+}
+
+// estimate returns the approximate number of failures in the window ending at now
+func (c *failureCount) estimate(now time.Time, window time.Duration) int {
+	c.roll(now, window)
+	elapsed := now.Sub(c.windowStart)
+	weight := 1 - float64(elapsed)/float64(window)
+	return c.current + int(float64(c.previous)*weight+0.5)
+}
+
+// roll advances the fixed windows to the one containing now
+func (c *failureCount) roll(now time.Time, window time.Duration) {
+	switch elapsed := now.Sub(c.windowStart); {
+	case elapsed < window:
+	case elapsed < 2*window:
+		c.previous, c.current = c.current, 0
+		c.windowStart = c.windowStart.Add(window)
+	default:
+		c.previous, c.current = 0, 0
+		c.windowStart = now
+	}
+}
+
+// Auditor records authentication events: it logs each one as a JSON line,
+// counts failures per source IP and passes the events on to handlers, e.g. a
+// webhook. Failures are counted so a brute-force limiter can consult Failures.
+type Auditor struct {
+	mu        sync.Mutex
+	window    time.Duration
+	failures  map[string]*failureCount
+	lastSweep time.Time
+
+	handlersMu sync.RWMutex
+	handlers   []func(AuthEvent)
+}
+
+// NewAuditor creates an Auditor counting failures per source IP over window
+func NewAuditor(window time.Duration) *Auditor {
+	if window <= 0 {
+		window = DefaultFailureWindow
+	}
+	return &Auditor{window: window, failures: make(map[string]*failureCount)}
+}
+
+// SetWindow changes the period over which failures are counted
+func (a *Auditor) SetWindow(window time.Duration) {
+	if window <= 0 {
+		window = DefaultFailureWindow
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if window != a.window {
+		a.window = window
+		clear(a.failures) // counts of the old windows cannot be carried over
+	}
+}
+
+// AddHandler registers h to be called for every event. Handlers are called
+// synchronously from the SOCKS handshake and must not block.
+func (a *Auditor) AddHandler(h func(AuthEvent)) {
+	a.handlersMu.Lock()
+	defer a.handlersMu.Unlock()
+	a.handlers = append(a.handlers, h)
+}
+
+// Failures returns the number of failed authentications from ip within the window
+func (a *Auditor) Failures(ip string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	count, ok := a.failures[ip]
+	if !ok {
+		return 0
+	}
+	return count.estimate(time.Now(), a.window)
+}
+
+// FailingIPs returns the source IPs with at least min failures within the
+// window, most failures first
+func (a *Auditor) FailingIPs(min int) []IPFailures {
+	now := time.Now()
+	a.mu.Lock()
+	var result []IPFailures
+	for ip, count := range a.failures {
+		if n := count.estimate(now, a.window); n >= min && n > 0 {
+			result = append(result, IPFailures{SourceIP: ip, Failures: n})
+		}
+	}
+	a.mu.Unlock()
+	slices.SortFunc(result, func(x, y IPFailures) int {
+		if x.Failures != y.Failures {
+			return y.Failures - x.Failures
+		}
+		if x.SourceIP < y.SourceIP {
+			return -1
+		}
+		return 1
+	})
+	return result
+}
+
+// Record completes ev with the time and failure count, logs it and passes it to
+// the handlers. It is used by frontends authenticating outside MultiAuth.
+func (a *Auditor) Record(ev AuthEvent) {
+	ev.Time = time.Now()
+	ev.SourceIP = sourceIP(ev.SourceIP)
+	if !ev.Success {
+		ev.RecentFailures = a.countFailure(ev.SourceIP, ev.Time)
+	}
+	if data, err := json.Marshal(ev); err == nil {
+		log.Printf("Auth audit: %s", data)
+	}
+	a.handlersMu.RLock()
+	defer a.handlersMu.RUnlock()
+	for _, h := range a.handlers {
+		h(ev)
+	}
+}
+
+// countFailure counts a failure from ip at now and returns the count within the window
+func (a *Auditor) countFailure(ip string, now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) >= a.window {
+		a.sweepLocked(now)
+	}
+	count, ok := a.failures[ip]
+	if !ok {
+		count = &failureCount{windowStart: now}
+		a.failures[ip] = count
+	}
+	count.roll(now, a.window)
+	count.current++
+	return count.estimate(now, a.window)
+}
+
+// sweepLocked forgets IPs without failures in the last two windows. The caller must hold a.mu.
+func (a *Auditor) sweepLocked(now time.Time) {
+	a.lastSweep = now
+	for ip, count := range a.failures {
+		if now.Sub(count.windowStart) >= 2*a.window {
+			delete(a.failures, ip)
+		}
+	}
+}
+
+// sourceIP returns the host part of a "host:port" client address
+func sourceIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
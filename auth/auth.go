@@ -2,23 +2,167 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"maps"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/secrets"
 	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"gopkg.in/yaml.v3"
 )
 
 type ClientConfig struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Allowed  bool   `json:"allowed"`
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+	// PasswordFile is read instead of Password, e.g. a mounted Docker secret.
+	// The password read is never written back to the users file.
+	PasswordFile string `yaml:"password_file,omitempty" json:"password_file,omitempty"`
+	Allowed  bool     `yaml:"allowed" json:"allowed"`
+	// Tags restricts the user to upstream proxies carrying at least one of these tags.
+	// When empty, the configured default behavior applies.
+	Tags     []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	// AllowedProxyTags is the legacy name for Tags and is merged into it on load.
+	AllowedProxyTags []string `yaml:"allowed_proxy_tags,omitempty" json:"allowed_proxy_tags,omitempty"`
+	// UpstreamUsername and UpstreamPassword are sent to passthrough proxies instead
+	// of the user's own credentials, e.g. a vendor username with session parameters.
+	UpstreamUsername string `yaml:"upstream_username,omitempty" json:"upstream_username,omitempty"`
+	UpstreamPassword string `yaml:"upstream_password,omitempty" json:"upstream_password,omitempty"`
+	// Country fills the {country} placeholder of templated proxy usernames.
+	Country string `yaml:"country,omitempty" json:"country,omitempty"`
+	// PinnedProxy is the address or ID of the upstream proxy all of the user's
+	// connections go through, so the user always appears from the same egress IP.
+	PinnedProxy string `yaml:"pinned_proxy,omitempty" json:"pinned_proxy,omitempty"`
+	// PinFailover decides what happens while the pinned proxy is unavailable:
+	// PinFailoverFail (the default) refuses the connection, PinFailoverFallback
+	// routes it by the user's tags instead.
+	PinFailover string `yaml:"pin_failover,omitempty" json:"pin_failover,omitempty"`
+	// RotateExit gives every new connection of the user a different upstream
+	// proxy than the previous ones where possible, for maximum IP diversity.
+	RotateExit bool `yaml:"rotate_exit,omitempty" json:"rotate_exit,omitempty"`
+	// MaxSessions limits the user's concurrent sessions; zero means no limit
+	MaxSessions int `yaml:"max_sessions,omitempty" json:"max_sessions,omitempty"`
+	// Pool is the named proxy pool the user's connections go through, whatever
+	// listener they arrive on. Empty uses the listener's pool.
+	Pool string `yaml:"pool,omitempty" json:"pool,omitempty"`
+	// Schedule routes the user by other tags during time windows: the first
+	// entry whose window contains the time of a request replaces Tags for it
+	Schedule []ScheduledTags `yaml:"schedule,omitempty" json:"schedule,omitempty"`
 }
 
+// ScheduledTags are the tags a user is routed by while the time is in When, a
+// cron-style time window (see config.TimeWindow)
+type ScheduledTags struct {
+	When string   `yaml:"when" json:"when"`
+	Tags []string `yaml:"tags" json:"tags"`
+}
+
+// Failover behaviors of pinned users (ClientConfig.PinFailover)
+const (
+	PinFailoverFail     = "fail"
+	PinFailoverFallback = "fallback"
+)
+
+// ValidatePin checks the pinning settings of c
+func (c ClientConfig) ValidatePin() error {
+	switch c.PinFailover {
+	case "", PinFailoverFail, PinFailoverFallback:
+	default:
+		return fmt.Errorf("invalid pin_failover '%s', expected '%s' or '%s'", c.PinFailover, PinFailoverFail, PinFailoverFallback)
+	}
+	if c.PinFailover != "" && c.PinnedProxy == "" {
+		return fmt.Errorf("pin_failover is set but pinned_proxy is empty")
+	}
+	return nil
+}
+
+// ValidatePasswords checks that the passwords of c can be written to the users file
+func (c ClientConfig) ValidatePasswords() error {
+	if err := secrets.CheckPlaintext(c.Password); err != nil {
+		return fmt.Errorf("password: %w", err)
+	}
+	if err := secrets.CheckPlaintext(c.UpstreamPassword); err != nil {
+		return fmt.Errorf("upstream_password: %w", err)
+	}
+	return nil
+}
+
+// ValidateTags checks that the tag expressions of c compile
+func (c ClientConfig) ValidateTags() error {
+	for _, tag := range append(slices.Clone(c.Tags), c.AllowedProxyTags...) {
+		if config.IsPlainTag(tag) {
+			continue
+		}
+		if _, err := config.ParseTagExpr(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateSchedule checks the time windows and tags of c's schedule
+func (c ClientConfig) ValidateSchedule() error {
+	for i, entry := range c.Schedule {
+		if _, err := config.ParseTimeWindow(entry.When); err != nil {
+			return fmt.Errorf("schedule[%d]: %w", i, err)
+		}
+		if len(entry.Tags) == 0 {
+			return fmt.Errorf("schedule[%d]: no tags", i)
+		}
+		if err := (ClientConfig{Tags: entry.Tags}).ValidateTags(); err != nil {
+			return fmt.Errorf("schedule[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Default behaviors for users without tags (users.default_behavior_no_tags)
+const (
+	BehaviorDeny                = "deny"
+	BehaviorAllowDefaultTagOnly = "allow_default_tag_only"
+	BehaviorAllowAllActive      = "allow_all_active"
+)
+
+// ErrNoProxyAccess is returned when a user is not allowed to use any upstream proxy
+var ErrNoProxyAccess = errors.New("user is not allowed to use any upstream proxy")
+
+// ErrTagNotAllowed is wrapped together with ErrNoProxyAccess when a user has no
+// tags of its own and the default behavior gives it none
+var ErrTagNotAllowed = errors.New("no proxy tag is allowed for the user")
+
+// Behaviors when the user store is empty (users.empty_store_behavior)
+const (
+	EmptyStoreDeny               = "deny"
+	EmptyStoreAllowAnonymousCIDR = "allow_anonymous_cidr"
+)
+
 type MultiAuth struct {
 	clients map[string]ClientConfig
 	mu      sync.RWMutex
+
+	defaultBehavior string
+	defaultTag      string
+
+	emptyStoreBehavior string
+	anonymousCIDRs     []netip.Prefix
+
+	auditor *Auditor
+
+	// tokens verifies access tokens sent as passwords; nil disables them.
+	// directory checks the credentials of users that are not in the users
+	// file; nil disables it. cache holds the users they admitted.
+	tokens    *TokenVerifier
+	directory *LDAPBackend
+	cache     *CredentialCache
 }
 
 // DefaultAuth is the default global authentication instance.
@@ -42,8 +186,190 @@ var _ socks5.CredentialStore = (*MultiAuth)(nil)
 
 func New() *MultiAuth { 
 	return &MultiAuth{
-		clients: make(map[string]ClientConfig),
+		clients:         make(map[string]ClientConfig),
+		defaultBehavior:    BehaviorAllowAllActive,
+		emptyStoreBehavior: EmptyStoreDeny,
+		auditor:            NewAuditor(DefaultFailureWindow),
+		cache:              NewCredentialCache(),
+	}
+}
+
+// Auditor returns the auditor that records the authentication attempts against a
+func (a *MultiAuth) Auditor() *Auditor {
+	return a.auditor
+}
+
+// CredentialCache returns the cache of logins admitted by external backends
+func (a *MultiAuth) CredentialCache() *CredentialCache {
+	return a.cache
+}
+
+// SetEmptyStorePolicy configures what happens while no users are defined.
+// With EmptyStoreAllowAnonymousCIDR, clients connecting from one of cidrs are
+// let in without credentials; any other behavior denies everyone.
+func (a *MultiAuth) SetEmptyStorePolicy(behavior string, cidrs []string) error {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid anonymous CIDR '%s': %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.emptyStoreBehavior = behavior
+	a.anonymousCIDRs = prefixes
+	return nil
+}
+
+// AllowsAnonymous reports whether a client at addr (host:port) may connect without
+// credentials, which is only the case while the store is empty and the empty-store
+// behavior is EmptyStoreAllowAnonymousCIDR.
+func (a *MultiAuth) AllowsAnonymous(addr string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.clients) > 0 || a.emptyStoreBehavior != EmptyStoreAllowAnonymousCIDR {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range a.anonymousCIDRs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPolicy configures how users without tags are routed.
+// behavior is one of BehaviorDeny, BehaviorAllowDefaultTagOnly or BehaviorAllowAllActive;
+// defaultTag is used with BehaviorAllowDefaultTagOnly.
+func (a *MultiAuth) SetPolicy(behavior, defaultTag string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.defaultBehavior = behavior
+	a.defaultTag = defaultTag
+}
+
+// Routing rules reported by ResolveRoute
+const (
+	RuleUserTags    = "user_tags"
+	RuleDefaultDeny = "default_deny"
+	RuleDefaultTag  = "default_tag"
+	RuleAllowAll    = "allow_all_active"
+	RulePinnedProxy = "pinned_proxy"
+	RuleSchedule    = "schedule"
+)
+
+// Route describes which upstream proxies a user may use and why
+type Route struct {
+	// Rule names the policy rule that matched
+	Rule string `json:"rule"`
+	// Tags lists the proxy tags the user may use (empty when AllowAll is set)
+	Tags []string `json:"tags,omitempty"`
+	// AllowAll is true when any active proxy may be used regardless of tags
+	AllowAll bool `json:"allow_all"`
+	// PinnedProxy is the address or ID of the only proxy a pinned user may use
+	PinnedProxy string `json:"pinned_proxy,omitempty"`
+	// Fallback is true when a pinned user is routed by Tags and AllowAll while
+	// the pinned proxy is unavailable
+	Fallback bool `json:"fallback,omitempty"`
+	// Rotate is true when the user rotates exits (see ClientConfig.RotateExit)
+	Rotate bool `json:"rotate,omitempty"`
+	// MaxSessions is the user's concurrent session limit, zero for none
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// Pool is the named proxy pool the user is bound to, empty for the listener's
+	Pool string `json:"pool,omitempty"`
+	// Window is the time window of the schedule entry that matched with RuleSchedule
+	Window string `json:"window,omitempty"`
+}
+
+// ResolveRoute returns the routing rule that applies to username. Unknown users get
+// the default behavior. ErrNoProxyAccess is returned together with the matching
+// route when the user is denied. A pinned user gets RulePinnedProxy; with
+// PinFailoverFallback the route also carries the tags the user would otherwise
+// be routed by, unless those deny the user.
+func (a *MultiAuth) ResolveRoute(username string) (Route, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	client, ok := a.clientLocked(username)
+	if ok && client.PinnedProxy != "" {
+		pinned := Route{Rule: RulePinnedProxy, PinnedProxy: client.PinnedProxy}
+		if client.PinFailover == PinFailoverFallback {
+			if fallback, err := a.tagRouteLocked(client, ok); err == nil {
+				pinned.Tags, pinned.AllowAll, pinned.Fallback = fallback.Tags, fallback.AllowAll, true
+			}
+		}
+		pinned.Rotate = pinned.Fallback && client.RotateExit
+		pinned.MaxSessions = client.MaxSessions
+		pinned.Pool = client.Pool
+		return pinned, nil
+	}
+	route, err := a.tagRouteLocked(client, ok)
+	route.Rotate = client.RotateExit
+	route.MaxSessions = client.MaxSessions
+	route.Pool = client.Pool
+	return route, err
+}
+
+// tagRouteLocked resolves the tag-based route of client (found is false for
+// unknown users). The caller must hold a.mu.
+func (a *MultiAuth) tagRouteLocked(client ClientConfig, found bool) (Route, error) {
+	if found && len(client.Schedule) > 0 {
+		now := time.Now()
+		for _, entry := range client.Schedule {
+			if config.InTimeWindow(entry.When, now) {
+				return Route{Rule: RuleSchedule, Tags: entry.Tags, Window: entry.When}, nil
+			}
+		}
+	}
+	if found && len(client.Tags) > 0 {
+		return Route{Rule: RuleUserTags, Tags: client.Tags}, nil
 	}
+
+	switch a.defaultBehavior {
+	case BehaviorDeny:
+		return Route{Rule: RuleDefaultDeny}, fmt.Errorf("%w: %w by default behavior %s", ErrNoProxyAccess, ErrTagNotAllowed, a.defaultBehavior)
+	case BehaviorAllowDefaultTagOnly:
+		if a.defaultTag == "" {
+			return Route{Rule: RuleDefaultDeny}, fmt.Errorf("%w: %w, default behavior %s has no default tag", ErrNoProxyAccess, ErrTagNotAllowed, a.defaultBehavior)
+		}
+		return Route{Rule: RuleDefaultTag, Tags: []string{a.defaultTag}}, nil
+	default:
+		return Route{Rule: RuleAllowAll, AllowAll: true}, nil
+	}
+}
+
+// UpstreamCredentials returns the credentials configured for username to present to
+// passthrough proxies. ok is false if the user has none and should pass its own.
+func (a *MultiAuth) UpstreamCredentials(username string) (user, password string, ok bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	client, found := a.clientLocked(username)
+	if !found || client.UpstreamUsername == "" {
+		return "", "", false
+	}
+	return client.UpstreamUsername, client.UpstreamPassword, true
+}
+
+// UpstreamCountry returns the country configured for username, or "" if none
+func (a *MultiAuth) UpstreamCountry(username string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	client, _ := a.clientLocked(username)
+	return client.Country
+}
+
+// AllowedTags returns the proxy tags username may use. allowAll is true when any
+// active proxy may be used regardless of tags.
+func (a *MultiAuth) AllowedTags(username string) (tags []string, allowAll bool, err error) {
+	route, err := a.ResolveRoute(username)
+	return route.Tags, route.AllowAll, err
 }
 
 func (a *MultiAuth) AddClient(username, password string, allowed bool) {
@@ -55,38 +381,136 @@ func (a *MultiAuth) AddClient(username, password string, allowed bool) {
 func (a *MultiAuth) Valid(username, password, addr string) bool {
 	a.mu.RLock()
 	client, ok := a.clients[username]
+	tokens, directory := a.tokens, a.directory
 	a.mu.RUnlock()
 
+	var cached bool
+	var source string
 	if !ok {
-		log.Printf("Auth attempt: client not found '%s'", username)
-		return false
+		_, source, cached = a.cache.Get(username, password)
 	}
-	if !client.Allowed {
-		log.Printf("Auth attempt: client access denied for '%s'", username)
-		return false
+
+	ev := AuthEvent{Username: username, SourceIP: sourceIP(addr)}
+	switch {
+	case cached:
+		ev.Success, ev.Reason = true, source
+	case !ok && tokens != nil && LooksLikeToken(password):
+		ev.Success, ev.Reason = a.admitToken(tokens, username, password), ReasonToken
+		if !ev.Success {
+			ev.Reason = ReasonInvalidToken
+		}
+	case !ok && directory != nil:
+		ev.Success, ev.Reason = a.admitDirectory(directory, username, password)
+	case !ok && a.AllowsAnonymous(addr):
+		ev.Success, ev.Reason = true, ReasonAnonymous
+	case !ok:
+		ev.Reason = ReasonUnknownUser
+	case !client.Allowed:
+		ev.Reason = ReasonUserDisabled
+	case client.Password != password:
+		ev.Reason = ReasonInvalidPassword
+	default:
+		ev.Success, ev.Reason = true, ReasonOK
 	}
-	if client.Password != password {
-		log.Printf("Auth attempt: invalid password for '%s'", username)
-		return false
+	a.auditor.Record(ev)
+	return ev.Success
+}
+
+// AdmitSocks4 decides whether a SOCKS4 client from addr is served as username,
+// which must be an allowed user. sourceAllowed tells whether addr is in the
+// SOCKS4 networks. The attempt is recorded by the auditor.
+func (a *MultiAuth) AdmitSocks4(username, addr string, sourceAllowed bool) bool {
+	a.mu.RLock()
+	client, ok := a.clients[username]
+	a.mu.RUnlock()
+
+	ev := AuthEvent{Username: username, SourceIP: addr}
+	switch {
+	case !sourceAllowed:
+		ev.Reason = ReasonSocks4Denied
+	case !ok:
+		ev.Reason = ReasonUnknownUser
+	case !client.Allowed:
+		ev.Reason = ReasonUserDisabled
+	default:
+		ev.Success, ev.Reason = true, ReasonSocks4
+	}
+	a.auditor.Record(ev)
+	return ev.Success
+}
+
+// ErrNoUsers is returned when a users file exists but defines no users
+var ErrNoUsers = errors.New("no users defined")
+
+// AnonymousAuthenticator offers the SOCKS5 "no authentication" method, but only
+// admits clients that Auth.AllowsAnonymous; everyone else is told no method is
+// acceptable. List it after the username/password authenticator so clients that
+// offer both still authenticate with credentials.
+type AnonymousAuthenticator struct {
+	Auth *MultiAuth
+}
+
+var _ socks5.Authenticator = AnonymousAuthenticator{}
+
+// GetCode implements socks5.Authenticator
+func (a AnonymousAuthenticator) GetCode() uint8 { return statute.MethodNoAuth }
+
+// Authenticate implements socks5.Authenticator
+func (a AnonymousAuthenticator) Authenticate(_ io.Reader, writer io.Writer, userAddr string) (*socks5.AuthContext, error) {
+	if !a.Auth.AllowsAnonymous(userAddr) {
+		a.Auth.auditor.Record(AuthEvent{SourceIP: sourceIP(userAddr), Reason: ReasonNoCredentials})
+		if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable}); err != nil {
+			return nil, err
+		}
+		return nil, statute.ErrNoSupportedAuth
+	}
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth}); err != nil {
+		return nil, err
 	}
-	log.Printf("Auth success for client '%s'", username)
-	return true
+	a.Auth.auditor.Record(AuthEvent{Success: true, SourceIP: sourceIP(userAddr), Reason: ReasonAnonymous})
+	return &socks5.AuthContext{Method: statute.MethodNoAuth, Payload: make(map[string]string)}, nil
 }
 
-// LoadUsersFromFile loads users from a JSON file
+// LoadUsersFromFile loads users from a JSON file, or a YAML file if its
+// extension is .yaml or .yml. A missing file yields an error
+// matching fs.ErrNotExist and an empty one an error matching ErrNoUsers.
 func LoadUsersFromFile(filePath string) ([]ClientConfig, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read users file %q: %w", filePath, err)
 	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, fmt.Errorf("users file %q is empty: %w", filePath, ErrNoUsers)
+	}
 
 	var users []ClientConfig
-	if err := json.Unmarshal(data, &users); err != nil {
+	if config.IsYAMLFile(filePath) {
+		if err := yaml.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal users YAML from %q: %w", filePath, err)
+		}
+	} else if err := json.Unmarshal(data, &users); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal users JSON from %q: %w", filePath, err)
 	}
 
 	if len(users) == 0 {
-		return nil, fmt.Errorf("no users found in file %q", filePath)
+		return nil, fmt.Errorf("no users found in file %q: %w", filePath, ErrNoUsers)
+	}
+	for i := range users {
+		if err := users[i].ValidatePin(); err != nil {
+			return nil, fmt.Errorf("user %q in %q: %w", users[i].Username, filePath, err)
+		}
+		if err := users[i].ValidateTags(); err != nil {
+			return nil, fmt.Errorf("user %q in %q: %w", users[i].Username, filePath, err)
+		}
+		if err := users[i].ValidateSchedule(); err != nil {
+			return nil, fmt.Errorf("user %q in %q: %w", users[i].Username, filePath, err)
+		}
+		if err := secrets.DecryptFields(&users[i].Password, &users[i].UpstreamPassword); err != nil {
+			return nil, fmt.Errorf("user %q in %q: %w", users[i].Username, filePath, err)
+		}
+		if err := secrets.LoadFile(&users[i].Password, users[i].PasswordFile); err != nil {
+			return nil, fmt.Errorf("user %q in %q: password_file: %w", users[i].Username, filePath, err)
+		}
 	}
 
 	return users, nil
@@ -99,12 +523,160 @@ func SetUsers(users []ClientConfig) {
 
 	DefaultAuth.clients = make(map[string]ClientConfig)
 	for _, user := range users {
+		user.Tags = mergeTags(user.Tags, user.AllowedProxyTags)
 		DefaultAuth.clients[user.Username] = user
 	}
 }
 
+// SetPolicy configures the default routing policy of the default authentication instance
+func SetPolicy(behavior, defaultTag string) {
+	DefaultAuth.SetPolicy(behavior, defaultTag)
+}
+
+// mergeTags returns tags with any entries from extra it doesn't already contain appended
+func mergeTags(tags, extra []string) []string {
+	for _, tag := range extra {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
 // GetCredentialStore returns the default authentication instance as a credential store
 // that can be used with the SOCKS5 server for user authentication.
 func GetCredentialStore() socks5.CredentialStore {
 	return DefaultAuth
-}
\ No newline at end of file
+}
+
+// ErrUserNotFound is returned when a username is not in the store
+var ErrUserNotFound = errors.New("user not found")
+
+// ListClients returns all configured clients sorted by username
+func (a *MultiAuth) ListClients() []ClientConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return sortedClients(a.clients)
+}
+
+// sortedClients returns the clients of byName sorted by username
+func sortedClients(byName map[string]ClientConfig) []ClientConfig {
+	clients := make([]ClientConfig, 0, len(byName))
+	for _, c := range byName {
+		clients = append(clients, c)
+	}
+	slices.SortFunc(clients, func(x, y ClientConfig) int {
+		return strings.Compare(x.Username, y.Username)
+	})
+	return clients
+}
+
+// GetClient returns the client with the given username
+func (a *MultiAuth) GetClient(username string) (ClientConfig, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	c, ok := a.clients[username]
+	if !ok {
+		return ClientConfig{}, ErrUserNotFound
+	}
+	return c, nil
+}
+
+// UpsertClient adds a client or replaces an existing one with the same username
+func (a *MultiAuth) UpsertClient(client ClientConfig) {
+	client.Tags = mergeTags(client.Tags, client.AllowedProxyTags)
+	client.AllowedProxyTags = nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clients[client.Username] = client
+}
+
+// UpdateClient changes the client with the given username with update, saves
+// the resulting client set with save and only then stores the change. The store
+// is locked throughout, so no other change of the client can interleave, and
+// it is left as it was if update or save fails.
+func (a *MultiAuth) UpdateClient(username string, update func(*ClientConfig) error, save func([]ClientConfig) error) (ClientConfig, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	client, ok := a.clients[username]
+	if !ok {
+		return ClientConfig{}, ErrUserNotFound
+	}
+	if err := update(&client); err != nil {
+		return ClientConfig{}, err
+	}
+	client.Tags = mergeTags(client.Tags, client.AllowedProxyTags)
+	client.AllowedProxyTags = nil
+
+	updated := maps.Clone(a.clients)
+	updated[username] = client
+	if err := save(sortedClients(updated)); err != nil {
+		return ClientConfig{}, err
+	}
+	a.clients[username] = client
+	return client, nil
+}
+
+// RemoveClient deletes the client with the given username
+func (a *MultiAuth) RemoveClient(username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.clients[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(a.clients, username)
+	return nil
+}
+
+// SaveUsersToFile atomically writes users to a JSON file, or YAML keeping the
+// comments of a .yaml or .yml file. Passwords are encrypted
+// if a secret key is configured; those read from password files are left out.
+func SaveUsersToFile(filePath string, users []ClientConfig) error {
+	encrypted := make([]ClientConfig, len(users))
+	for i, user := range users {
+		var err error
+		if user.PasswordFile != "" {
+			user.Password = ""
+		} else if user.Password, err = secrets.Encrypt(user.Password); err != nil {
+			return fmt.Errorf("failed to encrypt password of user %q: %w", user.Username, err)
+		}
+		if user.UpstreamPassword, err = secrets.Encrypt(user.UpstreamPassword); err != nil {
+			return fmt.Errorf("failed to encrypt upstream password of user %q: %w", user.Username, err)
+		}
+		encrypted[i] = user
+	}
+	var data []byte
+	var err error
+	if config.IsYAMLFile(filePath) {
+		if data, err = config.EncodeYAMLFile(filePath, encrypted, "username"); err != nil {
+			return fmt.Errorf("failed to marshal users YAML: %w", err)
+		}
+	} else {
+		if data, err = json.MarshalIndent(encrypted, "", "  "); err != nil {
+			return fmt.Errorf("failed to marshal users JSON: %w", err)
+		}
+		data = append(data, '\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp users file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if info, statErr := os.Stat(filePath); statErr == nil {
+		_ = tmp.Chmod(info.Mode().Perm())
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp users file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp users file: %w", err)
+	}
+	if err := os.Rename(tmpName, filePath); err != nil {
+		return fmt.Errorf("failed to replace users file %q: %w", filePath, err)
+	}
+	return nil
+}
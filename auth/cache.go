@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedLogin describes a cached external login, without its secret
+type CachedLogin struct {
+	Username string    `json:"username"`
+	Source   string    `json:"source"` // the audit reason of the login, e.g. "ldap" or "token"
+	Tags     []string  `json:"tags,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// cacheEntry is a successful login and the keyed hash of the secret it used
+type cacheEntry struct {
+	secretMAC []byte
+	client    ClientConfig
+	source    string
+	expires   time.Time
+}
+
+// CredentialCache remembers successful logins of users from external backends
+// (the directory, access tokens) until they expire, so a client opening many
+// connections does not hit the backend on every SOCKS handshake. Secrets are
+// only kept as an HMAC with a per-process key. It is safe for concurrent use.
+type CredentialCache struct {
+	key []byte
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewCredentialCache returns an empty cache
+func NewCredentialCache() *CredentialCache {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &CredentialCache{key: key, entries: make(map[string]cacheEntry)}
+}
+
+func (c *CredentialCache) mac(secret string) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// Get returns the cached user of username and the source of its login when
+// secret is the secret it logged in with and the entry has not expired
+func (c *CredentialCache) Get(username, secret string) (ClientConfig, string, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[username]
+	c.mu.Unlock()
+	if !ok || !time.Now().Before(entry.expires) || !hmac.Equal(entry.secretMAC, c.mac(secret)) {
+		return ClientConfig{}, "", false
+	}
+	return entry.client, entry.source, true
+}
+
+// Put caches the login of client with secret until expires, replacing the
+// user's previous login, and drops the expired entries
+func (c *CredentialCache) Put(client ClientConfig, secret, source string, expires time.Time) {
+	entry := cacheEntry{secretMAC: c.mac(secret), client: client, source: source, expires: expires}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, name)
+		}
+	}
+	c.entries[client.Username] = entry
+}
+
+// client returns the user of an unexpired login of username, whatever secret
+// it used, to route the connections of a client that has just logged in
+func (c *CredentialCache) client(username string) (ClientConfig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[username]
+	if !ok || !time.Now().Before(entry.expires) {
+		return ClientConfig{}, false
+	}
+	return entry.client, true
+}
+
+// Invalidate forgets the login of username, so its next handshake asks the
+// backend again. It reports whether there was an unexpired login.
+func (c *CredentialCache) Invalidate(username string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[username]
+	delete(c.entries, username)
+	return ok && time.Now().Before(entry.expires)
+}
+
+// Clear forgets all logins and returns how many had not expired
+func (c *CredentialCache) Clear() int {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, e := range c.entries {
+		if now.Before(e.expires) {
+			n++
+		}
+	}
+	clear(c.entries)
+	return n
+}
+
+// Logins returns the unexpired logins ordered by username
+func (c *CredentialCache) Logins() []CachedLogin {
+	now := time.Now()
+	c.mu.Lock()
+	logins := make([]CachedLogin, 0, len(c.entries))
+	for name, e := range c.entries {
+		if now.Before(e.expires) {
+			logins = append(logins, CachedLogin{Username: name, Source: e.source, Tags: e.client.Tags, Expires: e.expires})
+		}
+	}
+	c.mu.Unlock()
+	slices.SortFunc(logins, func(a, b CachedLogin) int { return strings.Compare(a.Username, b.Username) })
+	return logins
+}
@@ -0,0 +1,472 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the supported signature algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is wrapped by every error of TokenVerifier.Verify
+var ErrInvalidToken = errors.New("invalid access token")
+
+// jwksRefetchInterval is how often a token signed by an unknown key may trigger
+// an early JWKS refresh, so garbage tokens cannot hammer the IdP
+const jwksRefetchInterval = 30 * time.Second
+
+// maxJWKSSize bounds the JWKS document read from the IdP
+const maxJWKSSize = 1 << 20
+
+// TokenConfig configures access-token authentication: SOCKS clients send a JWT
+// issued by an external identity provider as their password
+type TokenConfig struct {
+	JWKSURL  string
+	Issuer   string // required "iss" when set
+	Audience string // required in "aud" when set
+	// UsernameClaim must equal the SOCKS username; TagsClaim and MaxSessionsClaim
+	// carry the user's proxy tags and concurrent session limit
+	UsernameClaim    string
+	TagsClaim        string
+	MaxSessionsClaim string
+	// Leeway is the clock skew tolerated on "exp" and "nbf"
+	Leeway time.Duration
+	// CacheTTL bounds how long a verified token is cached; 0 caches it until
+	// it expires
+	CacheTTL time.Duration
+}
+
+// TokenClaims is what an access token grants
+type TokenClaims struct {
+	Username    string
+	Tags        []string
+	MaxSessions int
+	Expires     time.Time
+}
+
+// TokenVerifier validates access tokens against the signing keys published at
+// a JWKS URL
+type TokenVerifier struct {
+	cfg    TokenConfig
+	client *http.Client
+
+	mu      sync.RWMutex
+	keys    []jwk
+	fetched time.Time
+
+	refreshMu sync.Mutex // serializes JWKS fetches
+}
+
+// NewTokenVerifier returns a verifier for cfg. Keys are fetched by Refresh and
+// when a token names a key that is not known yet.
+func NewTokenVerifier(cfg TokenConfig) *TokenVerifier {
+	return &TokenVerifier{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// jwk is a public key of a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	key crypto.PublicKey
+}
+
+// Refresh fetches the signing keys from the JWKS URL
+func (v *TokenVerifier) Refresh(ctx context.Context) error {
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	return v.refreshLocked(ctx)
+}
+
+// refreshLocked fetches the keys; the caller must hold refreshMu
+func (v *TokenVerifier) refreshLocked(ctx context.Context) error {
+	v.mu.Lock()
+	v.fetched = time.Now() // also on failure, to rate-limit early refreshes
+	v.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build JWKS request: %w", err)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %s: %w", v.cfg.JWKSURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS from %s: unexpected status %s", v.cfg.JWKSURL, resp.Status)
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to parse JWKS from %s: %w", v.cfg.JWKSURL, err)
+	}
+
+	keys := make([]jwk, 0, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Warning: skipping JWKS key '%s': %v", k.Kid, err)
+			continue
+		}
+		k.key = key
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS from %s has no usable signing keys", v.cfg.JWKSURL)
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the keys every interval until stop is closed
+func (v *TokenVerifier) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := v.Refresh(context.Background()); err != nil {
+				log.Printf("Warning: %v; keeping the previous signing keys", err)
+			}
+		}
+	}
+}
+
+// publicKey decodes the key material of k
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key of %d bits is too short", n.BitLen())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, errX := decodeBigInt(k.X)
+		y, errY := decodeBigInt(k.Y)
+		if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// LooksLikeToken reports whether password has the shape of a JWT, so other
+// passwords never reach the verifier
+func LooksLikeToken(password string) bool {
+	return strings.Count(password, ".") == 2 && strings.HasPrefix(password, "eyJ")
+}
+
+// Verify checks the signature and the time, issuer and audience claims of
+// token and returns what it grants
+func (v *TokenVerifier) Verify(token string, now time.Time) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	if len(header.Crit) > 0 {
+		return TokenClaims{}, fmt.Errorf("%w: unsupported critical header %v", ErrInvalidToken, header.Crit)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	granted, err := v.checkClaims(claims, now)
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return granted, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into out
+func decodeSegment(segment string, out any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+// verifySignature checks sig over signed with the key named kid, refreshing the
+// keys once if kid is unknown. Without a kid every key is tried.
+func (v *TokenVerifier) verifySignature(alg, kid string, signed, sig []byte) error {
+	hash, err := algHash(alg)
+	if err != nil {
+		return err
+	}
+	keys := v.keysFor(kid)
+	if len(keys) == 0 && kid != "" && v.refreshForUnknownKey() {
+		keys = v.keysFor(kid)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	for _, k := range keys {
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		if verifyWith(k.key, alg, hash, signed, sig) {
+			return nil
+		}
+	}
+	return errors.New("signature verification failed")
+}
+
+// keysFor returns the keys with ID kid, or all keys when kid is empty
+func (v *TokenVerifier) keysFor(kid string) []jwk {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if kid == "" {
+		return v.keys
+	}
+	for _, k := range v.keys {
+		if k.Kid == kid {
+			return []jwk{k}
+		}
+	}
+	return nil
+}
+
+// refreshForUnknownKey refreshes the keys unless that happened recently,
+// reporting whether it did
+func (v *TokenVerifier) refreshForUnknownKey() bool {
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	v.mu.RLock()
+	recent := time.Since(v.fetched) < jwksRefetchInterval
+	v.mu.RUnlock()
+	if recent {
+		return false
+	}
+	if err := v.refreshLocked(context.Background()); err != nil {
+		log.Printf("Warning: %v", err)
+		return false
+	}
+	return true
+}
+
+// algHash returns the hash of a supported JWS algorithm
+func algHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "PS512", "ES512":
+		return crypto.SHA512, nil
+	case "EdDSA":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unsupported algorithm '%s'", alg)
+}
+
+// esCurves are the curves the ECDSA algorithms are defined for
+var esCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// verifyWith reports whether sig is a valid alg signature of signed by key
+func verifyWith(key crypto.PublicKey, alg string, hash crypto.Hash, signed, sig []byte) bool {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if esCurves[alg] != pub.Curve || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// checkClaims validates the registered claims and extracts the granted ones
+func (v *TokenVerifier) checkClaims(claims map[string]any, now time.Time) (TokenClaims, error) {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return TokenClaims{}, errors.New("missing or invalid 'exp' claim")
+	}
+	expires := time.Unix(exp, 0)
+	if now.After(expires.Add(v.cfg.Leeway)) {
+		return TokenClaims{}, fmt.Errorf("token expired at %s", expires.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(v.cfg.Leeway).Before(time.Unix(nbf, 0)) {
+		return TokenClaims{}, errors.New("token is not valid yet")
+	}
+	if v.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+			return TokenClaims{}, fmt.Errorf("unexpected issuer '%s'", iss)
+		}
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return TokenClaims{}, fmt.Errorf("audience '%s' not in token", v.cfg.Audience)
+	}
+
+	username, _ := claims[v.cfg.UsernameClaim].(string)
+	if username == "" {
+		return TokenClaims{}, fmt.Errorf("missing '%s' claim", v.cfg.UsernameClaim)
+	}
+	tags, err := stringsClaim(claims[v.cfg.TagsClaim])
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("invalid '%s' claim: %v", v.cfg.TagsClaim, err)
+	}
+	maxSessions := 0
+	if _, present := claims[v.cfg.MaxSessionsClaim]; present {
+		n, ok := numericClaim(claims, v.cfg.MaxSessionsClaim)
+		if !ok || n < 0 || n > 1<<31-1 {
+			return TokenClaims{}, fmt.Errorf("invalid '%s' claim", v.cfg.MaxSessionsClaim)
+		}
+		maxSessions = int(n)
+	}
+	return TokenClaims{Username: username, Tags: tags, MaxSessions: maxSessions, Expires: expires}, nil
+}
+
+// numericClaim returns the integer value of a NumericDate or number claim
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+	num, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if n, err := num.Int64(); err == nil {
+		return n, true
+	}
+	f, err := num.Float64()
+	return int64(f), err == nil
+}
+
+// hasAudience reports whether the "aud" claim (a string or an array) contains want
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stringsClaim reads an array of strings, or a space separated string
+func stringsClaim(value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Fields(value), nil
+	case []any:
+		out := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected strings, got %v", v)
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("expected an array of strings, got %v", value)
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// testKeySet holds the signing keys of the tests
+type testKeySet struct {
+	rsa     *rsa.PrivateKey
+	p256    *ecdsa.PrivateKey
+	p384    *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+var (
+	testKeysOnce sync.Once
+	testKeys     testKeySet
+)
+
+// keys returns the signing keys of the tests, generated once
+func keys(t *testing.T) *testKeySet {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		var err error
+		if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+		if testKeys.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+		if testKeys.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+			panic(err)
+		}
+		if _, testKeys.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			panic(err)
+		}
+	})
+	return &testKeys
+}
+
+// jwkOf encodes the public part of key as a JWKS key
+func jwkOf(kid, alg string, key crypto.PublicKey) map[string]string {
+	k := map[string]string{"kid": kid, "use": "sig"}
+	if alg != "" {
+		k["alg"] = alg
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		k["kty"], k["n"], k["e"] = "RSA", b64.EncodeToString(key.N.Bytes()), b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		k["kty"], k["crv"] = "EC", key.Curve.Params().Name
+		k["x"], k["y"] = b64.EncodeToString(key.X.FillBytes(make([]byte, size))), b64.EncodeToString(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		k["kty"], k["crv"], k["x"] = "OKP", "Ed25519", b64.EncodeToString(key)
+	}
+	return k
+}
+
+// jwksServer serves the keys last set and counts the fetches
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches atomic.Int32
+}
+
+func (s *jwksServer) set(keys ...map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+// newVerifier returns a verifier of tokens with the keys served by s, fetched once
+func newVerifier(t *testing.T, s *jwksServer, cfg TokenConfig) *TokenVerifier {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+	}))
+	t.Cleanup(srv.Close)
+	cfg.JWKSURL = srv.URL
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "sub"
+	}
+	v := NewTokenVerifier(cfg)
+	if err := v.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	return v
+}
+
+// signer produces the signature of a token's signing input
+type signer func(t *testing.T, signed []byte) []byte
+
+func digest(hash crypto.Hash, signed []byte) []byte {
+	h := hash.New()
+	h.Write(signed)
+	return h.Sum(nil)
+}
+
+func pkcs1(key *rsa.PrivateKey, hash crypto.Hash) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest(hash, signed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func pss(key *rsa.PrivateKey, hash crypto.Hash) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		sig, err := rsa.SignPSS(rand.Reader, key, hash, digest(hash, signed), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+// es signs with key in the JWS r || s encoding, trimmed by trim bytes
+func es(key *ecdsa.PrivateKey, hash crypto.Hash, trim int) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest(hash, signed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		return sig[:len(sig)-trim]
+	}
+}
+
+func eddsa(key ed25519.PrivateKey) signer {
+	return func(t *testing.T, signed []byte) []byte { return ed25519.Sign(key, signed) }
+}
+
+func hs256(secret []byte) signer {
+	return func(t *testing.T, signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+// makeToken encodes header and claims and signs them with sign
+func makeToken(t *testing.T, header, claims map[string]any, sign signer) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b64.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	var sig []byte
+	if sign != nil {
+		sig = sign(t, []byte(signed))
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func validClaims() map[string]any {
+	return map[string]any{"sub": "alice", "exp": testNow.Add(time.Hour).Unix()}
+}
+
+func TestVerifySignature(t *testing.T) {
+	k := keys(t)
+	s := &jwksServer{}
+	s.set(
+		jwkOf("rsa", "", &k.rsa.PublicKey),
+		jwkOf("rsa-rs256", "RS256", &k.rsa.PublicKey),
+		jwkOf("p256", "", &k.p256.PublicKey),
+		jwkOf("p384", "", &k.p384.PublicKey),
+		jwkOf("ed", "", k.ed25519.Public()),
+	)
+	v := newVerifier(t, s, TokenConfig{})
+
+	for _, tc := range []struct {
+		name    string
+		alg     string
+		kid     string
+		extra   map[string]any
+		sign    signer
+		wantErr string
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa", sign: pkcs1(k.rsa, crypto.SHA256)},
+		{name: "PS256 on the same RSA key", alg: "PS256", kid: "rsa", sign: pss(k.rsa, crypto.SHA256)},
+		{name: "RS512", alg: "RS512", kid: "rsa", sign: pkcs1(k.rsa, crypto.SHA512)},
+		{name: "ES256", alg: "ES256", kid: "p256", sign: es(k.p256, crypto.SHA256, 0)},
+		{name: "ES384", alg: "ES384", kid: "p384", sign: es(k.p384, crypto.SHA384, 0)},
+		{name: "EdDSA", alg: "EdDSA", kid: "ed", sign: eddsa(k.ed25519)},
+		{name: "no kid tries every key", alg: "ES256", sign: es(k.p256, crypto.SHA256, 0)},
+		{name: "alg none", alg: "none", kid: "rsa", wantErr: "unsupported algorithm 'none'"},
+		{name: "HS256 keyed with the RSA modulus", alg: "HS256", kid: "rsa", sign: hs256(k.rsa.N.Bytes()), wantErr: "unsupported algorithm 'HS256'"},
+		{name: "PKCS1 signature as PS256", alg: "PS256", kid: "rsa", sign: pkcs1(k.rsa, crypto.SHA256), wantErr: "signature verification failed"},
+		{name: "PSS signature as RS256", alg: "RS256", kid: "rsa", sign: pss(k.rsa, crypto.SHA256), wantErr: "signature verification failed"},
+		{name: "alg other than the key's", alg: "PS256", kid: "rsa-rs256", sign: pss(k.rsa, crypto.SHA256), wantErr: "signature verification failed"},
+		{name: "alg of the key", alg: "RS256", kid: "rsa-rs256", sign: pkcs1(k.rsa, crypto.SHA256)},
+		{name: "short ES256 signature", alg: "ES256", kid: "p256", sign: es(k.p256, crypto.SHA256, 1), wantErr: "signature verification failed"},
+		{name: "ES384 on a P-256 key", alg: "ES384", kid: "p256", sign: es(k.p256, crypto.SHA384, 0), wantErr: "signature verification failed"},
+		{name: "ES256 on a P-384 key", alg: "ES256", kid: "p384", sign: es(k.p384, crypto.SHA256, 0), wantErr: "signature verification failed"},
+		{name: "EdDSA with an RSA key", alg: "EdDSA", kid: "rsa", sign: eddsa(k.ed25519), wantErr: "signature verification failed"},
+		{name: "critical header", alg: "RS256", kid: "rsa", extra: map[string]any{"crit": []string{"exp"}}, sign: pkcs1(k.rsa, crypto.SHA256), wantErr: "unsupported critical header"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := map[string]any{"alg": tc.alg, "typ": "JWT"}
+			if tc.kid != "" {
+				header["kid"] = tc.kid
+			}
+			for name, value := range tc.extra {
+				header[name] = value
+			}
+			claims, err := v.Verify(makeToken(t, header, validClaims(), tc.sign), testNow)
+			if tc.wantErr == "" {
+				if err != nil || claims.Username != "alice" {
+					t.Fatalf("Verify = %+v, %v; want alice", claims, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Verify = %+v, %v; want an error containing %q", claims, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRefreshesForUnknownKey(t *testing.T) {
+	k := keys(t)
+	s := &jwksServer{}
+	s.set(jwkOf("old", "", &k.p256.PublicKey))
+	v := newVerifier(t, s, TokenConfig{})
+	token := func(kid string) string {
+		return makeToken(t, map[string]any{"alg": "EdDSA", "kid": kid}, validClaims(), eddsa(k.ed25519))
+	}
+
+	// the keys were just fetched, so an unknown kid does not fetch them again
+	s.set(jwkOf("old", "", &k.p256.PublicKey), jwkOf("new", "", k.ed25519.Public()))
+	if _, err := v.Verify(token("new"), testNow); err == nil || !strings.Contains(err.Error(), "unknown signing key 'new'") {
+		t.Fatalf("Verify right after a fetch = %v, want unknown signing key", err)
+	}
+	if got := s.fetches.Load(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", got)
+	}
+
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksRefetchInterval)
+	v.mu.Unlock()
+	if _, err := v.Verify(token("new"), testNow); err != nil {
+		t.Fatalf("Verify after the refetch interval = %v, want the new key fetched", err)
+	}
+	if got := s.fetches.Load(); got != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", got)
+	}
+
+	for range 3 {
+		if _, err := v.Verify(token("unknown"), testNow); err == nil {
+			t.Fatal("Verify accepted a token of an unknown key")
+		}
+	}
+	if got := s.fetches.Load(); got != 2 {
+		t.Fatalf("JWKS fetched %d times for garbage kids, want no refetch within %v", got, jwksRefetchInterval)
+	}
+}
+
+func TestCheckClaims(t *testing.T) {
+	const leeway = time.Minute
+	v := &TokenVerifier{cfg: TokenConfig{
+		Issuer:           "https://idp.example.com",
+		Audience:         "chameleon",
+		UsernameClaim:    "preferred_username",
+		TagsClaim:        "groups",
+		MaxSessionsClaim: "max_sessions",
+		Leeway:           leeway,
+	}}
+	at := func(d time.Duration) int64 { return testNow.Add(d).Unix() }
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":                "https://idp.example.com",
+			"aud":                "chameleon",
+			"preferred_username": "alice",
+			"exp":                at(time.Hour),
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(c, name)
+				continue
+			}
+			c[name] = value
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name    string
+		claims  map[string]any
+		wantErr string
+	}{
+		{"valid", claims(nil), ""},
+		{"expired within the leeway", claims(map[string]any{"exp": at(-leeway + time.Second)}), ""},
+		{"expired beyond the leeway", claims(map[string]any{"exp": at(-leeway - time.Second)}), "token expired"},
+		{"missing exp", claims(map[string]any{"exp": nil}), "missing or invalid 'exp'"},
+		{"exp not a number", claims(map[string]any{"exp": "tomorrow"}), "missing or invalid 'exp'"},
+		{"nbf within the leeway", claims(map[string]any{"nbf": at(leeway - time.Second)}), ""},
+		{"nbf beyond the leeway", claims(map[string]any{"nbf": at(leeway + time.Second)}), "not valid yet"},
+		{"wrong issuer", claims(map[string]any{"iss": "https://evil.example.com"}), "unexpected issuer"},
+		{"aud array", claims(map[string]any{"aud": []string{"other", "chameleon"}}), ""},
+		{"aud array without ours", claims(map[string]any{"aud": []string{"other"}}), "audience 'chameleon' not in token"},
+		{"other aud string", claims(map[string]any{"aud": "other"}), "audience 'chameleon' not in token"},
+		{"missing aud", claims(map[string]any{"aud": nil}), "audience 'chameleon' not in token"},
+		{"missing username claim", claims(map[string]any{"preferred_username": nil}), "missing 'preferred_username' claim"},
+		{"username not a string", claims(map[string]any{"preferred_username": 42}), "missing 'preferred_username' claim"},
+		{"tags not strings", claims(map[string]any{"groups": []any{"eu", 1}}), "invalid 'groups' claim"},
+		{"negative max sessions", claims(map[string]any{"max_sessions": -1}), "invalid 'max_sessions' claim"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := json.Marshal(tc.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded map[string]any
+			if err := decodeSegment(b64.EncodeToString(data), &decoded); err != nil {
+				t.Fatal(err)
+			}
+			granted, err := v.checkClaims(decoded, testNow)
+			if tc.wantErr == "" {
+				if err != nil || granted.Username != "alice" {
+					t.Fatalf("checkClaims = %+v, %v; want alice", granted, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("checkClaims = %+v, %v; want an error containing %q", granted, err, tc.wantErr)
+			}
+		})
+	}
+
+	granted, err := v.checkClaims(map[string]any{
+		"iss":                "https://idp.example.com",
+		"aud":                "chameleon",
+		"preferred_username": "alice",
+		"exp":                json.Number("1704114000"),
+		"groups":             "eu residential",
+		"max_sessions":       json.Number("5"),
+	}, testNow)
+	if err != nil {
+		t.Fatalf("checkClaims: %v", err)
+	}
+	if strings.Join(granted.Tags, ",") != "eu,residential" || granted.MaxSessions != 5 || !granted.Expires.Equal(time.Unix(1704114000, 0)) {
+		t.Fatalf("checkClaims = %+v, want tags eu,residential, 5 sessions, expiry 13:00", granted)
+	}
+}
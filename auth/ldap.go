@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrDirectoryUserNotFound is returned when no directory entry matches the username
+	ErrDirectoryUserNotFound = errors.New("user not found in directory")
+	// ErrDirectoryInvalidCredentials is returned when the directory rejects the password
+	ErrDirectoryInvalidCredentials = errors.New("directory rejected the credentials")
+)
+
+// LDAPConfig configures an LDAPBackend
+type LDAPConfig struct {
+	URL      string
+	StartTLS bool
+	// CAFile is a PEM file of CAs trusted instead of the system roots
+	CAFile       string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds a user's entry; {username} is replaced by the escaped username
+	UserFilter     string
+	GroupAttribute string
+	// GroupTags maps group DNs to the proxy tags of their members
+	GroupTags map[string][]string
+	// CacheTTL is how long a successful login is cached
+	CacheTTL time.Duration
+	Timeout  time.Duration
+}
+
+// groupTag maps the members of a group to proxy tags
+type groupTag struct {
+	dn   *ldap.DN
+	tags []string
+}
+
+// LDAPBackend validates credentials against an LDAP or Active Directory server
+type LDAPBackend struct {
+	cfg       LDAPConfig
+	tlsConfig *tls.Config
+	groups    []groupTag
+}
+
+// NewLDAPBackend returns a backend for cfg
+func NewLDAPBackend(cfg LDAPConfig) (*LDAPBackend, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL '%s': %w", cfg.URL, err)
+	}
+	b := &LDAPBackend{
+		cfg:       cfg,
+		tlsConfig: &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LDAP CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in LDAP CA file %s", cfg.CAFile)
+		}
+		b.tlsConfig.RootCAs = roots
+	}
+	for group, tags := range cfg.GroupTags {
+		dn, err := ldap.ParseDN(group)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group DN '%s': %w", group, err)
+		}
+		if err := (ClientConfig{Tags: tags}).ValidateTags(); err != nil {
+			return nil, fmt.Errorf("tags of group '%s': %w", group, err)
+		}
+		b.groups = append(b.groups, groupTag{dn: dn, tags: tags})
+	}
+	return b, nil
+}
+
+// Authenticate checks username and password against the directory and returns
+// the user, tagged by its groups
+func (b *LDAPBackend) Authenticate(username, password string) (ClientConfig, error) {
+	if username == "" || password == "" {
+		// An empty password would be an unauthenticated bind, which succeeds
+		return ClientConfig{}, ErrDirectoryInvalidCredentials
+	}
+	groups, err := b.lookup(username, password)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+	return ClientConfig{Username: username, Allowed: true, Tags: b.tagsOf(groups)}, nil
+}
+
+// lookup finds the entry of username, binds as it with password and returns
+// the groups the entry lists
+func (b *LDAPBackend) lookup(username, password string) ([]string, error) {
+	conn, err := ldap.DialURL(b.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: b.cfg.Timeout}),
+		ldap.DialWithTLSConfig(b.tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", b.cfg.URL, err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(b.cfg.Timeout)
+
+	if b.cfg.StartTLS {
+		if err := conn.StartTLS(b.tlsConfig); err != nil {
+			return nil, fmt.Errorf("StartTLS with %s failed: %w", b.cfg.URL, err)
+		}
+	}
+	if b.cfg.BindDN != "" {
+		err = conn.Bind(b.cfg.BindDN, b.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup bind as '%s' failed: %w", b.cfg.BindDN, err)
+	}
+
+	filter := strings.ReplaceAll(b.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	timeLimit := max(int(b.cfg.Timeout/time.Second), 1)
+	result, err := conn.Search(ldap.NewSearchRequest(b.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, timeLimit, false, filter, []string{b.cfg.GroupAttribute}, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("search for '%s' failed: %w", username, err)
+	}
+	switch {
+	case result == nil || len(result.Entries) == 0:
+		return nil, ErrDirectoryUserNotFound
+	case len(result.Entries) > 1:
+		return nil, fmt.Errorf("filter %s matches more than one entry", filter)
+	}
+	user := result.Entries[0]
+
+	if err := conn.Bind(user.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrDirectoryInvalidCredentials
+		}
+		return nil, fmt.Errorf("bind as '%s' failed: %w", user.DN, err)
+	}
+	return user.GetEqualFoldAttributeValues(b.cfg.GroupAttribute), nil
+}
+
+// tagsOf returns the proxy tags of the given groups
+func (b *LDAPBackend) tagsOf(groups []string) []string {
+	var tags []string
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		if err != nil {
+			continue
+		}
+		for _, g := range b.groups {
+			if g.dn.EqualFold(dn) {
+				tags = append(tags, g.tags...)
+			}
+		}
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// SetLDAPBackend lets users that are not in the users file log in with their
+// directory credentials. A nil backend disables directory logins.
+func (a *MultiAuth) SetLDAPBackend(b *LDAPBackend) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.directory = b
+	a.cache.Clear()
+}
+
+// admitDirectory checks username and password against the directory, caching
+// a successful login for the backend's CacheTTL, and returns the audit reason
+// of the outcome
+func (a *MultiAuth) admitDirectory(directory *LDAPBackend, username, password string) (bool, string) {
+	client, err := directory.Authenticate(username, password)
+	switch {
+	case errors.Is(err, ErrDirectoryUserNotFound):
+		return false, ReasonUnknownUser
+	case errors.Is(err, ErrDirectoryInvalidCredentials):
+		return false, ReasonInvalidPassword
+	case err != nil:
+		log.Printf("Directory login of user '%s' failed: %v", username, err)
+		return false, ReasonDirectoryDown
+	}
+
+	a.cache.Put(client, password, ReasonDirectory, time.Now().Add(directory.cfg.CacheTTL))
+	return true, ReasonDirectory
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"log"
+	"time"
+)
+
+// SetTokenVerifier lets users that are not in the users file log in with an
+// access token as their password. A nil verifier disables token logins.
+func (a *MultiAuth) SetTokenVerifier(v *TokenVerifier) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens = v
+	a.cache.Clear()
+}
+
+// admitToken verifies token for username and, when it is valid, caches the
+// user with its claims until the token expires, at most for the cache TTL.
+// The most recent token of a user decides its tags and session limit.
+func (a *MultiAuth) admitToken(tokens *TokenVerifier, username, token string) bool {
+	now := time.Now()
+	claims, err := tokens.Verify(token, now)
+	if err != nil {
+		log.Printf("Access token of user '%s' rejected: %v", username, err)
+		return false
+	}
+	if claims.Username != username {
+		log.Printf("Access token of user '%s' rejected: issued to '%s'", username, claims.Username)
+		return false
+	}
+	client := ClientConfig{Username: username, Allowed: true, Tags: claims.Tags, MaxSessions: claims.MaxSessions}
+	if err := client.ValidateTags(); err != nil {
+		log.Printf("Access token of user '%s' rejected: %v", username, err)
+		return false
+	}
+
+	expires := claims.Expires.Add(tokens.cfg.Leeway)
+	if limit := now.Add(tokens.cfg.CacheTTL); tokens.cfg.CacheTTL > 0 && limit.Before(expires) {
+		expires = limit
+	}
+	a.cache.Put(client, token, ReasonToken, expires)
+	return true
+}
+
+// clientLocked returns the user named username: a user of the users file, or
+// one admitted by a token or the directory that has not expired. The caller
+// must hold a.mu.
+func (a *MultiAuth) clientLocked(username string) (ClientConfig, bool) {
+	if client, ok := a.clients[username]; ok {
+		return client, true
+	}
+	return a.cache.client(username)
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/secrets"
+)
+
+// ValidateUsersData checks data as a candidate users file, a JSON array or
+// with yamlFormat a YAML sequence, without applying it: every user is
+// validated like on load, and missing or repeated usernames are reported
+func ValidateUsersData(data []byte, yamlFormat bool) []config.ValidationError {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []config.ValidationError{{Index: -1, Message: ErrNoUsers.Error()}}
+	}
+	names := make(map[string]int)
+	count := 0
+	validateArray := config.ValidateJSONArray
+	if yamlFormat {
+		validateArray = config.ValidateYAMLArray
+	}
+	errs := validateArray(data, func(i int, entry json.RawMessage) error {
+		count++
+		var user ClientConfig
+		if err := json.Unmarshal(entry, &user); err != nil {
+			return err
+		}
+		if user.Username == "" {
+			return fmt.Errorf("user is missing required field 'username'")
+		}
+		if first, ok := names[user.Username]; ok {
+			return fmt.Errorf("duplicate username '%s' (first occurrence at index %d)", user.Username, first)
+		}
+		names[user.Username] = i
+		if err := user.ValidatePin(); err != nil {
+			return err
+		}
+		if err := user.ValidateTags(); err != nil {
+			return err
+		}
+		if err := user.ValidateSchedule(); err != nil {
+			return err
+		}
+		if err := secrets.DecryptFields(&user.Password, &user.UpstreamPassword); err != nil {
+			return err
+		}
+		if err := secrets.LoadFile(&user.Password, user.PasswordFile); err != nil {
+			return fmt.Errorf("password_file: %w", err)
+		}
+		return nil
+	})
+	if count == 0 && len(errs) == 0 {
+		errs = append(errs, config.ValidationError{Index: -1, Message: ErrNoUsers.Error()})
+	}
+	return errs
+}
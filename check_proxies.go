@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// checkReport is one row of the check-proxies report
+type checkReport struct {
+	ID        string `json:"id,omitempty"`
+	Address   string `json:"address"`
+	Alive     bool   `json:"alive"`
+	LatencyMs int64  `json:"latency_ms"`
+	ExitIP    string `json:"exit_ip,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runCheckProxies implements the check-proxies subcommand: it health-checks every
+// proxy in a definitions file once and exits non-zero if too few are healthy.
+func runCheckProxies(args []string) int {
+	fs := flag.NewFlagSet("check-proxies", flag.ContinueOnError)
+	proxiesPath := fs.String("proxies", "proxies.json", "Path to the proxy definitions file")
+	target := fs.String("target", config.DefaultHealthCheckTargetStr, "host:port to perform a TLS handshake with through each proxy")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout for checking a single proxy")
+	concurrency := fs.Int("concurrency", 10, "Number of proxies checked in parallel")
+	exitIPURL := fs.String("exit-ip-url", "https://api.ipify.org", "URL returning the caller's IP, fetched through each proxy (empty disables)")
+	format := fs.String("format", "table", "Output format: table or json")
+	minHealthy := fs.Float64("min-healthy", 100, "Exit non-zero if fewer than this percentage of proxies are alive")
+	skipVerify := fs.Bool("insecure", false, "Skip TLS certificate verification of the target")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-proxies [flags]\n\nRuns a one-shot health check of every proxy in a definitions file.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -format '%s'. Expected 'table' or 'json'\n", *format)
+		return 2
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	defs, err := config.ReadDefinitionsFile(*proxiesPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read proxy definitions from '%s': %v\n", *proxiesPath, err)
+		return 1
+	}
+
+	opts := proxypool.ProbeOptions{
+		Target:    *target,
+		Timeout:   *timeout,
+		TLS:       &proxypool.TLSCheckConfig{SkipVerify: *skipVerify},
+		ExitIPURL: *exitIPURL,
+	}
+	reports := make([]checkReport, len(defs))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, def := range defs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := proxypool.Probe(context.Background(), def, opts)
+			reports[i] = checkReport{
+				ID:        def.ID,
+				Address:   def.Address,
+				Alive:     result.Alive,
+				LatencyMs: result.Latency.Milliseconds(),
+				ExitIP:    result.ExitIP,
+			}
+			if result.Err != nil {
+				reports[i].Error = result.Err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	alive := 0
+	for _, r := range reports {
+		if r.Alive {
+			alive++
+		}
+	}
+	healthyPct := 100.0
+	if len(reports) > 0 {
+		healthyPct = float64(alive) * 100 / float64(len(reports))
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(struct {
+			Total      int           `json:"total"`
+			Alive      int           `json:"alive"`
+			HealthyPct float64       `json:"healthy_percent"`
+			Proxies    []checkReport `json:"proxies"`
+		}{len(reports), alive, healthyPct, reports})
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ADDRESS\tALIVE\tLATENCY\tEXIT IP\tERROR")
+		for _, r := range reports {
+			latency := "-"
+			if r.Alive {
+				latency = fmt.Sprintf("%dms", r.LatencyMs)
+			}
+			fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\n", r.Address, r.Alive, latency, r.ExitIP, r.Error)
+		}
+		tw.Flush()
+		fmt.Printf("\n%d/%d proxies alive (%.1f%%)\n", alive, len(reports), healthyPct)
+	}
+
+	if healthyPct < *minHealthy {
+		fmt.Fprintf(os.Stderr, "Only %.1f%% of proxies are alive, below the required %.1f%%\n", healthyPct, *minHealthy)
+		return 1
+	}
+	return 0
+}
@@ -1,63 +1,815 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
+
+	"github.com/sequring/chameleon/nats"
 )
 
+// maxDialTimeoutSecs caps proxies.dial_timeout_seconds and its per-tag overrides
+const maxDialTimeoutSecs = 300
+
+// minDiscoveryRefreshSecs keeps discovery from hammering provider APIs
+const minDiscoveryRefreshSecs = 10
+
+// maxPrewarmConnsPerProxy caps proxies.prewarm.connections_per_proxy
+const maxPrewarmConnsPerProxy = 64
+
+// maxRedialAttempts caps proxies.redial.max_attempts
+const maxRedialAttempts = 5
+
+// maxRedialReplayBufferBytes caps proxies.redial.replay_buffer_bytes
+const maxRedialReplayBufferBytes = 1 << 20
+
+// maxSocketBufferBytes caps the socket buffer sizes of server.tcp
+const maxSocketBufferBytes = 64 << 20
+
+// maxTapCaptureBytes caps how much of each tapped session direction is captured
+const maxTapCaptureBytes = 1 << 20
+
+// FieldError is a validation error for a single configuration field.
+// Path is the dotted YAML path of the field, e.g. "server.socks_port".
+type FieldError struct {
+	Path string
+	Msg  string
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// fieldErr builds a FieldError for path with a formatted message
+func fieldErr(path, format string, args ...any) *FieldError {
+	return &FieldError{Path: path, Msg: fmt.Sprintf(format, args...)}
+}
+
 func (appCfg *App) Validate() []error {
 	var errs []error
 
 	// Validate server configuration
 	if appCfg.Server.SocksPort == "" {
-		errs = append(errs, fmt.Errorf("server.socks_port must be set"))
+		errs = append(errs, fieldErr("server.socks_port", "must be set"))
 	} else if _, _, err := net.SplitHostPort(appCfg.Server.SocksPort); err != nil && !isValidPort(appCfg.Server.SocksPort) {
-		errs = append(errs, fmt.Errorf("invalid server.socks_port format '%s': %w. Expected 'port', ':port', or 'host:port'", appCfg.Server.SocksPort, err))
+		errs = append(errs, fieldErr("server.socks_port", "invalid format '%s': %v. Expected 'port', ':port', or 'host:port'", appCfg.Server.SocksPort, err))
+	} else if err == nil && !hasValidPort(appCfg.Server.SocksPort) {
+		errs = append(errs, fieldErr("server.socks_port", "port in '%s' must be between 1 and 65535", appCfg.Server.SocksPort))
+	}
+
+	// Validate TLS listener configuration
+	if appCfg.Server.TLS.Enabled {
+		tlsCfg := appCfg.Server.TLS
+		if _, _, err := net.SplitHostPort(tlsCfg.ListenAddr); err != nil {
+			errs = append(errs, fieldErr("server.tls.listen_addr", "invalid format '%s': %v. Expected host:port or :port", tlsCfg.ListenAddr, err))
+		} else if !hasValidPort(tlsCfg.ListenAddr) {
+			errs = append(errs, fieldErr("server.tls.listen_addr", "port in '%s' must be between 1 and 65535", tlsCfg.ListenAddr))
+		}
+		if tlsCfg.CertFile == "" || tlsCfg.KeyFile == "" {
+			errs = append(errs, fieldErr("server.tls", "cert_file and key_file must be set when enabled is true"))
+		} else if _, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile); err != nil {
+			errs = append(errs, fieldErr("server.tls", "failed to load certificate/key pair: %v", err))
+		}
+	}
+
+	// Validate SOCKS4 frontend configuration
+	if appCfg.Server.Socks4.Enabled {
+		socks4Cfg := appCfg.Server.Socks4
+		if socks4Cfg.ListenAddr != "" {
+			if _, _, err := net.SplitHostPort(socks4Cfg.ListenAddr); err != nil {
+				errs = append(errs, fieldErr("server.socks4.listen_addr", "invalid format '%s': %v. Expected host:port or :port", socks4Cfg.ListenAddr, err))
+			} else if !hasValidPort(socks4Cfg.ListenAddr) {
+				errs = append(errs, fieldErr("server.socks4.listen_addr", "port in '%s' must be between 1 and 65535", socks4Cfg.ListenAddr))
+			}
+		}
+		if len(socks4Cfg.AllowedCIDRs) == 0 {
+			errs = append(errs, fieldErr("server.socks4.allowed_cidrs", "must list at least one CIDR when enabled is true"))
+		}
+		for i, cidr := range socks4Cfg.AllowedCIDRs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				errs = append(errs, fieldErr(fmt.Sprintf("server.socks4.allowed_cidrs[%d]", i), "invalid CIDR '%s': %v", cidr, err))
+			}
+		}
+		if socks4Cfg.User == "" && len(socks4Cfg.UserMap) == 0 {
+			errs = append(errs, fieldErr("server.socks4.user", "must be set when enabled is true and user_map is empty"))
+		}
+		for userID, user := range socks4Cfg.UserMap {
+			if user == "" {
+				errs = append(errs, fieldErr(fmt.Sprintf("server.socks4.user_map[%s]", userID), "must name a user"))
+			}
+		}
+	}
+
+	// Validate admin port if set
+	if appCfg.Server.AdminPort != "" {
+		_, _, err := net.SplitHostPort(appCfg.Server.AdminPort)
+		if err != nil {
+			errs = append(errs, fieldErr("server.admin_port", "invalid format '%s': %v. Expected host:port or :port", appCfg.Server.AdminPort, err))
+		} else if !hasValidPort(appCfg.Server.AdminPort) {
+			errs = append(errs, fieldErr("server.admin_port", "port in '%s' must be between 1 and 65535", appCfg.Server.AdminPort))
+		}
+		if appCfg.Server.AdminToken == "" {
+			errs = append(errs, fieldErr("server.admin_token", "must be set when server.admin_port is set; the admin API does not run unauthenticated"))
+		}
+	}
+
+	// Validate gRPC port if set
+	if appCfg.Server.GRPCPort != "" {
+		if _, _, err := net.SplitHostPort(appCfg.Server.GRPCPort); err != nil {
+			errs = append(errs, fieldErr("server.grpc_port", "invalid format '%s': %v. Expected host:port or :port", appCfg.Server.GRPCPort, err))
+		} else if !hasValidPort(appCfg.Server.GRPCPort) {
+			errs = append(errs, fieldErr("server.grpc_port", "port in '%s' must be between 1 and 65535", appCfg.Server.GRPCPort))
+		}
+		if appCfg.Server.AdminToken == "" {
+			errs = append(errs, fieldErr("server.admin_token", "must be set when server.grpc_port is set; the gRPC API does not run unauthenticated"))
+		}
+	}
+
+	errs = append(errs, appCfg.validateListenerCollisions()...)
+
+	if appCfg.Server.UserDebugSecs < 0 || appCfg.Server.UserDebugSecs > 86400 {
+		errs = append(errs, fieldErr("server.user_debug_seconds", "must be between 1 and 86400, got %d", appCfg.Server.UserDebugSecs))
+	}
+	if appCfg.Server.SessionIdleTimeoutSecs < 0 {
+		errs = append(errs, fieldErr("server.session_idle_timeout_seconds", "must not be negative, got %d", appCfg.Server.SessionIdleTimeoutSecs))
+	}
+	if appCfg.Server.SessionMaxLifetimeSecs < 0 {
+		errs = append(errs, fieldErr("server.session_max_lifetime_seconds", "must not be negative, got %d", appCfg.Server.SessionMaxLifetimeSecs))
+	}
+	tokenNames := make(map[string]bool)
+	tokenValues := map[string]bool{appCfg.Server.ReloadToken: appCfg.Server.ReloadToken != ""}
+	for i, token := range appCfg.Server.ReloadTokens {
+		path := fmt.Sprintf("server.reload_tokens[%d]", i)
+		switch {
+		case token.Name == "":
+			errs = append(errs, fieldErr(path+".name", "must be set"))
+		case token.Name == rotatedReloadTokenName:
+			errs = append(errs, fieldErr(path+".name", "'%s' is reserved for server.reload_token", token.Name))
+		case tokenNames[token.Name]:
+			errs = append(errs, fieldErr(path+".name", "duplicate name '%s'", token.Name))
+		}
+		tokenNames[token.Name] = true
+		switch {
+		case token.Token == "":
+			errs = append(errs, fieldErr(path+".token", "must be set"))
+		case tokenValues[token.Token]:
+			errs = append(errs, fieldErr(path+".token", "is already used by another reload token"))
+		}
+		tokenValues[token.Token] = true
+	}
+
+	if appCfg.Server.UpgradeDrainTimeoutSecs < 0 {
+		errs = append(errs, fieldErr("server.upgrade_drain_timeout_seconds", "must not be negative, got %d", appCfg.Server.UpgradeDrainTimeoutSecs))
+	}
+	if appCfg.Server.HandshakeTimeoutSecs < 0 {
+		errs = append(errs, fieldErr("server.handshake_timeout_seconds", "must not be negative, got %d", appCfg.Server.HandshakeTimeoutSecs))
+	}
+	if appCfg.Server.MaxHalfOpenConnections < 0 {
+		errs = append(errs, fieldErr("server.max_half_open_connections", "must not be negative, got %d", appCfg.Server.MaxHalfOpenConnections))
+	}
+	errs = append(errs, validateTCPTuning("server.tcp.client", appCfg.Server.TCP.Client)...)
+	errs = append(errs, validateTCPTuning("server.tcp.upstream", appCfg.Server.TCP.Upstream)...)
+	if appCfg.Server.MaxConnections < 0 {
+		errs = append(errs, fieldErr("server.max_connections", "must not be negative, got %d", appCfg.Server.MaxConnections))
+	}
+	switch appCfg.Server.MaxConnectionsMode {
+	case "reject", "queue":
+	default:
+		errs = append(errs, fieldErr("server.max_connections_mode", "invalid value '%s'. Expected 'reject' or 'queue'", appCfg.Server.MaxConnectionsMode))
+	}
+	if appCfg.Server.MaxConnectionsQueueTimeoutSecs < 0 {
+		errs = append(errs, fieldErr("server.max_connections_queue_timeout_seconds", "must not be negative, got %d", appCfg.Server.MaxConnectionsQueueTimeoutSecs))
+	}
+
+	// Validate logging configuration
+	if appCfg.Logging.Directory == "" {
+		errs = append(errs, fieldErr("logging.directory", "must be set"))
+	}
+	if appCfg.Logging.AccessLogFile != "" && appCfg.Logging.AccessLogFile == appCfg.Logging.ErrorLogFile {
+		errs = append(errs, fieldErr("logging.error_log_file", "must differ from logging.access_log_file"))
+	}
+	if appCfg.Logging.LogMaxSizeMB <= 0 {
+		errs = append(errs, fieldErr("logging.log_max_size_mb", "must be greater than 0, got %d", appCfg.Logging.LogMaxSizeMB))
+	}
+	if appCfg.Logging.LogMaxBackups < 0 {
+		errs = append(errs, fieldErr("logging.log_max_backups", "must not be negative, got %d", appCfg.Logging.LogMaxBackups))
+	}
+	if appCfg.Logging.LogMaxAgeDays < 0 {
+		errs = append(errs, fieldErr("logging.log_max_age_days", "must not be negative, got %d", appCfg.Logging.LogMaxAgeDays))
+	}
+	switch appCfg.Logging.RedactDestinations.Mode {
+	case "", RedactDestinationsHash, RedactDestinationsTruncate:
+	default:
+		errs = append(errs, fieldErr("logging.redact_destinations.mode", "invalid value '%s'. Expected '%s' or '%s'", appCfg.Logging.RedactDestinations.Mode, RedactDestinationsHash, RedactDestinationsTruncate))
 	}
 
 	// Validate proxy configuration
 	if appCfg.Proxies.ConfigFilePath == "" {
-		errs = append(errs, fmt.Errorf("proxies.config_file_path must be set"))
+		errs = append(errs, fieldErr("proxies.config_file_path", "must be set"))
+	}
+
+	// Validate health check timing
+	if appCfg.Proxies.CheckIntervalSecs <= 0 {
+		errs = append(errs, fieldErr("proxies.check_interval_seconds", "must be greater than 0, got %d", appCfg.Proxies.CheckIntervalSecs))
+	}
+	if appCfg.Proxies.CheckTimeoutSecs <= 0 {
+		errs = append(errs, fieldErr("proxies.check_timeout_seconds", "must be greater than 0, got %d", appCfg.Proxies.CheckTimeoutSecs))
+	} else if appCfg.Proxies.CheckIntervalSecs > 0 && appCfg.Proxies.CheckTimeoutSecs > appCfg.Proxies.CheckIntervalSecs {
+		errs = append(errs, fieldErr("proxies.check_timeout_seconds", "(%d) must not exceed proxies.check_interval_seconds (%d)", appCfg.Proxies.CheckTimeoutSecs, appCfg.Proxies.CheckIntervalSecs))
 	}
 
 	// Validate health check target
 	if appCfg.Proxies.HealthCheckTarget == "" {
-		errs = append(errs, fmt.Errorf("proxies.health_check_target must be set"))
+		errs = append(errs, fieldErr("proxies.health_check_target", "must be set"))
 	} else if _, _, err := net.SplitHostPort(appCfg.Proxies.HealthCheckTarget); err != nil {
-		errs = append(errs, fmt.Errorf("invalid proxies.health_check_target format '%s': %w. Expected host:port", appCfg.Proxies.HealthCheckTarget, err))
+		errs = append(errs, fieldErr("proxies.health_check_target", "invalid format '%s': %v. Expected host:port", appCfg.Proxies.HealthCheckTarget, err))
+	}
+	errs = append(errs, validateCheckTargets("proxies.health_check_targets", appCfg.Proxies.HealthCheckTargets)...)
+	errs = append(errs, validateTLSCheck(appCfg.Proxies.HealthCheckTLS)...)
+	switch appCfg.Proxies.HealthCheckTargetOrder {
+	case "random", "round_robin":
+	default:
+		errs = append(errs, fieldErr("proxies.health_check_target_order", "invalid value '%s'. Expected 'random' or 'round_robin'", appCfg.Proxies.HealthCheckTargetOrder))
 	}
 
-	// Validate admin port if set
-	if appCfg.Server.AdminPort != "" {
-		_, _, err := net.SplitHostPort(appCfg.Server.AdminPort)
-		isJustPort := false
-		if err != nil {
-if len(appCfg.Server.AdminPort) > 0 && appCfg.Server.AdminPort[0] == ':' &&
-   isValidPort(appCfg.Server.AdminPort[1:]) {
-    isJustPort = true
-}
+	// Validate the health check type
+	switch appCfg.Proxies.CheckType {
+	case "tls":
+	case "http":
+		hc := appCfg.Proxies.HTTPCheck
+		if !strings.HasPrefix(hc.Path, "/") {
+			errs = append(errs, fieldErr("proxies.http_check.path", "must start with '/', got '%s'", hc.Path))
 		}
-		if err != nil && !isJustPort {
-			errs = append(errs, fmt.Errorf("invalid server.admin_port format '%s': %w. Expected host:port or :port", appCfg.Server.AdminPort, err))
+		for i, status := range hc.ExpectStatus {
+			if status < 100 || status > 599 {
+				errs = append(errs, fieldErr(fmt.Sprintf("proxies.http_check.expect_status[%d]", i), "invalid HTTP status %d", status))
+			}
+		}
+	default:
+		errs = append(errs, fieldErr("proxies.check_type", "invalid value '%s'. Expected 'tls' or 'http'", appCfg.Proxies.CheckType))
+	}
+
+	if err := ValidateDuplicatePolicy(appCfg.Proxies.DuplicatePolicy); err != nil {
+		errs = append(errs, fieldErr("proxies.duplicate_policy", "%v", err))
+	}
+
+	// Validate health check logging
+	switch appCfg.Proxies.HealthCheckLogMode {
+	case "all", "changes":
+	default:
+		errs = append(errs, fieldErr("proxies.health_check_log_mode", "invalid value '%s'. Expected 'all' or 'changes'", appCfg.Proxies.HealthCheckLogMode))
+	}
+	if appCfg.Proxies.HealthCheckLogSuccessEvery < -1 {
+		errs = append(errs, fieldErr("proxies.health_check_log_success_every", "must be -1 (disabled) or greater than 0"))
+	}
+
+	// Validate the startup readiness gate
+	if appCfg.Proxies.StartupCheckConcurrency <= 0 {
+		errs = append(errs, fieldErr("proxies.startup_check_concurrency", "must be greater than 0, got %d", appCfg.Proxies.StartupCheckConcurrency))
+	}
+	if appCfg.Proxies.StartupReadyTimeoutSecs < -1 {
+		errs = append(errs, fieldErr("proxies.startup_ready_timeout_seconds", "must be -1 (do not wait) or greater than 0"))
+	}
+	if !slices.Contains(PoolStrategies, appCfg.Proxies.Strategy) {
+		errs = append(errs, fieldErr("proxies.strategy", "invalid value '%s'. Expected one of %v", appCfg.Proxies.Strategy, PoolStrategies))
+	}
+	errs = append(errs, appCfg.validatePools()...)
+
+	// Validate CIDR tag rules
+	for i, rule := range appCfg.Proxies.TagRules {
+		path := fmt.Sprintf("proxies.tag_rules[%d]", i)
+		if _, err := netip.ParsePrefix(rule.CIDR); err != nil {
+			errs = append(errs, fieldErr(path+".cidr", "invalid CIDR '%s': %v", rule.CIDR, err))
+		}
+		if len(rule.Tags) == 0 {
+			errs = append(errs, fieldErr(path+".tags", "must not be empty"))
+		}
+	}
+
+	if appCfg.Proxies.DialTimeoutSecs <= 0 || appCfg.Proxies.DialTimeoutSecs > maxDialTimeoutSecs {
+		errs = append(errs, fieldErr("proxies.dial_timeout_seconds", "must be between 1 and %d, got %d", maxDialTimeoutSecs, appCfg.Proxies.DialTimeoutSecs))
+	}
+	overriddenTags := make(map[string]bool)
+	for i, rule := range appCfg.Proxies.DialTimeoutOverrides {
+		path := fmt.Sprintf("proxies.dial_timeout_overrides[%d]", i)
+		if rule.Tag == "" {
+			errs = append(errs, fieldErr(path+".tag", "cannot be empty"))
+		} else if overriddenTags[rule.Tag] {
+			errs = append(errs, fieldErr(path+".tag", "duplicate dial timeout override for tag '%s'", rule.Tag))
+		}
+		overriddenTags[rule.Tag] = true
+		if rule.Seconds <= 0 || rule.Seconds > maxDialTimeoutSecs {
+			errs = append(errs, fieldErr(path+".seconds", "must be between 1 and %d, got %d", maxDialTimeoutSecs, rule.Seconds))
+		}
+	}
+
+	errs = append(errs, appCfg.validateDiscovery()...)
+
+	// Validate hedging rules
+	hedgedTags := make(map[string]bool)
+	for i, rule := range appCfg.Proxies.Hedging {
+		path := fmt.Sprintf("proxies.hedging[%d]", i)
+		if rule.Tag == "" {
+			errs = append(errs, fieldErr(path+".tag", "cannot be empty"))
+		} else if hedgedTags[rule.Tag] {
+			errs = append(errs, fieldErr(path+".tag", "duplicate hedging rule for tag '%s'", rule.Tag))
+		}
+		hedgedTags[rule.Tag] = true
+		if rule.DelayMs < 0 {
+			errs = append(errs, fieldErr(path+".delay_ms", "must not be negative"))
+		}
+	}
+
+	// Validate rotation windows
+	rotatedTags := make(map[string]bool)
+	for i, rule := range appCfg.Proxies.RotationWindows {
+		path := fmt.Sprintf("proxies.rotation_windows[%d]", i)
+		switch {
+		case rule.Tag == "":
+			errs = append(errs, fieldErr(path+".tag", "cannot be empty"))
+		case !IsPlainTag(rule.Tag):
+			errs = append(errs, fieldErr(path+".tag", "must be a plain tag, not a pattern or expression: '%s'", rule.Tag))
+		case rotatedTags[rule.Tag]:
+			errs = append(errs, fieldErr(path+".tag", "duplicate rotation window for tag '%s'", rule.Tag))
+		}
+		rotatedTags[rule.Tag] = true
+		if rule.Fraction <= 0 || rule.Fraction > 1 {
+			errs = append(errs, fieldErr(path+".fraction", "must be greater than 0 and at most 1, got %v", rule.Fraction))
+		}
+		if rule.PeriodSecs <= 0 {
+			errs = append(errs, fieldErr(path+".period_seconds", "must be positive"))
+		}
+	}
+
+	entryTags := make(map[string]bool)
+	exitTags := make(map[string]bool)
+	for _, rule := range appCfg.Proxies.Chains {
+		entryTags[rule.EntryTag] = true
+	}
+	for i, rule := range appCfg.Proxies.Chains {
+		path := fmt.Sprintf("proxies.chains[%d]", i)
+		switch {
+		case rule.EntryTag == "":
+			errs = append(errs, fieldErr(path+".entry_tag", "cannot be empty"))
+		case !IsPlainTag(rule.EntryTag):
+			errs = append(errs, fieldErr(path+".entry_tag", "must be a plain tag, not a pattern or expression: '%s'", rule.EntryTag))
+		}
+		switch {
+		case rule.ExitTag != "" && !IsPlainTag(rule.ExitTag):
+			errs = append(errs, fieldErr(path+".exit_tag", "must be a plain tag, not a pattern or expression: '%s'", rule.ExitTag))
+		case entryTags[rule.ExitTag]:
+			errs = append(errs, fieldErr(path+".exit_tag", "'%s' is the entry tag of a chain; entries cannot be exits", rule.ExitTag))
+		case exitTags[rule.ExitTag]:
+			errs = append(errs, fieldErr(path+".exit_tag", "duplicate chain for exit tag '%s'", rule.ExitTag))
+		}
+		exitTags[rule.ExitTag] = true
+	}
+
+	backoffReasons := make(map[string]bool)
+	for i, rule := range appCfg.Proxies.CheckBackoff {
+		path := fmt.Sprintf("proxies.check_backoff[%d]", i)
+		switch {
+		case !slices.Contains(CheckFailureReasons, rule.Reason):
+			errs = append(errs, fieldErr(path+".reason", "invalid value '%s'. Expected one of %s", rule.Reason, strings.Join(CheckFailureReasons, ", ")))
+		case backoffReasons[rule.Reason]:
+			errs = append(errs, fieldErr(path+".reason", "duplicate backoff for reason '%s'", rule.Reason))
+		}
+		backoffReasons[rule.Reason] = true
+		if rule.Multiplier < 1 {
+			errs = append(errs, fieldErr(path+".multiplier", "must be at least 1, got %v", rule.Multiplier))
+		}
+		if rule.MaxIntervalSecs < 0 {
+			errs = append(errs, fieldErr(path+".max_interval_seconds", "must not be negative"))
+		}
+	}
+
+	// Validate connection prewarming
+	if pw := appCfg.Proxies.Prewarm; pw.ConnectionsPerProxy != 0 {
+		if pw.ConnectionsPerProxy < 0 || pw.ConnectionsPerProxy > maxPrewarmConnsPerProxy {
+			errs = append(errs, fieldErr("proxies.prewarm.connections_per_proxy", "must be between 0 and %d, got %d", maxPrewarmConnsPerProxy, pw.ConnectionsPerProxy))
+		}
+		if pw.IdleTimeoutSecs < 0 {
+			errs = append(errs, fieldErr("proxies.prewarm.idle_timeout_seconds", "must not be negative"))
+		}
+		if pw.HotWindowSecs < 0 {
+			errs = append(errs, fieldErr("proxies.prewarm.hot_window_seconds", "must not be negative"))
+		}
+	}
+
+	// Validate throughput speed tests
+	if st := appCfg.Proxies.SpeedTest; st.URL != "" {
+		if u, err := url.Parse(st.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fieldErr("proxies.speed_test.url", "must be an http(s) URL, got '%s'", st.URL))
+		}
+		if st.SizeKB < 0 {
+			errs = append(errs, fieldErr("proxies.speed_test.size_kb", "must not be negative"))
+		}
+		if st.IntervalSecs < 0 {
+			errs = append(errs, fieldErr("proxies.speed_test.interval_seconds", "must not be negative"))
+		}
+		if st.TimeoutSecs < 0 {
+			errs = append(errs, fieldErr("proxies.speed_test.timeout_seconds", "must not be negative"))
+		}
+	} else if appCfg.Proxies.Strategy == "fastest_throughput" {
+		errs = append(errs, fieldErr("proxies.speed_test.url", "is required by the fastest_throughput strategy"))
+	} else {
+		for i, pool := range appCfg.Pools {
+			if pool.Strategy == "fastest_throughput" {
+				errs = append(errs, fieldErr(fmt.Sprintf("pools[%d].strategy", i), "fastest_throughput requires proxies.speed_test.url"))
+			}
+		}
+	}
+
+	// Validate redialing of reset upstream connections
+	if rd := appCfg.Proxies.Redial; rd.MaxAttempts != 0 {
+		if rd.MaxAttempts < 0 || rd.MaxAttempts > maxRedialAttempts {
+			errs = append(errs, fieldErr("proxies.redial.max_attempts", "must be between 0 and %d, got %d", maxRedialAttempts, rd.MaxAttempts))
+		}
+		if rd.WindowMs < 0 {
+			errs = append(errs, fieldErr("proxies.redial.window_ms", "must not be negative"))
+		}
+		if rd.ReplayBufferBytes < 0 || rd.ReplayBufferBytes > maxRedialReplayBufferBytes {
+			errs = append(errs, fieldErr("proxies.redial.replay_buffer_bytes", "must be between 0 and %d, got %d", maxRedialReplayBufferBytes, rd.ReplayBufferBytes))
+		}
+	}
+
+	// Validate the pool health alert
+	if ha := appCfg.Proxies.HealthAlert; ha.Threshold < 0 || ha.Threshold > 1 {
+		errs = append(errs, fieldErr("proxies.health_alert.threshold", "must be between 0 and 1, got %v", ha.Threshold))
+	} else if ha.ForSecs < 0 {
+		errs = append(errs, fieldErr("proxies.health_alert.for_seconds", "must not be negative"))
+	}
+
+	if appCfg.Proxies.CostLatencyToleranceMs < 0 {
+		errs = append(errs, fieldErr("proxies.cost_latency_tolerance_ms", "must not be negative, got %d", appCfg.Proxies.CostLatencyToleranceMs))
+	}
+
+	// Validate the canary evaluation
+	if c := appCfg.Proxies.Canary; c.TrafficPercent < 0 || c.TrafficPercent > 100 {
+		errs = append(errs, fieldErr("proxies.canary.traffic_percent", "must be between 0 and 100, got %v", c.TrafficPercent))
+	} else if c.TrafficPercent > 0 {
+		if c.MinRequests < 1 {
+			errs = append(errs, fieldErr("proxies.canary.min_requests", "must be positive, got %d", c.MinRequests))
+		}
+		if c.SuccessRate < 0 || c.SuccessRate > 1 {
+			errs = append(errs, fieldErr("proxies.canary.success_rate", "must be between 0 and 1, got %v", c.SuccessRate))
+		}
+	}
+
+	// Validate the destination blacklist
+	if bl := appCfg.Proxies.DestinationBlacklist; bl.Enabled {
+		if bl.WindowSecs < 0 {
+			errs = append(errs, fieldErr("proxies.destination_blacklist.window_seconds", "must not be negative"))
+		}
+		if bl.MinAttempts < 0 {
+			errs = append(errs, fieldErr("proxies.destination_blacklist.min_attempts", "must not be negative"))
+		}
+		if bl.FailureRatio < 0 || bl.FailureRatio > 1 {
+			errs = append(errs, fieldErr("proxies.destination_blacklist.failure_ratio", "must be between 0 and 1, got %v", bl.FailureRatio))
+		}
+		if bl.DurationSecs < 0 {
+			errs = append(errs, fieldErr("proxies.destination_blacklist.duration_seconds", "must not be negative"))
+		}
+	}
+	if geo := appCfg.Proxies.GeoProximity; geo.Enabled {
+		if geo.DatabaseFile == "" {
+			errs = append(errs, fieldErr("proxies.geo_proximity.database_file", "must be set when geo proximity is enabled"))
+		}
+		if geo.CacheTTLSecs < 0 {
+			errs = append(errs, fieldErr("proxies.geo_proximity.cache_ttl_seconds", "must not be negative"))
+		}
+		if geo.ResolveTimeoutMs < 0 {
+			errs = append(errs, fieldErr("proxies.geo_proximity.resolve_timeout_ms", "must not be negative"))
+		}
+		if geo.MaxCacheEntries < 0 {
+			errs = append(errs, fieldErr("proxies.geo_proximity.max_cache_entries", "must not be negative"))
+		}
+	}
+
+	// Validate Prometheus settings
+	switch appCfg.Prometheus.ProxyLabel {
+	case "address", "hash", "truncate":
+	default:
+		errs = append(errs, fieldErr("prometheus.proxy_label", "invalid value '%s'. Expected 'address', 'hash' or 'truncate'", appCfg.Prometheus.ProxyLabel))
+	}
+	if appCfg.Prometheus.ProxyLabelMaxLength < 0 {
+		errs = append(errs, fieldErr("prometheus.proxy_label_max_length", "must not be negative"))
+	}
+	if appCfg.Prometheus.Enabled {
+		if _, _, err := net.SplitHostPort(appCfg.Prometheus.Port); err != nil {
+			errs = append(errs, fieldErr("prometheus.port", "invalid format '%s': %v. Expected host:port or :port", appCfg.Prometheus.Port, err))
+		} else if !hasValidPort(appCfg.Prometheus.Port) {
+			errs = append(errs, fieldErr("prometheus.port", "port in '%s' must be between 1 and 65535", appCfg.Prometheus.Port))
 		}
 	}
 
 	// Validate users configuration
 	if appCfg.Users.ConfigFilePath == "" {
-		errs = append(errs, fmt.Errorf("users.config_file_path must be set"))
+		errs = append(errs, fieldErr("users.config_file_path", "must be set"))
+	}
+
+	switch appCfg.Users.DefaultBehavior {
+	case "deny", "allow_all_active":
+	case "allow_default_tag_only":
+		if appCfg.Users.DefaultProxyTag == "" {
+			errs = append(errs, fieldErr("users.default_proxy_tag", "must be set when users.default_behavior_no_tags is 'allow_default_tag_only'"))
+		} else if !IsPlainTag(appCfg.Users.DefaultProxyTag) {
+			if _, err := ParseTagExpr(appCfg.Users.DefaultProxyTag); err != nil {
+				errs = append(errs, fieldErr("users.default_proxy_tag", "%v", err))
+			}
+		}
+	default:
+		errs = append(errs, fieldErr("users.default_behavior_no_tags", "invalid value '%s'. Expected 'deny', 'allow_default_tag_only' or 'allow_all_active'", appCfg.Users.DefaultBehavior))
+	}
+
+	switch tp := appCfg.Users.Tarpit; tp.Mode {
+	case "":
+	case TarpitDrip, TarpitReset:
+		if tp.DripIntervalSecs < 0 {
+			errs = append(errs, fieldErr("users.tarpit.drip_interval_seconds", "must not be negative"))
+		}
+		if tp.MaxDurationSecs < 0 {
+			errs = append(errs, fieldErr("users.tarpit.max_duration_seconds", "must not be negative"))
+		}
+		if tp.MaxConcurrent < 0 {
+			errs = append(errs, fieldErr("users.tarpit.max_concurrent", "must not be negative"))
+		}
+	default:
+		errs = append(errs, fieldErr("users.tarpit.mode", "invalid value '%s'. Expected '%s' or '%s'", tp.Mode, TarpitDrip, TarpitReset))
+	}
+
+	switch appCfg.Users.MissingFilePolicy {
+	case "fail", "start_empty":
+	default:
+		errs = append(errs, fieldErr("users.missing_file_policy", "invalid value '%s'. Expected 'fail' or 'start_empty'", appCfg.Users.MissingFilePolicy))
+	}
+
+	switch appCfg.Users.EmptyStoreBehavior {
+	case "deny":
+	case "allow_anonymous_cidr":
+		if len(appCfg.Users.AnonymousCIDRs) == 0 {
+			errs = append(errs, fieldErr("users.anonymous_cidrs", "must list at least one CIDR when users.empty_store_behavior is 'allow_anonymous_cidr'"))
+		}
+	default:
+		errs = append(errs, fieldErr("users.empty_store_behavior", "invalid value '%s'. Expected 'deny' or 'allow_anonymous_cidr'", appCfg.Users.EmptyStoreBehavior))
+	}
+	for i, cidr := range appCfg.Users.AnonymousCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fieldErr(fmt.Sprintf("users.anonymous_cidrs[%d]", i), "invalid CIDR '%s': %v", cidr, err))
+		}
+	}
+	if appCfg.Users.AuthFailureWindowSec <= 0 {
+		errs = append(errs, fieldErr("users.auth_failure_window_seconds", "must be greater than 0"))
+	}
+	if jwt := appCfg.Users.JWT; jwt.Enabled {
+		if u, err := url.Parse(jwt.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fieldErr("users.jwt.jwks_url", "must be an http(s) URL, got '%s'", jwt.JWKSURL))
+		}
+		if jwt.RefreshIntervalSecs <= 0 {
+			errs = append(errs, fieldErr("users.jwt.jwks_refresh_interval_seconds", "must be greater than 0"))
+		}
+		if jwt.LeewaySecs < 0 {
+			errs = append(errs, fieldErr("users.jwt.leeway_seconds", "must not be negative"))
+		}
+		if jwt.CacheTTLSecs <= 0 {
+			errs = append(errs, fieldErr("users.jwt.cache_ttl_seconds", "must be greater than 0"))
+		}
+	}
+	switch appCfg.Users.AuthBackend {
+	case "file":
+	case "ldap":
+		ldap := appCfg.Users.LDAP
+		if u, err := url.Parse(ldap.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			errs = append(errs, fieldErr("users.ldap.url", "must be an ldap:// or ldaps:// URL, got '%s'", ldap.URL))
+		} else if ldap.StartTLS && u.Scheme == "ldaps" {
+			errs = append(errs, fieldErr("users.ldap.start_tls", "cannot be used with an ldaps:// URL"))
+		}
+		if ldap.BaseDN == "" {
+			errs = append(errs, fieldErr("users.ldap.base_dn", "is required"))
+		}
+		if !strings.Contains(ldap.UserFilter, "{username}") {
+			errs = append(errs, fieldErr("users.ldap.user_filter", "must contain '{username}', got '%s'", ldap.UserFilter))
+		}
+		if ldap.CacheTTLSecs <= 0 {
+			errs = append(errs, fieldErr("users.ldap.cache_ttl_seconds", "must be greater than 0"))
+		}
+		if ldap.TimeoutSecs <= 0 {
+			errs = append(errs, fieldErr("users.ldap.timeout_seconds", "must be greater than 0"))
+		}
+		for group, tags := range ldap.GroupTags {
+			if len(tags) == 0 {
+				errs = append(errs, fieldErr("users.ldap.group_tags", "group '%s' maps to no tags", group))
+			}
+		}
+	default:
+		errs = append(errs, fieldErr("users.auth_backend", "invalid value '%s'. Expected 'file' or 'ldap'", appCfg.Users.AuthBackend))
 	}
 
 	// Validate webhook URL if set
 	if appCfg.Webhook.URL != "" {
 		if appCfg.Webhook.PostTimeoutSec <= 0 {
-			errs = append(errs, fmt.Errorf("webhook.post_timeout_seconds must be greater than 0"))
+			errs = append(errs, fieldErr("webhook.post_timeout_seconds", "must be greater than 0"))
+		}
+	}
+	switch appCfg.Webhook.AuthEvents {
+	case "none":
+	case "failures", "all":
+		if appCfg.Webhook.URL == "" {
+			errs = append(errs, fieldErr("webhook.url", "must be set when webhook.auth_events is '%s'", appCfg.Webhook.AuthEvents))
+		}
+	default:
+		errs = append(errs, fieldErr("webhook.auth_events", "invalid value '%s'. Expected 'none', 'failures' or 'all'", appCfg.Webhook.AuthEvents))
+	}
+
+	if appCfg.Tap.Enabled {
+		if appCfg.Tap.OutputFile == "" {
+			errs = append(errs, fieldErr("tap.output_file", "cannot be empty when tap is enabled"))
+		}
+		if len(appCfg.Tap.Users) == 0 && len(appCfg.Tap.Destinations) == 0 {
+			errs = append(errs, fieldErr("tap", "must list at least one of users or destinations when enabled"))
+		}
+		for i, pattern := range appCfg.Tap.Destinations {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fieldErr(fmt.Sprintf("tap.destinations[%d]", i), "invalid pattern '%s': %v", pattern, err))
+			}
+		}
+		if appCfg.Tap.CaptureBytes < 0 || appCfg.Tap.CaptureBytes > maxTapCaptureBytes {
+			errs = append(errs, fieldErr("tap.capture_bytes", "must be between 0 and %d", maxTapCaptureBytes))
+		}
+	}
+
+	if appCfg.Usage.Enabled {
+		if appCfg.Usage.FilePath == "" {
+			errs = append(errs, fieldErr("usage.file_path", "cannot be empty when usage accounting is enabled"))
+		}
+		if appCfg.Usage.FlushIntervalSecs <= 0 {
+			errs = append(errs, fieldErr("usage.flush_interval_seconds", "must be greater than 0, got %d", appCfg.Usage.FlushIntervalSecs))
+		}
+		if appCfg.Usage.RetentionMonths <= 0 {
+			errs = append(errs, fieldErr("usage.retention_months", "must be greater than 0, got %d", appCfg.Usage.RetentionMonths))
+		}
+	}
+	if stream := appCfg.Usage.Stream; stream.Enabled {
+		if stream.IntervalSecs <= 0 {
+			errs = append(errs, fieldErr("usage.stream.interval_seconds", "must be greater than 0, got %d", stream.IntervalSecs))
+		}
+		if !stream.Webhook && stream.NATS.URL == "" {
+			errs = append(errs, fieldErr("usage.stream", "set webhook: true or nats.url to publish the events somewhere"))
+		}
+		if stream.Webhook && appCfg.Webhook.URL == "" {
+			errs = append(errs, fieldErr("webhook.url", "must be set when usage.stream.webhook is enabled"))
+		}
+		if stream.NATS.URL != "" {
+			if _, err := nats.ParseURL(stream.NATS.URL); err != nil {
+				errs = append(errs, fieldErr("usage.stream.nats.url", "%v", err))
+			}
+			if err := nats.ValidateSubject(stream.NATS.Subject); err != nil {
+				errs = append(errs, fieldErr("usage.stream.nats.subject", "%v", err))
+			}
+			if stream.NATS.TimeoutSecs <= 0 {
+				errs = append(errs, fieldErr("usage.stream.nats.timeout_seconds", "must be greater than 0, got %d", stream.NATS.TimeoutSecs))
+			}
+		}
+	}
+
+	if appCfg.Telemetry.Enabled {
+		switch appCfg.Telemetry.Protocol {
+		case "grpc", "http":
+		default:
+			errs = append(errs, fieldErr("telemetry.protocol", "invalid value '%s'. Expected 'grpc' or 'http'", appCfg.Telemetry.Protocol))
+		}
+		if _, _, err := net.SplitHostPort(appCfg.Telemetry.Endpoint); err != nil {
+			errs = append(errs, fieldErr("telemetry.endpoint", "must be host:port: %v", err))
+		}
+		if appCfg.Telemetry.SampleRatio < 0 || appCfg.Telemetry.SampleRatio > 1 {
+			errs = append(errs, fieldErr("telemetry.sample_ratio", "must be between 0 and 1, got %v", appCfg.Telemetry.SampleRatio))
+		}
+	}
+
+	return errs
+}
+
+// validatePools checks the named proxy pools
+func (appCfg *App) validatePools() []error {
+	var errs []error
+	names := map[string]bool{DefaultPoolName: true}
+	files := map[string]bool{path.Clean(appCfg.Proxies.ConfigFilePath): true}
+	for i, pool := range appCfg.Pools {
+		prefix := fmt.Sprintf("pools[%d]", i)
+		switch {
+		case pool.Name == "":
+			errs = append(errs, fieldErr(prefix+".name", "must be set"))
+		case names[pool.Name]:
+			errs = append(errs, fieldErr(prefix+".name", "'%s' is already used by another pool", pool.Name))
+		}
+		names[pool.Name] = true
+		switch {
+		case pool.ConfigFilePath == "":
+			errs = append(errs, fieldErr(prefix+".config_file_path", "must be set"))
+		case files[path.Clean(pool.ConfigFilePath)]:
+			errs = append(errs, fieldErr(prefix+".config_file_path", "'%s' is already used by another pool", pool.ConfigFilePath))
+		}
+		files[path.Clean(pool.ConfigFilePath)] = true
+		if _, _, err := net.SplitHostPort(pool.HealthCheckTarget); err != nil {
+			errs = append(errs, fieldErr(prefix+".health_check_target", "invalid format '%s': %v. Expected host:port", pool.HealthCheckTarget, err))
+		}
+		errs = append(errs, validateCheckTargets(prefix+".health_check_targets", pool.HealthCheckTargets)...)
+		if pool.CheckIntervalSecs <= 0 {
+			errs = append(errs, fieldErr(prefix+".check_interval_seconds", "must be greater than 0, got %d", pool.CheckIntervalSecs))
+		}
+		if pool.CheckTimeoutSecs <= 0 || pool.CheckTimeoutSecs > pool.CheckIntervalSecs {
+			errs = append(errs, fieldErr(prefix+".check_timeout_seconds", "must be greater than 0 and not exceed check_interval_seconds, got %d", pool.CheckTimeoutSecs))
+		}
+		if !slices.Contains(PoolStrategies, pool.Strategy) {
+			errs = append(errs, fieldErr(prefix+".strategy", "invalid value '%s'. Expected one of %v", pool.Strategy, PoolStrategies))
+		}
+		if pool.ListenAddr != "" {
+			if !isValidPort(pool.ListenAddr) && !hasValidPort(pool.ListenAddr) {
+				errs = append(errs, fieldErr(prefix+".listen_addr", "invalid listen address '%s'", pool.ListenAddr))
+			}
 		}
 	}
+	return errs
+}
+
+// validateListenerCollisions reports enabled listeners that would bind the same port
+func (appCfg *App) validateListenerCollisions() []error {
+	type listener struct {
+		path string
+		addr string
+	}
+	listeners := []listener{
+		{"server.socks_port", appCfg.Server.SocksPort},
+		{"server.admin_port", appCfg.Server.AdminPort},
+		{"server.grpc_port", appCfg.Server.GRPCPort},
+	}
+	if appCfg.Server.TLS.Enabled {
+		listeners = append(listeners, listener{"server.tls.listen_addr", appCfg.Server.TLS.ListenAddr})
+	}
+	if appCfg.Server.Socks4.Enabled {
+		listeners = append(listeners, listener{"server.socks4.listen_addr", appCfg.Server.Socks4.ListenAddr})
+	}
+	if appCfg.Prometheus.Enabled {
+		listeners = append(listeners, listener{"prometheus.port", appCfg.Prometheus.Port})
+	}
+	for i, pool := range appCfg.Pools {
+		listeners = append(listeners, listener{fmt.Sprintf("pools[%d].listen_addr", i), pool.ListenAddr})
+	}
 
+	var errs []error
+	for i := 0; i < len(listeners); i++ {
+		for j := i + 1; j < len(listeners); j++ {
+			a, b := listeners[i], listeners[j]
+			if a.addr == "" || b.addr == "" {
+				continue
+			}
+			if listenersCollide(a.addr, b.addr) {
+				errs = append(errs, fieldErr(b.path, "'%s' collides with %s '%s'", b.addr, a.path, a.addr))
+			}
+		}
+	}
 	return errs
 }
 
+// listenersCollide reports whether two listen addresses would bind the same port.
+// An empty or wildcard host binds every interface and so collides with any host.
+func listenersCollide(a, b string) bool {
+	hostA, portA, okA := splitListenAddr(a)
+	hostB, portB, okB := splitListenAddr(b)
+	if !okA || !okB || portA != portB {
+		return false
+	}
+	return isWildcardHost(hostA) || isWildcardHost(hostB) || strings.EqualFold(hostA, hostB)
+}
+
+// splitListenAddr splits a listen address that may also be a bare port
+func splitListenAddr(addr string) (host, port string, ok bool) {
+	if isValidPort(addr) {
+		return "", strings.TrimPrefix(addr, ":"), true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", false
+	}
+	return host, port, true
+}
+
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// hasValidPort reports whether the port part of a host:port address is in range
+func hasValidPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && isValidPort(port)
+}
+
 // Helper function to check if a string is a valid port
 func isValidPort(portStr string) bool {
 	if len(portStr) == 0 {
@@ -74,4 +826,99 @@ func isValidPort(portStr string) bool {
 	}
 	// Check if port is in valid range (1-65535)
 	return port > 0 && port <= 65535
-}
\ No newline at end of file
+}
+
+// validateDiscovery checks the proxies.discovery sources
+func (appCfg *App) validateDiscovery() []error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, src := range appCfg.Proxies.Discovery {
+		path := fmt.Sprintf("proxies.discovery[%d]", i)
+		if names[src.Name] {
+			errs = append(errs, fieldErr(path+".name", "duplicate discovery source name '%s'", src.Name))
+		}
+		names[src.Name] = true
+		if src.RefreshIntervalSecs < minDiscoveryRefreshSecs {
+			errs = append(errs, fieldErr(path+".refresh_interval_seconds", "must be at least %d, got %d", minDiscoveryRefreshSecs, src.RefreshIntervalSecs))
+		}
+		if err := ValidateUsernameTemplate(src.Username); err != nil {
+			errs = append(errs, fieldErr(path+".username", "%v", err))
+		}
+		switch src.Provider {
+		case DiscoveryProviderConsul:
+			if u, err := url.Parse(src.Consul.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fieldErr(path+".consul.address", "must be an http(s) URL, got '%s'", src.Consul.Address))
+			}
+			if src.Consul.Service == "" {
+				errs = append(errs, fieldErr(path+".consul.service", "must be set"))
+			}
+		case DiscoveryProviderDigitalOcean:
+			if src.DigitalOcean.Token == "" {
+				errs = append(errs, fieldErr(path+".digitalocean.token", "must be set"))
+			}
+			if src.DigitalOcean.Tag == "" {
+				errs = append(errs, fieldErr(path+".digitalocean.tag", "must be set"))
+			}
+			if src.DigitalOcean.Port < 1 || src.DigitalOcean.Port > 65535 {
+				errs = append(errs, fieldErr(path+".digitalocean.port", "must be between 1 and 65535, got %d", src.DigitalOcean.Port))
+			}
+		default:
+			errs = append(errs, fieldErr(path+".provider", "invalid provider '%s', expected '%s' or '%s'", src.Provider, DiscoveryProviderConsul, DiscoveryProviderDigitalOcean))
+		}
+	}
+	return errs
+}
+
+// validateCheckTargets checks that every health check target at path is host:port
+func validateCheckTargets(path string, targets []string) []error {
+	var errs []error
+	for i, target := range targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			errs = append(errs, fieldErr(fmt.Sprintf("%s[%d]", path, i), "invalid format '%s': %v. Expected host:port", target, err))
+		}
+	}
+	return errs
+}
+
+// validateTCPTuning checks the TCP options at path
+func validateTCPTuning(path string, tcp TCPTuningConfig) []error {
+	var errs []error
+	if tcp.KeepAliveSecs < -1 {
+		errs = append(errs, fieldErr(path+".keepalive_seconds", "must be -1 (disabled), 0 (default) or positive, got %d", tcp.KeepAliveSecs))
+	}
+	if tcp.ReadBufferBytes < 0 || tcp.ReadBufferBytes > maxSocketBufferBytes {
+		errs = append(errs, fieldErr(path+".read_buffer_bytes", "must be between 0 and %d, got %d", maxSocketBufferBytes, tcp.ReadBufferBytes))
+	}
+	if tcp.WriteBufferBytes < 0 || tcp.WriteBufferBytes > maxSocketBufferBytes {
+		errs = append(errs, fieldErr(path+".write_buffer_bytes", "must be between 0 and %d, got %d", maxSocketBufferBytes, tcp.WriteBufferBytes))
+	}
+	return errs
+}
+
+// validateTLSCheck checks that the CA files of proxies.health_check_tls load and that
+// every override selects proxies
+func validateTLSCheck(tlsCheck TLSCheckConfig) []error {
+	var errs []error
+	if tlsCheck.CAFile != "" {
+		if _, err := LoadCertPool(tlsCheck.CAFile); err != nil {
+			errs = append(errs, fieldErr("proxies.health_check_tls.ca_file", "%v", err))
+		}
+	}
+	for i, o := range tlsCheck.Overrides {
+		path := fmt.Sprintf("proxies.health_check_tls.overrides[%d]", i)
+		if (o.Proxy == "") == (o.Tag == "") {
+			errs = append(errs, fieldErr(path, "exactly one of proxy and tag must be set"))
+		}
+		if o.Proxy != "" {
+			if _, _, err := net.SplitHostPort(o.Proxy); err != nil {
+				errs = append(errs, fieldErr(path+".proxy", "invalid format '%s': %v. Expected host:port", o.Proxy, err))
+			}
+		}
+		if o.CAFile != "" {
+			if _, err := LoadCertPool(o.CAFile); err != nil {
+				errs = append(errs, fieldErr(path+".ca_file", "%v", err))
+			}
+		}
+	}
+	return errs
+}
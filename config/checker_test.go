@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file named name into dir and returns its path
+func writeConfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadConfig loads content as a configuration file with the defaults applied
+func loadConfig(t *testing.T, content string) *App {
+	t.Helper()
+	appCfg, err := Load(writeConfig(t, t.TempDir(), "config.yml", content))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return appCfg
+}
+
+// fieldErrors returns the messages of the field errors in errs by path
+func fieldErrors(errs []error) map[string]string {
+	byPath := make(map[string]string)
+	for _, err := range errs {
+		var fe *FieldError
+		if errors.As(err, &fe) {
+			byPath[fe.Path] = fe.Msg
+		}
+	}
+	return byPath
+}
+
+func TestListenersCollide(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{":1080", "0.0.0.0:1080", true},
+		{"1080", "127.0.0.1:1080", true},
+		{"[::]:1080", "127.0.0.1:1080", true},
+		{"127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"localhost:1080", "LOCALHOST:1080", true},
+		{"127.0.0.1:1080", "127.0.0.2:1080", false},
+		{":1080", ":1081", false},
+		{"not an address", ":1080", false},
+	} {
+		if got := listenersCollide(tc.a, tc.b); got != tc.want {
+			t.Errorf("listenersCollide(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:1", true},
+		{":65535", true},
+		{"127.0.0.1:0", false},
+		{":65536", false},
+		{"host:-1", false},
+		{"host:http", false},
+		{"1080", false},
+	} {
+		if got := hasValidPort(tc.addr); got != tc.want {
+			t.Errorf("hasValidPort(%q) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		port string
+		want bool
+	}{
+		{"1080", true},
+		{":1080", true},
+		{"0", false},
+		{"70000", false},
+		{"", false},
+	} {
+		if got := isValidPort(tc.port); got != tc.want {
+			t.Errorf("isValidPort(%q) = %v, want %v", tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   string
+		wantPath string
+		wantMsg  string
+	}{
+		{
+			name:     "wildcard and any address on the same port",
+			config:   "server:\n  socks_port: ':1080'\nprometheus:\n  enabled: true\n  port: '0.0.0.0:1080'\n",
+			wantPath: "prometheus.port",
+			wantMsg:  "collides with server.socks_port",
+		},
+		{
+			name:     "admin port out of range",
+			config:   "server:\n  admin_port: '127.0.0.1:70000'\n  admin_token: secret\n",
+			wantPath: "server.admin_port",
+			wantMsg:  "must be between 1 and 65535",
+		},
+		{
+			name:     "socks port zero",
+			config:   "server:\n  socks_port: '127.0.0.1:0'\n",
+			wantPath: "server.socks_port",
+			wantMsg:  "must be between 1 and 65535",
+		},
+		{
+			name:     "admin API without a token",
+			config:   "server:\n  admin_port: '127.0.0.1:8081'\n",
+			wantPath: "server.admin_token",
+			wantMsg:  "must be set when server.admin_port is set",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			byPath := fieldErrors(loadConfig(t, tc.config).Validate())
+			if msg, ok := byPath[tc.wantPath]; !ok || !strings.Contains(msg, tc.wantMsg) {
+				t.Fatalf("errors = %v, want %s: ...%s...", byPath, tc.wantPath, tc.wantMsg)
+			}
+		})
+	}
+
+	byPath := fieldErrors(loadConfig(t, "server:\n  socks_port: ':1080'\n  admin_port: '127.0.0.1:8081'\n  admin_token: secret\n").Validate())
+	for _, path := range []string{"server.socks_port", "server.admin_port", "server.admin_token"} {
+		if msg, ok := byPath[path]; ok {
+			t.Errorf("valid listeners: %s: %s", path, msg)
+		}
+	}
+}
+
+func TestLoadStrictRejectsUnknownKeys(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "config.yml", "proxies:\n  chek_interval_seconds: 5\n")
+	if _, err := Load(path); err != nil {
+		t.Fatalf("Load: %v, want unknown keys ignored", err)
+	}
+	_, err := LoadStrict(path)
+	if err == nil || !strings.Contains(err.Error(), "chek_interval_seconds") {
+		t.Fatalf("LoadStrict = %v, want an error naming chek_interval_seconds", err)
+	}
+}
@@ -2,10 +2,7 @@ package config
 
 import (
 	"fmt"
-	"os"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
 
@@ -16,53 +13,678 @@ type ProxyEntry struct {
 }
 
 
+// ServerConfig configures the listeners and the admin APIs
 type ServerConfig struct {
-	SocksPort string `yaml:"socks_port" json:"socks_port"`
-	AdminPort string `yaml:"admin_port" json:"admin_port"`
+	// SocksPort is the listen address of the SOCKS5 server: "port", ":port" or "host:port"
+	SocksPort string         `yaml:"socks_port" json:"socks_port"`
+	// AdminPort is the listen address of the HTTP admin API. Empty disables it.
+	AdminPort string         `yaml:"admin_port" json:"admin_port"`
+	// AdminToken is the bearer token required by the admin APIs. It must be set
+	// when AdminPort or GRPCPort is.
+	AdminToken string        `yaml:"admin_token" json:"admin_token"`
+	// GRPCPort is the listen address of the gRPC admin API. Empty disables it.
+	// It shares admin_token with the HTTP admin API.
+	GRPCPort  string         `yaml:"grpc_port,omitempty" json:"grpc_port,omitempty"`
+	// ReloadToken allows POST /api/v1/reload with an X-Reload-Token header, for scripts
+	// that should be able to reload proxies but not use the rest of the admin API.
+	ReloadToken string       `yaml:"reload_token,omitempty" json:"reload_token,omitempty"`
+	// ReloadTokens are further named tokens accepted like ReloadToken, so every
+	// script can have its own token and be revoked on its own
+	ReloadTokens []ReloadToken `yaml:"reload_tokens,omitempty" json:"reload_tokens,omitempty"`
+	// SessionIdleTimeoutSecs closes relayed sessions that transferred no bytes in
+	// either direction for this long. 0 disables it.
+	SessionIdleTimeoutSecs int `yaml:"session_idle_timeout_seconds,omitempty" json:"session_idle_timeout_seconds,omitempty"`
+	// SessionMaxLifetimeSecs closes relayed sessions older than this. 0 disables it.
+	SessionMaxLifetimeSecs int `yaml:"session_max_lifetime_seconds,omitempty" json:"session_max_lifetime_seconds,omitempty"`
+	// UpgradeDrainTimeoutSecs is how long the old process keeps relaying its sessions
+	// after a SIGUSR2 upgrade handed the listeners to a new process
+	UpgradeDrainTimeoutSecs int `yaml:"upgrade_drain_timeout_seconds,omitempty" json:"upgrade_drain_timeout_seconds,omitempty"`
+	// PIDFile is written with the PID of the process serving the listeners, and
+	// rewritten by the new process after an upgrade. Empty disables it.
+	PIDFile string `yaml:"pid_file,omitempty" json:"pid_file,omitempty"`
+	// StatsDumpFile receives the snapshot written on SIGUSR1. Empty logs it instead.
+	StatsDumpFile string `yaml:"stats_dump_file,omitempty" json:"stats_dump_file,omitempty"`
+	// HandshakeTimeoutSecs closes client connections that have not completed the
+	// SOCKS negotiation (greeting, authentication and request) in this time
+	HandshakeTimeoutSecs int `yaml:"handshake_timeout_seconds,omitempty" json:"handshake_timeout_seconds,omitempty"`
+	// MaxHalfOpenConnections caps the client connections negotiating at once
+	// across all SOCKS listeners; further connections are closed right away
+	MaxHalfOpenConnections int `yaml:"max_half_open_connections,omitempty" json:"max_half_open_connections,omitempty"`
+	// MaxConnections caps the client connections served at once, from their
+	// SOCKS request until the session ends. 0 disables the limit.
+	MaxConnections int `yaml:"max_connections,omitempty" json:"max_connections,omitempty"`
+	// MaxConnectionsMode is what happens to requests over the limit: "reject"
+	// replies with a SOCKS error, "queue" waits up to
+	// MaxConnectionsQueueTimeoutSecs for a free slot first
+	MaxConnectionsMode             string `yaml:"max_connections_mode,omitempty" json:"max_connections_mode,omitempty"`
+	MaxConnectionsQueueTimeoutSecs int    `yaml:"max_connections_queue_timeout_seconds,omitempty" json:"max_connections_queue_timeout_seconds,omitempty"`
+	// UserDebugSecs is how long the debug mode of a user enabled through the
+	// admin API lasts unless the request sets another duration
+	UserDebugSecs int `yaml:"user_debug_seconds,omitempty" json:"user_debug_seconds,omitempty"`
+	TLS       SocksTLSConfig `yaml:"tls,omitempty" json:"tls,omitempty"`
+	Socks4    Socks4Config   `yaml:"socks4,omitempty" json:"socks4,omitempty"`
+	// TCP tunes the client and upstream connections of relayed sessions
+	TCP TCPConfig `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+}
+
+// TCPConfig holds the TCP options of both sides of relayed sessions
+type TCPConfig struct {
+	Client   TCPTuningConfig `yaml:"client,omitempty" json:"client,omitempty"`
+	Upstream TCPTuningConfig `yaml:"upstream,omitempty" json:"upstream,omitempty"`
+}
+
+// TCPTuningConfig sets socket options of TCP connections. Unset fields keep
+// the defaults of Go and the operating system.
+type TCPTuningConfig struct {
+	// NoDelay sets TCP_NODELAY. Go enables it by default, favouring latency;
+	// false lets the kernel coalesce small writes for bulk transfers.
+	NoDelay *bool `yaml:"no_delay,omitempty" json:"no_delay,omitempty"`
+	// KeepAliveSecs is the keepalive idle time and probe interval; -1 disables keepalives
+	KeepAliveSecs int `yaml:"keepalive_seconds,omitempty" json:"keepalive_seconds,omitempty"`
+	// ReadBufferBytes and WriteBufferBytes size the socket buffers (SO_RCVBUF, SO_SNDBUF)
+	ReadBufferBytes  int `yaml:"read_buffer_bytes,omitempty" json:"read_buffer_bytes,omitempty"`
+	WriteBufferBytes int `yaml:"write_buffer_bytes,omitempty" json:"write_buffer_bytes,omitempty"`
 }
 
+// ReloadToken is a named token accepted by the reload endpoint
+type ReloadToken struct {
+	// Name identifies the token in logs
+	Name  string `yaml:"name" json:"name"`
+	Token string `yaml:"token" json:"token"`
+}
+
+// SocksTLSConfig configures the optional TLS-wrapped SOCKS5 listener (socks5s).
+// The plain listener on socks_port keeps running alongside it.
+type SocksTLSConfig struct {
+	Enabled    bool   `yaml:"enabled" json:"enabled"`
+	// ListenAddr is the listen address of the TLS listener
+	ListenAddr string `yaml:"listen_addr" json:"listen_addr"`
+	// CertFile and KeyFile are the PEM encoded server certificate and private key
+	CertFile   string `yaml:"cert_file" json:"cert_file"`
+	KeyFile    string `yaml:"key_file" json:"key_file"`
+}
+
+// Socks4Config accepts legacy SOCKS4 and SOCKS4a clients. They are detected on
+// the SOCKS5 listeners and, if ListenAddr is set, served on a dedicated listener.
+type Socks4Config struct {
+	Enabled      bool              `yaml:"enabled" json:"enabled"`
+	// ListenAddr is an optional dedicated listener; it accepts SOCKS5 clients as well
+	ListenAddr   string            `yaml:"listen_addr,omitempty" json:"listen_addr,omitempty"`
+	// AllowedCIDRs lists the client networks admitted. SOCKS4 has no
+	// authentication, so clients from anywhere else are rejected.
+	AllowedCIDRs []string          `yaml:"allowed_cidrs" json:"allowed_cidrs"`
+	// User is the SOCKS user whose tags, pin and limits apply to SOCKS4 clients
+	User         string            `yaml:"user" json:"user"`
+	// UserMap maps the USERID sent by a client to the user it is served as instead of User
+	UserMap      map[string]string `yaml:"user_map,omitempty" json:"user_map,omitempty"`
+}
+
+// LoggingConfig configures the log files and their rotation
 type LoggingConfig struct {
+	// Directory holds the log files
 	Directory       string `yaml:"directory" json:"directory"`
+	// AccessLogFile receives one line per SOCKS5 connection
 	AccessLogFile   string `yaml:"access_log_file" json:"access_log_file"`
+	// ErrorLogFile receives application errors and informational messages
 	ErrorLogFile    string `yaml:"error_log_file" json:"error_log_file"`
+	// LogMaxSizeMB is the size at which a log file is rotated
 	LogMaxSizeMB    int    `yaml:"log_max_size_mb" json:"log_max_size_mb"`
+	// LogMaxBackups is how many rotated files are kept
 	LogMaxBackups   int    `yaml:"log_max_backups" json:"log_max_backups"`
+	// LogMaxAgeDays is how long rotated files are kept
 	LogMaxAgeDays   int    `yaml:"log_max_age_days" json:"log_max_age_days"`
+	// LogCompress gzips rotated files
 	LogCompress     bool   `yaml:"log_compress" json:"log_compress"`
+	// RedactDestinations hides destination hosts in connection log lines
+	RedactDestinations RedactDestinationsConfig `yaml:"redact_destinations,omitempty" json:"redact_destinations,omitempty"`
 }
 
+// Destination redaction modes (RedactDestinationsConfig.Mode)
+const (
+	RedactDestinationsHash     = "hash"
+	RedactDestinationsTruncate = "truncate"
+)
+
+// RedactDestinationsConfig hides the destinations users connect to in log
+// lines, for data minimization. Byte and duration accounting is unaffected.
+type RedactDestinationsConfig struct {
+	// Mode is "" (off), "hash" (a salted hash of the host) or "truncate" (the
+	// last two labels of a hostname, the /24 or /48 of an IP address)
+	Mode  string   `yaml:"mode,omitempty" json:"mode,omitempty"`
+	// Salt keys the hash so that common hostnames cannot be looked up
+	Salt  string   `yaml:"salt,omitempty" json:"salt,omitempty"`
+	// Users limits redaction to these SOCKS users; empty redacts for everyone
+	Users []string `yaml:"users,omitempty" json:"users,omitempty"`
+}
+
+// ProxiesConfig configures the upstream proxy pool
 type ProxiesConfig struct {
+	// ConfigFilePath is the JSON file defining the upstream proxies
 	ConfigFilePath      string `yaml:"config_file_path" json:"config_file_path"`
+	// CheckIntervalSecs is the time between health checks of each proxy
 	CheckIntervalSecs   int    `yaml:"check_interval_seconds" json:"check_interval_seconds"`
+	// CheckTimeoutSecs bounds a single health check
 	CheckTimeoutSecs    int    `yaml:"check_timeout_seconds" json:"check_timeout_seconds"`
+	// DialTimeoutSecs bounds each client dial through an upstream proxy
+	DialTimeoutSecs     int    `yaml:"dial_timeout_seconds" json:"dial_timeout_seconds"`
+	// DialTimeoutOverrides set a different dial timeout for proxies carrying a tag.
+	// The first rule matching one of the proxy's tags wins.
+	DialTimeoutOverrides []DialTimeoutRule `yaml:"dial_timeout_overrides,omitempty" json:"dial_timeout_overrides,omitempty"`
+	// HealthCheckTarget is the host:port a TLS handshake is made to through each proxy
 	HealthCheckTarget   string `yaml:"health_check_target" json:"health_check_target"`
-	// ConfigReloadToken is no longer used and will be removed in a future version
+	// HealthCheckTargets, when set, replace HealthCheckTarget: each check picks one
+	// of them in HealthCheckTargetOrder, "random" or "round_robin"
+	HealthCheckTargets     []string `yaml:"health_check_targets,omitempty" json:"health_check_targets,omitempty"`
+	HealthCheckTargetOrder string   `yaml:"health_check_target_order,omitempty" json:"health_check_target_order,omitempty"`
+	// CheckType is "tls" (a TLS handshake with HealthCheckTarget) or "http" (an
+	// HTTP/1.1 GET to it, validated as configured by HTTPCheck)
+	CheckType string `yaml:"check_type,omitempty" json:"check_type,omitempty"`
+	HTTPCheck HTTPCheckConfig `yaml:"http_check,omitempty" json:"http_check,omitempty"`
+	// HealthCheckTLS sets how the certificate of the check target is verified
+	HealthCheckTLS TLSCheckConfig `yaml:"health_check_tls,omitempty" json:"health_check_tls,omitempty"`
+	// HealthCheckLogMode is "changes" (log only state transitions) or "all" (log every check)
+	HealthCheckLogMode  string `yaml:"health_check_log_mode" json:"health_check_log_mode"`
+	// HealthCheckLogSuccessEvery logs every Nth consecutive successful check in "changes" mode (-1 disables)
+	HealthCheckLogSuccessEvery int `yaml:"health_check_log_success_every" json:"health_check_log_success_every"`
+	// DuplicatePolicy resolves entries of the definitions file sharing an address:
+	// "error", "first_wins", "last_wins" or "merge_tags"
+	DuplicatePolicy string `yaml:"duplicate_policy" json:"duplicate_policy"`
+	// TagRules automatically add tags to proxies whose address falls into a CIDR range
+	TagRules            []TagRule `yaml:"tag_rules,omitempty" json:"tag_rules,omitempty"`
+	// Hedging races dials through the two fastest proxies for users routed via these tags
+	Hedging             []HedgeRule `yaml:"hedging,omitempty" json:"hedging,omitempty"`
+	// RotationWindows keep only a rotating share of a tag's proxies eligible at a time
+	RotationWindows []RotationWindowRule `yaml:"rotation_windows,omitempty" json:"rotation_windows,omitempty"`
+	// Chains reach exit proxies through entry proxies, such as a mandatory gateway
+	Chains []ChainRule `yaml:"chains,omitempty" json:"chains,omitempty"`
+	// CheckBackoff overrides how health checks back off per failure reason
+	CheckBackoff []CheckBackoffRule `yaml:"check_backoff,omitempty" json:"check_backoff,omitempty"`
+	// AllowEmptyPool lets /readyz report ready while no upstream proxy is active
+	AllowEmptyPool      bool `yaml:"allow_empty_pool" json:"allow_empty_pool"`
+	// Discovery enumerates additional proxies from provider APIs and refreshes them periodically
+	Discovery           []DiscoverySource `yaml:"discovery,omitempty" json:"discovery,omitempty"`
+	// DestinationBlacklist stops selecting a proxy for a destination it keeps failing to reach
+	DestinationBlacklist DestinationBlacklistConfig `yaml:"destination_blacklist,omitempty" json:"destination_blacklist,omitempty"`
+	// GeoProximity prefers proxies tagged with the region of the destination
+	GeoProximity GeoProximityConfig `yaml:"geo_proximity,omitempty" json:"geo_proximity,omitempty"`
+	// StartupCheckConcurrency bounds how many first health checks of new proxies run at once
+	StartupCheckConcurrency int `yaml:"startup_check_concurrency" json:"startup_check_concurrency"`
+	// StartupReadyTimeoutSecs is how long startup waits for the first health check of
+	// every proxy before opening the SOCKS listeners (-1 opens them right away)
+	StartupReadyTimeoutSecs int `yaml:"startup_ready_timeout_seconds" json:"startup_ready_timeout_seconds"`
+	// Prewarm keeps authenticated connections to recently used proxies ready for client dials
+	Prewarm PrewarmConfig `yaml:"prewarm,omitempty" json:"prewarm,omitempty"`
+	// SpeedTest periodically measures the throughput of every active proxy
+	SpeedTest SpeedTestConfig `yaml:"speed_test,omitempty" json:"speed_test,omitempty"`
+	// Strategy picks among the eligible proxies: "random", "fastest", "round_robin",
+	// "cheapest" or "fastest_throughput"
+	Strategy string `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+	// CostLatencyToleranceMs is how much slower than the fastest eligible proxy
+	// a cheaper one may be and still be picked by the cheapest strategy
+	CostLatencyToleranceMs int `yaml:"cost_latency_tolerance_ms,omitempty" json:"cost_latency_tolerance_ms,omitempty"`
+	// Redial retries a CONNECT through another proxy when the upstream resets it right away
+	Redial RedialConfig `yaml:"redial,omitempty" json:"redial,omitempty"`
+	// HealthAlert raises a pool_degraded event when too few proxies stay active
+	HealthAlert HealthAlertConfig `yaml:"health_alert,omitempty" json:"health_alert,omitempty"`
+	// Canary gives proxies added while running a small share of traffic until they prove themselves
+	Canary CanaryConfig `yaml:"canary,omitempty" json:"canary,omitempty"`
+}
+
+// DefaultPoolName names the pool defined by the proxies section
+const DefaultPoolName = "default"
+
+// PoolStrategies are the values of ProxiesConfig.Strategy and PoolConfig.Strategy
+var PoolStrategies = []string{"random", "fastest", "round_robin", "cheapest", "fastest_throughput"}
+
+// PoolConfig defines a named proxy pool besides the default one of the proxies
+// section, e.g. "residential" next to "datacenter". It has its own definitions
+// file and health checks; the other proxies settings are shared.
+type PoolConfig struct {
+	Name           string `yaml:"name" json:"name"`
+	ConfigFilePath string `yaml:"config_file_path" json:"config_file_path"`
+	// HealthCheckTarget, CheckIntervalSecs, CheckTimeoutSecs and Strategy
+	// default to the values of the proxies section, as do HealthCheckTargets
+	// unless the pool sets a HealthCheckTarget
+	HealthCheckTarget  string   `yaml:"health_check_target,omitempty" json:"health_check_target,omitempty"`
+	HealthCheckTargets []string `yaml:"health_check_targets,omitempty" json:"health_check_targets,omitempty"`
+	CheckIntervalSecs int    `yaml:"check_interval_seconds,omitempty" json:"check_interval_seconds,omitempty"`
+	CheckTimeoutSecs  int    `yaml:"check_timeout_seconds,omitempty" json:"check_timeout_seconds,omitempty"`
+	Strategy          string `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+	// ListenAddr opens a SOCKS5 listener whose clients use this pool unless
+	// their user is bound to another one
+	ListenAddr string `yaml:"listen_addr,omitempty" json:"listen_addr,omitempty"`
+}
+
+// PrewarmConfig keeps ConnectionsPerProxy SOCKS5 connections with the greeting and
+// authentication done open to every proxy dialed within HotWindowSecs, so client
+// dials only wait for the CONNECT round trip
+type PrewarmConfig struct {
+	// ConnectionsPerProxy is the number of ready connections per hot proxy; 0 disables prewarming
+	ConnectionsPerProxy int `yaml:"connections_per_proxy" json:"connections_per_proxy"`
+	// IdleTimeoutSecs closes ready connections unused for this long
+	IdleTimeoutSecs int `yaml:"idle_timeout_seconds,omitempty" json:"idle_timeout_seconds,omitempty"`
+	// HotWindowSecs is how long after its last client dial a proxy is kept warm
+	HotWindowSecs int `yaml:"hot_window_seconds,omitempty" json:"hot_window_seconds,omitempty"`
+}
+
+// SpeedTestConfig downloads SizeKB of URL through every active proxy each
+// IntervalSecs and scores the proxy by the transfer rate, which the
+// fastest_throughput strategy picks by
+type SpeedTestConfig struct {
+	// URL is the http(s) file to download; empty disables speed tests
+	URL string `yaml:"url" json:"url"`
+	// SizeKB caps how much of the file is downloaded per test
+	SizeKB int `yaml:"size_kb,omitempty" json:"size_kb,omitempty"`
+	IntervalSecs int `yaml:"interval_seconds,omitempty" json:"interval_seconds,omitempty"`
+	TimeoutSecs  int `yaml:"timeout_seconds,omitempty" json:"timeout_seconds,omitempty"`
+}
+
+// RedialConfig retries a client's CONNECT through another proxy, replaying what
+// the client sent, when the upstream connection closes within WindowMs without
+// sending a byte
+type RedialConfig struct {
+	// MaxAttempts is the number of upstream connections a request may use,
+	// including the first; 0 or 1 disables redialing
+	MaxAttempts int `yaml:"max_attempts" json:"max_attempts"`
+	// WindowMs is how soon after connecting a close counts as an immediate reset
+	WindowMs int `yaml:"window_ms,omitempty" json:"window_ms,omitempty"`
+	// ReplayBufferBytes caps the client bytes kept for replay; sending more ends the window
+	ReplayBufferBytes int `yaml:"replay_buffer_bytes,omitempty" json:"replay_buffer_bytes,omitempty"`
+}
+
+// HealthAlertConfig emits one pool_degraded event when fewer than Threshold of
+// the enabled proxies have been active for ForSecs, and pool_health_restored
+// once enough are back
+type HealthAlertConfig struct {
+	// Threshold is the fraction of active proxies below which the pool is
+	// degraded, e.g. 0.2; 0 disables the alert
+	Threshold float64 `yaml:"threshold" json:"threshold"`
+	ForSecs   int     `yaml:"for_seconds,omitempty" json:"for_seconds,omitempty"`
+}
+
+// CanaryConfig puts proxies added after startup in a canary state: they serve
+// TrafficPercent of the selections until MinRequests client dials through them
+// succeeded at SuccessRate or better, then join full rotation
+type CanaryConfig struct {
+	// TrafficPercent is the percentage of selections offered to canaries, e.g. 5; 0 disables canaries
+	TrafficPercent float64 `yaml:"traffic_percent" json:"traffic_percent"`
+	MinRequests    int     `yaml:"min_requests,omitempty" json:"min_requests,omitempty"`
+	// SuccessRate is the fraction of dials that must succeed, e.g. 0.95
+	SuccessRate float64 `yaml:"success_rate,omitempty" json:"success_rate,omitempty"`
+}
+
+// DestinationBlacklistConfig avoids a proxy for a destination host when at least
+// FailureRatio of at least MinAttempts dials to it within WindowSecs failed
+type DestinationBlacklistConfig struct {
+	Enabled      bool    `yaml:"enabled" json:"enabled"`
+	// WindowSecs is the period over which dials are counted
+	WindowSecs   int     `yaml:"window_seconds,omitempty" json:"window_seconds,omitempty"`
+	// MinAttempts is the number of dials needed before a proxy can be avoided
+	MinAttempts  int     `yaml:"min_attempts,omitempty" json:"min_attempts,omitempty"`
+	// FailureRatio is the fraction of failed dials that gets a proxy avoided (0..1)
+	FailureRatio float64 `yaml:"failure_ratio,omitempty" json:"failure_ratio,omitempty"`
+	// DurationSecs is how long the proxy is avoided for the destination
+	DurationSecs int `yaml:"duration_seconds,omitempty" json:"duration_seconds,omitempty"`
+}
+
+// GeoProximityConfig prefers proxies tagged TagPrefix+region, where region is
+// looked up for the destination's IP address in DatabaseFile
+type GeoProximityConfig struct {
+	Enabled          bool   `yaml:"enabled" json:"enabled"`
+	// DatabaseFile lists networks and their regions, one "CIDR region" pair per line
+	DatabaseFile     string `yaml:"database_file,omitempty" json:"database_file,omitempty"`
+	// TagPrefix precedes the region in proxy tags
+	TagPrefix        string `yaml:"tag_prefix,omitempty" json:"tag_prefix,omitempty"`
+	// CacheTTLSecs is how long the region of a destination hostname is remembered
+	CacheTTLSecs     int    `yaml:"cache_ttl_seconds,omitempty" json:"cache_ttl_seconds,omitempty"`
+	// ResolveTimeoutMs bounds the lookup of a destination hostname's addresses
+	ResolveTimeoutMs int    `yaml:"resolve_timeout_ms,omitempty" json:"resolve_timeout_ms,omitempty"`
+	// MaxCacheEntries bounds the number of remembered hostnames
+	MaxCacheEntries  int    `yaml:"max_cache_entries,omitempty" json:"max_cache_entries,omitempty"`
+}
+
+// Discovery providers (DiscoverySource.Provider)
+const (
+	DiscoveryProviderConsul       = "consul"
+	DiscoveryProviderDigitalOcean = "digitalocean"
+)
+
+// DiscoverySource configures one proxy discovery plugin
+type DiscoverySource struct {
+	// Provider is "consul" or "digitalocean"
+	Provider string `yaml:"provider" json:"provider"`
+	// Name identifies the source in logs and in discovered proxy definitions. Defaults to Provider.
+	Name                string `yaml:"name,omitempty" json:"name,omitempty"`
+	// RefreshIntervalSecs is the time between queries of the provider
+	RefreshIntervalSecs int    `yaml:"refresh_interval_seconds,omitempty" json:"refresh_interval_seconds,omitempty"`
+	// Tags are added to every discovered proxy, along with "discovered" and "discovery:<name>"
+	Tags []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	// Username and Password are the SOCKS5 credentials of the discovered proxies
+	Username     string                `yaml:"username,omitempty" json:"username,omitempty"`
+	Password     string                `yaml:"password,omitempty" json:"password,omitempty"`
+	// Consul configures the "consul" provider
+	Consul       ConsulDiscovery       `yaml:"consul,omitempty" json:"consul,omitempty"`
+	// DigitalOcean configures the "digitalocean" provider
+	DigitalOcean DigitalOceanDiscovery `yaml:"digitalocean,omitempty" json:"digitalocean,omitempty"`
+}
+
+// ConsulDiscovery lists the passing instances of a Consul service
+type ConsulDiscovery struct {
+	// Address is the URL of the Consul HTTP API
+	Address    string `yaml:"address" json:"address"`
+	// Service is the name of the service whose instances are proxies
+	Service    string `yaml:"service" json:"service"`
+	// Tag only lists instances carrying this Consul tag
+	Tag        string `yaml:"tag,omitempty" json:"tag,omitempty"`
+	// Datacenter queries another datacenter than the agent's
+	Datacenter string `yaml:"datacenter,omitempty" json:"datacenter,omitempty"`
+	// Token is the Consul ACL token
+	Token      string `yaml:"token,omitempty" json:"token,omitempty"`
+}
+
+// DigitalOceanDiscovery lists the droplets carrying a tag
+type DigitalOceanDiscovery struct {
+	// Token is a DigitalOcean API token with read access
+	Token string `yaml:"token" json:"token"`
+	// Tag selects the droplets that are proxies
+	Tag   string `yaml:"tag" json:"tag"`
+	// Port is the SOCKS5 port the droplets listen on
+	Port int `yaml:"port" json:"port"`
+	// PrivateNetwork connects to the droplets' private (VPC) addresses instead of public ones
+	PrivateNetwork bool `yaml:"private_network,omitempty" json:"private_network,omitempty"`
+	// APIURL overrides the DigitalOcean API base URL
+	APIURL string `yaml:"api_url,omitempty" json:"api_url,omitempty"`
+}
+
+// DialTimeoutRule overrides the dial timeout for proxies carrying Tag
+type DialTimeoutRule struct {
+	Tag     string `yaml:"tag" json:"tag"`
+	// Seconds is the dial timeout for the tag's proxies
+	Seconds int    `yaml:"seconds" json:"seconds"`
+}
+
+// HedgeRule enables hedged dialing for a proxy tag: if the fastest proxy has not
+// connected after DelayMs, the second fastest is dialed as well.
+type HedgeRule struct {
+	Tag     string `yaml:"tag" json:"tag"`
+	// DelayMs is how long the fastest proxy may take before the second one is dialed
+	DelayMs int    `yaml:"delay_ms" json:"delay_ms"`
+}
+
+// RotationWindowRule makes only Fraction of the proxies carrying Tag eligible at
+// a time; the next group of them takes over every PeriodSecs
+type RotationWindowRule struct {
+	Tag        string  `yaml:"tag" json:"tag"`
+	Fraction   float64 `yaml:"fraction" json:"fraction"`
+	PeriodSecs int     `yaml:"period_seconds" json:"period_seconds"`
+}
+
+// ChainRule reaches the proxies tagged ExitTag (every proxy that is not an
+// entry if empty) through an active proxy tagged EntryTag. Entry proxies only
+// serve as first hops.
+type ChainRule struct {
+	EntryTag string `yaml:"entry_tag" json:"entry_tag"`
+	ExitTag  string `yaml:"exit_tag,omitempty" json:"exit_tag,omitempty"`
+}
+
+// CheckBackoffRule spaces out the health checks of a proxy failing for Reason
+// again and again: each consecutive failure multiplies the check interval by
+// Multiplier, up to MaxIntervalSecs. A Multiplier of 1 disables backoff.
+type CheckBackoffRule struct {
+	Reason          string  `yaml:"reason" json:"reason"`
+	Multiplier      float64 `yaml:"multiplier" json:"multiplier"`
+	MaxIntervalSecs int     `yaml:"max_interval_seconds" json:"max_interval_seconds"`
+}
+
+// CheckFailureReasons are the reasons health check failures are classified by
+var CheckFailureReasons = []string{"auth", "timeout", "connect_refused", "dns", "upstream_reply", "tls_verify", "tls", "http_check", "other"}
+
+// HTTPCheckConfig configures the "http" health check type
+type HTTPCheckConfig struct {
+	// Path is the path requested from the check target
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// ExpectStatus lists the accepted status codes
+	ExpectStatus []int `yaml:"expect_status,omitempty" json:"expect_status,omitempty"`
+	// ExpectBody, when set, must occur in the first 64 KiB of the response body
+	ExpectBody string `yaml:"expect_body,omitempty" json:"expect_body,omitempty"`
+	// Plain sends the request over TCP instead of TLS, for port 80 targets
+	Plain bool `yaml:"plain,omitempty" json:"plain,omitempty"`
 }
 
+// TLSCheckConfig sets how the certificate presented by the health check target
+// is verified, for the whole pool and, through Overrides, for single proxies or tags
+type TLSCheckConfig struct {
+	// SkipVerify accepts any certificate; only for trusted networks
+	SkipVerify bool `yaml:"skip_verify,omitempty" json:"skip_verify,omitempty"`
+	// CAFile is a PEM bundle of the CAs trusted instead of the system roots
+	CAFile string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	// ServerName is sent as SNI and verified instead of the target's host name
+	ServerName string             `yaml:"server_name,omitempty" json:"server_name,omitempty"`
+	Overrides  []TLSCheckOverride `yaml:"overrides,omitempty" json:"overrides,omitempty"`
+}
+
+// TLSCheckOverride replaces the TLS check settings for the proxy at Proxy, or
+// for the proxies tagged Tag. Proxy overrides win over tag overrides, and the
+// first matching tag override applies.
+type TLSCheckOverride struct {
+	Proxy      string `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	Tag        string `yaml:"tag,omitempty" json:"tag,omitempty"`
+	SkipVerify bool   `yaml:"skip_verify,omitempty" json:"skip_verify,omitempty"`
+	CAFile     string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	ServerName string `yaml:"server_name,omitempty" json:"server_name,omitempty"`
+}
+
+// TagRule assigns Tags to every proxy whose IP address is inside CIDR
+type TagRule struct {
+	CIDR string   `yaml:"cidr" json:"cidr"`
+	Tags []string `yaml:"tags" json:"tags"`
+}
+
+// UsersConfig configures the SOCKS5 users and how they are routed
 type UsersConfig struct {
+	// ConfigFilePath is the JSON file defining the SOCKS5 users
 	ConfigFilePath       string `yaml:"config_file_path" json:"config_file_path"`
+	// DefaultBehavior decides how users without tags are routed: "deny",
+	// "allow_default_tag_only" (via DefaultProxyTag) or "allow_all_active"
 	DefaultBehavior      string `yaml:"default_behavior_no_tags" json:"default_behavior_no_tags"`
+	// DefaultProxyTag is the tag used for users without tags in "allow_default_tag_only" mode
 	DefaultProxyTag      string `yaml:"default_proxy_tag" json:"default_proxy_tag"`
+	// MissingFilePolicy decides what happens when the users file is missing or empty:
+	// "fail" refuses to start, "start_empty" starts with no users (every SOCKS login is
+	// denied) so users can be provisioned through the admin API.
+	MissingFilePolicy    string `yaml:"missing_file_policy,omitempty" json:"missing_file_policy,omitempty"`
+	// EmptyStoreBehavior decides who may connect while no users are defined:
+	// "deny" rejects everyone, "allow_anonymous_cidr" admits clients from AnonymousCIDRs
+	// without credentials.
+	EmptyStoreBehavior   string   `yaml:"empty_store_behavior,omitempty" json:"empty_store_behavior,omitempty"`
+	// AnonymousCIDRs lists the client networks admitted by "allow_anonymous_cidr"
+	AnonymousCIDRs       []string `yaml:"anonymous_cidrs,omitempty" json:"anonymous_cidrs,omitempty"`
+	// AuthFailureWindowSec is the period over which failed SOCKS logins are counted per source IP
+	AuthFailureWindowSec int      `yaml:"auth_failure_window_seconds,omitempty" json:"auth_failure_window_seconds,omitempty"`
+	// JWT lets users that are not in the users file log in with an access token
+	JWT                  JWTConfig `yaml:"jwt,omitempty" json:"jwt,omitempty"`
+	// AuthBackend validates the credentials of users that are not in the users
+	// file: "file" (none) or "ldap", against the directory configured in LDAP
+	AuthBackend          string     `yaml:"auth_backend,omitempty" json:"auth_backend,omitempty"`
+	LDAP                 LDAPConfig `yaml:"ldap,omitempty" json:"ldap,omitempty"`
+	// Tarpit holds on to the connections of users the routing denies instead of refusing them
+	Tarpit TarpitConfig `yaml:"tarpit,omitempty" json:"tarpit,omitempty"`
+}
+
+// Tarpit modes (TarpitConfig.Mode)
+const (
+	TarpitDrip  = "drip"
+	TarpitReset = "reset"
+)
+
+// TarpitConfig treats the CONNECTs of users denied by the routing (no allowed
+// tag, default behavior deny) like a honeypot: every attempt is logged and the
+// client is held or reset instead of getting a SOCKS error
+type TarpitConfig struct {
+	// Mode is "" (off, refuse with a SOCKS error), "drip" (report success, then
+	// send a byte every DripIntervalSecs) or "reset" (reset the connection right away)
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	DripIntervalSecs int `yaml:"drip_interval_seconds,omitempty" json:"drip_interval_seconds,omitempty"`
+	// MaxDurationSecs is how long a dripping connection is held at most
+	MaxDurationSecs int `yaml:"max_duration_seconds,omitempty" json:"max_duration_seconds,omitempty"`
+	// MaxConcurrent caps the connections held at once; more are refused as usual
+	MaxConcurrent int `yaml:"max_concurrent,omitempty" json:"max_concurrent,omitempty"`
 }
 
+// LDAPConfig configures the LDAP/Active Directory auth backend. A user is
+// looked up with UserFilter below BaseDN, then its password is checked by
+// binding as the user's entry.
+type LDAPConfig struct {
+	// URL is the directory server, ldap:// or ldaps://
+	URL      string `yaml:"url" json:"url"`
+	// StartTLS upgrades an ldap:// connection to TLS before binding
+	StartTLS bool   `yaml:"start_tls,omitempty" json:"start_tls,omitempty"`
+	// CAFile is a PEM file of CAs trusted instead of the system roots
+	CAFile   string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	// BindDN and BindPassword are the service account used for the lookup;
+	// empty binds anonymously
+	BindDN       string `yaml:"bind_dn,omitempty" json:"bind_dn,omitempty"`
+	BindPassword string `yaml:"bind_password,omitempty" json:"bind_password,omitempty"`
+	BaseDN       string `yaml:"base_dn" json:"base_dn"`
+	// UserFilter finds the user's entry; {username} is replaced by the escaped
+	// SOCKS username, e.g. "(sAMAccountName={username})" for Active Directory
+	UserFilter string `yaml:"user_filter,omitempty" json:"user_filter,omitempty"`
+	// GroupAttribute lists the groups of a user's entry, usually memberOf
+	GroupAttribute string `yaml:"group_attribute,omitempty" json:"group_attribute,omitempty"`
+	// GroupTags maps group DNs (case-insensitive) to the proxy tags of their members
+	GroupTags map[string][]string `yaml:"group_tags,omitempty" json:"group_tags,omitempty"`
+	// CacheTTLSecs is how long a successful login is remembered before the
+	// directory is asked again
+	CacheTTLSecs int `yaml:"cache_ttl_seconds,omitempty" json:"cache_ttl_seconds,omitempty"`
+	// TimeoutSecs bounds the connection to the directory and each request
+	TimeoutSecs int `yaml:"timeout_seconds,omitempty" json:"timeout_seconds,omitempty"`
+}
+
+// JWTConfig configures SOCKS logins where the password is a JWT issued by an
+// external identity provider and verified with the keys published at JWKSURL
+type JWTConfig struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	JWKSURL  string `yaml:"jwks_url" json:"jwks_url"`
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	Audience string `yaml:"audience,omitempty" json:"audience,omitempty"`
+	// UsernameClaim must equal the SOCKS username; TagsClaim and
+	// MaxSessionsClaim carry the user's proxy tags and concurrent session limit
+	UsernameClaim    string `yaml:"username_claim,omitempty" json:"username_claim,omitempty"`
+	TagsClaim        string `yaml:"tags_claim,omitempty" json:"tags_claim,omitempty"`
+	MaxSessionsClaim string `yaml:"max_sessions_claim,omitempty" json:"max_sessions_claim,omitempty"`
+	// RefreshIntervalSecs is how often the signing keys are fetched again
+	RefreshIntervalSecs int `yaml:"jwks_refresh_interval_seconds,omitempty" json:"jwks_refresh_interval_seconds,omitempty"`
+	// LeewaySecs is the clock skew tolerated on exp and nbf
+	LeewaySecs int `yaml:"leeway_seconds,omitempty" json:"leeway_seconds,omitempty"`
+	// CacheTTLSecs is how long a verified token is cached, at most until it expires
+	CacheTTLSecs int `yaml:"cache_ttl_seconds,omitempty" json:"cache_ttl_seconds,omitempty"`
+}
+
+// WebhookConfig posts high-severity pool events, such as credential rejections, to an HTTP endpoint
 type WebhookConfig struct {
+	// URL receives the events as JSON. Empty disables the webhook.
 	URL            string `yaml:"url" json:"url"`
+	// PostTimeoutSec bounds each POST
 	PostTimeoutSec int    `yaml:"post_timeout_seconds" json:"post_timeout_seconds"`
+	// AuthEvents selects the SOCKS authentication audit events posted as well:
+	// "none", "failures" or "all"
+	AuthEvents     string `yaml:"auth_events,omitempty" json:"auth_events,omitempty"`
 }
 
+// PrometheusConfig configures the Prometheus metrics endpoint
 type PrometheusConfig struct {
 	Enabled bool   `yaml:"enabled" json:"enabled"`
+	// Port is the listen address of the /metrics endpoint
 	Port    string `yaml:"port" json:"port"`
+	// ProxyLabel controls the proxy_address label: "address" (default), "hash" or "truncate".
+	// Hashing or truncating bounds label size for very large pools.
+	ProxyLabel          string `yaml:"proxy_label,omitempty" json:"proxy_label,omitempty"`
+	// ProxyLabelMaxLength is the label length kept in "truncate" mode
+	ProxyLabelMaxLength int    `yaml:"proxy_label_max_length,omitempty" json:"proxy_label_max_length,omitempty"`
+	// LastErrorMetric exports the category of the error keeping each inactive proxy down
+	LastErrorMetric     bool   `yaml:"last_error_metric,omitempty" json:"last_error_metric,omitempty"`
+}
+
+// TapConfig enables mirroring of selected sessions to a file for debugging
+type TapConfig struct {
+	Enabled    bool   `yaml:"enabled" json:"enabled"`
+	// OutputFile receives the tapped sessions as JSON lines
+	OutputFile string `yaml:"output_file" json:"output_file"`
+	// Users and Destinations select the sessions to tap; destinations are
+	// glob patterns matched against "host:port" and "host".
+	Users        []string `yaml:"users,omitempty" json:"users,omitempty"`
+	Destinations []string `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+	// CaptureBytes is how many bytes per direction to capture; 0 records metadata only.
+	CaptureBytes int `yaml:"capture_bytes,omitempty" json:"capture_bytes,omitempty"`
+}
+
+// UsageConfig accumulates per-user monthly traffic for billing exports
+type UsageConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// FilePath is the JSON file the counters are persisted to
+	FilePath string `yaml:"file_path,omitempty" json:"file_path,omitempty"`
+	// FlushIntervalSecs is the time between writes of the file
+	FlushIntervalSecs int `yaml:"flush_interval_seconds,omitempty" json:"flush_interval_seconds,omitempty"`
+	// RetentionMonths is how many months are kept, including the current one
+	RetentionMonths int `yaml:"retention_months,omitempty" json:"retention_months,omitempty"`
+	// Stream publishes per-user and per-proxy traffic periodically, independently of Enabled
+	Stream UsageStreamConfig `yaml:"stream,omitempty" json:"stream,omitempty"`
+}
+
+// UsageStreamConfig publishes usage events for external billing and analytics pipelines
+type UsageStreamConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// IntervalSecs is the period each event covers
+	IntervalSecs int `yaml:"interval_seconds,omitempty" json:"interval_seconds,omitempty"`
+	// Webhook posts the events to webhook.url
+	Webhook bool `yaml:"webhook,omitempty" json:"webhook,omitempty"`
+	// NATS publishes the events to a NATS subject
+	NATS NATSConfig `yaml:"nats,omitempty" json:"nats,omitempty"`
+}
+
+// NATSConfig is a NATS server and the subject messages are published to
+type NATSConfig struct {
+	// URL is "nats://[user:pass@]host[:port]", or "tls://..." to require TLS. Empty disables NATS.
+	URL     string `yaml:"url,omitempty" json:"url,omitempty"`
+	Subject string `yaml:"subject,omitempty" json:"subject,omitempty"`
+	// TimeoutSecs bounds connecting and each publish
+	TimeoutSecs int `yaml:"timeout_seconds,omitempty" json:"timeout_seconds,omitempty"`
+}
+
+// TelemetryConfig exports OpenTelemetry traces of SOCKS requests and health checks via OTLP
+type TelemetryConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Endpoint is the OTLP collector's host:port
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// Protocol is "grpc" (default) or "http"
+	Protocol string `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	// Insecure sends traces to the collector without TLS
+	Insecure bool `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	// Headers are added to every export request, e.g. collector API keys
+	Headers     map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string            `yaml:"service_name,omitempty" json:"service_name,omitempty"`
+	// SampleRatio is the fraction of SOCKS requests and health checks traced (default 1)
+	SampleRatio float64 `yaml:"sample_ratio,omitempty" json:"sample_ratio,omitempty"`
 }
 
 // App represents the application configuration
 type App struct {
+	// Include lists configuration files loaded before this one, relative to its
+	// directory. Later files override earlier ones key by key and this file
+	// overrides them all; lists are replaced, not appended to.
+	Include     []string          `yaml:"include,omitempty" json:"include,omitempty"`
 	Server      ServerConfig      `yaml:"server" json:"server"`
 	Logging     LoggingConfig     `yaml:"logging" json:"logging"`
 	Proxies     ProxiesConfig     `yaml:"proxies" json:"proxies"`
 	Users       UsersConfig       `yaml:"users" json:"users"`
 	Webhook     WebhookConfig     `yaml:"webhook,omitempty" json:"webhook,omitempty"`
 	Prometheus  PrometheusConfig  `yaml:"prometheus,omitempty" json:"prometheus,omitempty"`
+	Tap         TapConfig         `yaml:"tap,omitempty" json:"tap,omitempty"`
+	Usage       UsageConfig       `yaml:"usage,omitempty" json:"usage,omitempty"`
+	Telemetry   TelemetryConfig   `yaml:"telemetry,omitempty" json:"telemetry,omitempty"`
+	Pools       []PoolConfig      `yaml:"pools,omitempty" json:"pools,omitempty"`
 }
 
 // Default configuration values
@@ -71,9 +693,54 @@ const (
 	DefaultProxyCheckTimeoutStr  = "10s"
 	DefaultMetricsIntervalStr    = "30s"
 	DefaultServerPortStr         = ":1080"
+	DefaultSocksTLSListenAddr    = ":1443"
 	DefaultHealthCheckTargetStr  = "www.google.com:443"
 	DefaultPrometheusListenAddr = ":9091"
 	DefaultProxiesFilePath      = "proxies.json"
+	DefaultHealthCheckLogMode   = "changes"
+	DefaultHealthCheckLogSuccessEvery = 100
+	DefaultDialTimeoutSecs      = 15
+	DefaultStartupCheckConcurrency = 50
+	DefaultStartupReadyTimeoutSecs = 30
+	DefaultPrewarmIdleTimeoutSecs  = 20
+	DefaultPrewarmHotWindowSecs    = 60
+	DefaultSpeedTestSizeKB         = 256
+	DefaultSpeedTestIntervalSecs   = 1800
+	DefaultSpeedTestTimeoutSecs    = 30
+	DefaultTarpitDripIntervalSecs  = 10
+	DefaultTarpitMaxDurationSecs   = 300
+	DefaultTarpitMaxConcurrent     = 100
+	DefaultRedialWindowMs          = 500
+	DefaultRedialReplayBufferBytes = 64 << 10
+	DefaultHealthAlertForSecs      = 120
+	DefaultCanaryMinRequests       = 50
+	DefaultCanarySuccessRate       = 0.95
+	DefaultCostLatencyToleranceMs  = 100
+	DefaultUsageFilePath           = "usage.json"
+	DefaultUsageFlushIntervalSecs  = 60
+	DefaultUsageRetentionMonths    = 24
+	DefaultUsageStreamIntervalSecs = 60
+	DefaultUsageStreamSubject      = "chameleon.usage"
+	DefaultNATSTimeoutSecs         = 10
+	DefaultDiscoveryRefreshSecs = 60
+	DefaultConsulAddress        = "http://127.0.0.1:8500"
+	DefaultDestinationBlacklistWindowSecs   = 300
+	DefaultDestinationBlacklistMinAttempts  = 5
+	DefaultDestinationBlacklistFailureRatio = 0.8
+	DefaultDestinationBlacklistDurationSecs = 900
+	DefaultGeoTagPrefix        = "region:"
+	DefaultGeoCacheTTLSecs     = 600
+	DefaultGeoResolveTimeoutMs = 2000
+	DefaultGeoMaxCacheEntries  = 10000
+	DefaultUpgradeDrainTimeoutSecs = 300
+	DefaultHandshakeTimeoutSecs    = 10
+	DefaultMaxHalfOpenConnections  = 1024
+	DefaultMaxConnectionsQueueTimeoutSecs = 10
+	DefaultUserDebugSecs                  = 900
+	DefaultAuthFailureWindowSec = 600
+	DefaultTelemetryEndpoint    = "localhost:4317"
+	DefaultTelemetryProtocol    = "grpc"
+	DefaultTelemetryServiceName = "chameleon"
 )
 
 var (
@@ -93,19 +760,27 @@ func init() {
 }
 
 
+// Load reads the application configuration from path, ignoring unknown keys
 func Load(path string) (*App, error) {
-	configFile, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
+	return load(path, false)
+}
+
+// LoadStrict is like Load but rejects keys that do not map to a configuration field,
+// which catches typos such as "chek_interval_seconds" that would otherwise be silently ignored
+func LoadStrict(path string) (*App, error) {
+	return load(path, true)
+}
 
+func load(path string, strict bool) (*App, error) {
 	var appCfg App
-	err = yaml.Unmarshal(configFile, &appCfg)
-	if err != nil {
+	if err := decodeFile(path, &appCfg, strict, nil); err != nil {
 		return nil, err
 	}
 
 	appCfg.applyDefaults()
+	if err := appCfg.decryptSecrets(); err != nil {
+		return nil, err
+	}
 
 	return &appCfg, nil
 }
@@ -116,8 +791,26 @@ func (appCfg *App) applyDefaults() {
 	if appCfg.Server.SocksPort == "" {
 		appCfg.Server.SocksPort = DefaultServerPortStr
 	}
-	if appCfg.Server.AdminPort == "" {
-		appCfg.Server.AdminPort = ":8081"
+	if appCfg.Server.UpgradeDrainTimeoutSecs == 0 {
+		appCfg.Server.UpgradeDrainTimeoutSecs = DefaultUpgradeDrainTimeoutSecs
+	}
+	if appCfg.Server.HandshakeTimeoutSecs == 0 {
+		appCfg.Server.HandshakeTimeoutSecs = DefaultHandshakeTimeoutSecs
+	}
+	if appCfg.Server.MaxHalfOpenConnections == 0 {
+		appCfg.Server.MaxHalfOpenConnections = DefaultMaxHalfOpenConnections
+	}
+	if appCfg.Server.MaxConnectionsMode == "" {
+		appCfg.Server.MaxConnectionsMode = "reject"
+	}
+	if appCfg.Server.MaxConnectionsMode == "queue" && appCfg.Server.MaxConnectionsQueueTimeoutSecs == 0 {
+		appCfg.Server.MaxConnectionsQueueTimeoutSecs = DefaultMaxConnectionsQueueTimeoutSecs
+	}
+	if appCfg.Server.UserDebugSecs == 0 {
+		appCfg.Server.UserDebugSecs = DefaultUserDebugSecs
+	}
+	if appCfg.Server.TLS.Enabled && appCfg.Server.TLS.ListenAddr == "" {
+		appCfg.Server.TLS.ListenAddr = DefaultSocksTLSListenAddr
 	}
 
 	// Logging defaults
@@ -150,9 +843,152 @@ func (appCfg *App) applyDefaults() {
 	if appCfg.Proxies.CheckTimeoutSecs == 0 {
 		appCfg.Proxies.CheckTimeoutSecs = 10
 	}
+	if appCfg.Proxies.DialTimeoutSecs == 0 {
+		appCfg.Proxies.DialTimeoutSecs = DefaultDialTimeoutSecs
+	}
 	if appCfg.Proxies.HealthCheckTarget == "" {
 		appCfg.Proxies.HealthCheckTarget = DefaultHealthCheckTargetStr
 	}
+	if appCfg.Proxies.HealthCheckTargetOrder == "" {
+		appCfg.Proxies.HealthCheckTargetOrder = "random"
+	}
+	if appCfg.Proxies.CheckType == "" {
+		appCfg.Proxies.CheckType = "tls"
+	}
+	if appCfg.Proxies.HTTPCheck.Path == "" {
+		appCfg.Proxies.HTTPCheck.Path = "/"
+	}
+	if len(appCfg.Proxies.HTTPCheck.ExpectStatus) == 0 {
+		appCfg.Proxies.HTTPCheck.ExpectStatus = []int{200}
+	}
+	if appCfg.Proxies.HealthCheckLogMode == "" {
+		appCfg.Proxies.HealthCheckLogMode = DefaultHealthCheckLogMode
+	}
+	if appCfg.Proxies.DuplicatePolicy == "" {
+		appCfg.Proxies.DuplicatePolicy = DuplicatePolicyError
+	}
+	if appCfg.Proxies.HealthCheckLogSuccessEvery == 0 {
+		appCfg.Proxies.HealthCheckLogSuccessEvery = DefaultHealthCheckLogSuccessEvery
+	}
+	if appCfg.Proxies.StartupCheckConcurrency == 0 {
+		appCfg.Proxies.StartupCheckConcurrency = DefaultStartupCheckConcurrency
+	}
+	if appCfg.Proxies.StartupReadyTimeoutSecs == 0 {
+		appCfg.Proxies.StartupReadyTimeoutSecs = DefaultStartupReadyTimeoutSecs
+	}
+	if appCfg.Proxies.Strategy == "" {
+		appCfg.Proxies.Strategy = "random"
+	}
+	if appCfg.Proxies.CostLatencyToleranceMs == 0 {
+		appCfg.Proxies.CostLatencyToleranceMs = DefaultCostLatencyToleranceMs
+	}
+	for i := range appCfg.Pools {
+		pool := &appCfg.Pools[i]
+		if pool.HealthCheckTarget == "" && len(pool.HealthCheckTargets) == 0 {
+			pool.HealthCheckTargets = appCfg.Proxies.HealthCheckTargets
+		}
+		if pool.HealthCheckTarget == "" {
+			pool.HealthCheckTarget = appCfg.Proxies.HealthCheckTarget
+		}
+		if pool.CheckIntervalSecs == 0 {
+			pool.CheckIntervalSecs = appCfg.Proxies.CheckIntervalSecs
+		}
+		if pool.CheckTimeoutSecs == 0 {
+			pool.CheckTimeoutSecs = appCfg.Proxies.CheckTimeoutSecs
+		}
+		if pool.Strategy == "" {
+			pool.Strategy = appCfg.Proxies.Strategy
+		}
+	}
+	if pw := &appCfg.Proxies.Prewarm; pw.ConnectionsPerProxy > 0 {
+		if pw.IdleTimeoutSecs == 0 {
+			pw.IdleTimeoutSecs = DefaultPrewarmIdleTimeoutSecs
+		}
+		if pw.HotWindowSecs == 0 {
+			pw.HotWindowSecs = DefaultPrewarmHotWindowSecs
+		}
+	}
+	if st := &appCfg.Proxies.SpeedTest; st.URL != "" {
+		if st.SizeKB == 0 {
+			st.SizeKB = DefaultSpeedTestSizeKB
+		}
+		if st.IntervalSecs == 0 {
+			st.IntervalSecs = DefaultSpeedTestIntervalSecs
+		}
+		if st.TimeoutSecs == 0 {
+			st.TimeoutSecs = DefaultSpeedTestTimeoutSecs
+		}
+	}
+	if tp := &appCfg.Users.Tarpit; tp.Mode != "" {
+		if tp.DripIntervalSecs == 0 {
+			tp.DripIntervalSecs = DefaultTarpitDripIntervalSecs
+		}
+		if tp.MaxDurationSecs == 0 {
+			tp.MaxDurationSecs = DefaultTarpitMaxDurationSecs
+		}
+		if tp.MaxConcurrent == 0 {
+			tp.MaxConcurrent = DefaultTarpitMaxConcurrent
+		}
+	}
+	if rd := &appCfg.Proxies.Redial; rd.MaxAttempts > 1 {
+		if rd.WindowMs == 0 {
+			rd.WindowMs = DefaultRedialWindowMs
+		}
+		if rd.ReplayBufferBytes == 0 {
+			rd.ReplayBufferBytes = DefaultRedialReplayBufferBytes
+		}
+	}
+	if ha := &appCfg.Proxies.HealthAlert; ha.Threshold > 0 && ha.ForSecs == 0 {
+		ha.ForSecs = DefaultHealthAlertForSecs
+	}
+	if c := &appCfg.Proxies.Canary; c.TrafficPercent > 0 {
+		if c.MinRequests == 0 {
+			c.MinRequests = DefaultCanaryMinRequests
+		}
+		if c.SuccessRate == 0 {
+			c.SuccessRate = DefaultCanarySuccessRate
+		}
+	}
+	if bl := &appCfg.Proxies.DestinationBlacklist; bl.Enabled {
+		if bl.WindowSecs == 0 {
+			bl.WindowSecs = DefaultDestinationBlacklistWindowSecs
+		}
+		if bl.MinAttempts == 0 {
+			bl.MinAttempts = DefaultDestinationBlacklistMinAttempts
+		}
+		if bl.FailureRatio == 0 {
+			bl.FailureRatio = DefaultDestinationBlacklistFailureRatio
+		}
+		if bl.DurationSecs == 0 {
+			bl.DurationSecs = DefaultDestinationBlacklistDurationSecs
+		}
+	}
+	if geo := &appCfg.Proxies.GeoProximity; geo.Enabled {
+		if geo.TagPrefix == "" {
+			geo.TagPrefix = DefaultGeoTagPrefix
+		}
+		if geo.CacheTTLSecs == 0 {
+			geo.CacheTTLSecs = DefaultGeoCacheTTLSecs
+		}
+		if geo.ResolveTimeoutMs == 0 {
+			geo.ResolveTimeoutMs = DefaultGeoResolveTimeoutMs
+		}
+		if geo.MaxCacheEntries == 0 {
+			geo.MaxCacheEntries = DefaultGeoMaxCacheEntries
+		}
+	}
+	for i := range appCfg.Proxies.Discovery {
+		src := &appCfg.Proxies.Discovery[i]
+		if src.Name == "" {
+			src.Name = src.Provider
+		}
+		if src.RefreshIntervalSecs == 0 {
+			src.RefreshIntervalSecs = DefaultDiscoveryRefreshSecs
+		}
+		if src.Provider == DiscoveryProviderConsul && src.Consul.Address == "" {
+			src.Consul.Address = DefaultConsulAddress
+		}
+	}
 
 	// Users defaults
 	if appCfg.Users.ConfigFilePath == "" {
@@ -164,14 +1000,99 @@ func (appCfg *App) applyDefaults() {
 	if appCfg.Users.DefaultProxyTag == "" {
 		appCfg.Users.DefaultProxyTag = "general"
 	}
+	if appCfg.Users.MissingFilePolicy == "" {
+		appCfg.Users.MissingFilePolicy = "fail"
+	}
+	if appCfg.Users.EmptyStoreBehavior == "" {
+		appCfg.Users.EmptyStoreBehavior = "deny"
+	}
+	if appCfg.Users.AuthFailureWindowSec == 0 {
+		appCfg.Users.AuthFailureWindowSec = DefaultAuthFailureWindowSec
+	}
+	if appCfg.Users.JWT.UsernameClaim == "" {
+		appCfg.Users.JWT.UsernameClaim = "sub"
+	}
+	if appCfg.Users.JWT.TagsClaim == "" {
+		appCfg.Users.JWT.TagsClaim = "tags"
+	}
+	if appCfg.Users.JWT.MaxSessionsClaim == "" {
+		appCfg.Users.JWT.MaxSessionsClaim = "max_sessions"
+	}
+	if appCfg.Users.JWT.RefreshIntervalSecs == 0 {
+		appCfg.Users.JWT.RefreshIntervalSecs = 300
+	}
+	if appCfg.Users.JWT.LeewaySecs == 0 {
+		appCfg.Users.JWT.LeewaySecs = 60
+	}
+	if appCfg.Users.JWT.CacheTTLSecs == 0 {
+		appCfg.Users.JWT.CacheTTLSecs = 300
+	}
+	if appCfg.Users.AuthBackend == "" {
+		appCfg.Users.AuthBackend = "file"
+	}
+	if appCfg.Users.LDAP.UserFilter == "" {
+		appCfg.Users.LDAP.UserFilter = "(uid={username})"
+	}
+	if appCfg.Users.LDAP.GroupAttribute == "" {
+		appCfg.Users.LDAP.GroupAttribute = "memberOf"
+	}
+	if appCfg.Users.LDAP.CacheTTLSecs == 0 {
+		appCfg.Users.LDAP.CacheTTLSecs = 60
+	}
+	if appCfg.Users.LDAP.TimeoutSecs == 0 {
+		appCfg.Users.LDAP.TimeoutSecs = 5
+	}
 
 	// Webhook defaults
 	if appCfg.Webhook.URL != "" && appCfg.Webhook.PostTimeoutSec == 0 {
 		appCfg.Webhook.PostTimeoutSec = 10
 	}
+	if appCfg.Webhook.AuthEvents == "" {
+		appCfg.Webhook.AuthEvents = "none"
+	}
+
+	// Telemetry defaults
+	if appCfg.Telemetry.Endpoint == "" {
+		appCfg.Telemetry.Endpoint = DefaultTelemetryEndpoint
+	}
+	if appCfg.Telemetry.Protocol == "" {
+		appCfg.Telemetry.Protocol = DefaultTelemetryProtocol
+	}
+	if appCfg.Telemetry.ServiceName == "" {
+		appCfg.Telemetry.ServiceName = DefaultTelemetryServiceName
+	}
+	if appCfg.Telemetry.SampleRatio == 0 {
+		appCfg.Telemetry.SampleRatio = 1
+	}
+
+	// Usage accounting defaults
+	if appCfg.Usage.FilePath == "" {
+		appCfg.Usage.FilePath = DefaultUsageFilePath
+	}
+	if appCfg.Usage.FlushIntervalSecs == 0 {
+		appCfg.Usage.FlushIntervalSecs = DefaultUsageFlushIntervalSecs
+	}
+	if appCfg.Usage.RetentionMonths == 0 {
+		appCfg.Usage.RetentionMonths = DefaultUsageRetentionMonths
+	}
+	if appCfg.Usage.Stream.IntervalSecs == 0 {
+		appCfg.Usage.Stream.IntervalSecs = DefaultUsageStreamIntervalSecs
+	}
+	if appCfg.Usage.Stream.NATS.Subject == "" {
+		appCfg.Usage.Stream.NATS.Subject = DefaultUsageStreamSubject
+	}
+	if appCfg.Usage.Stream.NATS.TimeoutSecs == 0 {
+		appCfg.Usage.Stream.NATS.TimeoutSecs = DefaultNATSTimeoutSecs
+	}
 
 	// Prometheus defaults
 	if appCfg.Prometheus.Port == "" {
 		appCfg.Prometheus.Port = DefaultPrometheusListenAddr
 	}
+	if appCfg.Prometheus.ProxyLabel == "" {
+		appCfg.Prometheus.ProxyLabel = "address"
+	}
+	if appCfg.Prometheus.ProxyLabelMaxLength == 0 {
+		appCfg.Prometheus.ProxyLabelMaxLength = 32
+	}
 }
\ No newline at end of file
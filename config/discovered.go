@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/sequring/chameleon/utils"
+)
+
+// SetDiscoveredDefinitions replaces the proxies found by the discovery source
+// named source and notifies the subscribers if they changed.
+// Discovered proxies are merged into the effective definitions but never
+// written to the definitions file; a proxy whose address is also in the file
+// keeps its file definition. IDs are derived from the source and address.
+func (m *ProxyDefinitionsManager) SetDiscoveredDefinitions(source string, defs []ProxyDefinition) (changed bool, err error) {
+	normalized := make([]ProxyDefinition, 0, len(defs))
+	seen := make(map[string]bool, len(defs))
+	for i, def := range defs {
+		if def.Address == "" {
+			return false, fmt.Errorf("discovered proxy at index %d is missing required field 'address'", i)
+		}
+		if seen[def.Address] {
+			continue
+		}
+		seen[def.Address] = true
+		if err := ValidateUsernameTemplate(def.Username); err != nil {
+			return false, fmt.Errorf("discovered proxy %s: %w", def.Address, err)
+		}
+		def.ID = utils.NameBasedUUID(source + "/" + def.Address)
+		def.Source = source
+		normalized = append(normalized, def)
+	}
+	sort.Slice(normalized, func(i, j int) bool { return normalized[i].Address < normalized[j].Address })
+
+	m.mu.Lock()
+	if m.discovered == nil {
+		m.discovered = make(map[string][]ProxyDefinition)
+	}
+	changed = !slices.EqualFunc(m.discovered[source], normalized, equalDefinitions)
+	if changed {
+		m.discovered[source] = normalized
+		m.rebuildEffectiveLocked()
+	}
+	m.mu.Unlock()
+	return changed, nil
+}
+
+// rebuildEffectiveLocked recomputes the effective definitions: the file
+// definitions, in file order, followed by discovered proxies whose address is
+// not in the file. Tag rules apply to both. Subscribers are notified of the
+// change. The caller must hold m.mu.
+func (m *ProxyDefinitionsManager) rebuildEffectiveLocked() {
+	defer m.notifyReload()
+	if len(m.discovered) == 0 {
+		m.definitions = applyTagRules(m.fileDefs, m.tagRules)
+		return
+	}
+	defs := make([]ProxyDefinition, len(m.fileDefs))
+	copy(defs, m.fileDefs)
+	seen := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		seen[def.Address] = true
+	}
+	sources := make([]string, 0, len(m.discovered))
+	for source := range m.discovered {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		for _, def := range m.discovered[source] {
+			if seen[def.Address] {
+				continue
+			}
+			seen[def.Address] = true
+			defs = append(defs, def)
+		}
+	}
+	m.definitions = applyTagRules(defs, m.tagRules)
+}
+
+// equalDefinitions reports whether two definitions are identical
+func equalDefinitions(a, b ProxyDefinition) bool {
+	return a.ID == b.ID && a.Address == b.Address && a.Username == b.Username &&
+		a.Password == b.Password && slices.Equal(a.Tags, b.Tags) && a.Description == b.Description &&
+		a.IsEnabled() == b.IsEnabled() && a.CredentialMode == b.CredentialMode && a.Source == b.Source &&
+		a.TLS == b.TLS && a.TLSServerName == b.TLSServerName && a.TLSCAFile == b.TLSCAFile &&
+		slices.Equal(a.TLSPinSHA256, b.TLSPinSHA256) && a.PreferIPv6 == b.PreferIPv6 &&
+		a.CostPerGB == b.CostPerGB && slices.Equal(a.MaintenanceWindows, b.MaintenanceWindows)
+}
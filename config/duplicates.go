@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Duplicate address policies of the definitions file (proxies.duplicate_policy)
+const (
+	// DuplicatePolicyError refuses to load a file with duplicate addresses
+	DuplicatePolicyError = "error"
+	// DuplicatePolicyFirstWins keeps the first entry of an address
+	DuplicatePolicyFirstWins = "first_wins"
+	// DuplicatePolicyLastWins keeps the last entry of an address
+	DuplicatePolicyLastWins = "last_wins"
+	// DuplicatePolicyMergeTags keeps the first entry with the tags of all entries
+	DuplicatePolicyMergeTags = "merge_tags"
+)
+
+// maxLoggedDuplicates bounds the duplicate addresses logged per load
+const maxLoggedDuplicates = 10
+
+// ValidateDuplicatePolicy checks that policy is a known duplicate address policy
+func ValidateDuplicatePolicy(policy string) error {
+	switch policy {
+	case DuplicatePolicyError, DuplicatePolicyFirstWins, DuplicatePolicyLastWins, DuplicatePolicyMergeTags:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate policy '%s', expected '%s', '%s', '%s' or '%s'", policy,
+		DuplicatePolicyError, DuplicatePolicyFirstWins, DuplicatePolicyLastWins, DuplicatePolicyMergeTags)
+}
+
+// DuplicateAddress reports the entries of the definitions file that shared an
+// address and how they were resolved. Entries are array indexes for JSON files
+// and line numbers for plain-text lists.
+type DuplicateAddress struct {
+	Address string   `json:"address"`
+	Entries []int    `json:"entries"`
+	Kept    int      `json:"kept"`
+	Tags    []string `json:"tags,omitempty"` // the merged tags with merge_tags
+}
+
+// SetDuplicatePolicy sets how LoadDefinitions handles entries with the same
+// address. The default is DuplicatePolicyError.
+func (m *ProxyDefinitionsManager) SetDuplicatePolicy(policy string) error {
+	if err := ValidateDuplicatePolicy(policy); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.duplicatePolicy = policy
+	return nil
+}
+
+// Duplicates returns the duplicate addresses resolved by the last successful
+// load of the definitions file, and the policy that resolved them
+func (m *ProxyDefinitionsManager) Duplicates() (policy string, duplicates []DuplicateAddress) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.duplicatePolicyLocked(), slices.Clone(m.duplicates)
+}
+
+// duplicatePolicyLocked returns the configured policy or the default. The caller must hold m.mu.
+func (m *ProxyDefinitionsManager) duplicatePolicyLocked() string {
+	if m.duplicatePolicy == "" {
+		return DuplicatePolicyError
+	}
+	return m.duplicatePolicy
+}
+
+// resolveDuplicates applies policy to the definitions sharing an address.
+// positions holds the file position of every definition and unit names it
+// ("index" or "line") in errors.
+func resolveDuplicates(defs []ProxyDefinition, positions []int, unit, policy string) ([]ProxyDefinition, []DuplicateAddress, error) {
+	entries := make(map[string][]int, len(defs)) // address -> indexes into defs
+	var order []string                           // duplicate addresses in order of first occurrence
+	for i, def := range defs {
+		if len(entries[def.Address]) == 1 {
+			if policy == DuplicatePolicyError {
+				return nil, nil, fmt.Errorf("duplicate proxy address '%s' found at %s %d (first occurrence at %s %d)",
+					def.Address, unit, positions[i], unit, positions[entries[def.Address][0]])
+			}
+			order = append(order, def.Address)
+		}
+		entries[def.Address] = append(entries[def.Address], i)
+	}
+	if len(order) == 0 {
+		return defs, nil, nil
+	}
+
+	keep := make(map[int]bool, len(entries))
+	resolved := make(map[int]ProxyDefinition)
+	for _, indexes := range entries {
+		kept := indexes[0]
+		if policy == DuplicatePolicyLastWins {
+			kept = indexes[len(indexes)-1]
+		}
+		keep[kept] = true
+	}
+	duplicates := make([]DuplicateAddress, 0, len(order))
+	for _, addr := range order {
+		indexes := entries[addr]
+		dup := DuplicateAddress{Address: addr}
+		for _, i := range indexes {
+			dup.Entries = append(dup.Entries, positions[i])
+			if keep[i] {
+				dup.Kept = positions[i]
+			}
+		}
+		if policy == DuplicatePolicyMergeTags {
+			merged := defs[indexes[0]]
+			merged.Tags = nil
+			for _, i := range indexes {
+				for _, tag := range defs[i].Tags {
+					if !slices.Contains(merged.Tags, tag) {
+						merged.Tags = append(merged.Tags, tag)
+					}
+				}
+			}
+			resolved[indexes[0]] = merged
+			dup.Tags = merged.Tags
+		}
+		duplicates = append(duplicates, dup)
+	}
+
+	out := make([]ProxyDefinition, 0, len(entries))
+	for i, def := range defs {
+		if !keep[i] {
+			continue
+		}
+		if merged, ok := resolved[i]; ok {
+			def = merged
+		}
+		out = append(out, def)
+	}
+	return out, duplicates, nil
+}
+
+// logDuplicates logs how duplicate addresses were resolved
+func logDuplicates(duplicates []DuplicateAddress, unit, policy string) {
+	if len(duplicates) == 0 {
+		return
+	}
+	log.Printf("Warning: proxy definitions contain %d duplicate addresses, resolved with duplicate policy '%s'", len(duplicates), policy)
+	for i, dup := range duplicates {
+		if i == maxLoggedDuplicates {
+			log.Printf("  ... and %d more (see GET /api/v1/proxies/duplicates)", len(duplicates)-i)
+			break
+		}
+		log.Printf("  %s: %ss %v, kept %s %d", dup.Address, unit, dup.Entries, unit, dup.Kept)
+	}
+}
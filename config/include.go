@@ -0,0 +1,54 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeFile decodes the configuration file at path into appCfg after the
+// files it includes. Decoding into the values of earlier files deep-merges
+// them: mappings and sections keep the keys a later file does not set, while
+// scalars and lists are replaced. chain lists the absolute paths of the files
+// including this one, to detect include cycles.
+func decodeFile(path string, appCfg *App, strict bool, chain []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(chain, abs) {
+		return fmt.Errorf("'%s' includes itself", abs)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var head struct {
+		Include []string `yaml:"include"`
+	}
+	if err := yaml.Unmarshal(data, &head); err != nil {
+		return err
+	}
+	for _, include := range head.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if err := decodeFile(include, appCfg, strict, append(chain, abs)); err != nil {
+			return fmt.Errorf("include '%s': %w", include, err)
+		}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(strict)
+	if err := decoder.Decode(appCfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
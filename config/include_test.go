@@ -0,0 +1,97 @@
+package config
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIncludeMergesMapsAndReplacesLists(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, "base.yml", `
+server:
+  socks_port: ':1080'
+  admin_token: base-token
+  socks4:
+    enabled: true
+    allowed_cidrs: ['10.0.0.0/8', '192.168.0.0/16']
+    user: legacy
+    user_map:
+      cam: cameras
+      printer: printers
+`)
+	appCfg := loadConfig(t, `
+include: [`+filepath.Join(dir, "base.yml")+`]
+server:
+  admin_token: site-token
+  socks4:
+    allowed_cidrs: ['172.16.0.0/12']
+    user_map:
+      printer: office
+      badge: doors
+`)
+
+	server := appCfg.Server
+	if server.SocksPort != ":1080" || server.AdminToken != "site-token" {
+		t.Errorf("server = socks_port %q, admin_token %q; want the included port and the overriding token", server.SocksPort, server.AdminToken)
+	}
+	if !server.Socks4.Enabled || server.Socks4.User != "legacy" {
+		t.Errorf("socks4 = %+v, want the included enabled and user kept", server.Socks4)
+	}
+	if want := []string{"172.16.0.0/12"}; !slices.Equal(server.Socks4.AllowedCIDRs, want) {
+		t.Errorf("allowed_cidrs = %v, want the list replaced by %v", server.Socks4.AllowedCIDRs, want)
+	}
+	if want := map[string]string{"cam": "cameras", "printer": "office", "badge": "doors"}; !maps.Equal(server.Socks4.UserMap, want) {
+		t.Errorf("user_map = %v, want the keys merged into %v", server.Socks4.UserMap, want)
+	}
+}
+
+func TestIncludeResolvesNestedRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	// shared/site.yml includes common.yml from its own directory, not the main file's
+	writeConfig(t, dir, "common.yml", "server:\n  socks_port: ':9999'\n")
+	writeConfig(t, dir, "shared/common.yml", "server:\n  socks_port: ':1081'\n  admin_token: common\n")
+	writeConfig(t, dir, "shared/site.yml", "include: [common.yml]\nserver:\n  admin_token: site\n")
+	appCfg, err := Load(writeConfig(t, dir, "config.yml", "include: [shared/site.yml]\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if appCfg.Server.SocksPort != ":1081" || appCfg.Server.AdminToken != "site" {
+		t.Fatalf("server = socks_port %q, admin_token %q; want ':1081' from shared/common.yml and 'site'", appCfg.Server.SocksPort, appCfg.Server.AdminToken)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, "a.yml", "include: [b.yml]\n")
+	writeConfig(t, dir, "b.yml", "include: [a.yml]\n")
+	_, err := Load(filepath.Join(dir, "a.yml"))
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Fatalf("Load = %v, want an include cycle error", err)
+	}
+
+	_, err = Load(writeConfig(t, dir, "self.yml", "include: [self.yml]\n"))
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Fatalf("Load of a file including itself = %v, want an include cycle error", err)
+	}
+}
+
+func TestIncludeStrict(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, "base.yml", "server:\n  socks_port: ':1081'\n")
+	appCfg, err := LoadStrict(writeConfig(t, dir, "config.yml", "include: [base.yml]\nserver:\n  admin_token: secret\n"))
+	if err != nil {
+		t.Fatalf("LoadStrict: %v, want include accepted", err)
+	}
+	if appCfg.Server.SocksPort != ":1081" {
+		t.Errorf("socks_port = %q, want the included ':1081'", appCfg.Server.SocksPort)
+	}
+
+	writeConfig(t, dir, "typo.yml", "server:\n  sock_port: ':1081'\n")
+	_, err = LoadStrict(writeConfig(t, dir, "main.yml", "include: [typo.yml]\n"))
+	if err == nil || !strings.Contains(err.Error(), "include '") || !strings.Contains(err.Error(), "sock_port") {
+		t.Fatalf("LoadStrict = %v, want the unknown key of the included file reported", err)
+	}
+}
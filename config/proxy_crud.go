@@ -0,0 +1,347 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sequring/chameleon/secrets"
+	"github.com/sequring/chameleon/utils"
+)
+
+var (
+	// ErrDefinitionNotFound is returned when no definition matches an address or ID
+	ErrDefinitionNotFound = errors.New("proxy definition not found")
+	// ErrDuplicateAddress is returned when a definition would duplicate an existing address
+	ErrDuplicateAddress = errors.New("proxy address already defined")
+	// ErrDiscoveredDefinition is returned when changing a proxy that comes from a discovery source
+	ErrDiscoveredDefinition = errors.New("proxy is managed by a discovery source")
+	// ErrTextProxyList is returned when changing definitions loaded from a
+	// plain-text proxy list, which cannot store most definition fields
+	ErrTextProxyList = errors.New("proxies file is a plain-text list; convert it to JSON or YAML to change it through the API")
+)
+
+// validateDefinition checks the fields of a single definition
+func validateDefinition(def ProxyDefinition) error {
+	if def.Address == "" {
+		return fmt.Errorf("proxy definition is missing required field 'address'")
+	}
+	if err := validateCredentialMode(def.CredentialMode); err != nil {
+		return err
+	}
+	if err := ValidateUsernameTemplate(def.Username); err != nil {
+		return err
+	}
+	if err := validateCostPerGB(def.CostPerGB); err != nil {
+		return err
+	}
+	if err := validateMaintenanceWindows(def.MaintenanceWindows); err != nil {
+		return err
+	}
+	if err := secrets.CheckPlaintext(def.Password); err != nil {
+		return fmt.Errorf("password: %w", err)
+	}
+	return validateUpstreamTLS(def)
+}
+
+// indexOfLocked returns the index of the file definition whose ID or address equals ref; the caller must hold mu
+func (m *ProxyDefinitionsManager) indexOfLocked(ref string) int {
+	for i, def := range m.fileDefs {
+		if def.Address == ref || (def.ID != "" && def.ID == ref) {
+			return i
+		}
+	}
+	return -1
+}
+
+// notFoundLocked returns the error for a ref that is not in the definitions file:
+// ErrDiscoveredDefinition if it names a discovered proxy, ErrDefinitionNotFound otherwise
+func (m *ProxyDefinitionsManager) notFoundLocked(ref string) error {
+	for _, def := range m.definitions[len(m.fileDefs):] {
+		if def.Address == ref || def.ID == ref {
+			return fmt.Errorf("%w '%s'", ErrDiscoveredDefinition, def.Source)
+		}
+	}
+	return ErrDefinitionNotFound
+}
+
+// FindDefinition returns the effective definition whose ID or address equals ref,
+// including discovered proxies
+func (m *ProxyDefinitionsManager) FindDefinition(ref string) (ProxyDefinition, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := m.indexOfLocked(ref); i >= 0 {
+		return m.definitions[i], nil
+	}
+	// discovered proxies follow the file definitions
+	for _, def := range m.definitions[len(m.fileDefs):] {
+		if def.Address == ref || def.ID == ref {
+			return def, nil
+		}
+	}
+	return ProxyDefinition{}, ErrDefinitionNotFound
+}
+
+// AddDefinition appends def, assigning an ID if needed, and persists the definitions file
+func (m *ProxyDefinitionsManager) AddDefinition(def ProxyDefinition) (ProxyDefinition, error) {
+	if err := validateDefinition(def); err != nil {
+		return ProxyDefinition{}, err
+	}
+	if err := secrets.LoadFile(&def.Password, def.PasswordFile); err != nil {
+		return ProxyDefinition{}, fmt.Errorf("password_file: %w", err)
+	}
+	def.Source = "" // only discovery sets the source
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.indexOfLocked(def.Address) >= 0 {
+		return ProxyDefinition{}, fmt.Errorf("%w: %s", ErrDuplicateAddress, def.Address)
+	}
+	if def.ID == "" {
+		id, err := utils.GenerateUUID()
+		if err != nil {
+			return ProxyDefinition{}, fmt.Errorf("failed to generate proxy id: %w", err)
+		}
+		def.ID = id
+	} else if m.indexOfLocked(def.ID) >= 0 {
+		return ProxyDefinition{}, fmt.Errorf("duplicate proxy id '%s'", def.ID)
+	}
+
+	newDefs := append(append([]ProxyDefinition{}, m.fileDefs...), def)
+	if err := m.commitLocked(newDefs); err != nil {
+		return ProxyDefinition{}, err
+	}
+	return def, nil
+}
+
+// UpdateDefinition replaces the definition whose ID or address equals ref with def,
+// keeping its ID, and persists the definitions file
+func (m *ProxyDefinitionsManager) UpdateDefinition(ref string, def ProxyDefinition) (ProxyDefinition, error) {
+	if err := validateDefinition(def); err != nil {
+		return ProxyDefinition{}, err
+	}
+	if err := secrets.LoadFile(&def.Password, def.PasswordFile); err != nil {
+		return ProxyDefinition{}, fmt.Errorf("password_file: %w", err)
+	}
+	def.Source = "" // only discovery sets the source
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.indexOfLocked(ref)
+	if i < 0 {
+		return ProxyDefinition{}, m.notFoundLocked(ref)
+	}
+	if j := m.indexOfLocked(def.Address); j >= 0 && j != i {
+		return ProxyDefinition{}, fmt.Errorf("%w: %s", ErrDuplicateAddress, def.Address)
+	}
+	def.ID = m.fileDefs[i].ID
+
+	newDefs := append([]ProxyDefinition{}, m.fileDefs...)
+	newDefs[i] = def
+	if err := m.commitLocked(newDefs); err != nil {
+		return ProxyDefinition{}, err
+	}
+	return def, nil
+}
+
+// SetDefinitionEnabled enables or drains the definition whose ID or address equals
+// ref and persists the definitions file
+func (m *ProxyDefinitionsManager) SetDefinitionEnabled(ref string, enabled bool) (ProxyDefinition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.indexOfLocked(ref)
+	if i < 0 {
+		return ProxyDefinition{}, m.notFoundLocked(ref)
+	}
+	newDefs := append([]ProxyDefinition{}, m.fileDefs...)
+	if enabled {
+		// enabled is the default, keep the file free of redundant fields
+		newDefs[i].Enabled = nil
+	} else {
+		newDefs[i].Enabled = &enabled
+	}
+	if err := m.commitLocked(newDefs); err != nil {
+		return ProxyDefinition{}, err
+	}
+	return newDefs[i], nil
+}
+
+// RemoveDefinition deletes the definition whose ID or address equals ref and persists the definitions file
+func (m *ProxyDefinitionsManager) RemoveDefinition(ref string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.indexOfLocked(ref)
+	if i < 0 {
+		return m.notFoundLocked(ref)
+	}
+	newDefs := append(append([]ProxyDefinition{}, m.fileDefs[:i]...), m.fileDefs[i+1:]...)
+	return m.commitLocked(newDefs)
+}
+
+// MergeResult summarizes a MergeDefinitions call
+type MergeResult struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// MergeDefinitions adds every definition whose address is not defined yet and
+// updates the credentials of those that are, keeping their ID and description
+// and merging in any new tags. The definitions file is written once.
+func (m *ProxyDefinitionsManager) MergeDefinitions(defs []ProxyDefinition) (MergeResult, error) {
+	var result MergeResult
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newDefs := append([]ProxyDefinition{}, m.fileDefs...)
+	index := make(map[string]int, len(newDefs))
+	ids := make(map[string]bool, len(newDefs))
+	for i, def := range newDefs {
+		index[def.Address] = i
+		if def.ID != "" {
+			ids[def.ID] = true
+		}
+	}
+
+	for _, def := range defs {
+		if def.Address == "" {
+			return MergeResult{}, fmt.Errorf("proxy definition is missing required field 'address'")
+		}
+		if i, ok := index[def.Address]; ok {
+			existing := newDefs[i]
+			merged := existing
+			merged.Username = def.Username
+			merged.Password = def.Password
+			merged.PasswordFile = def.PasswordFile
+			merged.Tags = mergeTags(existing.Tags, def.Tags)
+			if merged.Username == existing.Username && merged.Password == existing.Password && merged.PasswordFile == existing.PasswordFile && len(merged.Tags) == len(existing.Tags) {
+				result.Unchanged++
+				continue
+			}
+			newDefs[i] = merged
+			result.Updated++
+			continue
+		}
+		if def.ID == "" || ids[def.ID] {
+			id, err := utils.GenerateUUID()
+			if err != nil {
+				return MergeResult{}, fmt.Errorf("failed to generate proxy id: %w", err)
+			}
+			def.ID = id
+		}
+		ids[def.ID] = true
+		index[def.Address] = len(newDefs)
+		newDefs = append(newDefs, def)
+		result.Added++
+	}
+
+	if result.Added == 0 && result.Updated == 0 {
+		return result, nil
+	}
+	if err := m.commitLocked(newDefs); err != nil {
+		return MergeResult{}, err
+	}
+	return result, nil
+}
+
+// ReplaceResult lists the addresses a ReplaceDefinitions call added, removed
+// and changed
+type ReplaceResult struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// ReplaceDefinitions validates defs as a complete definitions file and, if
+// every entry is valid and no address or ID is duplicated, atomically replaces
+// the file with it. Entries without an ID keep the ID of the existing entry
+// with the same address, or get a new one.
+func (m *ProxyDefinitionsManager) ReplaceDefinitions(defs []ProxyDefinition) (ReplaceResult, error) {
+	for i, def := range defs {
+		if err := validateDefinition(def); err != nil {
+			return ReplaceResult{}, fmt.Errorf("proxy definition at index %d: %w", i, err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := make(map[string]ProxyDefinition, len(m.fileDefs))
+	for _, def := range m.fileDefs {
+		existing[def.Address] = def
+	}
+	newDefs := make([]ProxyDefinition, len(defs))
+	addresses := make(map[string]int, len(defs))
+	ids := make(map[string]int, len(defs))
+	for i, def := range defs {
+		if first, ok := addresses[def.Address]; ok {
+			return ReplaceResult{}, fmt.Errorf("%w: %s at index %d (first occurrence at index %d)", ErrDuplicateAddress, def.Address, i, first)
+		}
+		addresses[def.Address] = i
+		def.Source = "" // only discovery sets the source
+		if def.ID == "" {
+			if old, ok := existing[def.Address]; ok {
+				def.ID = old.ID
+			}
+		}
+		if def.ID != "" {
+			if first, ok := ids[def.ID]; ok {
+				return ReplaceResult{}, fmt.Errorf("duplicate proxy id '%s' at index %d (first occurrence at index %d)", def.ID, i, first)
+			}
+			ids[def.ID] = i
+		}
+		newDefs[i] = def
+	}
+	for i := range newDefs {
+		if newDefs[i].ID != "" {
+			continue
+		}
+		id, err := utils.GenerateUUID()
+		if err != nil {
+			return ReplaceResult{}, fmt.Errorf("failed to generate proxy id: %w", err)
+		}
+		newDefs[i].ID = id
+	}
+
+	result := ReplaceResult{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for _, def := range newDefs {
+		old, ok := existing[def.Address]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, def.Address)
+		case equalDefinitions(old, def):
+			result.Unchanged++
+		default:
+			result.Changed = append(result.Changed, def.Address)
+		}
+	}
+	for _, def := range m.fileDefs {
+		if _, ok := addresses[def.Address]; !ok {
+			result.Removed = append(result.Removed, def.Address)
+		}
+	}
+
+	if err := m.commitLocked(newDefs); err != nil {
+		return ReplaceResult{}, err
+	}
+	m.duplicates = nil
+	return result, nil
+}
+
+// commitLocked persists defs and makes them current; the caller must hold mu
+func (m *ProxyDefinitionsManager) commitLocked(defs []ProxyDefinition) error {
+	if m.textList {
+		return fmt.Errorf("%w: '%s'", ErrTextProxyList, m.filePath)
+	}
+	if err := writeDefinitionsFile(m.filePath, defs); err != nil {
+		return fmt.Errorf("failed to save proxy definitions: %w", err)
+	}
+	m.fileDefs = defs
+	m.rebuildEffectiveLocked()
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+)
+
+// UpstreamTLSConfig returns the TLS client config for wrapping the connection to
+// the proxy itself, or nil if the proxy is reached in cleartext. The server name
+// defaults to the host of the proxy address; TLSCAFile replaces the system roots
+// and TLSPinSHA256 additionally requires a certificate of the verified chain to
+// have one of the pinned public keys.
+func (d ProxyDefinition) UpstreamTLSConfig() (*tls.Config, error) {
+	if !d.TLS {
+		if d.TLSServerName != "" || d.TLSCAFile != "" || len(d.TLSPinSHA256) > 0 {
+			return nil, errors.New("tls_server_name, tls_ca_file and tls_pin_sha256 require 'tls': true")
+		}
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: d.TLSServerName, MinVersion: tls.VersionTLS12}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(d.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address '%s': %v", d.Address, err)
+		}
+		cfg.ServerName = host
+	}
+	if d.TLSCAFile != "" {
+		pem, err := os.ReadFile(d.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls_ca_file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls_ca_file '%s' contains no PEM certificates", d.TLSCAFile)
+		}
+	}
+	if len(d.TLSPinSHA256) > 0 {
+		pins := make([][]byte, 0, len(d.TLSPinSHA256))
+		for _, pin := range d.TLSPinSHA256 {
+			sum, err := decodePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, sum)
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if slices.ContainsFunc(pins, func(pin []byte) bool { return bytes.Equal(pin, sum[:]) }) {
+						return nil
+					}
+				}
+			}
+			return errors.New("no certificate of the proxy matches tls_pin_sha256")
+		}
+	}
+	return cfg, nil
+}
+
+// decodePin decodes a SHA-256 public key pin given as base64 (as printed by
+// "openssl ... | openssl dgst -sha256 -binary | base64") or as hex
+func decodePin(pin string) ([]byte, error) {
+	if sum, err := hex.DecodeString(pin); err == nil && len(sum) == sha256.Size {
+		return sum, nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(pin); err == nil && len(sum) == sha256.Size {
+		return sum, nil
+	}
+	return nil, fmt.Errorf("invalid tls_pin_sha256 '%s': expected a base64 or hex SHA-256 hash", pin)
+}
+
+// validateUpstreamTLS checks the TLS fields of def
+func validateUpstreamTLS(def ProxyDefinition) error {
+	_, err := def.UpstreamTLSConfig()
+	return err
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"net/url"
+)
+
+// RedactedValue replaces secrets in configuration dumps
+const RedactedValue = "REDACTED"
+
+// Redacted returns a copy of the configuration with tokens, passwords and URL
+// credentials replaced by RedactedValue, safe to include in diagnostics
+func (appCfg *App) Redacted() App {
+	c := *appCfg
+	c.Server.AdminToken = redact(c.Server.AdminToken)
+	c.Server.ReloadToken = redact(c.Server.ReloadToken)
+	if len(appCfg.Server.ReloadTokens) > 0 {
+		c.Server.ReloadTokens = make([]ReloadToken, len(appCfg.Server.ReloadTokens))
+		for i, token := range appCfg.Server.ReloadTokens {
+			token.Token = redact(token.Token)
+			c.Server.ReloadTokens[i] = token
+		}
+	}
+	c.Webhook.URL = redactURL(c.Webhook.URL)
+	c.Usage.Stream.NATS.URL = redactURL(c.Usage.Stream.NATS.URL)
+	c.Users.LDAP.BindPassword = redact(c.Users.LDAP.BindPassword)
+	c.Logging.RedactDestinations.Salt = redact(c.Logging.RedactDestinations.Salt)
+	c.Proxies.Discovery = make([]DiscoverySource, len(appCfg.Proxies.Discovery))
+	for i, src := range appCfg.Proxies.Discovery {
+		src.Password = redact(src.Password)
+		src.Consul.Token = redact(src.Consul.Token)
+		src.DigitalOcean.Token = redact(src.DigitalOcean.Token)
+		c.Proxies.Discovery[i] = src
+	}
+	if len(appCfg.Telemetry.Headers) > 0 {
+		c.Telemetry.Headers = make(map[string]string, len(appCfg.Telemetry.Headers))
+		for name, value := range appCfg.Telemetry.Headers {
+			c.Telemetry.Headers[name] = redact(value)
+		}
+	}
+	return c
+}
+
+// redact hides a secret but keeps an unset value visible as empty
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return RedactedValue
+}
+
+// redactURL hides the user info and query of rawURL, which often carry credentials
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return RedactedValue
+	}
+	if u.User != nil {
+		u.User = url.User(RedactedValue)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = RedactedValue
+	}
+	return u.String()
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// reloadTokenBytes is the entropy of generated reload tokens
+const reloadTokenBytes = 32
+
+// rotatedReloadTokenName names the token set by SetReloadToken and RotateReloadToken
+const rotatedReloadTokenName = "reload_token"
+
+// SetReloadToken sets the token accepted by CheckReloadToken besides those of
+// SetReloadTokens. An empty token disables it.
+func (m *ProxyDefinitionsManager) SetReloadToken(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reloadToken = token
+}
+
+// SetReloadTokens sets the named tokens accepted by CheckReloadToken
+func (m *ProxyDefinitionsManager) SetReloadTokens(tokens []ReloadToken) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reloadTokens = slices.Clone(tokens)
+}
+
+// RotateReloadToken replaces the reload token with a new random one and returns it.
+// The previous token stops working immediately; named tokens are not affected.
+func (m *ProxyDefinitionsManager) RotateReloadToken() (string, error) {
+	b := make([]byte, reloadTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate reload token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+	m.SetReloadToken(token)
+	return token, nil
+}
+
+// CheckReloadToken reports whether token is one of the reload tokens.
+// It always fails when no reload token is set.
+func (m *ProxyDefinitionsManager) CheckReloadToken(token string) bool {
+	_, ok := m.MatchReloadToken(token)
+	return ok
+}
+
+// MatchReloadToken returns the name of the reload token equal to token. Every
+// token is compared in constant time, so timing reveals neither which one
+// matched nor how much of it.
+func (m *ProxyDefinitionsManager) MatchReloadToken(token string) (name string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	candidates := append([]ReloadToken{{Name: rotatedReloadTokenName, Token: m.reloadToken}}, m.reloadTokens...)
+	for _, candidate := range candidates {
+		if candidate.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(candidate.Token)) == 1 && !ok {
+			name, ok = candidate.Name, true
+		}
+	}
+	return name, ok
+}
+
+// TriggerReload re-reads the definitions file; the subscribers are notified, so
+// the pool reconciles with the new definitions
+func (m *ProxyDefinitionsManager) TriggerReload() error {
+	if err := m.LoadDefinitions(); err != nil {
+		return fmt.Errorf("failed to reload proxy definitions: %w", err)
+	}
+	log.Printf("Proxy definitions reloaded from %s", m.filePath)
+	return nil
+}
+
+// Subscribe returns a channel that receives a value whenever the definitions
+// change: after TriggerReload or LoadDefinitions, a change made through the
+// CRUD methods, new tag rules and a change of discovered proxies. Notifications are coalesced while the
+// subscriber is busy, so it should re-read GetDefinitions on every value.
+// Subscriptions last for the lifetime of the manager.
+func (m *ProxyDefinitionsManager) Subscribe() <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.subscribers = append(m.subscribers, ch)
+	return ch
+}
+
+// notifyReload signals every subscriber without blocking
+func (m *ProxyDefinitionsManager) notifyReload() {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// a notification is already pending; the subscriber will pick up the latest definitions
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package config
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configSource holds the configuration structs. Their doc comments describe the
+// keys of the printed default configuration and of the JSON Schema, so the
+// documentation cannot drift from the code.
+//
+//go:embed config.go
+var configSource []byte
+
+var (
+	docsOnce  sync.Once
+	typeDocs  map[string]string // doc comments of struct types, by type name
+	fieldDocs map[string]string // doc comments of struct fields, by "Type.Field"
+)
+
+// loadDocs parses the doc comments out of configSource
+func loadDocs() {
+	docsOnce.Do(func() {
+		typeDocs = make(map[string]string)
+		fieldDocs = make(map[string]string)
+		file, err := parser.ParseFile(token.NewFileSet(), "config.go", configSource, parser.ParseComments)
+		if err != nil {
+			return // the file compiled, so it parses; without docs keys are printed bare
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				structType, ok := typeSpec.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				doc := typeSpec.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				typeDocs[typeSpec.Name.Name] = doc.Text()
+				for _, field := range structType.Fields.List {
+					text := field.Doc.Text()
+					if text == "" {
+						text = field.Comment.Text()
+					}
+					for _, name := range field.Names {
+						fieldDocs[typeSpec.Name.Name+"."+name.Name] = text
+					}
+				}
+			}
+		}
+	})
+}
+
+var goIdentifier = regexp.MustCompile(`\b[A-Z][A-Za-z0-9]*\b`)
+
+// describe returns the documentation of field of owner with Go names replaced by
+// configuration keys. A struct field without its own doc comment is described by
+// the doc comment of its type.
+func describe(owner reflect.Type, field reflect.StructField) string {
+	loadDocs()
+	key, _ := yamlKey(field)
+	if text := fieldDocs[owner.Name()+"."+field.Name]; text != "" {
+		return toKeys(text, owner)
+	}
+	if field.Type.Kind() != reflect.Struct {
+		return ""
+	}
+	text, found := strings.CutPrefix(typeDocs[field.Type.Name()], field.Type.Name()+" ")
+	if !found {
+		return ""
+	}
+	return toKeys(key+" "+text, field.Type)
+}
+
+// toKeys replaces the names of the fields of typ in text with their keys
+func toKeys(text string, typ reflect.Type) string {
+	keys := make(map[string]string)
+	for i := 0; i < typ.NumField(); i++ {
+		if key, ok := yamlKey(typ.Field(i)); ok {
+			keys[typ.Field(i).Name] = key
+		}
+	}
+	text = goIdentifier.ReplaceAllStringFunc(text, func(word string) string {
+		if key, ok := keys[word]; ok {
+			return key
+		}
+		return word
+	})
+	return strings.TrimSpace(text)
+}
+
+// yamlKey returns the configuration key of field, or false if it has none
+func yamlKey(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, true
+}
+
+// Defaults returns the configuration that applies when the configuration file
+// sets nothing. Optional sections stay disabled, but their defaults are filled
+// in so they can be shown.
+func Defaults() *App {
+	var appCfg App
+	appCfg.Server.TLS.Enabled = true
+	appCfg.Proxies.DestinationBlacklist.Enabled = true
+	appCfg.Webhook.URL = "-"
+	appCfg.applyDefaults()
+	appCfg.Server.TLS.Enabled = false
+	appCfg.Proxies.DestinationBlacklist.Enabled = false
+	appCfg.Webhook.URL = ""
+	return &appCfg
+}
+
+// WriteDefaults writes a config.yml with every key set to its default value and
+// documented by a comment
+func WriteDefaults(w io.Writer) error {
+	defaults := reflect.ValueOf(Defaults()).Elem()
+	var out bytes.Buffer
+	out.WriteString("# Chameleon configuration with every key set to its default value.\n")
+	out.WriteString("# Generated by `chameleon config print-defaults`; remove what you do not change.\n")
+	// top-level sections are encoded one by one to separate them with blank lines
+	for i := 0; i < defaults.NumField(); i++ {
+		field := defaults.Type().Field(i)
+		key, ok := yamlKey(field)
+		if !ok {
+			continue
+		}
+		section, err := defaultsEntry(defaults.Type(), field, key, defaults.Field(i))
+		if err != nil {
+			return err
+		}
+		text, err := encodeYAML(&yaml.Node{Kind: yaml.MappingNode, Content: section})
+		if err != nil {
+			return err
+		}
+		out.WriteString("\n")
+		out.Write(text)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// defaultsNode returns a mapping node of the fields of the struct v
+func defaultsNode(v reflect.Value) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key, ok := yamlKey(field)
+		if !ok {
+			continue
+		}
+		entry, err := defaultsEntry(v.Type(), field, key, v.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, entry...)
+	}
+	return node, nil
+}
+
+// defaultsEntry returns the key and value nodes of field of owner with value v.
+// Lists of structs are empty by default, so an example entry is shown in the comment.
+func defaultsEntry(owner reflect.Type, field reflect.StructField, key string, v reflect.Value) ([]*yaml.Node, error) {
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: key, HeadComment: describe(owner, field)}
+	switch {
+	case field.Type.Kind() == reflect.Struct:
+		valueNode, err := defaultsNode(v)
+		return []*yaml.Node{keyNode, valueNode}, err
+	case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct && v.Len() == 0:
+		item, err := defaultsNode(reflect.New(field.Type.Elem()).Elem())
+		if err != nil {
+			return nil, err
+		}
+		example, err := encodeYAML(&yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{item}})
+		if err != nil {
+			return nil, err
+		}
+		comment := "Example entry:\n" + strings.TrimRight(string(example), "\n")
+		if keyNode.HeadComment != "" {
+			comment = keyNode.HeadComment + "\n" + comment
+		}
+		keyNode.HeadComment = comment
+		return []*yaml.Node{keyNode, {Kind: yaml.SequenceNode, Style: yaml.FlowStyle}}, nil
+	}
+	valueNode := &yaml.Node{}
+	if err := valueNode.Encode(v.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to encode default of %s: %w", key, err)
+	}
+	if valueNode.Kind == yaml.SequenceNode || valueNode.Kind == yaml.MappingNode {
+		valueNode.Style = yaml.FlowStyle
+	}
+	return []*yaml.Node{keyNode, valueNode}, nil
+}
+
+// encodeYAML encodes node with the indentation used by the example configuration
+func encodeYAML(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// schemaEnums lists the accepted values of keys validated against a fixed set,
+// by key path ("[]" stands for any list entry)
+var schemaEnums = map[string][]string{
+	"server.max_connections_mode":       {"reject", "queue"},
+	"proxies.health_check_log_mode":     {"changes", "all"},
+	"proxies.check_type":                {"tls", "http"},
+	"proxies.health_check_target_order": {"random", "round_robin"},
+	"proxies.discovery[].provider":      {DiscoveryProviderConsul, DiscoveryProviderDigitalOcean},
+	"proxies.strategy":                  PoolStrategies,
+	"pools[].strategy":                  PoolStrategies,
+	"users.default_behavior_no_tags":    {"deny", "allow_default_tag_only", "allow_all_active"},
+	"users.missing_file_policy":         {"fail", "start_empty"},
+	"users.empty_store_behavior":        {"deny", "allow_anonymous_cidr"},
+	"users.tarpit.mode":                 {"", TarpitDrip, TarpitReset},
+	"webhook.auth_events":               {"none", "failures", "all"},
+	"prometheus.proxy_label":            {"address", "hash", "truncate"},
+	"logging.redact_destinations.mode":  {"", RedactDestinationsHash, RedactDestinationsTruncate},
+	"telemetry.protocol":                {"grpc", "http"},
+}
+
+// JSONSchema returns a JSON Schema (draft 2020-12) of the configuration file,
+// for editors and CI validation. Unknown keys are rejected as with -strict.
+func JSONSchema() ([]byte, error) {
+	schema := schemaFor(reflect.TypeOf(App{}), reflect.ValueOf(*Defaults()), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "Chameleon configuration"
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON Schema: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// schemaFor returns the schema of typ at path. v holds the default value, or is
+// the zero Value inside lists and maps, which have no defaults.
+func schemaFor(typ reflect.Type, v reflect.Value, path string) map[string]any {
+	switch typ.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			key, ok := yamlKey(field)
+			if !ok {
+				continue
+			}
+			var fv reflect.Value
+			if v.IsValid() {
+				fv = v.Field(i)
+			}
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			property := schemaFor(field.Type, fv, fieldPath)
+			if text := describe(typ, field); text != "" {
+				property["description"] = strings.ReplaceAll(text, "\n", " ")
+			}
+			properties[key] = property
+		}
+		return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaFor(typ.Elem(), reflect.Value{}, path+"[]")}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(typ.Elem(), reflect.Value{}, path+"[]")}
+	case reflect.Pointer:
+		// optional values are null until set
+		schema := schemaFor(typ.Elem(), reflect.Value{}, path)
+		schema["type"] = []any{schema["type"], "null"}
+		return schema
+	}
+
+	schema := make(map[string]any)
+	switch typ.Kind() {
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema["type"] = "integer"
+	case reflect.Float32, reflect.Float64:
+		schema["type"] = "number"
+	default:
+		schema["type"] = "string"
+	}
+	if values, ok := schemaEnums[path]; ok {
+		schema["enum"] = values
+	}
+	if v.IsValid() {
+		schema["default"] = v.Interface()
+	}
+	return schema
+}
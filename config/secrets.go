@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/sequring/chameleon/secrets"
+)
+
+// decryptSecrets decrypts the encrypted values of the configuration file
+func (appCfg *App) decryptSecrets() error {
+	type secretField struct {
+		path  string
+		value *string
+	}
+	fields := []secretField{
+		{"server.admin_token", &appCfg.Server.AdminToken},
+		{"server.reload_token", &appCfg.Server.ReloadToken},
+		{"webhook.url", &appCfg.Webhook.URL},
+		{"usage.stream.nats.url", &appCfg.Usage.Stream.NATS.URL},
+		{"users.ldap.bind_password", &appCfg.Users.LDAP.BindPassword},
+		{"logging.redact_destinations.salt", &appCfg.Logging.RedactDestinations.Salt},
+	}
+	for i := range appCfg.Server.ReloadTokens {
+		fields = append(fields, secretField{fmt.Sprintf("server.reload_tokens[%d].token", i), &appCfg.Server.ReloadTokens[i].Token})
+	}
+	for i := range appCfg.Proxies.Discovery {
+		src := &appCfg.Proxies.Discovery[i]
+		path := fmt.Sprintf("proxies.discovery[%d]", i)
+		fields = append(fields,
+			secretField{path + ".password", &src.Password},
+			secretField{path + ".consul.token", &src.Consul.Token},
+			secretField{path + ".digitalocean.token", &src.DigitalOcean.Token},
+		)
+	}
+	for name, value := range appCfg.Telemetry.Headers {
+		if err := secrets.DecryptFields(&value); err != nil {
+			return fmt.Errorf("telemetry.headers.%s: %w", name, err)
+		}
+		appCfg.Telemetry.Headers[name] = value
+	}
+	for _, field := range fields {
+		if err := secrets.DecryptFields(field.value); err != nil {
+			return fmt.Errorf("%s: %w", field.path, err)
+		}
+	}
+	return nil
+}
+
+// decryptDefinitions decrypts proxy passwords in place and reads those given
+// as password files
+func decryptDefinitions(defs []ProxyDefinition) error {
+	for i := range defs {
+		if err := secrets.DecryptFields(&defs[i].Password); err != nil {
+			return fmt.Errorf("proxy definition at index %d: password: %w", i, err)
+		}
+		if err := secrets.LoadFile(&defs[i].Password, defs[i].PasswordFile); err != nil {
+			return fmt.Errorf("proxy definition at index %d: password_file: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// encryptDefinitions returns a copy of defs with passwords encrypted for writing
+// to disk. Without a configured secret key the passwords are left as they are.
+// Passwords read from password files are left out.
+func encryptDefinitions(defs []ProxyDefinition) ([]ProxyDefinition, error) {
+	encrypted := make([]ProxyDefinition, len(defs))
+	copy(encrypted, defs)
+	for i := range encrypted {
+		if encrypted[i].PasswordFile != "" {
+			// the password stays in its file
+			encrypted[i].Password = ""
+			continue
+		}
+		password, err := secrets.Encrypt(encrypted[i].Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt password of proxy '%s': %w", encrypted[i].Address, err)
+		}
+		encrypted[i].Password = password
+	}
+	return encrypted, nil
+}
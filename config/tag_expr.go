@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Tag expression operators. They are keywords only in upper case and when
+// separated from operands by spaces or parentheses.
+const (
+	tagOpAnd = "AND"
+	tagOpOr  = "OR"
+	tagOpNot = "NOT"
+)
+
+// TagExpr is a compiled tag expression: a plain tag, a glob pattern such as
+// "country:*" or "dc-eu-*", a regular expression in slashes such as
+// "/^dc-(eu|us)-[0-9]+$/", or a combination of these with AND, OR, NOT and
+// parentheses, e.g. "country:* AND NOT (provider-b OR flaky)". A proxy matches
+// an operand if at least one of its tags does.
+type TagExpr struct {
+	root tagNode
+}
+
+// Match reports whether a proxy carrying tags satisfies the expression
+func (e *TagExpr) Match(tags []string) bool {
+	return e.root.match(tags)
+}
+
+type tagNode interface {
+	match(tags []string) bool
+}
+
+type (
+	tagLiteral string
+	tagGlob    string
+	tagRegexp  struct{ re *regexp.Regexp }
+	tagNot     struct{ x tagNode }
+	tagAnd     []tagNode
+	tagOr      []tagNode
+)
+
+func (n tagLiteral) match(tags []string) bool { return slices.Contains(tags, string(n)) }
+
+func (n tagGlob) match(tags []string) bool {
+	for _, tag := range tags {
+		if ok, _ := path.Match(string(n), tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (n tagRegexp) match(tags []string) bool {
+	for _, tag := range tags {
+		if n.re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n tagNot) match(tags []string) bool { return !n.x.match(tags) }
+
+func (n tagAnd) match(tags []string) bool {
+	for _, x := range n {
+		if !x.match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n tagOr) match(tags []string) bool {
+	for _, x := range n {
+		if x.match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPlainTag reports whether tag is matched literally, without glob, regex or
+// operators, so callers can use exact lookups
+func IsPlainTag(tag string) bool {
+	return tag != "" && !strings.ContainsAny(tag, "*?[()/ \t") &&
+		tag != tagOpAnd && tag != tagOpOr && tag != tagOpNot
+}
+
+// ParseTagExpr compiles a tag expression
+func ParseTagExpr(expr string) (*TagExpr, error) {
+	tokens, err := tokenizeTagExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag expression '%s': %w", expr, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("invalid tag expression '%s': empty", expr)
+	}
+	p := &tagParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag expression '%s': %w", expr, err)
+	}
+	return &TagExpr{root: root}, nil
+}
+
+// tokenizeTagExpr splits expr into operands, operators and parentheses. A
+// regex operand runs from '/' to the next unescaped '/' and may contain spaces.
+func tokenizeTagExpr(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case c == '/':
+			end := i + 1
+			for end < len(expr) && expr[end] != '/' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, errors.New("unterminated regular expression")
+			}
+			tokens = append(tokens, expr[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(expr) && !strings.ContainsRune(" \t()", rune(expr[end])) {
+				end++
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// tagParser parses tokens by precedence: NOT binds tighter than AND, AND tighter than OR
+type tagParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagParser) parseOr() (tagNode, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := tagOr{x}
+	for p.peek() == tagOpOr {
+		p.pos++
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, y)
+	}
+	if len(or) == 1 {
+		return x, nil
+	}
+	return or, nil
+}
+
+func (p *tagParser) parseAnd() (tagNode, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := tagAnd{x}
+	for p.peek() == tagOpAnd {
+		p.pos++
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, y)
+	}
+	if len(and) == 1 {
+		return x, nil
+	}
+	return and, nil
+}
+
+func (p *tagParser) parseUnary() (tagNode, error) {
+	switch tok := p.peek(); tok {
+	case "":
+		return nil, errors.New("unexpected end")
+	case tagOpNot:
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return tagNot{x}, nil
+	case "(":
+		p.pos++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		p.pos++
+		return x, nil
+	case ")", tagOpAnd, tagOpOr:
+		return nil, fmt.Errorf("unexpected '%s'", tok)
+	default:
+		p.pos++
+		return parseTagOperand(tok)
+	}
+}
+
+// parseTagOperand compiles a single tag, glob or /regex/
+func parseTagOperand(tok string) (tagNode, error) {
+	if len(tok) >= 2 && tok[0] == '/' && tok[len(tok)-1] == '/' {
+		re, err := regexp.Compile(strings.ReplaceAll(tok[1:len(tok)-1], `\/`, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %s: %w", tok, err)
+		}
+		return tagRegexp{re}, nil
+	}
+	if strings.ContainsAny(tok, "*?[") {
+		if _, err := path.Match(tok, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", tok, err)
+		}
+		return tagGlob(tok), nil
+	}
+	return tagLiteral(tok), nil
+}
+
+// tagExprCache holds compiled expressions by source, so selection compiles each once
+var tagExprCache sync.Map // string -> *TagExpr, or nil if invalid
+
+// MatchTagExpr reports whether a proxy carrying tags satisfies expr. Invalid
+// expressions, which validation rejects on load, match nothing.
+func MatchTagExpr(expr string, tags []string) bool {
+	if IsPlainTag(expr) {
+		return slices.Contains(tags, expr)
+	}
+	cached, ok := tagExprCache.Load(expr)
+	if !ok {
+		compiled, err := ParseTagExpr(expr)
+		if err != nil {
+			compiled = nil
+		}
+		cached, _ = tagExprCache.LoadOrStore(expr, compiled)
+	}
+	compiled := cached.(*TagExpr)
+	return compiled != nil && compiled.Match(tags)
+}
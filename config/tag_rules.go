@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// cidrTagRule is a parsed TagRule
+type cidrTagRule struct {
+	prefix netip.Prefix
+	tags   []string
+}
+
+// SetTagRules configures CIDR-based automatic tagging. Rules are applied on every
+// LoadDefinitions call; they are never written back to the definitions file.
+func (m *ProxyDefinitionsManager) SetTagRules(rules []TagRule) error {
+	parsed := make([]cidrTagRule, 0, len(rules))
+	for i, rule := range rules {
+		prefix, err := netip.ParsePrefix(rule.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid tag rule %d cidr '%s': %w", i, rule.CIDR, err)
+		}
+		parsed = append(parsed, cidrTagRule{prefix: prefix.Masked(), tags: rule.Tags})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tagRules = parsed
+	m.rebuildEffectiveLocked()
+	return nil
+}
+
+// applyTagRules returns a copy of defs with tags from matching CIDR rules merged in.
+// Proxies addressed by hostname are left untouched.
+func applyTagRules(defs []ProxyDefinition, rules []cidrTagRule) []ProxyDefinition {
+	if len(rules) == 0 {
+		return defs
+	}
+	result := make([]ProxyDefinition, len(defs))
+	copy(result, defs)
+	for i := range result {
+		host, _, err := net.SplitHostPort(result[i].Address)
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		for _, rule := range rules {
+			if rule.prefix.Contains(addr) {
+				result[i].Tags = mergeTags(result[i].Tags, rule.tags)
+			}
+		}
+	}
+	return result
+}
+
+// mergeTags returns existing with any tags from extra that it doesn't already contain appended
+func mergeTags(existing, extra []string) []string {
+	merged := make([]string, len(existing), len(existing)+len(extra))
+	copy(merged, existing)
+	for _, tag := range extra {
+		found := false
+		for _, have := range merged {
+			if have == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
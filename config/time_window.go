@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // time zones of time windows resolve in minimal images too
+)
+
+// TimeWindow is a compiled cron-style time window with the five fields
+// "minute hour day-of-month month day-of-week", e.g. "* 9-17 * * MON-FRI" for
+// business hours or "* 0-6,22-23 * * *" for nights. A time is in the window if
+// its minute matches every field. Fields take *, numbers, ranges (a-b), steps
+// (*/n, a-b/n), lists (a,b) and three-letter month and day names; 0 and 7 are
+// Sunday. As in cron, when both day fields are restricted a day matching either
+// one matches, and a day field starting with * is unrestricted. The expression
+// may start with "TZ=<IANA zone>" to evaluate it in that zone instead of local
+// time. Instead of the five fields, a window may be a daily time range
+// "HH:MM-HH:MM", e.g. "23:30-00:15", which contains its start but not its end.
+type TimeWindow struct {
+	minute, hour, dom, month, dow uint64 // bit i is set if value i matches
+	domAll, dowAll                bool   // the day field starts with *
+	loc                           *time.Location
+	// daily is set for a time range from minute of the day from up to to
+	daily    bool
+	from, to int
+}
+
+// timeWindowField describes one field of a TimeWindow expression
+type timeWindowField struct {
+	name     string
+	min, max int
+	names    []string // names of min, min+1, ...
+}
+
+var timeWindowFields = [5]timeWindowField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// ParseTimeWindow compiles a time window expression
+func ParseTimeWindow(expr string) (*TimeWindow, error) {
+	w := &TimeWindow{loc: time.Local}
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "TZ=") {
+		loc, err := time.LoadLocation(strings.TrimPrefix(fields[0], "TZ="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window '%s': %w", expr, err)
+		}
+		w.loc, fields = loc, fields[1:]
+	}
+	if len(fields) == 1 && strings.Contains(fields[0], ":") {
+		from, to, _ := strings.Cut(fields[0], "-")
+		var err error
+		if w.from, err = minuteOfDay(from); err == nil {
+			w.to, err = minuteOfDay(to)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window '%s': %w", expr, err)
+		}
+		if w.from == w.to {
+			return nil, fmt.Errorf("invalid time window '%s': time range is empty", expr)
+		}
+		w.daily = true
+		return w, nil
+	}
+	if len(fields) != len(timeWindowFields) {
+		return nil, fmt.Errorf("invalid time window '%s': want 5 fields (minute hour day-of-month month day-of-week), got %d", expr, len(fields))
+	}
+	masks := [5]*uint64{&w.minute, &w.hour, &w.dom, &w.month, &w.dow}
+	for i, field := range fields {
+		mask, err := timeWindowFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window '%s': %w", expr, err)
+		}
+		*masks[i] = mask
+	}
+	if w.dow&(1<<7) != 0 {
+		w.dow |= 1 // 7 is Sunday too
+	}
+	w.domAll, w.dowAll = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return w, nil
+}
+
+// parse returns the values matched by a field as a bit mask
+func (f timeWindowField) parse(field string) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step '%s' in %s field", stepStr, f.name)
+			}
+			step = n
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(first); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range '%s' of %s field ends before it starts", rng, f.name)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// value parses a number or name of the field
+func (f timeWindowField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid %s '%s', want %d-%d", f.name, s, f.min, f.max)
+	}
+	return n, nil
+}
+
+// minuteOfDay parses an "HH:MM" time of day
+func minuteOfDay(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || errH != nil || errM != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time of day '%s', want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// Contains reports whether t falls into the window
+func (w *TimeWindow) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.daily {
+		m := t.Hour()*60 + t.Minute()
+		if w.from < w.to {
+			return m >= w.from && m < w.to
+		}
+		return m >= w.from || m < w.to // across midnight
+	}
+	if w.minute&(1<<t.Minute()) == 0 || w.hour&(1<<t.Hour()) == 0 || w.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domMatch, dowMatch := w.dom&(1<<t.Day()) != 0, w.dow&(1<<int(t.Weekday())) != 0
+	if !w.domAll && !w.dowAll {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// timeWindowCache holds compiled windows by source, so routing compiles each once
+var timeWindowCache sync.Map // string -> *TimeWindow, or nil if invalid
+
+// InTimeWindow reports whether t falls into the window expr. Invalid
+// expressions, which validation rejects on load, contain no time.
+func InTimeWindow(expr string, t time.Time) bool {
+	cached, ok := timeWindowCache.Load(expr)
+	if !ok {
+		compiled, err := ParseTimeWindow(expr)
+		if err != nil {
+			compiled = nil
+		}
+		cached, _ = timeWindowCache.LoadOrStore(expr, compiled)
+	}
+	compiled := cached.(*TimeWindow)
+	return compiled != nil && compiled.Contains(t)
+}
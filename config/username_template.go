@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// Placeholders available in a templated ProxyDefinition.Username
+const (
+	PlaceholderUser      = "user"       // the SOCKS client's username
+	PlaceholderSessionID = "session_id" // a random ID generated for every connection
+	PlaceholderCountry   = "country"    // the SOCKS client's country from users.json
+)
+
+const (
+	sessionIDLength = 10
+	sessionIDChars  = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// UsernameVars are the values substituted into a username template
+type UsernameVars struct {
+	User      string
+	SessionID string
+	Country   string
+}
+
+// IsUsernameTemplate reports whether username contains placeholders
+func IsUsernameTemplate(username string) bool {
+	return strings.Contains(username, "{")
+}
+
+// ValidateUsernameTemplate checks that every {placeholder} in username is known
+// and that braces are balanced. A username without placeholders is always valid.
+func ValidateUsernameTemplate(username string) error {
+	rest := username
+	for {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			return nil
+		}
+		if rest[open] == '}' {
+			return fmt.Errorf("invalid username template '%s': unexpected '}'", username)
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return fmt.Errorf("invalid username template '%s': unclosed '{'", username)
+		}
+		switch name := rest[open+1 : open+1+end]; name {
+		case PlaceholderUser, PlaceholderSessionID, PlaceholderCountry:
+		default:
+			return fmt.Errorf("invalid username template '%s': unknown placeholder '{%s}', expected {%s}, {%s} or {%s}",
+				username, name, PlaceholderUser, PlaceholderSessionID, PlaceholderCountry)
+		}
+		rest = rest[open+1+end+1:]
+	}
+}
+
+// RenderUsername substitutes vars into a username template validated by
+// ValidateUsernameTemplate. An empty SessionID is replaced by a new one.
+func RenderUsername(template string, vars UsernameVars) string {
+	if !IsUsernameTemplate(template) {
+		return template
+	}
+	if vars.SessionID == "" && strings.Contains(template, "{"+PlaceholderSessionID+"}") {
+		vars.SessionID = NewSessionID()
+	}
+	return strings.NewReplacer(
+		"{"+PlaceholderUser+"}", vars.User,
+		"{"+PlaceholderSessionID+"}", vars.SessionID,
+		"{"+PlaceholderCountry+"}", vars.Country,
+	).Replace(template)
+}
+
+// NewSessionID returns a random vendor session ID. It only has to be unique
+// enough to pin a connection to one exit IP, so it does not use crypto/rand.
+func NewSessionID() string {
+	b := make([]byte, sessionIDLength)
+	for i := range b {
+		b[i] = sessionIDChars[rand.IntN(len(sessionIDChars))]
+	}
+	return string(b)
+}
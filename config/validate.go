@@ -0,0 +1,183 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in a candidate file. Line and Column are
+// 1-based and locate the entry (or the syntax error); they are 0 when unknown.
+type ValidationError struct {
+	Index   int    `json:"index"` // entry index, -1 for problems of the whole file
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidateJSONArray decodes data as a JSON array one entry at a time and
+// calls check with each entry. Syntax errors stop the validation; errors
+// returned by check are collected with the position of their entry.
+func ValidateJSONArray(data []byte, check func(index int, entry json.RawMessage) error) []ValidationError {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return []ValidationError{jsonError(data, 0, -1, err)}
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return []ValidationError{positioned(data, -1, skipSeparators(data, 0), "expected a JSON array")}
+	}
+
+	var errs []ValidationError
+	for i := 0; dec.More(); i++ {
+		start := skipSeparators(data, int(dec.InputOffset()))
+		var entry json.RawMessage
+		if err := dec.Decode(&entry); err != nil {
+			return append(errs, jsonError(data, 0, i, err))
+		}
+		if err := check(i, entry); err != nil {
+			errs = append(errs, jsonError(data, start, i, err))
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return append(errs, jsonError(data, 0, -1, err))
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		errs = append(errs, positioned(data, -1, skipSeparators(data, int(dec.InputOffset())), "unexpected data after the JSON array"))
+	}
+	return errs
+}
+
+// ValidateYAMLArray is ValidateJSONArray for a YAML sequence: every entry is
+// converted to JSON for check, and its errors are located at the entry.
+// Syntax errors stop the validation.
+func ValidateYAMLArray(data []byte, check func(index int, entry json.RawMessage) error) []ValidationError {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []ValidationError{{Index: -1, Message: err.Error()}}
+	}
+	if len(doc.Content) == 0 {
+		return nil // only comments
+	}
+	seq := doc.Content[0]
+	if seq.Kind != yaml.SequenceNode {
+		return []ValidationError{{Index: -1, Line: seq.Line, Column: seq.Column, Message: "expected a YAML sequence"}}
+	}
+	var errs []ValidationError
+	for i, item := range seq.Content {
+		var value any
+		err := item.Decode(&value)
+		var entry []byte
+		if err == nil {
+			entry, err = json.Marshal(value)
+		}
+		if err == nil {
+			err = check(i, entry)
+		}
+		if err != nil {
+			errs = append(errs, ValidationError{Index: i, Line: item.Line, Column: item.Column, Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// jsonError locates err: syntax and type errors at their own offset (relative
+// to base), anything else at base
+func jsonError(data []byte, base, index int, err error) ValidationError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return positioned(data, index, base+int(syntaxErr.Offset)-1, err.Error())
+	case errors.As(err, &typeErr):
+		return positioned(data, index, base+int(typeErr.Offset)-1, err.Error())
+	}
+	return positioned(data, index, base, err.Error())
+}
+
+// positioned builds a ValidationError located at offset in data
+func positioned(data []byte, index, offset int, message string) ValidationError {
+	line, col := findLineAndColumn(data, max(offset, 0))
+	return ValidationError{Index: index, Line: line, Column: col, Message: message}
+}
+
+// skipSeparators returns the offset of the first byte at or after offset that
+// is neither whitespace nor a comma
+func skipSeparators(data []byte, offset int) int {
+	for offset < len(data) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// ValidateData checks data as a candidate definitions file (a JSON array or a
+// plain-text list, or a YAML sequence if the file is YAML) without applying it: every entry is validated like on load,
+// and duplicate addresses are reported unless the duplicate policy resolves them.
+func (m *ProxyDefinitionsManager) ValidateData(data []byte) []ValidationError {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil // an empty file loads as an empty pool
+	}
+	m.mu.RLock()
+	policy := m.duplicatePolicyLocked()
+	m.mu.RUnlock()
+
+	addresses := make(map[string]int)
+	ids := make(map[string]int)
+	checkDefinition := func(i int, def ProxyDefinition) error {
+		if err := validateDefinition(def); err != nil {
+			return err
+		}
+		if first, ok := addresses[def.Address]; ok {
+			if policy == DuplicatePolicyError {
+				return fmt.Errorf("duplicate proxy address '%s' (first occurrence at index %d)", def.Address, first)
+			}
+			return nil // resolved by the duplicate policy
+		}
+		addresses[def.Address] = i
+		if def.ID != "" {
+			if first, ok := ids[def.ID]; ok {
+				return fmt.Errorf("duplicate proxy id '%s' (first occurrence at index %d)", def.ID, first)
+			}
+			ids[def.ID] = i
+		}
+		return nil
+	}
+
+	checkEntry := func(i int, entry json.RawMessage) error {
+		var def ProxyDefinition
+		if err := json.Unmarshal(entry, &def); err != nil {
+			return err
+		}
+		defs := []ProxyDefinition{def}
+		if err := decryptDefinitions(defs); err != nil {
+			return err
+		}
+		return checkDefinition(i, defs[0])
+	}
+	if IsYAMLFile(m.filePath) {
+		return ValidateYAMLArray(data, checkEntry)
+	}
+	if isTextProxyList(data) {
+		defs, lines, lineErrs := parseProxyList(bytes.NewReader(data), true)
+		var errs []ValidationError
+		for _, lineErr := range lineErrs {
+			errs = append(errs, ValidationError{Index: -1, Line: lineErr.Line, Column: 1, Message: lineErr.Err})
+		}
+		for i, def := range defs {
+			if err := checkDefinition(i, def); err != nil {
+				errs = append(errs, ValidationError{Index: i, Line: lines[i], Column: 1, Message: err.Error()})
+			}
+		}
+		return errs
+	}
+	return ValidateJSONArray(data, checkEntry)
+}
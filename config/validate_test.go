@@ -0,0 +1,73 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestValidateYAMLArray(t *testing.T) {
+	// check rejects entries without an address
+	check := func(index int, entry json.RawMessage) error {
+		var def struct {
+			Address string `json:"address"`
+		}
+		if err := json.Unmarshal(entry, &def); err != nil {
+			return err
+		}
+		if def.Address == "" {
+			return errors.New("address is required")
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		name string
+		data string
+		want []ValidationError
+	}{
+		{
+			name: "valid",
+			data: "# proxies\n- address: 1.2.3.4:1080\n- address: 5.6.7.8:1080\n",
+		},
+		{
+			name: "only comments",
+			data: "# nothing here yet\n",
+		},
+		{
+			name: "entries located",
+			data: "- address: 1.2.3.4:1080\n- username: u\n\n# broken\n- tags: [a]\n",
+			want: []ValidationError{
+				{Index: 1, Line: 2, Column: 3, Message: "address is required"},
+				{Index: 2, Line: 5, Column: 3, Message: "address is required"},
+			},
+		},
+		{
+			name: "wrong type",
+			data: "- address: [1, 2]\n",
+			want: []ValidationError{{Index: 0, Line: 1, Column: 3, Message: "json: cannot unmarshal array into Go struct field .address of type string"}},
+		},
+		{
+			name: "not a sequence",
+			data: "\naddress: 1.2.3.4:1080\n",
+			want: []ValidationError{{Index: -1, Line: 2, Column: 1, Message: "expected a YAML sequence"}},
+		},
+		{
+			name: "syntax error",
+			data: "- address: 1.2.3.4:1080\n  - broken\n",
+			want: []ValidationError{{Index: -1, Message: "yaml: line 1: did not find expected key"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ValidateYAMLArray([]byte(tc.data), check)
+			if len(got) != len(tc.want) {
+				t.Fatalf("ValidateYAMLArray = %+v, want %+v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("error %d = %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IsYAMLFile reports whether the proxies or users file at path is YAML rather
+// than JSON, by its .yaml or .yml extension
+func IsYAMLFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// EncodeYAML encodes v as YAML indented by two spaces
+func EncodeYAML(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeYAMLFile encodes items, a slice of entries identified by key, to
+// replace the YAML sequence in the file at path. The comments of the file are
+// kept: those of the document, and those of every entry and field still there,
+// found by the entry's key. An unreadable or missing file is encoded anew.
+func EncodeYAMLFile(path string, items any, key string) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(items); err != nil {
+		return nil, err
+	}
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&node}}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var old yaml.Node
+	if err == nil && yaml.Unmarshal(data, &old) == nil && len(old.Content) > 0 {
+		copyYAMLComments(doc, &old)
+		if oldSeq := old.Content[0]; oldSeq.Kind == yaml.SequenceNode && node.Kind == yaml.SequenceNode {
+			copyYAMLComments(&node, oldSeq)
+			copyYAMLEntryComments(&node, oldSeq, key)
+		}
+	}
+	return EncodeYAML(doc)
+}
+
+// copyYAMLEntryComments copies the comments of the entries of the sequence
+// src to the entries of dst with the same key
+func copyYAMLEntryComments(dst, src *yaml.Node, key string) {
+	byKey := make(map[string]*yaml.Node, len(src.Content))
+	for _, entry := range src.Content {
+		if _, id := yamlField(entry, key); id != nil && id.Value != "" {
+			byKey[id.Value] = entry
+		}
+	}
+	for _, entry := range dst.Content {
+		_, id := yamlField(entry, key)
+		if id == nil {
+			continue
+		}
+		old, ok := byKey[id.Value]
+		if !ok || len(old.Content) == 0 || len(entry.Content) == 0 {
+			continue
+		}
+		copyYAMLComments(entry, old)
+		// a comment above the entry stays above it, whichever key comes first
+		entry.Content[0].HeadComment = old.Content[0].HeadComment
+		for i := 0; i+1 < len(entry.Content); i += 2 {
+			field := entry.Content[i]
+			oldField, oldValue := yamlField(old, field.Value)
+			if oldField == nil {
+				continue
+			}
+			if i > 0 && oldField != old.Content[0] {
+				field.HeadComment = oldField.HeadComment
+			}
+			field.LineComment, field.FootComment = oldField.LineComment, oldField.FootComment
+			copyYAMLValueComments(entry.Content[i+1], oldValue)
+		}
+	}
+}
+
+// copyYAMLValueComments copies the comments of the value src, and of the
+// items and fields it holds, to the value dst
+func copyYAMLValueComments(dst, src *yaml.Node) {
+	copyYAMLComments(dst, src)
+	if dst.Kind != src.Kind {
+		return
+	}
+	switch dst.Kind {
+	case yaml.SequenceNode:
+		for i := 0; i < len(dst.Content) && i < len(src.Content); i++ {
+			copyYAMLValueComments(dst.Content[i], src.Content[i])
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			if oldField, oldValue := yamlField(src, dst.Content[i].Value); oldField != nil {
+				copyYAMLComments(dst.Content[i], oldField)
+				copyYAMLValueComments(dst.Content[i+1], oldValue)
+			}
+		}
+	}
+}
+
+// copyYAMLComments copies the comments of the node src to dst
+func copyYAMLComments(dst, src *yaml.Node) {
+	dst.HeadComment, dst.LineComment, dst.FootComment = src.HeadComment, src.LineComment, src.FootComment
+}
+
+// yamlField returns the key and value nodes of key in the mapping node m, or nils
+func yamlField(m *yaml.Node, key string) (keyNode, value *yaml.Node) {
+	if m.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i], m.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// parseYAMLDefinitions parses the contents of a YAML definitions file, a
+// sequence of definitions. Encrypted passwords are decrypted.
+func parseYAMLDefinitions(data []byte) (defs []ProxyDefinition, positions []int, err error) {
+	if err := yaml.Unmarshal(data, &defs); err != nil {
+		return nil, nil, fmt.Errorf("error parsing YAML: %v", err)
+	}
+	if defs == nil {
+		defs = []ProxyDefinition{}
+	}
+	if err := decryptDefinitions(defs); err != nil {
+		return nil, nil, err
+	}
+	positions = make([]int, len(defs))
+	for i := range positions {
+		positions[i] = i
+	}
+	return defs, positions, nil
+}
+
+// addYAMLIDs returns the YAML definitions file data with the IDs of defs,
+// parsed from it, added to the entries without one. Unlike encoding defs
+// again, this keeps the comments and the layout of the file.
+func addYAMLIDs(data []byte, defs []ProxyDefinition) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("expected a YAML sequence")
+	}
+	for i, entry := range doc.Content[0].Content {
+		if i >= len(defs) || entry.Kind != yaml.MappingNode || hasYAMLKey(entry, "id") {
+			continue
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: "id"}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: defs[i].ID}
+		if len(entry.Content) > 0 {
+			// a comment above the entry stays above it
+			key.HeadComment, entry.Content[0].HeadComment = entry.Content[0].HeadComment, ""
+		}
+		entry.Content = append([]*yaml.Node{key, value}, entry.Content...)
+	}
+	return EncodeYAML(&doc)
+}
+
+// hasYAMLKey reports whether the mapping node m has the key
+func hasYAMLKey(m *yaml.Node, key string) bool {
+	keyNode, _ := yamlField(m, key)
+	return keyNode != nil
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const proxiesYAML = `# vendor A, billed per GB
+- address: 1.2.3.4:1080
+  username: puser1
+  password: ppass1
+  tags: [usa, fast-isp]  # general browsing
+  cost_per_gb: 0.5
+
+# vendor B
+- id: 6f1c2d4e-0000-4000-8000-000000000002
+  address: 5.6.7.8:1080  # rotates daily
+`
+
+func TestParseYAMLDefinitions(t *testing.T) {
+	defs, positions, err := parseYAMLDefinitions([]byte(proxiesYAML))
+	if err != nil {
+		t.Fatalf("parseYAMLDefinitions: %v", err)
+	}
+	if len(defs) != 2 || len(positions) != 2 || positions[1] != 1 {
+		t.Fatalf("parseYAMLDefinitions = %+v at %v, want 2 definitions", defs, positions)
+	}
+	if d := defs[0]; d.Address != "1.2.3.4:1080" || d.Password != "ppass1" || strings.Join(d.Tags, ",") != "usa,fast-isp" || d.CostPerGB != 0.5 {
+		t.Errorf("first definition = %+v", d)
+	}
+	if defs[1].ID != "6f1c2d4e-0000-4000-8000-000000000002" {
+		t.Errorf("second definition ID = %q", defs[1].ID)
+	}
+
+	for _, tc := range []struct {
+		name, data string
+		wantDefs   int
+		wantErr    string
+	}{
+		{"only comments", "# no proxies yet\n", 0, ""},
+		{"empty sequence", "[]\n", 0, ""},
+		{"mapping", "address: 1.2.3.4:1080\n", 0, "error parsing YAML"},
+		{"unknown type", "- address: [1, 2]\n", 0, "error parsing YAML"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defs, _, err := parseYAMLDefinitions([]byte(tc.data))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("parseYAMLDefinitions = %+v, %v; want an error containing %q", defs, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || defs == nil || len(defs) != tc.wantDefs {
+				t.Fatalf("parseYAMLDefinitions = %#v, %v; want %d definitions", defs, err, tc.wantDefs)
+			}
+		})
+	}
+}
+
+func TestAddYAMLIDs(t *testing.T) {
+	defs, _, err := parseYAMLDefinitions([]byte(proxiesYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defs[0].ID = "6f1c2d4e-0000-4000-8000-000000000001"
+	defs[1].ID = "ignored, the entry has an ID"
+
+	data, err := addYAMLIDs([]byte(proxiesYAML), defs)
+	if err != nil {
+		t.Fatalf("addYAMLIDs: %v", err)
+	}
+	out := string(data)
+	for _, want := range []string{
+		"# vendor A, billed per GB\n- id: 6f1c2d4e-0000-4000-8000-000000000001\n  address: 1.2.3.4:1080\n",
+		"# general browsing",
+		"# vendor B\n- id: 6f1c2d4e-0000-4000-8000-000000000002\n",
+		"# rotates daily",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("addYAMLIDs output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "ignored") {
+		t.Errorf("addYAMLIDs replaced an existing ID:\n%s", out)
+	}
+
+	reparsed, _, err := parseYAMLDefinitions(data)
+	if err != nil || len(reparsed) != 2 || reparsed[0].ID != defs[0].ID || reparsed[0].Password != "ppass1" {
+		t.Fatalf("parsing the output = %+v, %v", reparsed, err)
+	}
+
+	if _, err := addYAMLIDs([]byte("address: 1.2.3.4:1080\n"), defs); err == nil {
+		t.Error("addYAMLIDs accepted a mapping")
+	}
+}
+
+func TestWriteDefinitionsFileKeepsYAMLComments(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "proxies.yml", `# managed through the admin API
+- id: a  # the first one
+  # vendor A
+  address: 1.2.3.4:1080
+  tags:
+    - usa  # general browsing
+- id: b
+  address: 5.6.7.8:1080  # rotates daily
+`)
+	defs := []ProxyDefinition{
+		{ID: "b", Address: "5.6.7.9:1080"},
+		{ID: "a", Address: "1.2.3.4:1080", Tags: []string{"usa", "eu"}},
+		{ID: "c", Address: "9.9.9.9:1080"},
+	}
+	if err := writeDefinitionsFile(path, defs); err != nil {
+		t.Fatalf("writeDefinitionsFile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, want := range []string{
+		"# managed through the admin API",
+		"id: a # the first one",
+		"# vendor A\n  address: 1.2.3.4:1080",
+		"- usa # general browsing",
+		"address: 5.6.7.9:1080 # rotates daily",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("written file lacks %q:\n%s", want, out)
+		}
+	}
+	written, _, err := parseYAMLDefinitions(data)
+	if err != nil || len(written) != 3 || written[0].ID != "b" || strings.Join(written[1].Tags, ",") != "usa,eu" {
+		t.Fatalf("parsing the written file = %+v, %v", written, err)
+	}
+
+	// a file that does not exist yet is encoded anew
+	path = t.TempDir() + "/new.yaml"
+	if err := writeDefinitionsFile(path, defs[:1]); err != nil {
+		t.Fatalf("writeDefinitionsFile of a new file: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !strings.HasPrefix(string(data), "- id: b\n") {
+		t.Fatalf("new file = %q, %v", data, err)
+	}
+}
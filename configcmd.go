@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// runConfig implements the config subcommand: printing the default configuration
+// and the JSON Schema of the configuration file
+func runConfig(args []string) int {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s config <command>
+
+Commands:
+  print-defaults  Print a commented config.yml with every key set to its default value
+  schema          Print the JSON Schema of the configuration file
+`, os.Args[0])
+	}
+	if len(args) != 1 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "print-defaults":
+		if err := config.WriteDefaults(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case "schema":
+		schema, err := config.JSONSchema()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(schema)
+		return 0
+	default:
+		usage()
+		return 2
+	}
+}
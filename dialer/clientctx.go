@@ -0,0 +1,64 @@
+package dialer
+
+import (
+	"context"
+
+	"github.com/sequring/chameleon/telemetry"
+	"github.com/things-go/go-socks5"
+)
+
+// clientKey carries the Client a dial is made for
+type clientKey struct{}
+
+// WithClient returns a copy of ctx carrying client, so everything below the
+// SOCKS server (proxy selection, quotas, access logs) can tell who dials
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the client recorded by WithClient. ok is false for
+// dials made outside a client request; the zero Client is then anonymous.
+func ClientFromContext(ctx context.Context) (client Client, ok bool) {
+	client, ok = ctx.Value(clientKey{}).(Client)
+	return client, ok
+}
+
+// sessionIDKey carries the ID of the session a request opens
+type sessionIDKey struct{}
+
+// WithSessionID returns a copy of ctx carrying the session ID id, which log
+// lines, metric exemplars and events of the request are tagged with
+func WithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, id)
+}
+
+// SessionIDFromContext returns the session ID recorded by WithSessionID, or ""
+func SessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey{}).(string)
+	return id
+}
+
+// logSuffix returns the session and trace IDs of ctx for appending to log lines
+func logSuffix(ctx context.Context) string {
+	suffix := telemetry.LogSuffix(ctx)
+	if id := SessionIDFromContext(ctx); id != "" {
+		suffix = " session=" + id + suffix
+	}
+	return suffix
+}
+
+// RequestContext is the go-socks5 rule set of a server. It permits every
+// request and records the authenticated client in the request context, which
+// go-socks5 passes to the command handlers and to Dialer.Dial.
+type RequestContext struct {
+	// Pool is the named pool the clients of the server are bound to, empty
+	// for the default pool
+	Pool string
+}
+
+// Allow records the client of request in ctx
+func (r RequestContext) Allow(ctx context.Context, request *socks5.Request) (context.Context, bool) {
+	client := requestClient(request)
+	client.Pool = r.Pool
+	return WithClient(ctx, client), true
+}
@@ -0,0 +1,384 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/events"
+	"github.com/sequring/chameleon/handshake"
+	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/session"
+	"github.com/sequring/chameleon/socks4"
+	"github.com/sequring/chameleon/tap"
+	"github.com/sequring/chameleon/telemetry"
+	"github.com/sequring/chameleon/utils"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// relayBufferSize matches the go-socks5 default buffer pool size
+const relayBufferSize = 32 * 1024
+
+// connectRequest is a CONNECT request of a SOCKS5 or SOCKS4 client
+type connectRequest struct {
+	version  string // "5" or "4"
+	client   Client
+	dest     string // address to dial
+	destName string // domain the client asked for, empty for IP destinations
+	remote   net.Addr
+	writer   io.Writer // the client connection
+	reader   io.Reader // what the client sends after the request
+	// reply tells the client the outcome: success when err is nil, with bind as
+	// the bound address, otherwise the failure matching err
+	reply func(err error, bind net.Addr) error
+}
+
+// HandleConnect serves a SOCKS5 CONNECT command: it dials the destination
+// through an upstream proxy, registers the session, and relays traffic in both
+// directions until either side closes or the session is killed.
+func (d *Dialer) HandleConnect(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	client, ok := ClientFromContext(ctx)
+	if !ok {
+		client = requestClient(request)
+	}
+	return d.connect(ctx, connectRequest{
+		version:  "5",
+		client:   client,
+		dest:     request.DestAddr.String(),
+		destName: request.DestAddr.FQDN,
+		remote:   request.RemoteAddr,
+		writer:   writer,
+		reader:   request.Reader,
+		reply: func(err error, bind net.Addr) error {
+			if err != nil {
+				return socks5.SendReply(writer, replyCodeFor(err), nil)
+			}
+			return socks5.SendReply(writer, statute.RepSuccess, bind)
+		},
+	})
+}
+
+// HandleSocks4 serves a SOCKS4 or SOCKS4a CONNECT request admitted as
+// request.Username like HandleConnect serves SOCKS5. A SOCKS4a hostname is
+// resolved by the upstream proxy.
+func (d *Dialer) HandleSocks4(ctx context.Context, conn net.Conn, reader io.Reader, request *socks4.Request) error {
+	return d.connect(ctx, connectRequest{
+		version:  "4",
+		client:   Client{Username: request.Username, Addr: conn.RemoteAddr()},
+		dest:     request.DestAddr(),
+		destName: request.Host,
+		remote:   conn.RemoteAddr(),
+		writer:   conn,
+		reader:   reader,
+		reply: func(err error, bind net.Addr) error {
+			if err != nil {
+				return socks4.SendReply(conn, socks4.RepRejected, nil)
+			}
+			return socks4.SendReply(conn, socks4.RepGranted, bind)
+		},
+	})
+}
+
+// connect serves a CONNECT request of any SOCKS version
+func (d *Dialer) connect(ctx context.Context, request connectRequest) (err error) {
+	dest := request.dest
+	socksClient := request.client
+	username := socksClient.Username
+	writer := request.writer
+	// the client is done negotiating, lift the handshake deadline
+	handshake.Done(writer)
+
+	id, err := utils.GenerateUUID()
+	if err != nil {
+		return fmt.Errorf("failed to generate session id: %w", err)
+	}
+	ctx = WithSessionID(ctx, id)
+	// the SOCKS servers log the returned error
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("session %s: %w", id, err)
+		}
+	}()
+	ctx, span := telemetry.Tracer().Start(ctx, "socks.connect", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("session.id", id),
+		attribute.String("socks.version", request.version),
+		attribute.String("socks.user", username),
+		attribute.String("socks.destination", dest),
+		attribute.String("socks.destination_name", request.destName),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+	if request.remote != nil {
+		span.SetAttributes(attribute.String("socks.client", request.remote.String()))
+	}
+	d.debugf(ctx, username, "SOCKS%s CONNECT to %s from %v", request.version, d.logDest(username, dest), request.remote)
+	release, err := d.acquireConnection(ctx)
+	if err != nil {
+		d.debugf(ctx, username, "CONNECT to %s refused: %v", d.logDest(username, dest), err)
+		if errReply := request.reply(err, nil); errReply != nil {
+			return fmt.Errorf("failed to send reply, %v", errReply)
+		}
+		return fmt.Errorf("connect to %v refused, %v", d.logDest(username, dest), err)
+	}
+	release = sync.OnceFunc(release)
+	defer release()
+	if err := d.clientTCP.apply(writer); err != nil {
+		log.Printf("Client %v: failed to apply TCP options: %v%s", request.remote, err, logSuffix(ctx))
+	}
+
+	dialCtx := withDestinationName(ctx, request.destName)
+	upstream, proxyCfg, err := d.DialUpstream(dialCtx, "tcp", dest, socksClient)
+	if err != nil {
+		d.debugf(ctx, username, "CONNECT to %s failed: %v", d.logDest(username, dest), d.logErr(username, dest, err))
+		if d.tarpits(err) {
+			// a held client must not keep a slot of server.max_connections
+			release()
+			if held, errTarpit := d.tarpitRequest(ctx, request, err); held {
+				return errTarpit
+			}
+		}
+		if errReply := request.reply(err, nil); errReply != nil {
+			return fmt.Errorf("failed to send reply, %v", errReply)
+		}
+		return fmt.Errorf("connect to %v failed, %v", d.logDest(username, dest), d.logErr(username, dest, err))
+	}
+	target := upstream
+	if d.redial.MaxAttempts > 1 {
+		target = d.newRedialConn(dialCtx, upstream, proxyCfg, dest, socksClient)
+	}
+	defer target.Close()
+
+	client, _ := writer.(net.Conn)
+	sess := session.New(id, username, client, target, dest, proxyCfg.Address)
+	if d.sessions != nil {
+		d.sessions.Add(sess)
+		defer d.sessions.Remove(sess.ID)
+	}
+	defer sess.Close()
+	d.publishSession(events.TypeSessionStarted, sess)
+	defer d.publishSession(events.TypeSessionEnded, sess)
+
+	if err := request.reply(nil, target.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	d.debugf(ctx, username, "session to %s via proxy %s established", d.logDest(username, dest), proxyCfg.Address)
+	_, relaySpan := telemetry.Tracer().Start(ctx, "socks.relay", trace.WithAttributes(
+		attribute.String("proxy.address", proxyCfg.Address),
+	))
+	defer func() {
+		relaySpan.SetAttributes(
+			attribute.Int64("socks.bytes_up", int64(sess.BytesUp())),
+			attribute.Int64("socks.bytes_down", int64(sess.BytesDown())),
+		)
+		telemetry.EndSpan(relaySpan, err)
+	}()
+
+	var up, down io.Reader = request.reader, target
+	if d.tap.Match(username, dest) {
+		rec := d.tap.Start(sess.Info())
+		defer func() { rec.Close(sess.Info()) }()
+		up = rec.Reader(tap.DirectionUp, up)
+		down = rec.Reader(tap.DirectionDown, down)
+	}
+
+	if d.hasSessionLimits() {
+		done := make(chan struct{})
+		defer close(done)
+		go d.enforceSessionLimits(sess, done)
+	}
+
+	traffic := metrics.NewTagTraffic(proxyTags(proxyCfg))
+	proxyTraffic := metrics.NewProxyTraffic(proxyCfg.Address, proxyCfg.Cost())
+	meter := d.usage.Meter(username)
+	tally := d.usageStream.Tally(username, proxyCfg.ID, proxyCfg.Address)
+	defer func() {
+		sess.Close() // stops the relays before their last bytes are accounted
+		meter.Close()
+		tally.Close()
+	}()
+	errCh := make(chan relayEnd, 2)
+	d.relays.Add(2)
+	go func() {
+		defer d.relays.Add(-1)
+		err := relay(target, up, func(n int) {
+			sess.AddBytesUp(n)
+			traffic.AddUp(n)
+			proxyTraffic.AddUp(n)
+			meter.AddUp(n)
+			tally.AddUp(n)
+		})
+		errCh <- relayEnd{direction: tap.DirectionUp, err: err}
+	}()
+	go func() {
+		defer d.relays.Add(-1)
+		err := relay(writer, down, func(n int) {
+			sess.AddBytesDown(n)
+			traffic.AddDown(n)
+			proxyTraffic.AddDown(n)
+			meter.AddDown(n)
+			tally.AddDown(n)
+		})
+		errCh <- relayEnd{direction: tap.DirectionDown, err: err}
+	}()
+	for i := 0; i < 2; i++ {
+		end := <-errCh
+		if i == 0 && d.debugging(username) {
+			d.debugf(ctx, username, "session to %s via proxy %s closed: %s (%d bytes up, %d bytes down, %v)",
+				d.logDest(username, dest), proxyCfg.Address, end.reason(), sess.BytesUp(), sess.BytesDown(), time.Since(sess.StartedAt).Round(time.Millisecond))
+		}
+		if e := end.err; e != nil && !errors.Is(e, net.ErrClosed) {
+			// returning closes target and the client connection
+			return e
+		}
+	}
+	return nil
+}
+
+// relayEnd is how the relay of one direction of a session ended
+type relayEnd struct {
+	direction string
+	err       error
+}
+
+// reason describes why the session ended when this relay ended first
+func (e relayEnd) reason() string {
+	switch {
+	case errors.Is(e.err, net.ErrClosed):
+		return "closed by Chameleon (killed, expired or shutting down)"
+	case e.err != nil:
+		return fmt.Sprintf("relay %s failed: %v", e.direction, e.err)
+	case e.direction == tap.DirectionUp:
+		return "client closed the connection"
+	default:
+		return "destination closed the connection"
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies src to dst, reporting each chunk to count, and half-closes dst when src is exhausted
+func relay(dst io.Writer, src io.Reader, count func(int)) error {
+	buf := make([]byte, relayBufferSize)
+	var err error
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			written, writeErr := dst.Write(buf[:n])
+			count(written)
+			if writeErr != nil {
+				err = writeErr
+				break
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+	return err
+}
+
+// requestClient returns the authenticated SOCKS client of request; anonymous if none
+func requestClient(request *socks5.Request) Client {
+	if request.AuthContext == nil {
+		return Client{Addr: request.RemoteAddr}
+	}
+	return Client{
+		Username: request.AuthContext.Payload["username"],
+		Password: request.AuthContext.Payload["password"],
+		Addr:     request.RemoteAddr,
+	}
+}
+
+// upstreamReplies maps the reply names golang.org/x/net/proxy reports, as
+// "unknown error <name>", when an upstream proxy refuses a CONNECT
+var upstreamReplies = map[string]uint8{
+	"general SOCKS server failure":      statute.RepServerFailure,
+	"connection not allowed by ruleset": statute.RepRuleFailure,
+	"network unreachable":               statute.RepNetworkUnreachable,
+	"host unreachable":                  statute.RepHostUnreachable,
+	"connection refused":                statute.RepConnectionRefused,
+	"TTL expired":                       statute.RepTTLExpired,
+	"command not supported":             statute.RepCommandNotSupported,
+	"address type not supported":        statute.RepAddrTypeNotSupported,
+}
+
+// replyCodeFor maps a dial error to the SOCKS5 reply code sent to the client.
+// Replies from the upstream proxy about the destination are passed through;
+// failures to select or reach an upstream are reported as server failures.
+func replyCodeFor(err error) uint8 {
+	switch {
+	case errors.Is(err, auth.ErrNoProxyAccess), errors.Is(err, auth.ErrTagNotAllowed), errors.Is(err, ErrSessionLimit),
+		errors.Is(err, ErrUnknownPool):
+		return statute.RepRuleFailure
+	case errors.Is(err, proxypool.ErrNoActiveProxies), errors.Is(err, ErrPinnedProxyUnavailable), errors.Is(err, ErrConnectionLimit):
+		return statute.RepServerFailure
+	case errors.Is(err, context.DeadlineExceeded):
+		return statute.RepTTLExpired
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		if name, ok := strings.CutPrefix(opErr.Err.Error(), "unknown error "); ok {
+			if code, ok := upstreamReplies[name]; ok {
+				return code
+			}
+		}
+		if opErr.Timeout() {
+			return statute.RepTTLExpired
+		}
+	}
+	// the upstream proxy itself was unreachable or rejected our credentials
+	return statute.RepServerFailure
+}
+
+// Error kinds reported by ErrorKind
+const (
+	KindTagNotAllowed          = "tag_not_allowed"
+	KindNoProxyAccess          = "no_proxy_access"
+	KindNoActiveProxies        = "no_active_proxies"
+	KindPinnedProxyUnavailable = "pinned_proxy_unavailable"
+	KindProxyDialFailed        = "proxy_dial_failed"
+	KindSessionLimit           = "session_limit"
+	KindUnknownPool            = "unknown_pool"
+)
+
+// ErrorKind returns a stable name for the kind of a routing or dial error,
+// or "" when err is none of the known kinds
+func ErrorKind(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrTagNotAllowed):
+		return KindTagNotAllowed
+	case errors.Is(err, auth.ErrNoProxyAccess):
+		return KindNoProxyAccess
+	case errors.Is(err, proxypool.ErrNoActiveProxies):
+		return KindNoActiveProxies
+	case errors.Is(err, ErrPinnedProxyUnavailable):
+		return KindPinnedProxyUnavailable
+	case errors.Is(err, ErrProxyDialFailed):
+		return KindProxyDialFailed
+	case errors.Is(err, ErrSessionLimit):
+		return KindSessionLimit
+	case errors.Is(err, ErrUnknownPool):
+		return KindUnknownPool
+	}
+	return ""
+}
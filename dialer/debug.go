@@ -0,0 +1,107 @@
+package dialer
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserDebug is a user whose connections are logged in detail until Until
+type UserDebug struct {
+	Username string    `json:"username"`
+	Until    time.Time `json:"until"`
+}
+
+// userDebug is the debug state of one user; timer ends it
+type userDebug struct {
+	until time.Time
+	timer *time.Timer
+}
+
+// debugUsers holds the users in debug mode
+type debugUsers struct {
+	mu    sync.RWMutex
+	users map[string]*userDebug
+}
+
+// EnableUserDebug logs the connection lifecycle of username in detail (route,
+// proxy selection, upstream handshake timings and close reason) for duration.
+// Enabling it again extends or shortens the period. It returns when it ends.
+func (d *Dialer) EnableUserDebug(username string, duration time.Duration) time.Time {
+	until := time.Now().Add(duration)
+	d.debug.mu.Lock()
+	defer d.debug.mu.Unlock()
+	if d.debug.users == nil {
+		d.debug.users = make(map[string]*userDebug)
+	}
+	if prev, ok := d.debug.users[username]; ok {
+		prev.timer.Stop()
+	}
+	entry := &userDebug{until: until}
+	entry.timer = time.AfterFunc(duration, func() {
+		d.debug.mu.Lock()
+		defer d.debug.mu.Unlock()
+		if d.debug.users[username] == entry {
+			delete(d.debug.users, username)
+			log.Printf("Debug logging for user '%s' expired", username)
+		}
+	})
+	d.debug.users[username] = entry
+	log.Printf("Debug logging for user '%s' enabled until %s", username, until.Format(time.RFC3339))
+	return until
+}
+
+// DisableUserDebug ends the debug mode of username. It reports whether it was on.
+func (d *Dialer) DisableUserDebug(username string) bool {
+	d.debug.mu.Lock()
+	defer d.debug.mu.Unlock()
+	entry, ok := d.debug.users[username]
+	if !ok {
+		return false
+	}
+	entry.timer.Stop()
+	delete(d.debug.users, username)
+	log.Printf("Debug logging for user '%s' disabled", username)
+	return true
+}
+
+// UserDebugUntil returns when the debug mode of username ends; ok is false if it is off
+func (d *Dialer) UserDebugUntil(username string) (until time.Time, ok bool) {
+	d.debug.mu.RLock()
+	defer d.debug.mu.RUnlock()
+	entry, ok := d.debug.users[username]
+	if !ok {
+		return time.Time{}, false
+	}
+	return entry.until, true
+}
+
+// DebugUsers returns the users in debug mode ordered by username
+func (d *Dialer) DebugUsers() []UserDebug {
+	d.debug.mu.RLock()
+	users := make([]UserDebug, 0, len(d.debug.users))
+	for username, entry := range d.debug.users {
+		users = append(users, UserDebug{Username: username, Until: entry.until})
+	}
+	d.debug.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// debugging reports whether the connections of username are logged in detail
+func (d *Dialer) debugging(username string) bool {
+	d.debug.mu.RLock()
+	defer d.debug.mu.RUnlock()
+	_, ok := d.debug.users[username]
+	return ok
+}
+
+// debugf logs a connection lifecycle event of username if it is in debug mode,
+// tagged with the session of ctx
+func (d *Dialer) debugf(ctx context.Context, username, format string, args ...any) {
+	if d.debugging(username) {
+		log.Printf("Debug [user %s] "+format+"%s", append(append([]any{username}, args...), logSuffix(ctx))...)
+	}
+}
@@ -0,0 +1,264 @@
+package dialer
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sequring/chameleon/events"
+	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// DestinationBlacklist configures per-destination proxy avoidance: a proxy that
+// failed at least FailureRatio of at least MinAttempts dials to one destination
+// within Window is not selected for that destination for Duration.
+type DestinationBlacklist struct {
+	Window       time.Duration
+	MinAttempts  int
+	FailureRatio float64
+	Duration     time.Duration
+}
+
+// destKey identifies the dials through one proxy to one destination host
+type destKey struct {
+	proxy string // proxy address
+	host  string // lowercased destination host without port
+}
+
+// destStats are the dial outcomes of one (proxy, destination) pair in the current window
+type destStats struct {
+	windowStart  time.Time
+	attempts     int
+	failures     int
+	blockedUntil time.Time
+	lastFailures int // failures of the window that triggered the blacklisting
+	lastAttempts int
+}
+
+// destinationTracker records dial outcomes per (proxy, destination) pair
+type destinationTracker struct {
+	cfg       DestinationBlacklist
+	mu        sync.Mutex
+	stats     map[destKey]*destStats
+	hostUntil map[string]time.Time // latest blacklisting expiry per destination host
+	lastSweep time.Time
+}
+
+// BlacklistedDestination is a proxy currently avoided for a destination
+type BlacklistedDestination struct {
+	ProxyAddress string    `json:"proxy_address"`
+	Destination  string    `json:"destination"`
+	Attempts     int       `json:"attempts"`
+	Failures     int       `json:"failures"`
+	BlockedUntil time.Time `json:"blocked_until"`
+}
+
+// SetDestinationBlacklist enables per-destination proxy avoidance
+func (d *Dialer) SetDestinationBlacklist(cfg DestinationBlacklist) {
+	d.destinations = &destinationTracker{
+		cfg:       cfg,
+		stats:     make(map[destKey]*destStats),
+		hostUntil: make(map[string]time.Time),
+	}
+}
+
+// BlacklistedDestinations returns the (proxy, destination) pairs currently avoided
+func (d *Dialer) BlacklistedDestinations() []BlacklistedDestination {
+	if d.destinations == nil {
+		return []BlacklistedDestination{}
+	}
+	return d.destinations.blacklisted(time.Now())
+}
+
+// BlacklistedDestinationCount returns how many (proxy, destination) pairs are currently avoided
+func (d *Dialer) BlacklistedDestinationCount() int {
+	if d.destinations == nil {
+		return 0
+	}
+	return len(d.destinations.blacklisted(time.Now()))
+}
+
+// ClearDestinationBlacklist forgets all recorded dial outcomes and blacklistings
+// and returns how many pairs were blacklisted
+func (d *Dialer) ClearDestinationBlacklist() int {
+	if d.destinations == nil {
+		return 0
+	}
+	t := d.destinations
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	cleared := 0
+	for _, st := range t.stats {
+		if now.Before(st.blockedUntil) {
+			cleared++
+		}
+	}
+	t.stats = make(map[destKey]*destStats)
+	t.hostUntil = make(map[string]time.Time)
+	return cleared
+}
+
+// destinationNameKey carries the destination domain requested by the SOCKS client
+type destinationNameKey struct{}
+
+// withDestinationName records the domain the client asked for. The dialed
+// address may be an IP literal instead (see upstreamDestination).
+func withDestinationName(ctx context.Context, fqdn string) context.Context {
+	if fqdn == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, destinationNameKey{}, fqdn)
+}
+
+// destinationHost returns the lowercased domain requested for the dial to addr,
+// or the host of addr without its port
+func destinationHost(ctx context.Context, addr string) string {
+	host, ok := ctx.Value(destinationNameKey{}).(string)
+	if !ok {
+		var err error
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			host = addr
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// avoidFor returns a selection filter skipping proxies blacklisted for host,
+// or nil if nothing needs to be avoided
+func (d *Dialer) avoidFor(host string) func(*proxypool.ProxyConfig) bool {
+	avoided := d.avoidAddressFor(host)
+	if avoided == nil {
+		return nil
+	}
+	return func(proxyCfg *proxypool.ProxyConfig) bool {
+		return avoided(proxyCfg.Address)
+	}
+}
+
+// avoidAddressFor is avoidFor for proxies identified by address
+func (d *Dialer) avoidAddressFor(host string) func(address string) bool {
+	if d.destinations == nil || host == "" {
+		return nil
+	}
+	if !d.destinations.hasBlocks(host, time.Now()) {
+		return nil
+	}
+	return func(address string) bool {
+		return d.destinations.isBlocked(address, host, time.Now())
+	}
+}
+
+// recordDestination records the outcome of a dial to addr through proxyCfg
+func (d *Dialer) recordDestination(ctx context.Context, proxyCfg *proxypool.ProxyConfig, addr string, ok bool) {
+	if d.destinations == nil {
+		return
+	}
+	host := destinationHost(ctx, addr)
+	if d.destinations.record(destKey{proxy: proxyCfg.Address, host: host}, ok, time.Now()) {
+		metrics.DestinationBlacklistedTotal.Inc()
+		log.Printf("Proxy %s: avoiding it for destination %s for %v after repeated failures%s", proxyCfg.Address, d.logDest("", host), d.destinations.cfg.Duration, logSuffix(ctx))
+		d.events.Publish(events.TypeDestinationBlacklisted, string(proxypool.SeverityWarning), blacklistEvent{
+			ProxyAddress:    proxyCfg.Address,
+			Destination:     d.logDest("", host),
+			DurationSeconds: d.destinations.cfg.Duration.Seconds(),
+			SessionID:       SessionIDFromContext(ctx),
+		})
+	}
+}
+
+// record adds a dial outcome and reports whether it got the pair blacklisted
+func (t *destinationTracker) record(key destKey, ok bool, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweepLocked(now)
+	st := t.stats[key]
+	if st == nil {
+		st = &destStats{windowStart: now}
+		t.stats[key] = st
+	}
+	if now.Sub(st.windowStart) >= t.cfg.Window {
+		st.windowStart, st.attempts, st.failures = now, 0, 0
+	}
+	st.attempts++
+	if ok {
+		return false
+	}
+	st.failures++
+	if now.Before(st.blockedUntil) || st.attempts < t.cfg.MinAttempts ||
+		float64(st.failures)/float64(st.attempts) < t.cfg.FailureRatio {
+		return false
+	}
+	st.blockedUntil = now.Add(t.cfg.Duration)
+	if st.blockedUntil.After(t.hostUntil[key.host]) {
+		t.hostUntil[key.host] = st.blockedUntil
+	}
+	st.lastAttempts, st.lastFailures = st.attempts, st.failures
+	st.windowStart, st.attempts, st.failures = now, 0, 0
+	return true
+}
+
+// sweepLocked drops pairs whose window and blacklisting have expired, at most once per window
+func (t *destinationTracker) sweepLocked(now time.Time) {
+	if now.Sub(t.lastSweep) < t.cfg.Window {
+		return
+	}
+	t.lastSweep = now
+	for key, st := range t.stats {
+		if now.Sub(st.windowStart) >= t.cfg.Window && !now.Before(st.blockedUntil) {
+			delete(t.stats, key)
+		}
+	}
+	for host, until := range t.hostUntil {
+		if !now.Before(until) {
+			delete(t.hostUntil, host)
+		}
+	}
+}
+
+// hasBlocks reports whether any proxy is blacklisted for host
+func (t *destinationTracker) hasBlocks(host string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return now.Before(t.hostUntil[host])
+}
+
+// isBlocked reports whether proxyAddr is blacklisted for host
+func (t *destinationTracker) isBlocked(proxyAddr, host string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.stats[destKey{proxy: proxyAddr, host: host}]
+	return st != nil && now.Before(st.blockedUntil)
+}
+
+// blacklisted returns the pairs blacklisted at now, ordered by destination and proxy
+func (t *destinationTracker) blacklisted(now time.Time) []BlacklistedDestination {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := []BlacklistedDestination{}
+	for key, st := range t.stats {
+		if !now.Before(st.blockedUntil) {
+			continue
+		}
+		list = append(list, BlacklistedDestination{
+			ProxyAddress: key.proxy,
+			Destination:  key.host,
+			Attempts:     st.lastAttempts,
+			Failures:     st.lastFailures,
+			BlockedUntil: st.blockedUntil,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Destination != list[j].Destination {
+			return list[i].Destination < list[j].Destination
+		}
+		return list[i].ProxyAddress < list[j].ProxyAddress
+	})
+	return list
+}
@@ -3,66 +3,372 @@ package dialer
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"sync/atomic"
 	"time"
 
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/events"
 	"github.com/sequring/chameleon/metrics" 
 	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/session"
+	"github.com/sequring/chameleon/tap"
+	"github.com/sequring/chameleon/telemetry"
+	"github.com/sequring/chameleon/usage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	px "golang.org/x/net/proxy"
 )
 
+// TagPolicy resolves which upstream proxy tags a SOCKS user may use
+type TagPolicy interface {
+	ResolveRoute(username string) (auth.Route, error)
+}
+
+// UpstreamCredentialSource provides per-user credentials for passthrough proxies
+// and the per-user values of templated proxy usernames
+type UpstreamCredentialSource interface {
+	UpstreamCredentials(username string) (user, password string, ok bool)
+	UpstreamCountry(username string) string
+}
+
+// Client is the authenticated SOCKS client a connection is dialed for.
+// The zero value is an anonymous client.
+type Client struct {
+	Username string
+	Password string
+	Addr     net.Addr // the client's address, nil if unknown
+	// Pool is the named pool of the listener the client connected to, empty
+	// for the shared listeners
+	Pool string
+}
+
 type Dialer struct {
-	pool         *proxypool.Pool
+	pool         ProxySelector
+	pools        map[string]ProxySelector // named pools besides the default one
 	commonMetrics *Metrics 
+	sessions     *session.Registry
+	policy       TagPolicy
+	credentials  UpstreamCredentialSource
+	tap          *tap.Tap
+	usage        *usage.Store // monthly per-user traffic; nil disables accounting
+	usageStream  *usage.Collector // per-user and per-proxy traffic for usage events; nil disables it
+	hedging      map[string]time.Duration // hedge delay per proxy tag
+	dialTimeout  time.Duration
+	tagTimeouts  []TagTimeout
+	idleTimeout  time.Duration // close sessions without traffic for this long; 0 disables
+	maxLifetime  time.Duration // close sessions older than this; 0 disables
+	destinations *destinationTracker // per-destination proxy blacklist; nil disables
+	redial       RedialConfig // retrying CONNECTs the upstream reset right away
+	connLimit    ConnectionLimit
+	connSlots    chan struct{} // one entry per connection served; nil without a limit
+	clientTCP    TCPOptions
+	upstreamTCP  TCPOptions
+	debug        debugUsers // users whose connections are logged in detail
+	redaction    redaction  // hides destinations in log lines
+	geo          *geoResolver // regions of destinations for proximity-aware selection; nil disables
+	events       *events.Hub  // receives session and blacklist events; nil disables
+	tarpit       Tarpit       // holds the clients of CONNECTs the routing policy rejects
+
+	pendingDials atomic.Int64 // upstream dials in progress
+	relays       atomic.Int64 // running relay goroutines (two per connected session)
+	hedgeWins    atomic.Int64 // hedged dials won by the backup proxy
+	connections  atomic.Int64 // client connections being served
+	tarpitted    atomic.Int64 // rejected clients being held in the tarpit
 }
 
-func New(pool *proxypool.Pool, commonMetrics *Metrics) *Dialer {
+// DefaultDialTimeout bounds a dial through an upstream proxy unless SetDialTimeouts overrides it
+const DefaultDialTimeout = 15 * time.Second
+
+// TagTimeout is a dial timeout for proxies carrying Tag
+type TagTimeout struct {
+	Tag     string
+	Timeout time.Duration
+}
+
+func New(pool ProxySelector, commonMetrics *Metrics, sessions *session.Registry) *Dialer {
 	return &Dialer{
 		pool:         pool,
 		commonMetrics: commonMetrics,
+		sessions:     sessions,
+		dialTimeout:  DefaultDialTimeout,
+	}
+}
+
+// PendingDials returns the number of upstream dials in progress
+func (d *Dialer) PendingDials() int64 {
+	return d.pendingDials.Load()
+}
+
+// ActiveRelays returns the number of running relay goroutines
+func (d *Dialer) ActiveRelays() int64 {
+	return d.relays.Load()
+}
+
+// SetPools sets the named pools users and listeners can be bound to. The
+// default pool passed to New is used for everyone else.
+func (d *Dialer) SetPools(pools map[string]*proxypool.Pool) {
+	d.pools = make(map[string]ProxySelector, len(pools))
+	for name, pool := range pools {
+		d.pools[name] = pool
+	}
+}
+
+// ErrUnknownPool is returned when a user or listener is bound to a pool that
+// is not configured
+var ErrUnknownPool = errors.New("unknown proxy pool")
+
+// poolFor returns the pool a connection routed by route is served from: the
+// user's pool if it is bound to one, else the pool of the client's listener,
+// else the default pool
+func (d *Dialer) poolFor(route auth.Route, client Client) (ProxySelector, error) {
+	name := route.Pool
+	if name == "" {
+		name = client.Pool
+	}
+	if name == "" || name == config.DefaultPoolName {
+		return d.pool, nil
+	}
+	pool, ok := d.pools[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPool, name)
+	}
+	return pool, nil
+}
+
+// SetTagPolicy restricts upstream selection per user. A nil policy allows any active proxy.
+func (d *Dialer) SetTagPolicy(policy TagPolicy) {
+	d.policy = policy
+}
+
+// SetUpstreamCredentials sets where per-user credentials for passthrough proxies
+// come from. Users without configured upstream credentials pass their own.
+func (d *Dialer) SetUpstreamCredentials(src UpstreamCredentialSource) {
+	d.credentials = src
+}
+
+// upstreamAuth returns the credentials to present to proxyCfg for client, or nil
+// to use the proxy's own credentials. A templated proxy username is rendered
+// for every connection so each one gets its own vendor session.
+func (d *Dialer) upstreamAuth(proxyCfg *proxypool.ProxyConfig, client Client) *px.Auth {
+	proxyCfg.Mu.RLock()
+	passthrough := proxyCfg.Passthrough
+	username, password := proxyCfg.Username, proxyCfg.Password
+	proxyCfg.Mu.RUnlock()
+	if !passthrough || client.Username == "" {
+		if !config.IsUsernameTemplate(username) {
+			return nil
+		}
+		vars := config.UsernameVars{User: client.Username}
+		if d.credentials != nil && client.Username != "" {
+			vars.Country = d.credentials.UpstreamCountry(client.Username)
+		}
+		return &px.Auth{User: config.RenderUsername(username, vars), Password: password}
+	}
+	if d.credentials != nil {
+		if user, password, ok := d.credentials.UpstreamCredentials(client.Username); ok {
+			return &px.Auth{User: user, Password: password}
+		}
 	}
+	return &px.Auth{User: client.Username, Password: client.Password}
+}
+
+// SetDialTimeouts sets the timeout of dials through upstream proxies. A proxy
+// carrying the tag of one of overrides uses that rule's timeout instead; the
+// first matching rule wins.
+func (d *Dialer) SetDialTimeouts(timeout time.Duration, overrides []TagTimeout) {
+	d.dialTimeout = timeout
+	d.tagTimeouts = overrides
+}
+
+// dialTimeoutFor returns the dial timeout for a proxy carrying tags
+func (d *Dialer) dialTimeoutFor(tags []string) time.Duration {
+	for _, rule := range d.tagTimeouts {
+		for _, tag := range tags {
+			if tag == rule.Tag {
+				return rule.Timeout
+			}
+		}
+	}
+	return d.dialTimeout
+}
+
+// SetHedging enables hedged dialing for users routed through the given tags: if the
+// fastest eligible proxy has not connected after the tag's delay, the second fastest
+// is dialed too and whichever connects first is used.
+func (d *Dialer) SetHedging(delays map[string]time.Duration) {
+	d.hedging = delays
+}
+
+// HedgeWins returns how many hedged dials were won by the backup proxy
+func (d *Dialer) HedgeWins() int64 {
+	return d.hedgeWins.Load()
+}
+
+// SetTap mirrors sessions matching t's filter to t. A nil tap disables mirroring.
+func (d *Dialer) SetTap(t *tap.Tap) {
+	d.tap = t
+}
+
+// SetUsage accounts the traffic of every session to its user in store. A nil store disables accounting.
+func (d *Dialer) SetUsage(store *usage.Store) {
+	d.usage = store
+}
+
+// SetUsageStream counts the traffic of every session to its user and upstream
+// proxy in c for usage events. A nil collector disables it.
+func (d *Dialer) SetUsageStream(c *usage.Collector) {
+	d.usageStream = c
 }
 
+// Dial connects to addr through an active upstream proxy
 func (d *Dialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, _ := ClientFromContext(ctx)
+	conn, _, err := d.DialUpstream(ctx, network, addr, client)
+	return conn, err
+}
+
+// DialUpstream connects to addr through an active upstream proxy that client
+// is allowed to use and also returns the proxy that was used.
+func (d *Dialer) DialUpstream(ctx context.Context, network, addr string, client Client) (conn net.Conn, proxyCfg *proxypool.ProxyConfig, err error) {
 	metrics.SocksRequestsTotal.Inc()
 	atomic.AddUint64(&d.commonMetrics.TotalRequests, 1) 
+	ctx = WithClient(ctx, client)
+
+	ctx, span := telemetry.Tracer().Start(ctx, "dialer.dial", trace.WithAttributes(
+		attribute.String("socks.user", client.Username),
+		attribute.String("socks.destination", addr),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+	if client.Addr != nil {
+		span.SetAttributes(attribute.String("socks.client", client.Addr.String()))
+	}
 
-	proxyCfg, err := d.pool.GetActiveProxy()
+	_, selectSpan := telemetry.Tracer().Start(ctx, "dialer.select_proxy")
+	selectStart := time.Now()
+	pool, proxies, hedgeDelay, err := d.selectProxies(ctx, client, destinationHost(ctx, addr), nil)
+	if err == nil {
+		metrics.ObserveConnectPhase(metrics.PhaseSelect, time.Since(selectStart), SessionIDFromContext(ctx))
+		selectSpan.SetAttributes(attribute.Int("proxy.candidates", len(proxies)))
+	}
+	telemetry.EndSpan(selectSpan, err)
+	if err == nil && d.debugging(client.Username) {
+		backup := ""
+		if len(proxies) > 1 {
+			backup = fmt.Sprintf(", hedged with %s after %v", proxies[1].Address, hedgeDelay)
+		}
+		d.debugf(ctx, client.Username, "selected proxy %s for %s in %v%s", proxies[0].Address, d.logDest(client.Username, addr), time.Since(selectStart), backup)
+	}
 	if err != nil {
 		metrics.SocksRequestsFailedTotal.Inc()
 		atomic.AddUint64(&d.commonMetrics.TotalFailed, 1) 
-		log.Printf("Failed to get active proxy: %v", err)
-		return nil, err
+		log.Printf("Failed to get active proxy: %v%s", err, logSuffix(ctx))
+		return nil, nil, err
 	}
 
-	var auth *px.Auth
-	if proxyCfg.Username != "" {
-		auth = &px.Auth{User: proxyCfg.Username, Password: proxyCfg.Password}
-	}
+	d.pendingDials.Add(1)
+	defer d.pendingDials.Add(-1)
 
-	upstreamDialer, err := px.SOCKS5(network, proxyCfg.Address, auth, px.Direct)
+	proxyCfg = proxies[0]
+	if len(proxies) > 1 {
+		conn, proxyCfg, err = d.dialHedged(ctx, pool, proxies[0], proxies[1], hedgeDelay, network, addr, client)
+	} else {
+		conn, err = d.dialVia(ctx, pool, proxyCfg, network, addr, client)
+	}
 	if err != nil {
 		metrics.SocksRequestsFailedTotal.Inc()
 		atomic.AddUint64(&d.commonMetrics.TotalFailed, 1) 
+		return nil, nil, err
+	}
+	metrics.SocksRequestsSuccessTotal.Inc()
+	atomic.AddUint64(&d.commonMetrics.TotalSuccess, 1)
+	span.SetAttributes(attribute.String("proxy.address", proxyCfg.Address))
+	return conn, proxyCfg, nil
+}
+
+// ErrProxyDialFailed matches every ProxyDialError with errors.Is
+var ErrProxyDialFailed = errors.New("dial through upstream proxy failed")
+
+// ProxyDialError is returned when connecting through the upstream proxy at Addr
+// fails. Cause is the underlying error, which may be a reply of the upstream
+// about the destination.
+type ProxyDialError struct {
+	Addr  string
+	Cause error
+}
+
+func (e *ProxyDialError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Addr, e.Cause)
+}
 
-		metrics.UpstreamProxyFailTotal.WithLabelValues(proxyCfg.Address).Inc()
+func (e *ProxyDialError) Unwrap() error { return e.Cause }
+
+// Is reports whether target is ErrProxyDialFailed
+func (e *ProxyDialError) Is(target error) bool { return target == ErrProxyDialFailed }
+
+// dialVia connects to addr through proxyCfg of pool and records the outcome against the proxy.
+// Cancellation of ctx is not counted as a proxy failure.
+func (d *Dialer) dialVia(ctx context.Context, pool ProxySelector, proxyCfg *proxypool.ProxyConfig, network, addr string, client Client) (conn net.Conn, err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "dialer.upstream_dial", trace.WithAttributes(
+		attribute.String("proxy.address", proxyCfg.Address),
+		attribute.String("proxy.id", proxyCfg.ID),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	creds := d.upstreamAuth(proxyCfg, client)
+	upstreamDialer, err := proxyCfg.UpstreamDialerWithAuth(network, creds)
+	if err != nil {
+		metrics.UpstreamProxyFailTotal.WithLabelValues(metrics.ProxyLabel(proxyCfg.Address)).Inc()
 		atomic.AddUint32(&proxyCfg.FailCount, 1) 
 
-		log.Printf("Proxy %s: failed to create SOCKS5 dialer for client request to %s: %v", proxyCfg.Address, addr, err)
-		return nil, err
+		log.Printf("Proxy %s: failed to create SOCKS5 dialer for client request to %s: %v%s", proxyCfg.Address, d.logDest(client.Username, addr), d.logErr(client.Username, addr, err), logSuffix(ctx))
+		return nil, &ProxyDialError{Addr: proxyCfg.Address, Cause: err}
 	}
 
-	dialOpTimeout := 15 * time.Second
-	dialProxyCtx, dialProxyCancel := context.WithTimeout(ctx, dialOpTimeout)
+	tags := proxyTags(proxyCfg)
+	start := time.Now()
+	dialProxyCtx, dialProxyCancel := context.WithTimeout(ctx, d.dialTimeoutFor(tags))
 	defer dialProxyCancel()
 
 	connCh := make(chan net.Conn, 1)
 	errCh := make(chan error, 1)
 
 	go func() {
-		c, e := proxypool.DialContext(dialProxyCtx, upstreamDialer, network, addr)
+		dialAddr := upstreamDestination(dialProxyCtx, proxyCfg, addr)
+		if network == "tcp" {
+			// a prewarmed connection skips the greeting and authentication round trips
+			if creds == nil {
+				connectStart := time.Now()
+				if c, ok, e := pool.DialWarm(dialProxyCtx, proxyCfg, dialAddr); ok {
+					if e != nil {
+						d.debugf(ctx, client.Username, "proxy %s: CONNECT to %s over a prewarmed connection failed after %v: %v", proxyCfg.Address, d.logDest(client.Username, dialAddr), time.Since(connectStart), d.logErr(client.Username, dialAddr, e))
+						errCh <- e
+						return
+					}
+					d.debugf(ctx, client.Username, "proxy %s: CONNECT to %s over a prewarmed connection took %v", proxyCfg.Address, d.logDest(client.Username, dialAddr), time.Since(connectStart))
+					metrics.ObserveConnectPhase(metrics.PhaseTargetConnect, time.Since(connectStart), SessionIDFromContext(ctx))
+					connCh <- c
+					return
+				}
+			}
+			c, timing, e := proxyCfg.DialTimed(dialProxyCtx, creds, dialAddr)
+			if timing.Handshake > 0 {
+				metrics.ObserveConnectPhase(metrics.PhaseUpstreamHandshake, timing.Handshake, SessionIDFromContext(ctx))
+			}
+			if e != nil {
+				d.debugf(ctx, client.Username, "proxy %s: dial to %s failed (upstream handshake %v): %v", proxyCfg.Address, d.logDest(client.Username, dialAddr), timing.Handshake, d.logErr(client.Username, dialAddr, e))
+				errCh <- e
+				return
+			}
+			d.debugf(ctx, client.Username, "proxy %s: upstream handshake took %v, CONNECT to %s %v", proxyCfg.Address, timing.Handshake, d.logDest(client.Username, dialAddr), timing.Connect)
+			metrics.ObserveConnectPhase(metrics.PhaseTargetConnect, timing.Connect, SessionIDFromContext(ctx))
+			connCh <- c
+			return
+		}
+		c, e := proxypool.DialContext(dialProxyCtx, upstreamDialer, network, dialAddr)
 		if e != nil {
 			errCh <- e
 			return
@@ -72,32 +378,238 @@ func (d *Dialer) Dial(ctx context.Context, network, addr string) (net.Conn, erro
 
 	select {
 	case c := <-connCh:
-		metrics.SocksRequestsSuccessTotal.Inc()
-		atomic.AddUint64(&d.commonMetrics.TotalSuccess, 1)
-
-		metrics.UpstreamProxySuccessTotal.WithLabelValues(proxyCfg.Address).Inc()
+		metrics.UpstreamProxySuccessTotal.WithLabelValues(metrics.ProxyLabel(proxyCfg.Address)).Inc()
+		metrics.ObserveTagDial(tags, true, time.Since(start), SessionIDFromContext(ctx))
 		atomic.AddUint32(&proxyCfg.SuccessCount, 1)
+		d.recordDestination(ctx, proxyCfg, addr, true)
 
-		log.Printf("Successfully connected to %s via proxy %s", addr, proxyCfg.Address)
+		if err := d.upstreamTCP.apply(c); err != nil {
+			log.Printf("Proxy %s: failed to apply TCP options: %v%s", proxyCfg.Address, err, logSuffix(ctx))
+		}
+		log.Printf("Successfully connected to %s via proxy %s%s", d.logDest(client.Username, addr), proxyCfg.Address, logSuffix(ctx))
 		return c, nil
 	case e := <-errCh:
-		metrics.SocksRequestsFailedTotal.Inc()
-		atomic.AddUint64(&d.commonMetrics.TotalFailed, 1) 
-
-		metrics.UpstreamProxyFailTotal.WithLabelValues(proxyCfg.Address).Inc()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ctx.Err()
+		}
+		metrics.UpstreamProxyFailTotal.WithLabelValues(metrics.ProxyLabel(proxyCfg.Address)).Inc()
+		metrics.ObserveTagDial(tags, false, time.Since(start), SessionIDFromContext(ctx))
 		atomic.AddUint32(&proxyCfg.FailCount, 1) 
+		d.recordDestination(ctx, proxyCfg, addr, false)
 
-		log.Printf("Failed to connect to %s via proxy %s: %v (dialProxyCtx.Err: %v, original_ctx.Err: %v)", addr, proxyCfg.Address, e, dialProxyCtx.Err(), ctx.Err())
-		return nil, e
+		log.Printf("Failed to connect to %s via proxy %s: %v (dialProxyCtx.Err: %v, original_ctx.Err: %v)%s", d.logDest(client.Username, addr), proxyCfg.Address, d.logErr(client.Username, addr, e), dialProxyCtx.Err(), ctx.Err(), logSuffix(ctx))
+		return nil, &ProxyDialError{Addr: proxyCfg.Address, Cause: e}
 	case <-dialProxyCtx.Done():
-		metrics.SocksRequestsFailedTotal.Inc()
-		atomic.AddUint64(&d.commonMetrics.TotalFailed, 1) 
-
-		metrics.UpstreamProxyFailTotal.WithLabelValues(proxyCfg.Address).Inc()
+		// the dial goroutine may still deliver a connection nobody will use
+		go func() {
+			select {
+			case c := <-connCh:
+				c.Close()
+			case <-errCh:
+			}
+		}()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ctx.Err()
+		}
+		metrics.UpstreamProxyFailTotal.WithLabelValues(metrics.ProxyLabel(proxyCfg.Address)).Inc()
+		metrics.ObserveTagDial(tags, false, time.Since(start), SessionIDFromContext(ctx))
 		atomic.AddUint32(&proxyCfg.FailCount, 1) 
-		
-		err := errors.New("dialing " + addr + " via proxy " + proxyCfg.Address + " timed out or was cancelled: " + dialProxyCtx.Err().Error())
-		log.Print(err.Error())
-		return nil, err
+		d.recordDestination(ctx, proxyCfg, addr, false)
+
+		log.Printf("Dialing %s via proxy %s timed out or was cancelled: %v%s", d.logDest(client.Username, addr), proxyCfg.Address, dialProxyCtx.Err(), logSuffix(ctx))
+		return nil, &ProxyDialError{Addr: proxyCfg.Address, Cause: fmt.Errorf("dialing %s timed out or was cancelled: %w", d.logDest(client.Username, addr), dialProxyCtx.Err())}
+	}
+}
+
+// dialHedged dials addr through primary and, if it has not connected after delay
+// (or fails sooner), also through backup. The first connection wins and the other
+// attempt is cancelled.
+func (d *Dialer) dialHedged(ctx context.Context, pool ProxySelector, primary, backup *proxypool.ProxyConfig, delay time.Duration, network, addr string, client Client) (net.Conn, *proxypool.ProxyConfig, error) {
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn  net.Conn
+		proxy *proxypool.ProxyConfig
+		err   error
+	}
+	results := make(chan result, 2)
+	start := func(proxyCfg *proxypool.ProxyConfig) {
+		go func() {
+			c, err := d.dialVia(hedgeCtx, pool, proxyCfg, network, addr, client)
+			results <- result{conn: c, proxy: proxyCfg, err: err}
+		}()
+	}
+
+	start(primary)
+	pending, backupStarted := 1, false
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !backupStarted {
+				backupStarted = true
+				pending++
+				start(backup)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if r.proxy == backup {
+					d.hedgeWins.Add(1)
+				}
+				if pending > 0 {
+					// the loser is cancelled; close its connection if it raced us anyway
+					go func() {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}()
+				}
+				return r.conn, r.proxy, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !backupStarted {
+				backupStarted = true
+				pending++
+				start(backup)
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
+
+// proxyTags returns the current tags of proxyCfg
+func proxyTags(proxyCfg *proxypool.ProxyConfig) []string {
+	proxyCfg.Mu.RLock()
+	defer proxyCfg.Mu.RUnlock()
+	return proxyCfg.Tags
+}
+
+// selectProxies picks the upstream proxy to use for client's connection to host and
+// returns the pool it belongs to. When the user's route goes through a hedged tag it
+// returns the two fastest eligible proxies and the hedge delay. Proxies blacklisted
+// for host are avoided. tried lists the proxies earlier attempts of a redialed
+// request used; they are avoided too, and the session limit is not checked
+// again since the request already holds its session.
+func (d *Dialer) selectProxies(ctx context.Context, client Client, host string, tried []string) (ProxySelector, []*proxypool.ProxyConfig, time.Duration, error) {
+	username := client.Username
+	avoid := d.avoidFor(host)
+	if len(tried) > 0 {
+		avoid = avoidTried(avoid, tried)
+	}
+	route := auth.Route{Rule: auth.RuleAllowAll, AllowAll: true}
+	if d.policy != nil {
+		var err error
+		if route, err = d.policy.ResolveRoute(username); err != nil {
+			d.debugf(ctx, username, "route %s denies access: %v", route.Rule, err)
+			return nil, nil, 0, err
+		}
 	}
-}
\ No newline at end of file
+	if d.debugging(username) {
+		redial := ""
+		if len(tried) > 0 {
+			redial = fmt.Sprintf(", redialing without %v", tried)
+		}
+		d.debugf(ctx, username, "route %s: tags %v, allow all %t, pinned proxy %q, rotate %t, pool %q%s",
+			route.Rule, route.Tags, route.AllowAll, route.PinnedProxy, route.Rotate, route.Pool, redial)
+	}
+	if route.MaxSessions > 0 && d.sessions != nil && len(tried) == 0 {
+		if n := d.sessions.CountUser(username); n >= route.MaxSessions {
+			return nil, nil, 0, fmt.Errorf("%w: user '%s' has %d of %d sessions open", ErrSessionLimit, username, n, route.MaxSessions)
+		}
+	}
+	pool, err := d.poolFor(route, client)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if route.PinnedProxy != "" {
+		proxyCfg, err := pinnedProxy(pool, route.PinnedProxy)
+		if err == nil {
+			return pool, []*proxypool.ProxyConfig{proxyCfg}, 0, nil
+		}
+		if !route.Fallback {
+			return nil, nil, 0, err
+		}
+		log.Printf("User '%s': %v, falling back to tag routing", username, err)
+	}
+	if route.Rotate {
+		proxyCfg, err := pool.GetRotatingProxy(username, routeTags(route), avoid)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return pool, []*proxypool.ProxyConfig{proxyCfg}, 0, nil
+	}
+	regionTag := d.regionTagFor(host)
+	if delay, ok := d.hedgeDelay(route); ok {
+		if regionTag != "" {
+			if proxies, ok := d.selectNear(pool, route.Tags, 2, regionTag, avoid); ok {
+				return pool, proxies, delay, nil
+			}
+		}
+		proxies, err := pool.GetFastestActiveProxiesAvoiding(route.Tags, 2, avoid)
+		return pool, proxies, delay, err
+	}
+	if regionTag != "" {
+		if proxies, ok := d.selectNear(pool, routeTags(route), 0, regionTag, avoid); ok {
+			d.debugf(ctx, username, "destination is in %s, selected a proxy carrying that tag", regionTag)
+			return pool, proxies, 0, nil
+		}
+	}
+	proxyCfg, err := pool.SelectProxy(routeTags(route), avoid)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return pool, []*proxypool.ProxyConfig{proxyCfg}, 0, nil
+}
+
+// ErrSessionLimit is returned when a user already has as many sessions open as
+// its session limit allows
+var ErrSessionLimit = errors.New("session limit reached")
+
+// ErrPinnedProxyUnavailable is returned when a user's pinned proxy is unknown,
+// inactive or disabled and the user does not fall back to tag routing
+var ErrPinnedProxyUnavailable = errors.New("pinned upstream proxy is unavailable")
+
+// pinnedProxy returns the proxy of pool with address or ID ref if it may be dialed
+func pinnedProxy(pool ProxySelector, ref string) (*proxypool.ProxyConfig, error) {
+	proxyCfg, err := pool.FindProxy(ref)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s is not in the pool", ErrPinnedProxyUnavailable, ref)
+	}
+	proxyCfg.Mu.RLock()
+	usable := proxyCfg.IsActive && !proxyCfg.Disabled
+	proxyCfg.Mu.RUnlock()
+	if !usable {
+		return nil, fmt.Errorf("%w: %s is inactive or disabled", ErrPinnedProxyUnavailable, ref)
+	}
+	return proxyCfg, nil
+}
+
+// hedgeDelay returns the shortest hedge delay configured for any of route's tags
+func (d *Dialer) hedgeDelay(route auth.Route) (time.Duration, bool) {
+	if route.AllowAll {
+		return 0, false
+	}
+	var delay time.Duration
+	found := false
+	for _, tag := range route.Tags {
+		if dl, ok := d.hedging[tag]; ok && (!found || dl < delay) {
+			delay, found = dl, true
+		}
+	}
+	return delay, found
+}
+
+// routeTags returns the tags to select by for route, nil when any proxy may be used
+func routeTags(route auth.Route) []string {
+	if route.AllowAll {
+		return nil
+	}
+	return route.Tags
+}
@@ -0,0 +1,677 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/geoip"
+	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/socks4"
+)
+
+// fakePool is a ProxySelector over a fixed list of proxies, selected in order
+type fakePool struct {
+	proxies []*proxypool.ProxyConfig
+}
+
+func newFakePool(proxies ...*proxypool.ProxyConfig) *fakePool {
+	return &fakePool{proxies: proxies}
+}
+
+// eligible returns the proxies carrying one of tags (any proxy for nil tags)
+// that avoid does not skip
+func (p *fakePool) eligible(tags []string, avoid func(*proxypool.ProxyConfig) bool) []*proxypool.ProxyConfig {
+	var result []*proxypool.ProxyConfig
+	for _, proxyCfg := range p.proxies {
+		if tags != nil && !proxypool.HasAnyTag(proxyCfg.Tags, tags) {
+			continue
+		}
+		if avoid != nil && avoid(proxyCfg) {
+			continue
+		}
+		result = append(result, proxyCfg)
+	}
+	return result
+}
+
+func (p *fakePool) SelectProxy(tags []string, avoid func(*proxypool.ProxyConfig) bool) (*proxypool.ProxyConfig, error) {
+	proxies, err := p.GetFastestActiveProxiesAvoiding(tags, 1, avoid)
+	if err != nil {
+		return nil, err
+	}
+	return proxies[0], nil
+}
+
+func (p *fakePool) GetRotatingProxy(key string, tags []string, avoid func(*proxypool.ProxyConfig) bool) (*proxypool.ProxyConfig, error) {
+	return p.SelectProxy(tags, avoid)
+}
+
+func (p *fakePool) GetFastestActiveProxiesAvoiding(tags []string, n int, avoid func(*proxypool.ProxyConfig) bool) ([]*proxypool.ProxyConfig, error) {
+	proxies := p.eligible(tags, avoid)
+	if len(proxies) == 0 {
+		// like the real pool, fall back to avoided proxies
+		proxies = p.eligible(tags, nil)
+	}
+	if len(proxies) == 0 {
+		return nil, proxypool.ErrNoActiveProxies
+	}
+	return proxies[:min(n, len(proxies))], nil
+}
+
+func (p *fakePool) FindProxy(ref string) (*proxypool.ProxyConfig, error) {
+	for _, proxyCfg := range p.proxies {
+		if proxyCfg.Address == ref || proxyCfg.ID == ref {
+			return proxyCfg, nil
+		}
+	}
+	return nil, errors.New("proxy not found")
+}
+
+func (p *fakePool) DialWarm(ctx context.Context, proxyCfg *proxypool.ProxyConfig, addr string) (net.Conn, bool, error) {
+	return nil, false, nil
+}
+
+func (p *fakePool) GetProxiesSnapshot() []proxypool.ProxySnapshot {
+	return nil
+}
+
+// fixedPolicy routes every user by route
+type fixedPolicy struct {
+	route auth.Route
+}
+
+func (p fixedPolicy) ResolveRoute(username string) (auth.Route, error) {
+	return p.route, nil
+}
+
+// upstreamMode is how a fakeUpstream treats a client
+type upstreamMode int
+
+const (
+	upstreamEcho   upstreamMode = iota // accept the CONNECT and echo the client's bytes
+	upstreamRefuse                     // answer the CONNECT with "connection refused"
+	upstreamStall                      // never answer the greeting
+	upstreamHangUp                     // accept the CONNECT and close right away
+)
+
+// fakeUpstream is an in-process SOCKS5 proxy without authentication
+type fakeUpstream struct {
+	ln       net.Listener
+	mode     upstreamMode
+	connects atomic.Int32 // CONNECT requests received
+}
+
+func startUpstream(t *testing.T, mode upstreamMode) *fakeUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	u := &fakeUpstream{ln: ln, mode: mode}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+// proxy returns an active ProxyConfig for the upstream
+func (u *fakeUpstream) proxy(tags ...string) *proxypool.ProxyConfig {
+	return &proxypool.ProxyConfig{Address: u.ln.Addr().String(), Tags: tags, IsActive: true}
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	if u.mode == upstreamStall {
+		io.Copy(io.Discard, conn)
+		return
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+
+	// VER CMD RSV ATYP, then the address and the port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	addrLen := map[byte]int{1: net.IPv4len, 4: net.IPv6len}[request[3]]
+	if request[3] == 3 {
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		addrLen = int(size[0])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return
+	}
+	u.connects.Add(1)
+
+	reply := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], 1080)
+	if u.mode == upstreamRefuse {
+		reply[1] = 5
+	}
+	conn.Write(reply)
+	if u.mode == upstreamEcho {
+		io.Copy(conn, conn)
+	}
+}
+
+// counterValue returns the current value of c
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// expectEcho checks that conn is relayed to an echoing upstream
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read = %q, %v; want the echo", buf, err)
+	}
+}
+
+func TestDialUpstreamConnectsThroughProxy(t *testing.T) {
+	upstream := startUpstream(t, upstreamEcho)
+	proxyCfg := upstream.proxy()
+	m := &Metrics{}
+	d := New(newFakePool(proxyCfg), m, nil)
+	success := metrics.UpstreamProxySuccessTotal.WithLabelValues(metrics.ProxyLabel(proxyCfg.Address))
+	before := counterValue(t, success)
+
+	conn, used, err := d.DialUpstream(context.Background(), "tcp", "example.com:443", Client{Username: "alice"})
+	if err != nil {
+		t.Fatalf("DialUpstream: %v", err)
+	}
+	defer conn.Close()
+	if used != proxyCfg {
+		t.Fatalf("dialed via %s, want %s", used.Address, proxyCfg.Address)
+	}
+	expectEcho(t, conn)
+
+	if m.TotalRequests != 1 || m.TotalSuccess != 1 || m.TotalFailed != 0 {
+		t.Errorf("metrics = %+v, want one successful request", *m)
+	}
+	if proxyCfg.SuccessCount != 1 || proxyCfg.FailCount != 0 {
+		t.Errorf("proxy counts = %d/%d, want 1 success", proxyCfg.SuccessCount, proxyCfg.FailCount)
+	}
+	if got := counterValue(t, success) - before; got != 1 {
+		t.Errorf("upstream success counter grew by %v, want 1", got)
+	}
+	if n := d.PendingDials(); n != 0 {
+		t.Errorf("%d dials still pending", n)
+	}
+}
+
+func TestDialUpstreamReportsRefusedDestination(t *testing.T) {
+	upstream := startUpstream(t, upstreamRefuse)
+	proxyCfg := upstream.proxy()
+	m := &Metrics{}
+	d := New(newFakePool(proxyCfg), m, nil)
+	failures := metrics.UpstreamProxyFailTotal.WithLabelValues(metrics.ProxyLabel(proxyCfg.Address))
+	before := counterValue(t, failures)
+
+	_, _, err := d.DialUpstream(context.Background(), "tcp", "example.com:443", Client{})
+	var dialErr *ProxyDialError
+	if !errors.As(err, &dialErr) || dialErr.Addr != proxyCfg.Address {
+		t.Fatalf("DialUpstream = %v, want a ProxyDialError of %s", err, proxyCfg.Address)
+	}
+	if m.TotalFailed != 1 || m.TotalSuccess != 0 {
+		t.Errorf("metrics = %+v, want one failed request", *m)
+	}
+	if proxyCfg.FailCount != 1 {
+		t.Errorf("proxy fail count = %d, want 1", proxyCfg.FailCount)
+	}
+	if got := counterValue(t, failures) - before; got != 1 {
+		t.Errorf("upstream fail counter grew by %v, want 1", got)
+	}
+}
+
+func TestDialUpstreamTimesOut(t *testing.T) {
+	upstream := startUpstream(t, upstreamStall)
+	proxyCfg := upstream.proxy("slow")
+	d := New(newFakePool(proxyCfg), &Metrics{}, nil)
+	d.SetDialTimeouts(time.Minute, []TagTimeout{{Tag: "slow", Timeout: 100 * time.Millisecond}})
+
+	start := time.Now()
+	_, _, err := d.DialUpstream(context.Background(), "tcp", "example.com:443", Client{})
+	// the deadline ends the handshake with either a context or an I/O timeout
+	var netErr net.Error
+	if !errors.Is(err, ErrProxyDialFailed) || !(errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Fatalf("DialUpstream = %v, want a timed out proxy dial", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("DialUpstream returned after %v, want close to the tag's 100ms timeout", elapsed)
+	}
+	if proxyCfg.FailCount != 1 {
+		t.Errorf("proxy fail count = %d, want 1", proxyCfg.FailCount)
+	}
+}
+
+func TestDialUpstreamCancelledIsNotAProxyFailure(t *testing.T) {
+	upstream := startUpstream(t, upstreamStall)
+	proxyCfg := upstream.proxy()
+	d := New(newFakePool(proxyCfg), &Metrics{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, _, err := d.DialUpstream(ctx, "tcp", "example.com:443", Client{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialUpstream = %v, want context canceled", err)
+	}
+	if proxyCfg.FailCount != 0 {
+		t.Errorf("proxy fail count = %d, want cancellation not counted", proxyCfg.FailCount)
+	}
+}
+
+func TestHedgedDialFailsOverToBackup(t *testing.T) {
+	primary, backup := startUpstream(t, upstreamRefuse), startUpstream(t, upstreamEcho)
+	primaryCfg, backupCfg := primary.proxy("hedged"), backup.proxy("hedged")
+	d := New(newFakePool(primaryCfg, backupCfg), &Metrics{}, nil)
+	d.SetTagPolicy(fixedPolicy{route: auth.Route{Tags: []string{"hedged"}}})
+	// the backup is dialed as soon as the primary fails, long before the delay
+	d.SetHedging(map[string]time.Duration{"hedged": time.Minute})
+
+	conn, used, err := d.DialUpstream(context.Background(), "tcp", "example.com:443", Client{Username: "alice"})
+	if err != nil {
+		t.Fatalf("DialUpstream: %v", err)
+	}
+	defer conn.Close()
+	if used != backupCfg {
+		t.Fatalf("dialed via %s, want the backup %s", used.Address, backupCfg.Address)
+	}
+	expectEcho(t, conn)
+	if d.HedgeWins() != 1 {
+		t.Errorf("hedge wins = %d, want 1", d.HedgeWins())
+	}
+	if primaryCfg.FailCount != 1 || backupCfg.SuccessCount != 1 {
+		t.Errorf("primary fails = %d, backup successes = %d, want 1 each", primaryCfg.FailCount, backupCfg.SuccessCount)
+	}
+}
+
+func TestRedialReplaysToAnotherProxy(t *testing.T) {
+	first, second := startUpstream(t, upstreamHangUp), startUpstream(t, upstreamEcho)
+	firstCfg, secondCfg := first.proxy(), second.proxy()
+	d := New(newFakePool(firstCfg, secondCfg), &Metrics{}, nil)
+	d.SetRedial(RedialConfig{MaxAttempts: 2, Window: 5 * time.Second, BufferBytes: 1024})
+
+	ctx := context.Background()
+	upstream, used, err := d.DialUpstream(ctx, "tcp", "example.com:443", Client{})
+	if err != nil {
+		t.Fatalf("DialUpstream: %v", err)
+	}
+	if used != firstCfg {
+		t.Fatalf("dialed via %s, want %s", used.Address, firstCfg.Address)
+	}
+	conn := d.newRedialConn(ctx, upstream, used, "example.com:443", Client{})
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	if n := second.connects.Load(); n != 1 {
+		t.Errorf("second proxy got %d CONNECTs, want 1", n)
+	}
+	if !slices.Equal(conn.tried, []string{firstCfg.Address, secondCfg.Address}) {
+		t.Errorf("tried = %v, want both proxies in order", conn.tried)
+	}
+	if firstCfg.FailCount != 1 {
+		t.Errorf("first proxy fail count = %d, want 1", firstCfg.FailCount)
+	}
+}
+
+func TestSelectProxiesUnknownPool(t *testing.T) {
+	d := New(newFakePool(), &Metrics{}, nil)
+	d.SetTagPolicy(fixedPolicy{route: auth.Route{AllowAll: true, Pool: "missing"}})
+	if _, _, err := d.DialUpstream(context.Background(), "tcp", "example.com:443", Client{}); !errors.Is(err, ErrUnknownPool) {
+		t.Fatalf("DialUpstream = %v, want ErrUnknownPool", err)
+	}
+}
+
+func TestUserDebugLogsOnlyThatUserUntilItExpires(t *testing.T) {
+	upstream := startUpstream(t, upstreamEcho)
+	d := New(newFakePool(upstream.proxy()), &Metrics{}, nil)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	d.EnableUserDebug("alice", 200*time.Millisecond)
+	for _, username := range []string{"alice", "bob"} {
+		conn, _, err := d.DialUpstream(context.Background(), "tcp", "example.com:443", Client{Username: username})
+		if err != nil {
+			t.Fatalf("DialUpstream as %s: %v", username, err)
+		}
+		conn.Close()
+	}
+	out := buf.String()
+	for _, want := range []string{"Debug [user alice] route", "Debug [user alice] selected proxy", "Debug [user alice] proxy " + upstream.ln.Addr().String() + ": upstream handshake took"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Debug [user bob]") {
+		t.Errorf("bob's connection was logged in detail:\n%s", out)
+	}
+	if users := d.DebugUsers(); len(users) != 1 || users[0].Username != "alice" {
+		t.Fatalf("DebugUsers = %v, want alice", users)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.DebugUsers()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("debug mode of alice did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d.DisableUserDebug("alice") {
+		t.Errorf("DisableUserDebug after expiry reported debug mode on")
+	}
+}
+
+func TestLogLinesCarryTheSessionID(t *testing.T) {
+	upstream := startUpstream(t, upstreamEcho)
+	d := New(newFakePool(upstream.proxy()), &Metrics{}, nil)
+	d.EnableUserDebug("alice", time.Minute)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx := WithSessionID(context.Background(), "0b7e5c1a")
+	conn, _, err := d.DialUpstream(ctx, "tcp", "example.com:443", Client{Username: "alice"})
+	if err != nil {
+		t.Fatalf("DialUpstream: %v", err)
+	}
+	conn.Close()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected debug and connection lines, got:\n%s", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.HasSuffix(line, " session=0b7e5c1a") {
+			t.Errorf("log line without the session ID: %s", line)
+		}
+	}
+}
+
+func TestDestinationRedactionAppliesToListedUsers(t *testing.T) {
+	upstream := startUpstream(t, upstreamEcho)
+	d := New(newFakePool(upstream.proxy()), &Metrics{}, nil)
+	d.SetDestinationRedaction(DestinationRedaction{Mode: RedactTruncate, Users: []string{"alice"}})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, username := range []string{"alice", "bob"} {
+		conn, _, err := d.DialUpstream(context.Background(), "tcp", username+".mail.example.com:443", Client{Username: username})
+		if err != nil {
+			t.Fatalf("DialUpstream as %s: %v", username, err)
+		}
+		conn.Close()
+	}
+	out := buf.String()
+	if strings.Contains(out, "alice.mail.example.com") || !strings.Contains(out, "Successfully connected to *.example.com:443") {
+		t.Errorf("alice's destination was not truncated:\n%s", out)
+	}
+	if !strings.Contains(out, "Successfully connected to bob.mail.example.com:443") {
+		t.Errorf("bob's destination was redacted:\n%s", out)
+	}
+}
+
+func TestLogDestModes(t *testing.T) {
+	d := New(newFakePool(), &Metrics{}, nil)
+	d.SetDestinationRedaction(DestinationRedaction{Mode: RedactTruncate})
+	for addr, want := range map[string]string{
+		"www.example.com:443":   "*.example.com:443",
+		"example.com:80":        "example.com:80",
+		"203.0.113.77:443":      "203.0.113.0/24:443",
+		"[2001:db8:1:2::1]:443": "[2001:db8:1::/48]:443",
+	} {
+		if got := d.logDest("alice", addr); got != want {
+			t.Errorf("truncated %s = %s, want %s", addr, got, want)
+		}
+	}
+
+	d.SetDestinationRedaction(DestinationRedaction{Mode: RedactHash, Salt: "pepper"})
+	hashed := d.logDest("alice", "Example.com:443")
+	if !strings.HasPrefix(hashed, "h-") || !strings.HasSuffix(hashed, ":443") || strings.Contains(hashed, "example") {
+		t.Errorf("hashed = %s, want h-<hash>:443", hashed)
+	}
+	if again := d.logDest("bob", "example.com:443"); again != hashed {
+		t.Errorf("hash of the same host differs: %s vs %s", again, hashed)
+	}
+	d.SetDestinationRedaction(DestinationRedaction{Mode: RedactHash, Salt: "salt"})
+	if other := d.logDest("alice", "example.com:443"); other == hashed {
+		t.Errorf("hash does not depend on the salt")
+	}
+	if msg := d.logErr("alice", "example.com:443", errors.New("socks connect tcp proxy->example.com:443: refused")); strings.Contains(msg, "example.com") {
+		t.Errorf("error message keeps the destination: %s", msg)
+	}
+}
+
+// newTestTracker returns a destination tracker blacklisting a pair for five
+// minutes after half of at least four dials in a minute failed
+func newTestTracker() *destinationTracker {
+	d := New(newFakePool(), &Metrics{}, nil)
+	d.SetDestinationBlacklist(DestinationBlacklist{Window: time.Minute, MinAttempts: 4, FailureRatio: 0.5, Duration: 5 * time.Minute})
+	return d.destinations
+}
+
+func TestDestinationTrackerThresholds(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		outcomes []bool // true for a successful dial, one second apart
+		want     []int  // indexes of the outcomes that blacklist the pair
+	}{
+		{"below min attempts", []bool{false, false, false}, nil},
+		{"min attempts all failed", []bool{false, false, false, false}, []int{3}},
+		{"below the failure ratio", []bool{true, true, true, false, false}, nil},
+		{"at the failure ratio", []bool{true, true, true, false, false, false}, []int{5}},
+		{"successes never blacklist", []bool{true, true, true, true, true}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := newTestTracker()
+			key := destKey{proxy: "10.0.0.1:1080", host: "example.com"}
+			var got []int
+			for i, ok := range tc.outcomes {
+				if tracker.record(key, ok, start.Add(time.Duration(i)*time.Second)) {
+					got = append(got, i)
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("blacklisted after outcomes %v, want %v", got, tc.want)
+			}
+			now := start.Add(time.Duration(len(tc.outcomes)) * time.Second)
+			if blocked := tracker.isBlocked(key.proxy, key.host, now); blocked != (tc.want != nil) {
+				t.Errorf("isBlocked = %v, want %v", blocked, tc.want != nil)
+			}
+			if tracker.isBlocked("10.0.0.2:1080", key.host, now) || tracker.isBlocked(key.proxy, "example.org", now) {
+				t.Error("another proxy or destination is blocked")
+			}
+		})
+	}
+}
+
+func TestDestinationTrackerWindowReset(t *testing.T) {
+	tracker := newTestTracker()
+	key := destKey{proxy: "10.0.0.1:1080", host: "example.com"}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		tracker.record(key, false, start.Add(time.Duration(i)*time.Second))
+	}
+	// the fourth failure falls into a new window, which starts counting again
+	later := start.Add(time.Minute + time.Second)
+	if tracker.record(key, false, later) {
+		t.Fatal("failures of an earlier window counted toward the blacklisting")
+	}
+	for i := 1; i <= 3; i++ {
+		if blocked := tracker.record(key, false, later.Add(time.Duration(i)*time.Second)); blocked != (i == 3) {
+			t.Fatalf("failure %d of the new window: blacklisted = %v", i+1, blocked)
+		}
+	}
+	list := tracker.blacklisted(later.Add(4 * time.Second))
+	if len(list) != 1 || list[0].Attempts != 4 || list[0].Failures != 4 {
+		t.Fatalf("blacklisted = %+v, want the pair with 4 of 4 failed attempts", list)
+	}
+}
+
+func TestDestinationTrackerExpiry(t *testing.T) {
+	tracker := newTestTracker()
+	key := destKey{proxy: "10.0.0.1:1080", host: "example.com"}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		tracker.record(key, false, start)
+	}
+	if !tracker.hasBlocks(key.host, start) || !tracker.isBlocked(key.proxy, key.host, start.Add(5*time.Minute-time.Second)) {
+		t.Fatal("pair not blacklisted for the configured duration")
+	}
+	expired := start.Add(5 * time.Minute)
+	if tracker.hasBlocks(key.host, expired) || tracker.isBlocked(key.proxy, key.host, expired) {
+		t.Fatal("blacklisting outlived its duration")
+	}
+	if list := tracker.blacklisted(expired); len(list) != 0 {
+		t.Fatalf("blacklisted = %+v after expiry, want none", list)
+	}
+
+	// the next dial sweeps the expired pair
+	tracker.record(destKey{proxy: "10.0.0.2:1080", host: "example.org"}, true, expired)
+	tracker.mu.Lock()
+	_, kept := tracker.stats[key]
+	_, keptHost := tracker.hostUntil[key.host]
+	tracker.mu.Unlock()
+	if kept || keptHost {
+		t.Errorf("expired pair kept: stats %v, host %v", kept, keptHost)
+	}
+}
+
+func TestGeoProximityPrefersProxiesInTheDestinationRegion(t *testing.T) {
+	eu := &proxypool.ProxyConfig{Address: "10.0.0.1:1080", Tags: []string{"region:eu"}, IsActive: true}
+	us := &proxypool.ProxyConfig{Address: "10.0.0.2:1080", Tags: []string{"region:us"}, IsActive: true}
+	db, err := geoip.Parse(strings.NewReader("# test networks\n203.0.113.0/24 US\n198.51.100.0/24,eu\n"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	d := New(newFakePool(eu, us), &Metrics{}, nil)
+	d.SetGeoProximity(GeoProximity{DB: db, TagPrefix: "region:", CacheTTL: time.Minute, ResolveTimeout: time.Second, MaxCacheEntries: 10})
+
+	for host, want := range map[string]*proxypool.ProxyConfig{
+		"203.0.113.9":  us,
+		"198.51.100.1": eu,
+		"192.0.2.1":    eu, // unknown region: the usual first pick
+	} {
+		_, proxies, _, err := d.selectProxies(context.Background(), Client{}, host, nil)
+		if err != nil {
+			t.Fatalf("selectProxies(%s): %v", host, err)
+		}
+		if proxies[0] != want {
+			t.Errorf("selected %s for %s, want %s", proxies[0].Address, host, want.Address)
+		}
+	}
+
+	// a blacklisted proxy in the region is not preferred over the usual pick
+	_, proxies, _, err := d.selectProxies(context.Background(), Client{}, "203.0.113.9", []string{us.Address})
+	if err != nil || proxies[0] != eu {
+		t.Errorf("selected %v, %v with the near proxy avoided, want %s", proxies, err, eu.Address)
+	}
+}
+
+// denyPolicy denies every user like the deny default behavior
+type denyPolicy struct{}
+
+func (denyPolicy) ResolveRoute(username string) (auth.Route, error) {
+	return auth.Route{Rule: auth.RuleDefaultDeny}, fmt.Errorf("%w: %w", auth.ErrNoProxyAccess, auth.ErrTagNotAllowed)
+}
+
+// tcpPair returns the two ends of a loopback TCP connection
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return client, server
+}
+
+func TestTarpitHoldsDeniedConnections(t *testing.T) {
+	for _, mode := range []string{TarpitDrip, TarpitReset} {
+		t.Run(mode, func(t *testing.T) {
+			d := New(newFakePool(), &Metrics{}, nil)
+			d.SetTagPolicy(denyPolicy{})
+			d.SetTarpit(Tarpit{Mode: mode, DripInterval: 20 * time.Millisecond, MaxDuration: 5 * time.Second})
+			before := counterValue(t, metrics.SocksTarpittedTotal.WithLabelValues(mode))
+
+			client, server := tcpPair(t)
+			done := make(chan error, 1)
+			go func() {
+				done <- d.HandleSocks4(context.Background(), server, server, &socks4.Request{
+					Command: 1, Port: 443, Host: "internal.example", Username: "mallory",
+				})
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 9)
+			if mode == TarpitDrip {
+				// a granted reply, then the drip
+				if _, err := io.ReadFull(client, buf); err != nil || buf[1] != socks4.RepGranted {
+					t.Fatalf("read = %v, %v; want a granted reply and a dripped byte", buf, err)
+				}
+				client.Close()
+			} else if n, err := client.Read(buf); err == nil || errors.Is(err, io.EOF) {
+				t.Fatalf("read = %d, %v; want the connection reset", n, err)
+			}
+			want := map[string]string{TarpitDrip: "rejected and tarpitted", TarpitReset: "rejected and reset"}[mode]
+			if err := <-done; err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("HandleSocks4 = %v, want %q", err, want)
+			}
+			if got := counterValue(t, metrics.SocksTarpittedTotal.WithLabelValues(mode)) - before; got != 1 {
+				t.Errorf("tarpitted_total{mode=%q} grew by %v, want 1", mode, got)
+			}
+			if n := d.tarpitted.Load(); n != 0 {
+				t.Errorf("%d connections still counted as tarpitted", n)
+			}
+		})
+	}
+}
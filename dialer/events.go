@@ -0,0 +1,43 @@
+package dialer
+
+import (
+	"time"
+
+	"github.com/sequring/chameleon/events"
+	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/session"
+)
+
+// sessionEvent is the payload of session_started and session_ended events.
+// Destinations are redacted like in log lines.
+type sessionEvent struct {
+	session.Info
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// blacklistEvent is the payload of destination_blacklisted events
+type blacklistEvent struct {
+	ProxyAddress    string  `json:"proxy_address"`
+	Destination     string  `json:"destination"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// SessionID is the session whose failed dial tipped the balance
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// SetEvents publishes session starts and ends and per-destination blacklisting to hub
+func (d *Dialer) SetEvents(hub *events.Hub) {
+	d.events = hub
+}
+
+// publishSession publishes a session event of type typ for sess
+func (d *Dialer) publishSession(typ string, sess *session.Session) {
+	if d.events == nil {
+		return
+	}
+	ev := sessionEvent{Info: sess.Info()}
+	ev.Destination = d.logDest(ev.Username, ev.Destination)
+	if typ == events.TypeSessionEnded {
+		ev.DurationSeconds = time.Since(ev.StartedAt).Seconds()
+	}
+	d.events.Publish(typ, string(proxypool.SeverityInfo), ev)
+}
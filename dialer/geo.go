@@ -0,0 +1,166 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sequring/chameleon/geoip"
+	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// GeoProximity prefers upstream proxies in the region of the destination: a
+// proxy tagged TagPrefix+region is selected when one is eligible.
+type GeoProximity struct {
+	DB *geoip.DB
+	// TagPrefix precedes the region in proxy tags, e.g. "region:" for "region:eu"
+	TagPrefix string
+	// CacheTTL is how long the region of a destination host is remembered
+	CacheTTL time.Duration
+	// ResolveTimeout bounds the lookup of a destination hostname's addresses
+	ResolveTimeout time.Duration
+	// MaxCacheEntries bounds the number of remembered hosts
+	MaxCacheEntries int
+}
+
+// Results of a proximity-aware selection (label of chameleon_geo_selections_total)
+const (
+	geoNear     = "near"
+	geoFallback = "fallback"
+	geoUnknown  = "unknown"
+)
+
+// geoEntry is the cached region of a destination host; empty if it has none
+type geoEntry struct {
+	region  string
+	expires time.Time
+}
+
+// geoResolver maps destination hosts to regions. Hostnames are resolved in the
+// background so that a cache miss never delays a dial.
+type geoResolver struct {
+	cfg      GeoProximity
+	resolver *net.Resolver
+	mu       sync.Mutex
+	cache    map[string]geoEntry
+	pending  map[string]bool
+}
+
+// SetGeoProximity enables proximity-aware selection as configured by cfg
+func (d *Dialer) SetGeoProximity(cfg GeoProximity) {
+	d.geo = &geoResolver{
+		cfg:      cfg,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]geoEntry),
+		pending:  make(map[string]bool),
+	}
+}
+
+// regionTagFor returns the tag of the proxies near host, or "" if geo
+// proximity is disabled or the region of host is not known (yet)
+func (d *Dialer) regionTagFor(host string) string {
+	if d.geo == nil || host == "" {
+		return ""
+	}
+	region, ok := d.geo.region(host)
+	if !ok || region == "" {
+		metrics.GeoSelectionsTotal.WithLabelValues(geoUnknown).Inc()
+		return ""
+	}
+	return d.geo.cfg.TagPrefix + region
+}
+
+// region returns the region of host. ok is false if it still has to be resolved.
+func (g *geoResolver) region(host string) (string, bool) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		region, _ := g.cfg.DB.Lookup(addr)
+		return region, true
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if entry, ok := g.cache[host]; ok && now.Before(entry.expires) {
+		return entry.region, true
+	}
+	if !g.pending[host] {
+		g.pending[host] = true
+		go g.resolve(host)
+	}
+	return "", false
+}
+
+// resolve looks up the addresses of host and caches the region of the first
+// one the database knows, or no region
+func (g *geoResolver) resolve(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.cfg.ResolveTimeout)
+	defer cancel()
+	region := ""
+	if addrs, err := g.resolver.LookupNetIP(ctx, "ip", host); err == nil {
+		for _, addr := range addrs {
+			if r, ok := g.cfg.DB.Lookup(addr); ok {
+				region = r
+				break
+			}
+		}
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.pending, host)
+	if len(g.cache) >= g.cfg.MaxCacheEntries {
+		for h, entry := range g.cache {
+			if !now.Before(entry.expires) {
+				delete(g.cache, h)
+			}
+		}
+		if len(g.cache) >= g.cfg.MaxCacheEntries {
+			g.cache = make(map[string]geoEntry)
+		}
+	}
+	g.cache[host] = geoEntry{region: region, expires: now.Add(g.cfg.CacheTTL)}
+}
+
+// nearFilter extends the selection filter avoid to skip proxies without
+// regionTag, and returns whether a selected proxy honors both
+func nearFilter(regionTag string, avoid func(*proxypool.ProxyConfig) bool) (filter, near func(*proxypool.ProxyConfig) bool) {
+	near = func(proxyCfg *proxypool.ProxyConfig) bool {
+		return slices.Contains(proxyTags(proxyCfg), regionTag) && (avoid == nil || !avoid(proxyCfg))
+	}
+	filter = func(proxyCfg *proxypool.ProxyConfig) bool {
+		return !near(proxyCfg)
+	}
+	return filter, near
+}
+
+// selectNear picks n proxies carrying tags (one for SelectProxy when n is 0)
+// near the destination. ok is false when none is eligible; the caller then
+// selects as usual.
+func (d *Dialer) selectNear(pool ProxySelector, tags []string, n int, regionTag string, avoid func(*proxypool.ProxyConfig) bool) ([]*proxypool.ProxyConfig, bool) {
+	filter, near := nearFilter(regionTag, avoid)
+	var proxies []*proxypool.ProxyConfig
+	if n == 0 {
+		proxyCfg, err := pool.SelectProxy(tags, filter)
+		if err != nil {
+			return nil, false
+		}
+		proxies = []*proxypool.ProxyConfig{proxyCfg}
+	} else {
+		var err error
+		if proxies, err = pool.GetFastestActiveProxiesAvoiding(tags, n, filter); err != nil {
+			return nil, false
+		}
+	}
+	// selection falls back to filtered proxies when nothing else is eligible
+	for _, proxyCfg := range proxies {
+		if !near(proxyCfg) {
+			metrics.GeoSelectionsTotal.WithLabelValues(geoFallback).Inc()
+			return nil, false
+		}
+	}
+	metrics.GeoSelectionsTotal.WithLabelValues(geoNear).Inc()
+	return proxies, true
+}
@@ -0,0 +1,42 @@
+package dialer
+
+import (
+	"context"
+	"net"
+
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// UpstreamResolver is the go-socks5 resolver of the server: it leaves SOCKS5
+// hostname destinations unresolved, so they reach the upstream proxy as
+// hostnames and the proxy resolves them with the address family its exit has.
+// Resolving locally would pin destinations to whatever family this host prefers.
+type UpstreamResolver struct{}
+
+// Resolve returns no address, keeping the request's FQDN as the destination
+func (UpstreamResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// lookupIP6 resolves AAAA records for prefer_ipv6 proxies; replaced in tests
+var lookupIP6 = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip6", host)
+}
+
+// upstreamDestination returns the address to request from proxyCfg for addr.
+// A proxy with prefer_ipv6 that passed its dual-stack check gets hostnames as
+// IPv6 literals when the host has AAAA records; everything else is unchanged.
+func upstreamDestination(ctx context.Context, proxyCfg *proxypool.ProxyConfig, addr string) string {
+	if !proxyCfg.PreferIPv6 || !proxyCfg.IPv6Reachable() {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr
+	}
+	ips, err := lookupIP6(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return addr
+	}
+	return net.JoinHostPort(ips[0].String(), port)
+}
@@ -0,0 +1,80 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sequring/chameleon/metrics"
+)
+
+// ErrConnectionLimit is returned when the server serves its maximum number of
+// connections and no slot became free in time
+var ErrConnectionLimit = errors.New("server connection limit reached")
+
+// ConnectionLimit caps the client connections served at once, counting each
+// from its SOCKS request until the session ends
+type ConnectionLimit struct {
+	// Max is the number of connections; 0 disables the limit
+	Max int
+	// QueueTimeout, when positive, makes requests over the limit wait this long
+	// for a free slot instead of being rejected right away
+	QueueTimeout time.Duration
+}
+
+// SetConnectionLimit limits the client connections served at once
+func (d *Dialer) SetConnectionLimit(limit ConnectionLimit) {
+	d.connLimit = limit
+	d.connSlots = nil
+	if limit.Max > 0 {
+		d.connSlots = make(chan struct{}, limit.Max)
+	}
+}
+
+// Connections returns the number of client connections being served
+func (d *Dialer) Connections() int64 {
+	return d.connections.Load()
+}
+
+// acquireConnection takes a connection slot, queueing for it if configured.
+// The returned function gives the slot back.
+func (d *Dialer) acquireConnection(ctx context.Context) (func(), error) {
+	slots := d.connSlots
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if err := d.queueForConnection(ctx, slots); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.connections.Add(1)
+	metrics.SocksConnections.Inc()
+	return func() {
+		d.connections.Add(-1)
+		metrics.SocksConnections.Dec()
+		if slots != nil {
+			<-slots
+		}
+	}, nil
+}
+
+// queueForConnection waits for a free slot up to the queue timeout
+func (d *Dialer) queueForConnection(ctx context.Context, slots chan struct{}) error {
+	if d.connLimit.QueueTimeout <= 0 {
+		metrics.SocksConnectionsRejectedTotal.WithLabelValues("limit").Inc()
+		return ErrConnectionLimit
+	}
+	timer := time.NewTimer(d.connLimit.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		metrics.SocksConnectionsRejectedTotal.WithLabelValues("queue_timeout").Inc()
+		return ErrConnectionLimit
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
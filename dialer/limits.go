@@ -0,0 +1,72 @@
+package dialer
+
+import (
+	"log"
+	"time"
+
+	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/session"
+)
+
+// Reasons a session is closed by its limits (label of chameleon_socks_sessions_expired_total)
+const (
+	expiredIdle     = "idle_timeout"
+	expiredLifetime = "max_lifetime"
+)
+
+// SetSessionLimits closes relayed sessions that transferred no bytes in either
+// direction for idleTimeout, or that are older than maxLifetime. Zero disables a limit.
+func (d *Dialer) SetSessionLimits(idleTimeout, maxLifetime time.Duration) {
+	d.idleTimeout = idleTimeout
+	d.maxLifetime = maxLifetime
+}
+
+// hasSessionLimits reports whether sessions need a limit watchdog
+func (d *Dialer) hasSessionLimits() bool {
+	return d.idleTimeout > 0 || d.maxLifetime > 0
+}
+
+// enforceSessionLimits closes sess once it exceeds a limit. It returns when the
+// session is closed or done is closed.
+func (d *Dialer) enforceSessionLimits(sess *session.Session, done <-chan struct{}) {
+	_, wait := d.sessionLimitState(sess, time.Now())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-timer.C:
+			reason, wait := d.sessionLimitState(sess, now)
+			if reason == "" {
+				timer.Reset(wait)
+				continue
+			}
+			log.Printf("Closing session %s (%s -> %s via %s): %s", sess.ID, sess.Username, d.logDest(sess.Username, sess.Destination), sess.Upstream, reason)
+			metrics.SocksSessionsExpiredTotal.WithLabelValues(reason).Inc()
+			sess.Close()
+			return
+		}
+	}
+}
+
+// sessionLimitState returns the limit sess has exceeded at now, or "" and how
+// long until the next limit could be reached
+func (d *Dialer) sessionLimitState(sess *session.Session, now time.Time) (reason string, wait time.Duration) {
+	wait = time.Duration(1<<63 - 1)
+	if d.maxLifetime > 0 {
+		left := sess.StartedAt.Add(d.maxLifetime).Sub(now)
+		if left <= 0 {
+			return expiredLifetime, 0
+		}
+		wait = left
+	}
+	if d.idleTimeout > 0 {
+		left := sess.LastActivity().Add(d.idleTimeout).Sub(now)
+		if left <= 0 {
+			return expiredIdle, 0
+		}
+		wait = min(wait, left)
+	}
+	return "", wait
+}
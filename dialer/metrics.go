@@ -32,18 +32,14 @@ func PrintMetrics(ctx context.Context, interval time.Duration, pPool *proxypool.
 			}
 			log.Printf("Global Metrics: TotalReq=%d, Success=%d (%.1f%%), Failed=%d", total, success, successRate, failed)
 
-			proxiesSnapshot := pPool.GetProxiesSnapshot() 
-
-			for _, proxy := range proxiesSnapshot {
-				proxy.Mu.RLock()
+			for _, proxy := range pPool.GetProxiesSnapshot() {
 				lastCheckStr := "Never"
 				if !proxy.LastCheck.IsZero() {
 					lastCheckStr = proxy.LastCheck.Format(time.RFC3339Nano)
 				}
-				log.Printf("Proxy %s: Active=%v, RespTime=%v, LastCheck=%s, Success=%d, Fail=%d",
-					proxy.Address, proxy.IsActive, proxy.ResponseTime, lastCheckStr,
-					atomic.LoadUint32(&proxy.SuccessCount), atomic.LoadUint32(&proxy.FailCount))
-				proxy.Mu.RUnlock()
+				log.Printf("Proxy %s: Active=%v, AuthFailed=%v, RespTime=%v, LastCheck=%s, Success=%d, Fail=%d",
+					proxy.Address, proxy.IsActive, proxy.AuthFailed, proxy.ResponseTime, lastCheckStr,
+					proxy.SuccessCount, proxy.FailCount)
 			}
 		case <-ctx.Done():
 			log.Println("Metrics printer stopping...")
@@ -0,0 +1,35 @@
+package dialer
+
+import (
+	"context"
+	"net"
+
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// ProxySelector picks the upstream proxies a Dialer dials through.
+// *proxypool.Pool implements it; a static list or a test fake can stand in.
+type ProxySelector interface {
+	SelectProxy(tags []string, avoid func(*proxypool.ProxyConfig) bool) (*proxypool.ProxyConfig, error)
+	GetRotatingProxy(key string, tags []string, avoid func(*proxypool.ProxyConfig) bool) (*proxypool.ProxyConfig, error)
+	GetFastestActiveProxiesAvoiding(tags []string, n int, avoid func(*proxypool.ProxyConfig) bool) ([]*proxypool.ProxyConfig, error)
+	FindProxy(ref string) (*proxypool.ProxyConfig, error)
+	// DialWarm hands out a prewarmed connection to proxyCfg connected to addr;
+	// ok is false if none was available
+	DialWarm(ctx context.Context, proxyCfg *proxypool.ProxyConfig, addr string) (conn net.Conn, ok bool, err error)
+	// GetProxiesSnapshot lists the proxies for route explanations and stats
+	GetProxiesSnapshot() []proxypool.ProxySnapshot
+}
+
+// PoolStats is implemented by selectors that report their state. WriteStats
+// includes it for selectors that do.
+type PoolStats interface {
+	ActiveProxyCount() int
+	Strategy() proxypool.Strategy
+	PrewarmStats() (hits, misses uint64)
+}
+
+var (
+	_ ProxySelector = (*proxypool.Pool)(nil)
+	_ PoolStats     = (*proxypool.Pool)(nil)
+)
@@ -0,0 +1,112 @@
+package dialer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// Destination redaction modes (DestinationRedaction.Mode)
+const (
+	RedactHash     = "hash"
+	RedactTruncate = "truncate"
+)
+
+// redactHashLength is the number of hex characters kept from a destination hash
+const redactHashLength = 12
+
+// DestinationRedaction hides the destination hosts of connections in log lines
+type DestinationRedaction struct {
+	// Mode is RedactHash, RedactTruncate or empty to log destinations as is
+	Mode string
+	// Salt keys the hash
+	Salt string
+	// Users limits redaction to these users; empty redacts for everyone
+	Users []string
+}
+
+// redaction is the compiled form of a DestinationRedaction
+type redaction struct {
+	mode  string
+	salt  []byte
+	users map[string]bool // nil: every user
+}
+
+// SetDestinationRedaction hides destination hosts in the log lines of
+// connections as configured by cfg. Ports are kept; lines not attributed to a
+// user (such as the per-destination blacklist) are redacted whenever a mode is set.
+func (d *Dialer) SetDestinationRedaction(cfg DestinationRedaction) {
+	r := redaction{mode: cfg.Mode, salt: []byte(cfg.Salt)}
+	if len(cfg.Users) > 0 {
+		r.users = make(map[string]bool, len(cfg.Users))
+		for _, username := range cfg.Users {
+			r.users[username] = true
+		}
+	}
+	d.redaction = r
+}
+
+// logDest returns addr as it may appear in the log lines of username
+func (d *Dialer) logDest(username, addr string) string {
+	r := d.redaction
+	if r.mode == "" || (r.users != nil && username != "" && !r.users[username]) {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	switch r.mode {
+	case RedactHash:
+		mac := hmac.New(sha256.New, r.salt)
+		mac.Write([]byte(strings.ToLower(host)))
+		host = "h-" + hex.EncodeToString(mac.Sum(nil))[:redactHashLength]
+	case RedactTruncate:
+		host = truncateHost(host)
+	}
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// logErr returns the message of err as it may appear in the log lines of
+// username: upstream errors often name the destination addr themselves
+func (d *Dialer) logErr(username, addr string, err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	msg := err.Error()
+	redacted := d.logDest(username, addr)
+	if redacted == addr {
+		return msg
+	}
+	host, _, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		host = addr
+	}
+	redactedHost, _, splitErr := net.SplitHostPort(redacted)
+	if splitErr != nil {
+		redactedHost = redacted
+	}
+	msg = strings.ReplaceAll(msg, addr, redacted)
+	return strings.ReplaceAll(msg, host, redactedHost)
+}
+
+// truncateHost keeps the /24 of an IPv4 address, the /48 of an IPv6 address or
+// the last two labels of a hostname
+func truncateHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return "*." + strings.Join(labels[len(labels)-2:], ".")
+}
@@ -0,0 +1,238 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// RedialConfig retries a CONNECT through another proxy when the upstream closes
+// the connection within Window of connecting without sending a byte. What the
+// client sent meanwhile, up to BufferBytes, is replayed to the new upstream.
+type RedialConfig struct {
+	// MaxAttempts is the number of upstream connections a request may use,
+	// including the first; 0 or 1 disables redialing
+	MaxAttempts int
+	Window      time.Duration
+	BufferBytes int
+}
+
+// SetRedial enables redialing of immediately reset upstream connections
+func (d *Dialer) SetRedial(cfg RedialConfig) {
+	d.redial = cfg
+}
+
+// errNoOtherProxy is returned when a redial would select a proxy the request already tried
+var errNoOtherProxy = errors.New("no other eligible proxy")
+
+// avoidTried extends the selection filter avoid to skip the proxies in tried
+func avoidTried(avoid func(*proxypool.ProxyConfig) bool, tried []string) func(*proxypool.ProxyConfig) bool {
+	return func(proxyCfg *proxypool.ProxyConfig) bool {
+		return slices.Contains(tried, proxyCfg.Address) || (avoid != nil && avoid(proxyCfg))
+	}
+}
+
+// redialUpstream connects to addr through a proxy not in tried
+func (d *Dialer) redialUpstream(ctx context.Context, addr string, client Client, tried []string) (net.Conn, *proxypool.ProxyConfig, error) {
+	pool, proxies, _, err := d.selectProxies(ctx, client, destinationHost(ctx, addr), tried)
+	if err != nil {
+		return nil, nil, err
+	}
+	// selection falls back to avoided proxies when nothing else is eligible
+	proxyCfg := proxies[0]
+	if slices.Contains(tried, proxyCfg.Address) {
+		return nil, nil, errNoOtherProxy
+	}
+	d.pendingDials.Add(1)
+	defer d.pendingDials.Add(-1)
+	conn, err := d.dialVia(ctx, pool, proxyCfg, "tcp", addr, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, proxyCfg, nil
+}
+
+// redialConn is the upstream side of a session that is redialed through another
+// proxy when the upstream closes it right away. It stays on probation, keeping
+// what the client sends for replay, until the upstream sends its first byte,
+// the window passes or the replay buffer would overflow.
+type redialConn struct {
+	d      *Dialer
+	ctx    context.Context
+	addr   string
+	client Client
+
+	settled atomic.Bool // off probation: conn no longer changes
+
+	mu          sync.Mutex
+	conn        net.Conn
+	proxy       *proxypool.ProxyConfig
+	connectedAt time.Time
+	tried       []string
+	replay      []byte
+	writeClosed bool
+	closed      bool
+}
+
+// newRedialConn puts conn, connected to addr through proxyCfg, on probation
+func (d *Dialer) newRedialConn(ctx context.Context, conn net.Conn, proxyCfg *proxypool.ProxyConfig, addr string, client Client) *redialConn {
+	return &redialConn{
+		d:           d,
+		ctx:         ctx,
+		addr:        addr,
+		client:      client,
+		conn:        conn,
+		proxy:       proxyCfg,
+		connectedAt: time.Now(),
+		tried:       []string{proxyCfg.Address},
+	}
+}
+
+// current returns the upstream connection in use
+func (r *redialConn) current() net.Conn {
+	if r.settled.Load() {
+		return r.conn
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+// settleLocked ends the probation. The caller must hold r.mu.
+func (r *redialConn) settleLocked() {
+	r.replay = nil
+	r.settled.Store(true)
+}
+
+func (r *redialConn) Read(p []byte) (int, error) {
+	for {
+		conn := r.current()
+		n, err := conn.Read(p)
+		if n > 0 && !r.settled.Load() {
+			r.mu.Lock()
+			if conn == r.conn {
+				r.settleLocked()
+			}
+			r.mu.Unlock()
+		}
+		if n > 0 || err == nil || !r.redial(conn) {
+			return n, err
+		}
+	}
+}
+
+func (r *redialConn) Write(p []byte) (int, error) {
+	if r.settled.Load() {
+		return r.conn.Write(p)
+	}
+	r.mu.Lock()
+	if !r.settled.Load() {
+		if len(r.replay)+len(p) > r.d.redial.BufferBytes || time.Since(r.connectedAt) > r.d.redial.Window {
+			r.settleLocked()
+		} else {
+			r.replay = append(r.replay, p...)
+		}
+	}
+	conn := r.conn
+	r.mu.Unlock()
+
+	n, err := conn.Write(p)
+	if err != nil && r.redial(conn) {
+		// p was replayed to the new upstream
+		return len(p), nil
+	}
+	return n, err
+}
+
+// redial replaces failed, which the upstream closed, with a connection through
+// another proxy and replays the buffered client bytes to it. It reports whether
+// the session can go on, which is also the case if another caller already
+// replaced failed.
+func (r *redialConn) redial(failed net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != failed {
+		return true
+	}
+	cfg := r.d.redial
+	if r.closed || r.settled.Load() || time.Since(r.connectedAt) > cfg.Window || len(r.tried) >= cfg.MaxAttempts {
+		return false
+	}
+
+	metrics.UpstreamProxyFailTotal.WithLabelValues(metrics.ProxyLabel(r.proxy.Address)).Inc()
+	atomic.AddUint32(&r.proxy.FailCount, 1)
+	r.d.recordDestination(r.ctx, r.proxy, r.addr, false)
+	log.Printf("Proxy %s closed the connection to %s after %v without a reply, redialing (attempt %d of %d)%s",
+		r.proxy.Address, r.d.logDest(r.client.Username, r.addr), time.Since(r.connectedAt).Round(time.Millisecond), len(r.tried)+1, cfg.MaxAttempts, logSuffix(r.ctx))
+	failed.Close()
+
+	conn, proxyCfg, err := r.d.redialUpstream(r.ctx, r.addr, r.client, r.tried)
+	if err == nil {
+		err = r.resume(conn, proxyCfg)
+	}
+	if err != nil {
+		metrics.SocksRedialsTotal.WithLabelValues("failed").Inc()
+		log.Printf("Redialing %s failed: %v%s", r.d.logDest(r.client.Username, r.addr), r.d.logErr(r.client.Username, r.addr, err), logSuffix(r.ctx))
+		r.settleLocked()
+		return false
+	}
+	metrics.SocksRedialsTotal.WithLabelValues("success").Inc()
+	return true
+}
+
+// resume replays the buffered client bytes to conn and makes it the upstream
+// connection. The caller must hold r.mu.
+func (r *redialConn) resume(conn net.Conn, proxyCfg *proxypool.ProxyConfig) error {
+	r.tried = append(r.tried, proxyCfg.Address)
+	if len(r.replay) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(r.d.dialTimeoutFor(proxyTags(proxyCfg))))
+		_, err := conn.Write(r.replay)
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to replay %d bytes via proxy %s: %w", len(r.replay), proxyCfg.Address, err)
+		}
+	}
+	if r.writeClosed {
+		if cw, ok := conn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}
+	r.conn, r.proxy, r.connectedAt = conn, proxyCfg, time.Now()
+	return nil
+}
+
+// CloseWrite half-closes the upstream connection once the client is done sending
+func (r *redialConn) CloseWrite() error {
+	r.mu.Lock()
+	r.writeClosed = true
+	conn := r.conn
+	r.mu.Unlock()
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (r *redialConn) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	conn := r.conn
+	r.mu.Unlock()
+	return conn.Close()
+}
+
+func (r *redialConn) LocalAddr() net.Addr                { return r.current().LocalAddr() }
+func (r *redialConn) RemoteAddr() net.Addr               { return r.current().RemoteAddr() }
+func (r *redialConn) SetDeadline(t time.Time) error      { return r.current().SetDeadline(t) }
+func (r *redialConn) SetReadDeadline(t time.Time) error  { return r.current().SetReadDeadline(t) }
+func (r *redialConn) SetWriteDeadline(t time.Time) error { return r.current().SetWriteDeadline(t) }
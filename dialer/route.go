@@ -0,0 +1,104 @@
+package dialer
+
+import (
+	"context"
+	"slices"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// RouteCandidate is a proxy matched by a routing decision
+type RouteCandidate struct {
+	ID       string   `json:"id,omitempty"`
+	Address  string   `json:"address"`
+	Tags     []string `json:"tags,omitempty"`
+	Active   bool     `json:"active"`
+	Disabled bool     `json:"disabled,omitempty"`
+	Eligible bool     `json:"eligible"`
+	// Avoided is set when the proxy is blacklisted for the destination
+	Avoided bool `json:"avoided,omitempty"`
+	// Pinned is set on the proxy a pinned user is routed through
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// RouteDecision explains how a connection would be routed, without dialing
+type RouteDecision struct {
+	Username    string     `json:"username"`
+	Destination string     `json:"destination"`
+	Route       auth.Route `json:"route"`
+	// Pool is the name of the pool the connection would be served from
+	Pool   string `json:"pool"`
+	Denied bool   `json:"denied"`
+	Error  string `json:"error,omitempty"`
+	// Reason is the ErrorKind of Error
+	Reason     string           `json:"reason,omitempty"`
+	Candidates []RouteCandidate `json:"candidates"`
+}
+
+// ExplainRoute reports which routing rule matches username and which proxies would be
+// eligible for a connection to destination. Proxies that match the rule but are
+// currently inactive or administratively disabled are listed with Eligible set to false;
+// proxies blacklisted for destination are listed with Avoided set. For a pinned user
+// the pinned proxy is listed with Pinned set, followed by the fallback candidates if any.
+// Only the proxies of the user's pool are considered; listener bindings are not.
+func (d *Dialer) ExplainRoute(username, destination string) RouteDecision {
+	decision := RouteDecision{
+		Username:    username,
+		Destination: destination,
+		Route:       auth.Route{Rule: auth.RuleAllowAll, AllowAll: true},
+		Pool:        config.DefaultPoolName,
+		Candidates:  []RouteCandidate{},
+	}
+	if d.policy != nil {
+		route, err := d.policy.ResolveRoute(username)
+		decision.Route = route
+		if err != nil {
+			decision.Denied = true
+			decision.Error = err.Error()
+			decision.Reason = ErrorKind(err)
+			return decision
+		}
+	}
+
+	pool, err := d.poolFor(decision.Route, Client{})
+	if err != nil {
+		decision.Denied = true
+		decision.Error = err.Error()
+		decision.Reason = ErrorKind(err)
+		return decision
+	}
+	if decision.Route.Pool != "" {
+		decision.Pool = decision.Route.Pool
+	}
+
+	avoid := d.avoidAddressFor(destinationHost(context.Background(), destination))
+	for _, proxy := range pool.GetProxiesSnapshot() {
+		pinned := decision.Route.PinnedProxy != "" && (proxy.Address == decision.Route.PinnedProxy || proxy.ID == decision.Route.PinnedProxy)
+		if !pinned && !decision.Route.AllowAll && !proxypool.HasAnyTag(proxy.Tags, decision.Route.Tags) {
+			continue
+		}
+		decision.Candidates = append(decision.Candidates, RouteCandidate{
+			ID:       proxy.ID,
+			Address:  proxy.Address,
+			Tags:     proxy.Tags,
+			Active:   proxy.IsActive,
+			Disabled: proxy.Disabled,
+			Pinned:   pinned,
+			Eligible: proxy.IsActive && !proxy.Disabled,
+			Avoided:  !pinned && avoid != nil && avoid(proxy.Address),
+		})
+	}
+	// the pinned proxy is tried first
+	slices.SortStableFunc(decision.Candidates, func(a, b RouteCandidate) int {
+		switch {
+		case a.Pinned == b.Pinned:
+			return 0
+		case a.Pinned:
+			return -1
+		}
+		return 1
+	})
+	return decision
+}
@@ -0,0 +1,102 @@
+package dialer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sequring/chameleon/proxypool"
+)
+
+// WriteStats writes a human-readable snapshot of the pool, the dial counters and
+// the active sessions to w, the same figures PrintMetrics logs periodically
+func (d *Dialer) WriteStats(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	now := time.Now()
+	fmt.Fprintf(bw, "Stats snapshot at %s\n", now.Format(time.RFC3339))
+
+	if d.commonMetrics != nil {
+		total := atomic.LoadUint64(&d.commonMetrics.TotalRequests)
+		success := atomic.LoadUint64(&d.commonMetrics.TotalSuccess)
+		failed := atomic.LoadUint64(&d.commonMetrics.TotalFailed)
+		var successRate float64
+		if total > 0 {
+			successRate = float64(success) / float64(total) * 100
+		}
+		fmt.Fprintf(bw, "Global Metrics: TotalReq=%d, Success=%d (%.1f%%), Failed=%d\n", total, success, successRate, failed)
+	}
+	var hits, misses uint64
+	stats, hasStats := d.pool.(PoolStats)
+	if hasStats {
+		hits, misses = stats.PrewarmStats()
+	}
+	fmt.Fprintf(bw, "Dialer: PendingDials=%d, ActiveRelays=%d, HedgeBackupWins=%d, PrewarmHits=%d, PrewarmMisses=%d, BlacklistedDestinations=%d\n",
+		d.PendingDials(), d.ActiveRelays(), d.HedgeWins(), hits, misses, d.BlacklistedDestinationCount())
+
+	proxies := d.pool.GetProxiesSnapshot()
+	var active, disabled, authFailed int
+	for _, proxy := range proxies {
+		switch {
+		case proxy.Disabled:
+			disabled++
+		case proxy.IsActive:
+			active++
+		}
+		if proxy.AuthFailed {
+			authFailed++
+		}
+	}
+	selectable := active
+	if hasStats {
+		selectable = stats.ActiveProxyCount()
+	}
+	fmt.Fprintf(bw, "Pool: Proxies=%d, Active=%d, Disabled=%d, AuthFailed=%d, Selectable=%d\n",
+		len(proxies), active, disabled, authFailed, selectable)
+	writeProxyStats(bw, proxies)
+
+	for _, name := range slices.Sorted(maps.Keys(d.pools)) {
+		pool := d.pools[name]
+		poolProxies := pool.GetProxiesSnapshot()
+		if stats, ok := pool.(PoolStats); ok {
+			fmt.Fprintf(bw, "Pool %s: Proxies=%d, Selectable=%d, Strategy=%s\n",
+				name, len(poolProxies), stats.ActiveProxyCount(), stats.Strategy())
+		} else {
+			fmt.Fprintf(bw, "Pool %s: Proxies=%d\n", name, len(poolProxies))
+		}
+		writeProxyStats(bw, poolProxies)
+	}
+
+	if d.sessions != nil {
+		sessions := d.sessions.List()
+		fmt.Fprintf(bw, "Sessions: %d active\n", len(sessions))
+		for _, s := range sessions {
+			fmt.Fprintf(bw, "Session %s: User=%s, Client=%s, Destination=%s, Upstream=%s, Up=%d, Down=%d, Age=%v, Idle=%v\n",
+				s.ID, s.Username, s.ClientAddr, s.Destination, s.Upstream, s.BytesUp, s.BytesDown,
+				now.Sub(s.StartedAt).Truncate(time.Second), now.Sub(s.LastActivity).Truncate(time.Second))
+		}
+	}
+	return bw.Flush()
+}
+
+// writeProxyStats writes the lines of the proxies of a pool snapshot to bw
+func writeProxyStats(bw *bufio.Writer, proxies []proxypool.ProxySnapshot) {
+	for _, proxy := range proxies {
+		lastCheckStr := "Never"
+		if !proxy.LastCheck.IsZero() {
+			lastCheckStr = proxy.LastCheck.Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(bw, "Proxy %s: State=%s, Active=%v, Disabled=%v, AuthFailed=%v, RespTime=%v, EWMA=%v, Jitter=%v, LastCheck=%s, Success=%d, Fail=%d, Tags=[%s]\n",
+			proxy.Address, proxy.State, proxy.IsActive, proxy.Disabled, proxy.AuthFailed, proxy.ResponseTime,
+			proxy.LatencyEWMA, proxy.LatencyJitter, lastCheckStr, proxy.SuccessCount, proxy.FailCount,
+			strings.Join(proxy.Tags, ","))
+		if !proxy.IsActive && proxy.LastError != nil {
+			fmt.Fprintf(bw, "Proxy %s: LastError=%q, Category=%s, At=%s\n",
+				proxy.Address, proxy.LastError.Message, proxy.LastError.Category, proxy.LastError.Time.Format(time.RFC3339Nano))
+		}
+	}
+}
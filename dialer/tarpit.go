@@ -0,0 +1,105 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/metrics"
+)
+
+// Tarpit modes (Tarpit.Mode)
+const (
+	TarpitDrip  = "drip"
+	TarpitReset = "reset"
+)
+
+// Tarpit holds on to the CONNECTs the routing policy rejects instead of
+// refusing them with a SOCKS error, so misconfigured clients stand out in the
+// logs and on their own side rather than failing quietly
+type Tarpit struct {
+	// Mode is TarpitDrip (report success, then send a byte every DripInterval
+	// until MaxDuration), TarpitReset (reset the connection without a reply)
+	// or empty to refuse rejected requests with a SOCKS error
+	Mode         string
+	DripInterval time.Duration
+	MaxDuration  time.Duration
+	// MaxConcurrent caps the connections held at once; requests over it are
+	// refused as usual
+	MaxConcurrent int
+}
+
+// SetTarpit tarpits the CONNECTs the routing policy rejects as configured by cfg
+func (d *Dialer) SetTarpit(cfg Tarpit) {
+	d.tarpit = cfg
+}
+
+// tarpits reports whether a request that failed with err is tarpitted
+func (d *Dialer) tarpits(err error) bool {
+	return d.tarpit.Mode != "" && (errors.Is(err, auth.ErrNoProxyAccess) || errors.Is(err, auth.ErrTagNotAllowed))
+}
+
+// tarpitRequest holds the client of a request the routing policy rejected with
+// cause. It returns false without touching the client if the tarpit is full.
+func (d *Dialer) tarpitRequest(ctx context.Context, request connectRequest, cause error) (bool, error) {
+	client, ok := request.writer.(net.Conn)
+	if !ok {
+		return false, nil
+	}
+	if n := d.tarpitted.Add(1); d.tarpit.MaxConcurrent > 0 && n > int64(d.tarpit.MaxConcurrent) {
+		d.tarpitted.Add(-1)
+		return false, nil
+	}
+	defer d.tarpitted.Add(-1)
+
+	username, dest, mode := request.client.Username, d.logDest(request.client.Username, request.dest), d.tarpit.Mode
+	log.Printf("Tarpitting (%s) rejected SOCKS%s CONNECT to %s from %v, user '%s': %v%s",
+		mode, request.version, dest, request.remote, username, cause, logSuffix(ctx))
+	metrics.SocksTarpittedTotal.WithLabelValues(mode).Inc()
+
+	if mode == TarpitReset {
+		if tcp := underlyingTCP(client); tcp != nil {
+			// closing with a zero linger sends an RST instead of a FIN
+			tcp.SetLinger(0)
+		}
+		client.Close()
+		return true, fmt.Errorf("connect to %v rejected and reset, %v", dest, cause)
+	}
+
+	start := time.Now()
+	if err := request.reply(nil, client.LocalAddr()); err != nil {
+		return true, fmt.Errorf("failed to send reply, %v", err)
+	}
+	// the client hanging up ends the tarpit
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, request.reader)
+		close(gone)
+	}()
+	ticker := time.NewTicker(d.tarpit.DripInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(d.tarpit.MaxDuration)
+	defer timeout.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			client.SetWriteDeadline(time.Now().Add(d.tarpit.DripInterval))
+			if _, err := client.Write([]byte{0}); err != nil {
+				done = true
+			}
+		case <-gone:
+			done = true
+		case <-timeout.C:
+			done = true
+		case <-ctx.Done():
+			done = true
+		}
+	}
+	client.Close()
+	return true, fmt.Errorf("connect to %v rejected and tarpitted for %v, %v", dest, time.Since(start).Round(time.Millisecond), cause)
+}
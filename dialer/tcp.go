@@ -0,0 +1,77 @@
+package dialer
+
+import (
+	"net"
+	"time"
+)
+
+// TCPOptions tunes the TCP connections on one side of relayed sessions. Zero
+// values keep the defaults of Go and the operating system.
+type TCPOptions struct {
+	// NoDelay sets TCP_NODELAY; nil keeps Go's default, which disables Nagle's algorithm
+	NoDelay *bool
+	// KeepAlive is the idle time before the first keepalive probe and the
+	// interval between probes; negative disables keepalives
+	KeepAlive time.Duration
+	// ReadBuffer and WriteBuffer set SO_RCVBUF and SO_SNDBUF in bytes
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// SetTCPOptions tunes the client connections and the upstream proxy connections
+// of relayed sessions
+func (d *Dialer) SetTCPOptions(client, upstream TCPOptions) {
+	d.clientTCP = client
+	d.upstreamTCP = upstream
+}
+
+// apply sets the options on the TCP connection underlying c, looking through
+// wrappers such as TLS that expose it with a NetConn method. Connections
+// without one, like in-memory pipes, are left alone.
+func (o TCPOptions) apply(c any) error {
+	tcp := underlyingTCP(c)
+	if tcp == nil {
+		return nil
+	}
+	if o.NoDelay != nil {
+		if err := tcp.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+	switch {
+	case o.KeepAlive < 0:
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return err
+		}
+	case o.KeepAlive > 0:
+		if err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: o.KeepAlive, Interval: o.KeepAlive}); err != nil {
+			return err
+		}
+	}
+	if o.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// underlyingTCP returns the TCP connection beneath c, or nil if there is none
+func underlyingTCP(c any) *net.TCPConn {
+	for c != nil {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
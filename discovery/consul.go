@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// consulSource lists the passing instances of a Consul service. The service's
+// Consul tags are carried over as proxy tags.
+type consulSource struct {
+	cfg    config.ConsulDiscovery
+	client *http.Client
+}
+
+// consulServiceEntry is the subset of /v1/health/service entries used for discovery
+type consulServiceEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+	}
+}
+
+// Discover implements Source
+func (s *consulSource) Discover(ctx context.Context) ([]config.ProxyDefinition, error) {
+	query := url.Values{"passing": {"true"}}
+	if s.cfg.Tag != "" {
+		query.Set("tag", s.cfg.Tag)
+	}
+	if s.cfg.Datacenter != "" {
+		query.Set("dc", s.cfg.Datacenter)
+	}
+	endpoint := strings.TrimRight(s.cfg.Address, "/") + "/v1/health/service/" + url.PathEscape(s.cfg.Service) + "?" + query.Encode()
+
+	header := http.Header{}
+	if s.cfg.Token != "" {
+		header.Set("X-Consul-Token", s.cfg.Token)
+	}
+	body, err := getJSON(ctx, s.client, endpoint, header)
+	if err != nil {
+		return nil, fmt.Errorf("consul service %s: %w", s.cfg.Service, err)
+	}
+	var entries []consulServiceEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("consul service %s: error parsing response: %w", s.cfg.Service, err)
+	}
+
+	defs := make([]config.ProxyDefinition, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		if host == "" || entry.Service.Port == 0 {
+			continue
+		}
+		defs = append(defs, config.ProxyDefinition{
+			Address:     net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Tags:        append([]string(nil), entry.Service.Tags...),
+			Description: "consul node " + entry.Node.Node,
+		})
+	}
+	return defs, nil
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sequring/chameleon/config"
+)
+
+const (
+	digitalOceanAPIURL = "https://api.digitalocean.com"
+	// digitalOceanPageSize is the maximum page size of the droplets API
+	digitalOceanPageSize = 200
+	// digitalOceanMaxPages bounds pagination in case the API keeps returning a next link
+	digitalOceanMaxPages = 100
+)
+
+// digitalOceanSource lists the active droplets carrying a tag
+type digitalOceanSource struct {
+	cfg    config.DigitalOceanDiscovery
+	apiURL string
+	client *http.Client
+}
+
+func newDigitalOceanSource(cfg config.DigitalOceanDiscovery, client *http.Client) *digitalOceanSource {
+	apiURL := digitalOceanAPIURL
+	if cfg.APIURL != "" {
+		apiURL = strings.TrimRight(cfg.APIURL, "/")
+	}
+	return &digitalOceanSource{cfg: cfg, apiURL: apiURL, client: client}
+}
+
+// digitalOceanDroplets is the subset of a /v2/droplets page used for discovery
+type digitalOceanDroplets struct {
+	Droplets []struct {
+		Name     string
+		Status   string
+		Region   struct{ Slug string }
+		Networks struct {
+			V4 []struct {
+				IPAddress string `json:"ip_address"`
+				Type      string
+			}
+		}
+	}
+	Links struct {
+		Pages struct{ Next string }
+	}
+}
+
+// Discover implements Source
+func (s *digitalOceanSource) Discover(ctx context.Context) ([]config.ProxyDefinition, error) {
+	query := url.Values{
+		"tag_name": {s.cfg.Tag},
+		"per_page": {strconv.Itoa(digitalOceanPageSize)},
+	}
+	next := s.apiURL + "/v2/droplets?" + query.Encode()
+	header := http.Header{"Authorization": {"Bearer " + s.cfg.Token}}
+	networkType := "public"
+	if s.cfg.PrivateNetwork {
+		networkType = "private"
+	}
+	port := strconv.Itoa(s.cfg.Port)
+
+	var defs []config.ProxyDefinition
+	for page := 0; next != ""; page++ {
+		if page == digitalOceanMaxPages {
+			return nil, fmt.Errorf("digitalocean tag %s: more than %d pages of droplets", s.cfg.Tag, digitalOceanMaxPages)
+		}
+		body, err := getJSON(ctx, s.client, next, header)
+		if err != nil {
+			return nil, fmt.Errorf("digitalocean tag %s: %w", s.cfg.Tag, err)
+		}
+		var resp digitalOceanDroplets
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("digitalocean tag %s: error parsing response: %w", s.cfg.Tag, err)
+		}
+		for _, droplet := range resp.Droplets {
+			if droplet.Status != "active" {
+				continue
+			}
+			for _, network := range droplet.Networks.V4 {
+				if network.Type != networkType || network.IPAddress == "" {
+					continue
+				}
+				defs = append(defs, config.ProxyDefinition{
+					Address:     net.JoinHostPort(network.IPAddress, port),
+					Description: fmt.Sprintf("droplet %s (%s)", droplet.Name, droplet.Region.Slug),
+				})
+				break
+			}
+		}
+		next = resp.Links.Pages.Next
+	}
+	return defs, nil
+}
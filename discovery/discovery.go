@@ -0,0 +1,150 @@
+// Package discovery enumerates upstream proxies from provider APIs (Consul,
+// DigitalOcean) and merges them into the proxy definitions, refreshing periodically.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// TagDiscovered is added to every discovered proxy, along with "discovery:<source name>"
+const TagDiscovered = "discovered"
+
+// requestTimeout bounds each refresh of a source, including pagination
+const requestTimeout = 30 * time.Second
+
+// maxErrorBody is how much of an API error response is included in errors
+const maxErrorBody = 512
+
+// Source enumerates the proxies known to one provider
+type Source interface {
+	Discover(ctx context.Context) ([]config.ProxyDefinition, error)
+}
+
+// New creates the Source configured by cfg
+func New(cfg config.DiscoverySource) (Source, error) {
+	client := &http.Client{Timeout: requestTimeout}
+	switch cfg.Provider {
+	case config.DiscoveryProviderConsul:
+		return &consulSource{cfg: cfg.Consul, client: client}, nil
+	case config.DiscoveryProviderDigitalOcean:
+		return newDigitalOceanSource(cfg.DigitalOcean, client), nil
+	}
+	return nil, fmt.Errorf("unknown discovery provider '%s'", cfg.Provider)
+}
+
+// Runner periodically merges the proxies of one source into the definitions manager
+type Runner struct {
+	cfg    config.DiscoverySource
+	source Source
+	defs   *config.ProxyDefinitionsManager
+}
+
+// NewRunner creates a runner for the source configured by cfg
+func NewRunner(cfg config.DiscoverySource, defs *config.ProxyDefinitionsManager) (*Runner, error) {
+	source, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{cfg: cfg, source: source, defs: defs}, nil
+}
+
+// Run refreshes the source immediately and then every refresh interval until ctx
+// is done. A failed refresh keeps the previously discovered proxies, so a provider
+// API outage does not empty the pool.
+func (r *Runner) Run(ctx context.Context) {
+	interval := time.Duration(r.cfg.RefreshIntervalSecs) * time.Second
+	log.Printf("Discovery %s: refreshing %s proxies every %v", r.cfg.Name, r.cfg.Provider, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Discovery %s: refresh failed, keeping previous proxies: %v", r.cfg.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh queries the source once and replaces its discovered proxies
+func (r *Runner) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	defs, err := r.source.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	standardTags := append([]string{TagDiscovered, "discovery:" + r.cfg.Name}, r.cfg.Tags...)
+	for i := range defs {
+		defs[i].Tags = appendMissing(defs[i].Tags, standardTags)
+		if defs[i].Username == "" {
+			defs[i].Username = r.cfg.Username
+			defs[i].Password = r.cfg.Password
+		}
+	}
+	changed, err := r.defs.SetDiscoveredDefinitions(r.cfg.Name, defs)
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Printf("Discovery %s: %d proxies discovered", r.cfg.Name, len(defs))
+	}
+	return nil
+}
+
+// appendMissing returns tags with every tag from extra it doesn't already contain appended
+func appendMissing(tags, extra []string) []string {
+	for _, tag := range extra {
+		found := false
+		for _, have := range tags {
+			if have == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// getJSON performs an authenticated GET and returns the response body, or an
+// error including the start of the body for non-2xx responses
+func getJSON(ctx context.Context, client *http.Client, rawURL string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > maxErrorBody {
+			msg = msg[:maxErrorBody]
+		}
+		return nil, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, msg)
+	}
+	return body, nil
+}
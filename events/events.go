@@ -0,0 +1,113 @@
+// Package events fans structured events of all components (pool, dialer,
+// authentication, reloads) out to live subscribers such as the admin API's
+// event stream. Slow subscribers lose events instead of stalling publishers.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published besides the pool's own (proxypool.EventType values)
+const (
+	TypeProxiesReloaded        = "proxies_reloaded"
+	TypeDestinationBlacklisted = "destination_blacklisted"
+	TypeSessionStarted         = "session_started"
+	TypeSessionEnded           = "session_ended"
+	TypeAuthFailure            = "auth_failure"
+)
+
+// DefaultHistory is the number of recent events kept for reconnecting subscribers
+const DefaultHistory = 256
+
+// Event is one published event. IDs increase by one per event.
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Severity string    `json:"severity,omitempty"`
+	Time     time.Time `json:"time"`
+	Data     any       `json:"data,omitempty"`
+}
+
+// subscriber receives events on ch, dropping them when ch is full
+type subscriber struct {
+	ch      chan Event
+	dropped uint64
+}
+
+// Hub distributes published events to subscribers. A nil Hub discards events.
+type Hub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event // ring of the most recent events, oldest first
+	limit   int
+	subs    map[*subscriber]struct{}
+}
+
+// NewHub returns a hub remembering the last history events
+func NewHub(history int) *Hub {
+	return &Hub{limit: history, subs: make(map[*subscriber]struct{})}
+}
+
+// Publish sends an event of type typ carrying data to every subscriber
+func (h *Hub) Publish(typ, severity string, data any) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextID++
+	ev := Event{ID: h.nextID, Type: typ, Severity: severity, Time: time.Now(), Data: data}
+	if h.limit > 0 {
+		if len(h.history) >= h.limit {
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, ev)
+	}
+	for sub := range h.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Subscribe returns a channel receiving published events, starting with the
+// remembered events after lastID (none if lastID is 0), and a function that
+// cancels the subscription and closes the channel. Events are dropped while
+// the subscriber is more than buffer events behind.
+func (h *Hub) Subscribe(buffer int, lastID uint64) (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var replay []Event
+	if lastID > 0 {
+		for _, ev := range h.history {
+			if ev.ID > lastID {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	sub := &subscriber{ch: make(chan Event, buffer+len(replay))}
+	for _, ev := range replay {
+		sub.ch <- ev
+	}
+	h.subs[sub] = struct{}{}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subs, sub)
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+// Subscribers returns the number of active subscriptions
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
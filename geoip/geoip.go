@@ -0,0 +1,118 @@
+// Package geoip maps IP addresses to regions using a plain-text list of
+// networks, one "CIDR region" pair per line. The most specific network
+// containing an address wins.
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DB is a loaded list of networks and their regions
+type DB struct {
+	// byBits holds the networks of each prefix length; bits lists those
+	// lengths from the most to the least specific
+	byBits map[int]map[netip.Prefix]string
+	bits   []int
+	count  int
+}
+
+// Load reads the network list at path
+func Load(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	defer f.Close()
+	db, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Parse reads a network list: lines of a CIDR and a region separated by a comma
+// or whitespace. Empty lines and lines starting with '#' are skipped. Regions are
+// lowercased.
+func Parse(r io.Reader) (*DB, error) {
+	db := &DB{byBits: make(map[int]map[netip.Prefix]string)}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a CIDR and a region, got '%s'", line, text)
+		}
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefix = prefix.Masked()
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked()
+		}
+		bits := prefixKey(prefix)
+		set, ok := db.byBits[bits]
+		if !ok {
+			set = make(map[netip.Prefix]string)
+			db.byBits[bits] = set
+			db.bits = append(db.bits, bits)
+		}
+		if _, dup := set[prefix]; !dup {
+			db.count++
+		}
+		set[prefix] = strings.ToLower(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(db.bits)))
+	return db, nil
+}
+
+// prefixKey tells IPv4 and IPv6 prefixes of the same length apart
+func prefixKey(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return prefix.Bits()
+	}
+	return 1000 + prefix.Bits()
+}
+
+// Lookup returns the region of the most specific network containing addr
+func (db *DB) Lookup(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, key := range db.bits {
+		bits := key
+		if key >= 1000 {
+			if addr.Is4() {
+				continue
+			}
+			bits = key - 1000
+		} else if !addr.Is4() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if region, ok := db.byBits[key][prefix]; ok {
+			return region, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of networks in db
+func (db *DB) Len() int {
+	return db.count
+}
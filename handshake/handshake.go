@@ -0,0 +1,141 @@
+// Package handshake bounds the SOCKS negotiation of client connections: the
+// time from accepting a connection until its request is handed to the dialer,
+// and how many connections may be in that phase at once. This keeps slowloris
+// clients, which open connections and then send nothing or trickle bytes, from
+// exhausting file descriptors before they ever authenticate.
+package handshake
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sequring/chameleon/metrics"
+)
+
+// Guard limits the negotiation of the connections accepted through its listeners
+type Guard struct {
+	timeout    time.Duration
+	maxPending int64
+	pending    atomic.Int64
+	rejected   atomic.Uint64 // logged every rejectLogEvery rejections
+}
+
+// rejectLogEvery is how often rejections at the half-open limit are logged
+const rejectLogEvery = 100
+
+// NewGuard returns a Guard that closes connections still negotiating after
+// timeout and rejects new ones while maxPending connections are negotiating.
+// Zero disables the respective limit.
+func NewGuard(timeout time.Duration, maxPending int) *Guard {
+	return &Guard{timeout: timeout, maxPending: int64(maxPending)}
+}
+
+// Pending returns the number of connections currently negotiating
+func (g *Guard) Pending() int {
+	return int(g.pending.Load())
+}
+
+// Listener wraps l so its connections are subject to g until Done is called
+// on them. Listeners wrapped by the same Guard share its half-open limit.
+func (g *Guard) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, guard: g}
+}
+
+type listener struct {
+	net.Listener
+	guard *Guard
+}
+
+// Accept returns the next connection that fits under the half-open limit.
+// Connections beyond it are closed right away.
+func (l *listener) Accept() (net.Conn, error) {
+	g := l.guard
+	for {
+		nc, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if n := g.pending.Add(1); g.maxPending > 0 && n > g.maxPending {
+			g.pending.Add(-1)
+			nc.Close()
+			metrics.SocksHandshakesAbortedTotal.WithLabelValues("limit").Inc()
+			if n := g.rejected.Add(1); n%rejectLogEvery == 1 {
+				log.Printf("Warning: %d SOCKS clients are negotiating, rejecting new connections (%d rejected so far)", g.maxPending, n)
+			}
+			continue
+		}
+		metrics.SocksHalfOpenConnections.Inc()
+		c := &conn{Conn: nc, guard: g}
+		if g.timeout > 0 {
+			c.deadline = time.Now().Add(g.timeout)
+			nc.SetDeadline(c.deadline)
+		}
+		return c, nil
+	}
+}
+
+// conn is a client connection that is negotiating until done
+type conn struct {
+	net.Conn
+	guard    *Guard
+	deadline time.Time
+	once     sync.Once
+}
+
+// done ends the negotiation: the deadline is lifted and the slot freed
+func (c *conn) done() {
+	c.once.Do(func() {
+		if !c.deadline.IsZero() {
+			c.Conn.SetDeadline(time.Time{})
+		}
+		c.release()
+	})
+}
+
+func (c *conn) release() {
+	c.guard.pending.Add(-1)
+	metrics.SocksHalfOpenConnections.Dec()
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+			metrics.SocksHandshakesAbortedTotal.WithLabelValues("timeout").Inc()
+		}
+		c.release()
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the wrapped connection
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Done marks the negotiation of c as complete once its request is about to be
+// served. It looks through wrappers that expose the connection they wrap with
+// a NetConn method and does nothing for connections not from a Guard.
+func Done(c any) {
+	for c != nil {
+		if gc, ok := c.(*conn); ok {
+			gc.done()
+			return
+		}
+		wrapper, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		c = wrapper.NetConn()
+	}
+}
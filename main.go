@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"os"
@@ -14,12 +18,28 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/sequring/chameleon/admin"
+	"github.com/sequring/chameleon/api"
 	"github.com/sequring/chameleon/auth"
 	"github.com/sequring/chameleon/config"
 	"github.com/sequring/chameleon/dialer"
+	"github.com/sequring/chameleon/discovery"
+	"github.com/sequring/chameleon/events"
+	"github.com/sequring/chameleon/geoip"
+	"github.com/sequring/chameleon/handshake"
 	"github.com/sequring/chameleon/metrics"
+	"github.com/sequring/chameleon/nats"
 	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/secrets"
+	"github.com/sequring/chameleon/service"
+	"github.com/sequring/chameleon/session"
+	"github.com/sequring/chameleon/socks4"
+	"github.com/sequring/chameleon/tap"
+	"github.com/sequring/chameleon/telemetry"
+	"github.com/sequring/chameleon/upgrade"
+	"github.com/sequring/chameleon/usage"
 	"github.com/sequring/chameleon/utils"
+	"github.com/sequring/chameleon/webhook"
 	"github.com/things-go/go-socks5"
 )
 
@@ -27,15 +47,45 @@ const AppVersion = "0.1.0"
 
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-proxies" {
+		os.Exit(runCheckProxies(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "secret" {
+		os.Exit(runSecret(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		os.Exit(runService(os.Args[2:]))
+	}
+
 	// Command line flags
 	configPath := flag.String("config", "config.yml", "Path to the configuration file (supports .yml and .json)")
 	testConfig := flag.Bool("t", false, "Test configuration and exit")
 	enableMetrics := flag.Bool("metrics", true, "Enable legacy text metrics output to log")
+	strictConfig := flag.Bool("strict", false, "Reject unknown keys in the configuration file")
 
 	flag.Parse()
 
+	// Started by the Windows Service Control Manager, report to it; the
+	// service stays start pending until the listeners are serving
+	if err := service.Run(defaultServiceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run as a Windows service: %v\n", err)
+		os.Exit(1)
+	}
 	log.SetFlags(0) 
-	appCfg, err := config.Load(*configPath)
+	secretBox, err := secrets.Default()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid secret key: %v\n", err)
+		os.Exit(1)
+	}
+
+	loadConfig := config.Load
+	if *strictConfig {
+		loadConfig = config.LoadStrict
+	}
+	appCfg, err := loadConfig(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading application configuration from '%s': %v\n", *configPath, err)
 		fmt.Fprintln(os.Stderr, "Configuration test failed.")
@@ -52,6 +102,9 @@ func main() {
 		fmt.Fprintln(os.Stderr, strings.Join(errorMessages, "\n"))
 		os.Exit(1)
 	}
+	if secretBox != nil {
+		log.Println("Secret key loaded: encrypted credentials are decrypted at load and files are written with passwords encrypted")
+	}
 
 	// Get absolute path to the proxies file
 	abProxiesPath, err := filepath.Abs(appCfg.Proxies.ConfigFilePath)
@@ -70,6 +123,16 @@ func main() {
 	}
 
 	proxyDefsManager := config.NewProxyDefinitionsManager(proxiesFilePath)
+	proxyDefsManager.SetReloadToken(appCfg.Server.ReloadToken)
+	proxyDefsManager.SetReloadTokens(appCfg.Server.ReloadTokens)
+	if err := proxyDefsManager.SetTagRules(appCfg.Proxies.TagRules); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid proxies.tag_rules: %v\n", err)
+		os.Exit(1)
+	}
+	if err := proxyDefsManager.SetDuplicatePolicy(appCfg.Proxies.DuplicatePolicy); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid proxies.duplicate_policy: %v\n", err)
+		os.Exit(1)
+	}
 	if err := proxyDefsManager.LoadDefinitions(); err != nil {
 		log.Printf("Error loading proxy definitions from '%s': %v", proxiesFilePath, err)
 		if *testConfig {
@@ -102,11 +165,97 @@ func main() {
 
 	users, err := auth.LoadUsersFromFile(abUsersPath)
 	if err != nil {
-		log.Fatalf("Failed to load users from file: %v", err)
+		missing := errors.Is(err, fs.ErrNotExist) || errors.Is(err, auth.ErrNoUsers)
+		if !missing || (appCfg.Users.MissingFilePolicy != "start_empty" && !appCfg.Users.JWT.Enabled && appCfg.Users.AuthBackend != "ldap") {
+			log.Fatalf("Failed to load users from file: %v", err)
+		}
+		log.Printf("Warning: %v. Starting with no users until users are added via the admin API (users.empty_store_behavior: %s).", err, appCfg.Users.EmptyStoreBehavior)
+		users = nil
 	}
 	auth.SetUsers(users)
+	auth.SetPolicy(appCfg.Users.DefaultBehavior, appCfg.Users.DefaultProxyTag)
+	if err := auth.DefaultAuth.SetEmptyStorePolicy(appCfg.Users.EmptyStoreBehavior, appCfg.Users.AnonymousCIDRs); err != nil {
+		log.Fatalf("Invalid users.anonymous_cidrs: %v", err)
+	}
+	if len(users) == 0 && appCfg.Users.EmptyStoreBehavior == auth.EmptyStoreAllowAnonymousCIDR {
+		log.Printf("WARNING: no users defined; admitting anonymous clients from %v until users are added", appCfg.Users.AnonymousCIDRs)
+	}
 	log.Printf("Loaded %d users from %s", len(users), abUsersPath)
 
+	var tokenVerifier *auth.TokenVerifier
+	if jwtCfg := appCfg.Users.JWT; jwtCfg.Enabled {
+		tokenVerifier = auth.NewTokenVerifier(auth.TokenConfig{
+			JWKSURL:          jwtCfg.JWKSURL,
+			Issuer:           jwtCfg.Issuer,
+			Audience:         jwtCfg.Audience,
+			UsernameClaim:    jwtCfg.UsernameClaim,
+			TagsClaim:        jwtCfg.TagsClaim,
+			MaxSessionsClaim: jwtCfg.MaxSessionsClaim,
+			Leeway:           time.Duration(jwtCfg.LeewaySecs) * time.Second,
+			CacheTTL:         time.Duration(jwtCfg.CacheTTLSecs) * time.Second,
+		})
+		if err := tokenVerifier.Refresh(context.Background()); err != nil {
+			log.Printf("Warning: %v; access tokens are rejected until the signing keys can be fetched", err)
+		}
+		auth.DefaultAuth.SetTokenVerifier(tokenVerifier)
+		log.Printf("Access token logins enabled, signing keys from %s", jwtCfg.JWKSURL)
+	}
+	if appCfg.Users.AuthBackend == "ldap" {
+		ldapCfg := appCfg.Users.LDAP
+		directory, err := auth.NewLDAPBackend(auth.LDAPConfig{
+			URL:            ldapCfg.URL,
+			StartTLS:       ldapCfg.StartTLS,
+			CAFile:         ldapCfg.CAFile,
+			BindDN:         ldapCfg.BindDN,
+			BindPassword:   ldapCfg.BindPassword,
+			BaseDN:         ldapCfg.BaseDN,
+			UserFilter:     ldapCfg.UserFilter,
+			GroupAttribute: ldapCfg.GroupAttribute,
+			GroupTags:      ldapCfg.GroupTags,
+			CacheTTL:       time.Duration(ldapCfg.CacheTTLSecs) * time.Second,
+			Timeout:        time.Duration(ldapCfg.TimeoutSecs) * time.Second,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up the LDAP auth backend: %v", err)
+		}
+		auth.DefaultAuth.SetLDAPBackend(directory)
+		log.Printf("LDAP auth backend enabled, users looked up in %s below %s", ldapCfg.URL, ldapCfg.BaseDN)
+	}
+
+	auditor := auth.DefaultAuth.Auditor()
+	auditor.SetWindow(time.Duration(appCfg.Users.AuthFailureWindowSec) * time.Second)
+	auditor.AddHandler(func(ev auth.AuthEvent) {
+		result := "failure"
+		if ev.Success {
+			result = "success"
+		}
+		metrics.SocksAuthTotal.WithLabelValues(result, ev.Reason).Inc()
+	})
+
+	if appCfg.Telemetry.Enabled {
+		shutdownTracing, err := telemetry.Setup(context.Background(), telemetry.Config{
+			Endpoint:       appCfg.Telemetry.Endpoint,
+			Protocol:       appCfg.Telemetry.Protocol,
+			Insecure:       appCfg.Telemetry.Insecure,
+			Headers:        appCfg.Telemetry.Headers,
+			ServiceName:    appCfg.Telemetry.ServiceName,
+			ServiceVersion: AppVersion,
+			SampleRatio:    appCfg.Telemetry.SampleRatio,
+		})
+		if err != nil {
+			log.Fatalf("Failed to enable tracing: %v", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				log.Printf("Error flushing traces: %v", err)
+			}
+		}()
+		log.Printf("Tracing enabled: exporting spans via OTLP/%s to %s (sample ratio %.2f)",
+			appCfg.Telemetry.Protocol, appCfg.Telemetry.Endpoint, appCfg.Telemetry.SampleRatio)
+	}
+
 	proxyCheckInterval := time.Duration(appCfg.Proxies.CheckIntervalSecs) * time.Second
 	proxyCheckTimeout := time.Duration(appCfg.Proxies.CheckTimeoutSecs) * time.Second
 
@@ -117,21 +266,212 @@ func main() {
 		proxyCheckTimeout,
 		appCfg.Proxies.HealthCheckTarget,
 	)
+	configurePool(pool, appCfg.Proxies, appCfg.Proxies.Strategy, appCfg.Proxies.HealthCheckTargets)
+
+	// Forward high-severity pool events to the webhook if configured
+	var webhookHandler func(proxypool.Event)
+	if appCfg.Webhook.URL != "" {
+		notifier := webhook.New(appCfg.Webhook.URL, time.Duration(appCfg.Webhook.PostTimeoutSec)*time.Second)
+		webhookHandler = forwardPoolEvents(notifier)
+		pool.AddEventHandler(webhookHandler)
+		if appCfg.Webhook.AuthEvents != "none" {
+			forwardAuthEvents(auditor, notifier, appCfg.Webhook.AuthEvents == "all")
+		}
+	}
+
+	// Structured events for the admin API's event stream
+	eventHub := events.NewHub(events.DefaultHistory)
+	publishPoolEvents(eventHub, "", pool, proxyDefsManager)
+	auditor.AddHandler(func(ev auth.AuthEvent) {
+		if !ev.Success {
+			eventHub.Publish(events.TypeAuthFailure, string(proxypool.SeverityWarning), ev)
+		}
+	})
+
+	// Named pools have their own definitions file and health checks
+	namedPools := make(map[string]*proxypool.Pool, len(appCfg.Pools))
+	poolManagers := []*config.ProxyDefinitionsManager{proxyDefsManager}
+	for _, poolCfg := range appCfg.Pools {
+		mgr, namedPool := newNamedPool(poolCfg, appCfg.Proxies)
+		if webhookHandler != nil {
+			namedPool.AddEventHandler(webhookHandler)
+		}
+		publishPoolEvents(eventHub, poolCfg.Name, namedPool, mgr)
+		namedPools[poolCfg.Name] = namedPool
+		poolManagers = append(poolManagers, mgr)
+	}
 
 	oldMetricsSvc := &dialer.Metrics{}
-	appDialer := dialer.New(pool, oldMetricsSvc)
+	sessions := session.NewRegistry()
+	appDialer := dialer.New(pool, oldMetricsSvc, sessions)
+	appDialer.SetTagPolicy(auth.DefaultAuth)
+	appDialer.SetEvents(eventHub)
+	appDialer.SetUpstreamCredentials(auth.DefaultAuth)
+	appDialer.SetPools(namedPools)
+	dialTimeouts := make([]dialer.TagTimeout, 0, len(appCfg.Proxies.DialTimeoutOverrides))
+	for _, rule := range appCfg.Proxies.DialTimeoutOverrides {
+		dialTimeouts = append(dialTimeouts, dialer.TagTimeout{Tag: rule.Tag, Timeout: time.Duration(rule.Seconds) * time.Second})
+	}
+	appDialer.SetDialTimeouts(time.Duration(appCfg.Proxies.DialTimeoutSecs)*time.Second, dialTimeouts)
+	appDialer.SetSessionLimits(time.Duration(appCfg.Server.SessionIdleTimeoutSecs)*time.Second,
+		time.Duration(appCfg.Server.SessionMaxLifetimeSecs)*time.Second)
+	if len(appCfg.Proxies.Hedging) > 0 {
+		hedging := make(map[string]time.Duration, len(appCfg.Proxies.Hedging))
+		for _, rule := range appCfg.Proxies.Hedging {
+			hedging[rule.Tag] = time.Duration(rule.DelayMs) * time.Millisecond
+		}
+		appDialer.SetHedging(hedging)
+	}
+	appDialer.SetTCPOptions(tcpOptions(appCfg.Server.TCP.Client), tcpOptions(appCfg.Server.TCP.Upstream))
+	if appCfg.Server.MaxConnections > 0 {
+		limit := dialer.ConnectionLimit{Max: appCfg.Server.MaxConnections}
+		overflow := "rejected"
+		if appCfg.Server.MaxConnectionsMode == "queue" {
+			limit.QueueTimeout = time.Duration(appCfg.Server.MaxConnectionsQueueTimeoutSecs) * time.Second
+			overflow = fmt.Sprintf("queued for up to %v", limit.QueueTimeout)
+		}
+		appDialer.SetConnectionLimit(limit)
+		log.Printf("Connection limit: %d connections, further requests are %s", appCfg.Server.MaxConnections, overflow)
+	}
+	if rd := appCfg.Proxies.Redial; rd.MaxAttempts > 1 {
+		appDialer.SetRedial(dialer.RedialConfig{
+			MaxAttempts: rd.MaxAttempts,
+			Window:      time.Duration(rd.WindowMs) * time.Millisecond,
+			BufferBytes: rd.ReplayBufferBytes,
+		})
+		log.Printf("Redialing enabled: connections closed within %dms without a reply are retried, up to %d upstream connections per request",
+			rd.WindowMs, rd.MaxAttempts)
+	}
+	if bl := appCfg.Proxies.DestinationBlacklist; bl.Enabled {
+		appDialer.SetDestinationBlacklist(dialer.DestinationBlacklist{
+			Window:       time.Duration(bl.WindowSecs) * time.Second,
+			MinAttempts:  bl.MinAttempts,
+			FailureRatio: bl.FailureRatio,
+			Duration:     time.Duration(bl.DurationSecs) * time.Second,
+		})
+		log.Printf("Destination blacklist enabled: %d+ dials with a failure ratio of %.2f within %ds avoid a proxy for %ds",
+			bl.MinAttempts, bl.FailureRatio, bl.WindowSecs, bl.DurationSecs)
+	}
+	if geo := appCfg.Proxies.GeoProximity; geo.Enabled {
+		geoDB, err := geoip.Load(geo.DatabaseFile)
+		if err != nil {
+			log.Fatalf("Invalid proxies.geo_proximity: %v", err)
+		}
+		appDialer.SetGeoProximity(dialer.GeoProximity{
+			DB:              geoDB,
+			TagPrefix:       geo.TagPrefix,
+			CacheTTL:        time.Duration(geo.CacheTTLSecs) * time.Second,
+			ResolveTimeout:  time.Duration(geo.ResolveTimeoutMs) * time.Millisecond,
+			MaxCacheEntries: geo.MaxCacheEntries,
+		})
+		log.Printf("Geo proximity enabled: %d networks from %s, preferring proxies tagged %s<region>", geoDB.Len(), geo.DatabaseFile, geo.TagPrefix)
+	}
+	if rd := appCfg.Logging.RedactDestinations; rd.Mode != "" {
+		appDialer.SetDestinationRedaction(dialer.DestinationRedaction{
+			Mode:  rd.Mode,
+			Salt:  rd.Salt,
+			Users: rd.Users,
+		})
+		scope := "all users"
+		if len(rd.Users) > 0 {
+			scope = fmt.Sprintf("%d users", len(rd.Users))
+		}
+		log.Printf("Destination redaction enabled: destinations of %s are logged in '%s' form", scope, rd.Mode)
+	}
+	if tp := appCfg.Users.Tarpit; tp.Mode != "" {
+		appDialer.SetTarpit(dialer.Tarpit{
+			Mode:          tp.Mode,
+			DripInterval:  time.Duration(tp.DripIntervalSecs) * time.Second,
+			MaxDuration:   time.Duration(tp.MaxDurationSecs) * time.Second,
+			MaxConcurrent: tp.MaxConcurrent,
+		})
+		log.Printf("Tarpit enabled: CONNECTs denied by the routing are logged and handled in '%s' mode", tp.Mode)
+	}
+	if appCfg.Tap.Enabled {
+		sessionTap, err := tap.Open(appCfg.Tap.OutputFile, tap.Filter{
+			Users:        appCfg.Tap.Users,
+			Destinations: appCfg.Tap.Destinations,
+		}, appCfg.Tap.CaptureBytes)
+		if err != nil {
+			log.Fatalf("Failed to enable session tap: %v", err)
+		}
+		defer sessionTap.Close()
+		appDialer.SetTap(sessionTap)
+		log.Printf("WARNING: session tap enabled, writing to %s (users: %v, destinations: %v, capture_bytes: %d)",
+			appCfg.Tap.OutputFile, appCfg.Tap.Users, appCfg.Tap.Destinations, appCfg.Tap.CaptureBytes)
+	}
 
 	appCtx, appCancel := context.WithCancel(context.Background())
 	defer appCancel()
 
+	if tokenVerifier != nil {
+		go tokenVerifier.Run(time.Duration(appCfg.Users.JWT.RefreshIntervalSecs)*time.Second, appCtx.Done())
+	}
+
+	// Accumulate per-user monthly traffic for billing exports
+	var usageStore *usage.Store
+	if appCfg.Usage.Enabled {
+		usageStore, err = usage.Open(appCfg.Usage.FilePath, appCfg.Usage.RetentionMonths)
+		if err != nil {
+			log.Fatalf("Failed to open usage store: %v", err)
+		}
+		appDialer.SetUsage(usageStore)
+		go usageStore.Run(time.Duration(appCfg.Usage.FlushIntervalSecs)*time.Second, appCtx.Done())
+		defer func() {
+			if err := usageStore.Flush(); err != nil {
+				log.Printf("Failed to save usage: %v", err)
+			}
+		}()
+		log.Printf("Usage accounting enabled, saving to %s every %ds", appCfg.Usage.FilePath, appCfg.Usage.FlushIntervalSecs)
+	}
+
+	// Stream per-user and per-proxy traffic to external pipelines
+	if stream := appCfg.Usage.Stream; stream.Enabled {
+		publishers := make(map[string]usage.Publisher)
+		if stream.Webhook {
+			publishers["webhook"] = webhook.New(appCfg.Webhook.URL, time.Duration(appCfg.Webhook.PostTimeoutSec)*time.Second)
+		}
+		if stream.NATS.URL != "" {
+			natsPublisher, err := nats.New(stream.NATS.URL, stream.NATS.Subject, time.Duration(stream.NATS.TimeoutSecs)*time.Second)
+			if err != nil {
+				log.Fatalf("Failed to configure NATS usage stream: %v", err)
+			}
+			defer natsPublisher.Close()
+			publishers["nats"] = natsPublisher
+		}
+		collector := usage.NewCollector()
+		appDialer.SetUsageStream(collector)
+		go collector.Stream(time.Duration(stream.IntervalSecs)*time.Second, publishers, appCtx.Done())
+		log.Printf("Usage stream enabled, publishing every %ds", stream.IntervalSecs)
+	}
+
+	// Merge proxies from discovery sources into the pool
+	for _, src := range appCfg.Proxies.Discovery {
+		runner, err := discovery.NewRunner(src, proxyDefsManager)
+		if err != nil {
+			log.Fatalf("Failed to start proxy discovery %s: %v", src.Name, err)
+		}
+		go runner.Run(appCtx)
+	}
+
 	// Define metrics interval
 	metricsUpdateInterval := 30 * time.Second
 
 	// Start Prometheus metrics server if enabled
 	if appCfg.Prometheus.Enabled {
 		log.Printf("Initializing Prometheus exporter on port %s", appCfg.Prometheus.Port)
+		if err := metrics.ConfigureProxyLabels(appCfg.Prometheus.ProxyLabel, appCfg.Prometheus.ProxyLabelMaxLength); err != nil {
+			log.Printf("Warning: %v; using full proxy addresses as metric labels", err)
+		}
 		promExporter := metrics.NewPrometheusExporter(pool, appCfg.Prometheus.Port)
-		
+		promExporter.RegisterDialerStats(appDialer)
+		for name, namedPool := range namedPools {
+			promExporter.AddPool(name, namedPool)
+		}
+		promExporter.SetLastErrorMetric(appCfg.Prometheus.LastErrorMetric)
+		// Bind now so the socket is adopted before upgrade readiness; Start reports failures
+		_ = promExporter.Listen()
+
 		// Start Prometheus server
 		go func() {
 			log.Println("Starting Prometheus metrics server...")
@@ -167,55 +507,596 @@ func main() {
 		log.Println("Prometheus metrics endpoint is disabled (prometheus.enabled is false)")
 	}
 
+	// Start admin API server
+	adminSrv := admin.New(appCfg.Server.AdminPort, appCfg.Server.AdminToken, admin.Deps{
+		Pool:        pool,
+		Pools:       namedPools,
+		Definitions: proxyDefsManager,
+		Users:       auth.DefaultAuth,
+		UsersFile:   abUsersPath,
+		Sessions:    sessions,
+		Dialer:      appDialer,
+		Usage:       usageStore,
+		Config:      appCfg,
+		Version:     AppVersion,
+		Events:      eventHub,
+	})
+	adminSrv.SetRequireActiveProxy(!appCfg.Proxies.AllowEmptyPool)
+	adminSrv.SetUserDebugDuration(time.Duration(appCfg.Server.UserDebugSecs) * time.Second)
+	_ = adminSrv.Listen() // Start reports failures
+	go func() {
+		if err := adminSrv.Start(); err != nil {
+			log.Printf("Admin API server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-appCtx.Done()
+		if err := adminSrv.Stop(); err != nil {
+			log.Printf("Error stopping admin API server: %v", err)
+		}
+	}()
+
+	// Start gRPC admin API server if configured
+	if appCfg.Server.GRPCPort != "" {
+		grpcSrv := api.New(appCfg.Server.GRPCPort, appCfg.Server.AdminToken, api.Deps{
+			Pool:        pool,
+			Definitions: proxyDefsManager,
+			Users:       auth.DefaultAuth,
+			UsersFile:   abUsersPath,
+			Sessions:    sessions,
+		})
+		_ = grpcSrv.Listen() // Start reports failures
+		go func() {
+			if err := grpcSrv.Start(); err != nil {
+				log.Printf("gRPC API server failed: %v", err)
+			}
+		}()
+		go func() {
+			<-appCtx.Done()
+			grpcSrv.Stop()
+		}()
+	}
+
 	// Start legacy metrics if enabled
 	if *enableMetrics {
 		go dialer.PrintMetrics(appCtx, metricsUpdateInterval, pool, oldMetricsSvc)
 	}
 
 	// Create SOCKS5 server instance
-	server := socks5.NewServer(
-		socks5.WithDial(appDialer.Dial),
-		socks5.WithAuthMethods([]socks5.Authenticator{
-			socks5.UserPassAuthenticator{Credentials: auth.GetCredentialStore()},
-		}),
-	)
+	server := newSocksServer(appDialer, dialer.RequestContext{})
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	service.Notify(sigChan)
+
+	// SIGHUP reloads the proxy definitions file
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Println("Received SIGHUP, reloading proxy definitions...")
+			for _, mgr := range poolManagers {
+				if err := mgr.TriggerReload(); err != nil {
+					log.Printf("Reload failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	// SIGUSR1 dumps a snapshot of the pool, dial counters and sessions
+	usr1Chan := make(chan os.Signal, 1)
+	notifyStatsSignal(usr1Chan)
+	go func() {
+		for range usr1Chan {
+			dumpStats(appDialer, appCfg.Server.StatsDumpFile)
+		}
+	}()
+
+	// SOCKS4 clients are detected on every SOCKS listener when enabled
+	var legacy *socks4.Server
+	if appCfg.Server.Socks4.Enabled {
+		socks4Cfg := appCfg.Server.Socks4
+		legacy, err = socks4.New(socks4.Config{
+			AllowedCIDRs: socks4Cfg.AllowedCIDRs,
+			User:         socks4Cfg.User,
+			UserMap:      socks4Cfg.UserMap,
+		}, appDialer.HandleSocks4)
+		if err != nil {
+			log.Fatalf("Invalid server.socks4: %v", err)
+		}
+		legacy.SetAdmit(auth.DefaultAuth.AdmitSocks4)
+		legacy.SetContext(appCtx)
+	}
+
+	// Give every proxy its first health check before accepting clients, so they
+	// don't hit a pool where nothing is active yet
+	if appCfg.Proxies.StartupReadyTimeoutSecs > 0 {
+		waitForWarmPool(pool, time.Duration(appCfg.Proxies.StartupReadyTimeoutSecs)*time.Second)
+		for _, namedPool := range namedPools {
+			waitForWarmPool(namedPool, time.Duration(appCfg.Proxies.StartupReadyTimeoutSecs)*time.Second)
+		}
+	}
 
-	errChan := make(chan error, 1)
+	// Every SOCKS listener shares the bounds on clients that have not completed
+	// the negotiation yet
+	guard := handshake.NewGuard(time.Duration(appCfg.Server.HandshakeTimeoutSecs)*time.Second, appCfg.Server.MaxHalfOpenConnections)
+
+	errChan := make(chan error, 3)
 	// Start SOCKS5 server
 	listenAddr := appCfg.Server.SocksPort
 	if listenAddr == "" {
 		listenAddr = ":1080"
 	}
 	
-	listener, err := net.Listen("tcp", listenAddr)
+	listener, err := upgrade.Listen("tcp", listenAddr)
 	if err != nil {
 		log.Fatalf("Failed to start SOCKS5 server: %v", err)
 	}
 	defer listener.Close()
 	
 	// Start serving in a goroutine
+	go serveSocks(server, legacy, guard, listener, "SOCKS5", errChan)
+
+	// Start the TLS-wrapped SOCKS5 (socks5s) listener if enabled
+	var tlsListener net.Listener
+	if appCfg.Server.TLS.Enabled {
+		tlsListener, err = listenSocksTLS(appCfg.Server.TLS)
+		if err != nil {
+			log.Fatalf("Failed to start SOCKS5 over TLS server: %v", err)
+		}
+		defer tlsListener.Close()
+		log.Printf("SOCKS5 over TLS listening on %s", appCfg.Server.TLS.ListenAddr)
+		go serveSocks(server, legacy, guard, tlsListener, "SOCKS5 over TLS", errChan)
+	}
+
+	// Start the dedicated SOCKS4 listener if configured
+	var socks4Listener net.Listener
+	if legacy != nil && appCfg.Server.Socks4.ListenAddr != "" {
+		socks4Listener, err = upgrade.Listen("tcp", appCfg.Server.Socks4.ListenAddr)
+		if err != nil {
+			log.Fatalf("Failed to start SOCKS4 server: %v", err)
+		}
+		defer socks4Listener.Close()
+		log.Printf("SOCKS4 listening on %s", appCfg.Server.Socks4.ListenAddr)
+		go serveSocks(server, legacy, guard, socks4Listener, "SOCKS4", errChan)
+	}
+
+	// Start the listeners bound to named pools; they serve SOCKS5 only
+	var poolListeners []net.Listener
+	for _, poolCfg := range appCfg.Pools {
+		if poolCfg.ListenAddr == "" {
+			continue
+		}
+		poolListener, err := upgrade.Listen("tcp", poolCfg.ListenAddr)
+		if err != nil {
+			log.Fatalf("Failed to start SOCKS5 server of pool '%s': %v", poolCfg.Name, err)
+		}
+		defer poolListener.Close()
+		poolListeners = append(poolListeners, poolListener)
+		log.Printf("SOCKS5 for pool '%s' listening on %s", poolCfg.Name, poolCfg.ListenAddr)
+		go serveSocks(newSocksServer(appDialer, dialer.RequestContext{Pool: poolCfg.Name}), nil, guard, poolListener, "SOCKS5 pool "+poolCfg.Name, errChan)
+	}
+	adminSrv.SetReady(true)
+	if upgrade.Default().IsUpgrade() {
+		log.Printf("Upgrade: serving on the listeners of the previous process")
+	}
+	if err := upgrade.Default().Ready(); err != nil {
+		log.Printf("Upgrade: %v", err)
+	}
+	if appCfg.Server.PIDFile != "" {
+		if err := upgrade.WritePIDFile(appCfg.Server.PIDFile); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		defer upgrade.RemovePIDFile(appCfg.Server.PIDFile)
+	}
+
+	// SIGUSR2 upgrades the binary in place: a new process takes over the listeners
+	usr2Chan := make(chan os.Signal, 1)
+	notifyUpgradeSignal(usr2Chan)
+
+	// Tell systemd (Type=notify) or the Windows Service Control Manager that
+	// the listeners are serving, and keep the systemd watchdog fed
+	if err := service.Ready(); err != nil {
+		log.Printf("Service: %v", err)
+	}
+	service.Status(fmt.Sprintf("Serving SOCKS5 on %s", listenAddr))
+	go service.Watchdog(appCtx)
+
+	for {
+		select {
+		case errVal, ok := <-errChan:
+			if ok && errVal != nil {
+				log.Fatalf("SOCKS server failed: %v", errVal)
+			} else {
+				log.Println("SOCKS5 server has stopped.")
+			}
+		case s := <-sigChan:
+			log.Printf("Received signal: %v. Shutting down...", s)
+			adminSrv.SetReady(false)
+			service.Stopping()
+			appCancel()
+			stopPools(pool, namedPools)
+			log.Println("SOCKS5 server will stop as part of process termination.")
+		case <-usr2Chan:
+			log.Println("Received SIGUSR2, starting a new process to take over the listeners...")
+			pid, err := upgrade.Default().Upgrade(upgrade.DefaultReadyTimeout)
+			if err != nil {
+				log.Printf("Upgrade failed, this process keeps serving: %v", err)
+				continue
+			}
+			log.Printf("Upgrade: process %d took over the listeners; draining", pid)
+			adminSrv.SetReady(false)
+			listener.Close()
+			if tlsListener != nil {
+				tlsListener.Close()
+			}
+			if socks4Listener != nil {
+				socks4Listener.Close()
+			}
+			for _, poolListener := range poolListeners {
+				poolListener.Close()
+			}
+			appCancel()
+			stopPools(pool, namedPools)
+			drainSessions(sessions, appDialer, time.Duration(appCfg.Server.UpgradeDrainTimeoutSecs)*time.Second, sigChan)
+		}
+		break
+	}
+	log.Println("Application finished.")
+	service.Exit()
+}
+
+// newSocksServer returns a SOCKS5 server dialing through d whose requests are
+// recorded by rule
+func newSocksServer(d *dialer.Dialer, rule dialer.RequestContext) *socks5.Server {
+	return socks5.NewServer(
+		socks5.WithDial(d.Dial),
+		socks5.WithResolver(dialer.UpstreamResolver{}),
+		socks5.WithRule(rule),
+		socks5.WithConnectHandle(d.HandleConnect),
+		socks5.WithAuthMethods([]socks5.Authenticator{
+			socks5.UserPassAuthenticator{Credentials: auth.GetCredentialStore()},
+			auth.AnonymousAuthenticator{Auth: auth.DefaultAuth},
+		}),
+	)
+}
+
+// configureTLSCheck applies the pool-wide and the per-proxy and per-tag TLS
+// check settings to pool
+func configureTLSCheck(pool *proxypool.Pool, cfg config.TLSCheckConfig) {
+	loadCA := func(path string) *x509.CertPool {
+		if path == "" {
+			return nil
+		}
+		roots, err := config.LoadCertPool(path)
+		if err != nil {
+			log.Fatalf("Invalid proxies.health_check_tls: %v", err)
+		}
+		return roots
+	}
+	if cfg.SkipVerify || cfg.CAFile != "" || cfg.ServerName != "" {
+		pool.ConfigureTLS(cfg.SkipVerify, loadCA(cfg.CAFile), cfg.ServerName)
+	}
+	overrides := make([]proxypool.TLSCheckOverride, 0, len(cfg.Overrides))
+	for _, o := range cfg.Overrides {
+		overrides = append(overrides, proxypool.TLSCheckOverride{
+			Address: o.Proxy,
+			Tag:     o.Tag,
+			TLSCheckConfig: proxypool.TLSCheckConfig{
+				SkipVerify: o.SkipVerify,
+				RootCAs:    loadCA(o.CAFile),
+				ServerName: o.ServerName,
+			},
+		})
+	}
+	pool.SetTLSCheckOverrides(overrides)
+}
+
+// tcpOptions converts the TCP options of one side of relayed sessions
+func tcpOptions(cfg config.TCPTuningConfig) dialer.TCPOptions {
+	return dialer.TCPOptions{
+		NoDelay:     cfg.NoDelay,
+		KeepAlive:   time.Duration(cfg.KeepAliveSecs) * time.Second,
+		ReadBuffer:  cfg.ReadBufferBytes,
+		WriteBuffer: cfg.WriteBufferBytes,
+	}
+}
+
+// stopPools stops the health checks of the default and the named pools
+func stopPools(pool *proxypool.Pool, named map[string]*proxypool.Pool) {
+	pool.Stop()
+	for _, namedPool := range named {
+		namedPool.Stop()
+	}
+}
+
+// dumpStats writes the dialer's stats snapshot to path, or to the log if path is empty
+func dumpStats(d *dialer.Dialer, path string) {
+	if path == "" {
+		var buf bytes.Buffer
+		d.WriteStats(&buf)
+		for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+			log.Print(line)
+		}
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to dump stats: %v", err)
+		return
+	}
+	err = d.WriteStats(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Failed to dump stats to %s: %v", path, err)
+		return
+	}
+	log.Printf("Stats dumped to %s", path)
+}
+
+// drainSessions waits until no dial or relayed session is left, drainTimeout
+// expires or a shutdown signal arrives
+func drainSessions(sessions *session.Registry, d *dialer.Dialer, drainTimeout time.Duration, sigChan <-chan os.Signal) {
+	deadline := time.After(drainTimeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		active, pending := sessions.Count(), d.PendingDials()
+		if active == 0 && pending == 0 {
+			log.Println("Upgrade: all sessions drained")
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Printf("Upgrade: drain timeout of %v expired, closing %d remaining sessions", drainTimeout, active)
+			return
+		case s := <-sigChan:
+			log.Printf("Received signal: %v while draining, closing %d remaining sessions", s, active)
+			return
+		}
+	}
+}
+
+// serveSocks serves SOCKS5 connections from l, and SOCKS4 ones if legacy is set,
+// and reports unexpected errors to errChan.
+func serveSocks(server *socks5.Server, legacy *socks4.Server, guard *handshake.Guard, l net.Listener, name string, errChan chan<- error) {
+	l = guard.Listener(l)
+	var errSrv error
+	if legacy != nil {
+		errSrv = legacy.Serve(l, server.ServeConn)
+	} else {
+		errSrv = server.Serve(l)
+	}
+	if errSrv != nil && !errors.Is(errSrv, net.ErrClosed) {
+		errChan <- fmt.Errorf("%s: %w", name, errSrv)
+	}
+}
+
+// waitForWarmPool waits up to timeout for the first health check of every proxy
+func waitForWarmPool(pool *proxypool.Pool, timeout time.Duration) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	pending, total := pool.WaitInitialChecks(ctx)
+	active := pool.ActiveProxyCount()
+	if pending > 0 {
+		log.Printf("Warning: %d of %d proxies not checked after %v, serving with %d active", pending, total, timeout, active)
+		return
+	}
+	log.Printf("Startup: checked %d proxies in %v, %d active", total, time.Since(start).Round(time.Millisecond), active)
+}
+
+// listenSocksTLS opens the TLS-wrapped SOCKS5 listener described by cfg.
+func listenSocksTLS(cfg config.SocksTLSConfig) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate/key pair: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	l, err := upgrade.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, tlsCfg), nil
+}
+
+// poolWebhookQueue bounds the pool events waiting for the webhook, so a slow or
+// unreachable endpoint cannot pile up goroutines; events beyond it are dropped.
+const poolWebhookQueue = 256
+
+// forwardPoolEvents returns an event handler posting the warning and critical
+// events of the pools it is added to to notifier from a single goroutine.
+func forwardPoolEvents(notifier *webhook.Notifier) func(proxypool.Event) {
+	queue := make(chan proxypool.Event, poolWebhookQueue)
 	go func() {
-		if errSrv := server.Serve(listener); errSrv != nil && !errors.Is(errSrv, net.ErrClosed) {
-			errChan <- errSrv
+		for ev := range queue {
+			if err := notifier.Send(ev); err != nil {
+				log.Printf("Failed to send webhook notification for event %s: %v", ev.Type, err)
+			}
 		}
-		close(errChan)
 	}()
+	return func(ev proxypool.Event) {
+		if ev.Severity == proxypool.SeverityInfo {
+			return
+		}
+		select {
+		case queue <- ev:
+		default:
+		}
+	}
+}
+
+// authWebhookQueue bounds the authentication events waiting for the webhook, so
+// a brute-force attempt cannot pile up goroutines; events beyond it are dropped.
+const authWebhookQueue = 256
+
+// authWebhookEvent is the webhook payload of an authentication audit event
+type authWebhookEvent struct {
+	Type string `json:"type"`
+	auth.AuthEvent
+}
 
-	select {
-	case errVal, ok := <-errChan:
-		if ok && errVal != nil {
-			log.Fatalf("SOCKS5 server failed: %v", errVal)
-		} else if !ok {
-			log.Println("SOCKS5 server has stopped (errChan closed).")
+// forwardAuthEvents posts authentication failures, and successes if all is set,
+// to notifier from a single goroutine.
+func forwardAuthEvents(auditor *auth.Auditor, notifier *webhook.Notifier, all bool) {
+	queue := make(chan authWebhookEvent, authWebhookQueue)
+	auditor.AddHandler(func(ev auth.AuthEvent) {
+		if ev.Success && !all {
+			return
 		}
-	case s := <-sigChan:
-		log.Printf("Received signal: %v. Shutting down...", s)
-		appCancel()
-		pool.Stop()
-		log.Println("SOCKS5 server will stop as part of process termination.")
+		payload := authWebhookEvent{Type: "auth_failure", AuthEvent: ev}
+		if ev.Success {
+			payload.Type = "auth_success"
+		}
+		select {
+		case queue <- payload:
+		default:
+		}
+	})
+	go func() {
+		for ev := range queue {
+			if err := notifier.Send(ev); err != nil {
+				log.Printf("Failed to send webhook notification for event %s: %v", ev.Type, err)
+			}
+		}
+	}()
+}
+
+// poolEventData is the payload of pool events in the event stream; Pool is
+// empty for the default pool
+type poolEventData struct {
+	Pool         string `json:"pool,omitempty"`
+	ProxyAddress string `json:"proxy_address,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// reloadEventData is the payload of proxies_reloaded events
+type reloadEventData struct {
+	Pool    string `json:"pool,omitempty"`
+	Proxies int    `json:"proxies"`
+}
+
+// publishPoolEvents publishes the events of pool and the definition changes of
+// mgr, the named pool's manager (name is empty for the default pool), to hub.
+func publishPoolEvents(hub *events.Hub, name string, pool *proxypool.Pool, mgr *config.ProxyDefinitionsManager) {
+	pool.AddEventHandler(func(ev proxypool.Event) {
+		hub.Publish(string(ev.Type), string(ev.Severity), poolEventData{
+			Pool:         name,
+			ProxyAddress: ev.ProxyAddress,
+			Message:      ev.Message,
+		})
+	})
+	reloads := mgr.Subscribe()
+	go func() {
+		for range reloads {
+			hub.Publish(events.TypeProxiesReloaded, string(proxypool.SeverityInfo), reloadEventData{
+				Pool:    name,
+				Proxies: len(mgr.GetDefinitions()),
+			})
+		}
+	}()
+}
+
+// configurePool applies the shared settings of the proxies section, strategy
+// and health check targets to pool
+func configurePool(pool *proxypool.Pool, proxies config.ProxiesConfig, strategy string, checkTargets []string) {
+	pool.SetStartupCheckConcurrency(proxies.StartupCheckConcurrency)
+	pool.SetPrewarm(proxypool.PrewarmConfig{
+		PerProxy:    proxies.Prewarm.ConnectionsPerProxy,
+		IdleTimeout: time.Duration(proxies.Prewarm.IdleTimeoutSecs) * time.Second,
+		HotWindow:   time.Duration(proxies.Prewarm.HotWindowSecs) * time.Second,
+	})
+	pool.SetSpeedTest(proxypool.SpeedTest{
+		URL:      proxies.SpeedTest.URL,
+		Bytes:    int64(proxies.SpeedTest.SizeKB) << 10,
+		Interval: time.Duration(proxies.SpeedTest.IntervalSecs) * time.Second,
+		Timeout:  time.Duration(proxies.SpeedTest.TimeoutSecs) * time.Second,
+	})
+
+	rotationWindows := make([]proxypool.RotationWindow, 0, len(proxies.RotationWindows))
+	for _, rule := range proxies.RotationWindows {
+		rotationWindows = append(rotationWindows, proxypool.RotationWindow{
+			Tag:      rule.Tag,
+			Fraction: rule.Fraction,
+			Period:   time.Duration(rule.PeriodSecs) * time.Second,
+		})
 	}
-	log.Println("Application finished.")
-}
\ No newline at end of file
+	pool.SetRotationWindows(rotationWindows)
+
+	chains := make([]proxypool.Chain, 0, len(proxies.Chains))
+	for _, rule := range proxies.Chains {
+		chains = append(chains, proxypool.Chain{EntryTag: rule.EntryTag, ExitTag: rule.ExitTag})
+	}
+	pool.SetChains(chains)
+
+	checkBackoff := make(map[proxypool.ErrorCategory]proxypool.CheckBackoff, len(proxies.CheckBackoff))
+	for _, rule := range proxies.CheckBackoff {
+		checkBackoff[proxypool.ErrorCategory(rule.Reason)] = proxypool.CheckBackoff{
+			Multiplier:  rule.Multiplier,
+			MaxInterval: time.Duration(rule.MaxIntervalSecs) * time.Second,
+		}
+	}
+	pool.SetCheckBackoff(checkBackoff)
+
+	successEvery := uint64(0)
+	if proxies.HealthCheckLogSuccessEvery > 0 {
+		successEvery = uint64(proxies.HealthCheckLogSuccessEvery)
+	}
+	pool.ConfigureHealthLogging(proxies.HealthCheckLogMode, successEvery)
+	pool.SetStrategy(proxypool.Strategy(strategy))
+	pool.SetCostLatencyTolerance(time.Duration(proxies.CostLatencyToleranceMs) * time.Millisecond)
+	pool.SetHealthCheckTargets(checkTargets, proxies.HealthCheckTargetOrder)
+	configureTLSCheck(pool, proxies.HealthCheckTLS)
+	pool.SetHealthAlert(proxypool.HealthAlert{
+		Threshold: proxies.HealthAlert.Threshold,
+		For:       time.Duration(proxies.HealthAlert.ForSecs) * time.Second,
+	})
+	pool.SetCanary(proxypool.Canary{
+		TrafficPercent: proxies.Canary.TrafficPercent,
+		MinRequests:    uint32(proxies.Canary.MinRequests),
+		SuccessRate:    proxies.Canary.SuccessRate,
+	})
+
+	if proxies.CheckType == "http" {
+		pool.SetHTTPCheck(&proxypool.HTTPCheck{
+			Path:         proxies.HTTPCheck.Path,
+			ExpectStatus: proxies.HTTPCheck.ExpectStatus,
+			ExpectBody:   proxies.HTTPCheck.ExpectBody,
+			Plain:        proxies.HTTPCheck.Plain,
+		})
+	}
+}
+
+// newNamedPool loads the definitions of the named pool cfg and starts its
+// health checks
+func newNamedPool(cfg config.PoolConfig, proxies config.ProxiesConfig) (*config.ProxyDefinitionsManager, *proxypool.Pool) {
+	path, err := filepath.Abs(cfg.ConfigFilePath)
+	if err != nil {
+		path = cfg.ConfigFilePath
+	}
+	mgr := config.NewProxyDefinitionsManager(path)
+	if err := mgr.SetTagRules(proxies.TagRules); err != nil {
+		log.Fatalf("Invalid proxies.tag_rules: %v", err)
+	}
+	if err := mgr.SetDuplicatePolicy(proxies.DuplicatePolicy); err != nil {
+		log.Fatalf("Invalid proxies.duplicate_policy: %v", err)
+	}
+	if err := mgr.LoadDefinitions(); err != nil {
+		log.Printf("Error loading proxy definitions of pool '%s' from '%s': %v", cfg.Name, path, err)
+	} else {
+		log.Printf("Pool '%s': loaded %d proxy definitions from %s", cfg.Name, len(mgr.GetDefinitions()), path)
+	}
+
+	pool := proxypool.New(mgr,
+		time.Duration(cfg.CheckIntervalSecs)*time.Second,
+		time.Duration(cfg.CheckTimeoutSecs)*time.Second,
+		cfg.HealthCheckTarget)
+	configurePool(pool, proxies, cfg.Strategy, cfg.HealthCheckTargets)
+	return mgr, pool
+}
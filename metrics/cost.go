@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// bytesPerGB converts relayed bytes to the unit of cost_per_gb
+const bytesPerGB = 1e9
+
+// Per-proxy traffic and the spend estimated from it
+var (
+	UpstreamProxyBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "bytes_total",
+		Help:      "Total bytes relayed through an upstream proxy, by direction (up: client to destination).",
+	},
+		[]string{"proxy_address", "direction"},
+	)
+	UpstreamProxyEstimatedSpendTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "estimated_spend_total",
+		Help:      "Estimated spend on an upstream proxy: the bytes relayed in both directions priced at its cost_per_gb at the time.",
+	},
+		[]string{"proxy_address"},
+	)
+)
+
+// ProxyTraffic counts the bytes of one session against its upstream proxy and
+// prices them at the proxy's cost per GB. Like TagTraffic, the counters are
+// resolved once per session.
+type ProxyTraffic struct {
+	up, down, spend prometheus.Counter
+	costPerByte     float64
+}
+
+// NewProxyTraffic returns traffic counters for a session through the proxy at
+// address, which costs costPerGB per GB relayed
+func NewProxyTraffic(address string, costPerGB float64) *ProxyTraffic {
+	label := ProxyLabel(address)
+	t := &ProxyTraffic{
+		up:          UpstreamProxyBytesTotal.WithLabelValues(label, "up"),
+		down:        UpstreamProxyBytesTotal.WithLabelValues(label, "down"),
+		costPerByte: costPerGB / bytesPerGB,
+	}
+	if costPerGB > 0 {
+		t.spend = UpstreamProxyEstimatedSpendTotal.WithLabelValues(label)
+	}
+	return t
+}
+
+// AddUp records n bytes sent from the client towards the destination
+func (t *ProxyTraffic) AddUp(n int) {
+	t.up.Add(float64(n))
+	t.addSpend(n)
+}
+
+// AddDown records n bytes sent from the destination back to the client
+func (t *ProxyTraffic) AddDown(n int) {
+	t.down.Add(float64(n))
+	t.addSpend(n)
+}
+
+func (t *ProxyTraffic) addSpend(n int) {
+	if t.spend != nil {
+		t.spend.Add(float64(n) * t.costPerByte)
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+// Proxy label modes control how upstream proxy addresses appear in the proxy_address label
+const (
+	// ProxyLabelAddress uses the full proxy address
+	ProxyLabelAddress = "address"
+	// ProxyLabelHash uses a short, stable hash of the proxy address
+	ProxyLabelHash = "hash"
+	// ProxyLabelTruncate cuts the proxy address to a maximum length, ending in a
+	// short hash of the full address so truncated addresses stay distinct
+	ProxyLabelTruncate = "truncate"
+)
+
+// DefaultProxyLabelMaxLength is the truncation length used when none is configured
+const DefaultProxyLabelMaxLength = 32
+
+// proxyLabelHashLength is the number of hex characters kept from the address hash
+const proxyLabelHashLength = 12
+
+// proxyLabelTruncatedHashLength is the number of hex characters of the address
+// hash appended to a truncated address
+const proxyLabelTruncatedHashLength = 8
+
+type proxyLabelConfig struct {
+	mode      string
+	maxLength int
+}
+
+var proxyLabelCfg atomic.Value
+
+func init() {
+	proxyLabelCfg.Store(proxyLabelConfig{mode: ProxyLabelAddress, maxLength: DefaultProxyLabelMaxLength})
+}
+
+// ConfigureProxyLabels sets how proxy addresses are rendered in metric labels.
+// It should be called before any proxy metric is recorded; series recorded
+// under a previous mode are not relabelled.
+func ConfigureProxyLabels(mode string, maxLength int) error {
+	switch mode {
+	case "", ProxyLabelAddress:
+		mode = ProxyLabelAddress
+	case ProxyLabelHash, ProxyLabelTruncate:
+	default:
+		return fmt.Errorf("unknown proxy label mode '%s'", mode)
+	}
+	if maxLength <= 0 {
+		maxLength = DefaultProxyLabelMaxLength
+	}
+	proxyLabelCfg.Store(proxyLabelConfig{mode: mode, maxLength: maxLength})
+	return nil
+}
+
+// ProxyLabel returns the proxy_address label value for addr under the configured mode
+func ProxyLabel(addr string) string {
+	cfg := proxyLabelCfg.Load().(proxyLabelConfig)
+	switch cfg.mode {
+	case ProxyLabelHash:
+		return addressHash(addr)[:proxyLabelHashLength]
+	case ProxyLabelTruncate:
+		if len(addr) > cfg.maxLength {
+			// long hosts differing only in the port must not share a series
+			suffix := "~" + addressHash(addr)[:proxyLabelTruncatedHashLength]
+			return addr[:max(cfg.maxLength-len(suffix), 0)] + suffix
+		}
+	}
+	return addr
+}
+
+// addressHash returns the hex SHA-256 of addr
+func addressHash(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sequring/chameleon/proxypool"
+	"github.com/sequring/chameleon/upgrade"
 )
 
 const namespace = "chameleon" 
@@ -35,8 +38,109 @@ var (
 		Name:      "requests_failed_total",
 		Help:      "Total number of failed SOCKS connections.",
 	})
+	SocksSessionsExpiredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "sessions_expired_total",
+		Help:      "Total number of sessions closed for exceeding the idle timeout or maximum lifetime.",
+	},
+		[]string{"reason"},
+	)
+	SocksAuthTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "auth_total",
+		Help:      "Total number of SOCKS authentication attempts by result and reason.",
+	},
+		[]string{"result", "reason"},
+	)
+	SocksRedialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "redials_total",
+		Help:      "Total number of CONNECTs redialed through another proxy after an immediate upstream reset, by result.",
+	},
+		[]string{"result"},
+	)
+	GeoSelectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "geo",
+		Name:      "selections_total",
+		Help:      "Total number of proxy selections with geo proximity enabled, by result: near (a proxy in the destination's region), fallback (none eligible) or unknown (region not known yet).",
+	},
+		[]string{"result"},
+	)
+	SocksConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "connections",
+		Help:      "Number of client connections being served, from the SOCKS request until the session ends.",
+	})
+	SocksConnectionsRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "connections_rejected_total",
+		Help:      "Total number of requests rejected at server.max_connections, by reason: limit (rejected right away) or queue_timeout.",
+	},
+		[]string{"reason"},
+	)
+	SocksTarpittedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "tarpitted_total",
+		Help:      "Total number of CONNECTs rejected by the routing policy that were tarpitted, by mode: drip or reset.",
+	},
+		[]string{"mode"},
+	)
+	SocksHalfOpenConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "half_open_connections",
+		Help:      "Number of client connections that have not completed the SOCKS negotiation yet.",
+	})
+	SocksHandshakesAbortedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "handshakes_aborted_total",
+		Help:      "Total number of client connections closed during the SOCKS negotiation, by reason: timeout or limit (too many half-open connections).",
+	},
+		[]string{"reason"},
+	)
+	SocksConnectPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "connect_phase_duration_seconds",
+		Help:      "Time spent in each phase of a CONNECT: proxy selection, the upstream SOCKS handshake and the connect to the destination.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16), // 0.5ms to ~16s
+	},
+		[]string{"phase"},
+	)
+)
+
+// Phases of a CONNECT (the phase label of SocksConnectPhaseDuration)
+const (
+	PhaseSelect            = "select"             // picking the upstream proxy
+	PhaseUpstreamHandshake = "upstream_handshake" // connecting and authenticating to the proxy
+	PhaseTargetConnect     = "target_connect"     // the proxy connecting to the destination
 )
 
+// ObserveConnectPhase records the duration of a completed phase of a CONNECT,
+// with the ID of its session as exemplar unless sessionID is empty
+func ObserveConnectPhase(phase string, d time.Duration, sessionID string) {
+	observeWithSession(SocksConnectPhaseDuration.WithLabelValues(phase), d.Seconds(), sessionID)
+}
+
+// observeWithSession adds v to o, attaching sessionID as exemplar so a slow
+// bucket can be traced to the session in the logs. Exemplars are exposed to
+// scrapers negotiating the OpenMetrics format.
+func observeWithSession(o prometheus.Observer, v float64, sessionID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && sessionID != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"session_id": sessionID})
+		return
+	}
+	o.Observe(v)
+}
+
 var (
 	UpstreamProxyActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -54,6 +158,78 @@ var (
 	},
 		[]string{"proxy_address"},
 	)
+	UpstreamProxyLatencyEWMA = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "latency_ewma_seconds",
+		Help:      "Exponentially weighted moving average of health check response times for an upstream proxy in seconds.",
+	},
+		[]string{"proxy_address"},
+	)
+	UpstreamProxyLatencyJitter = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "latency_jitter_seconds",
+		Help:      "Exponentially weighted standard deviation of health check response times for an upstream proxy in seconds.",
+	},
+		[]string{"proxy_address"},
+	)
+	UpstreamProxyThroughput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "throughput_bytes_per_second",
+		Help:      "Moving average of the speed test download rates through an upstream proxy in bytes per second (0 until measured).",
+	},
+		[]string{"proxy_address"},
+	)
+	UpstreamProxyInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "info",
+		Help:      "Maps the stable upstream proxy ID to its current address (always 1).",
+	},
+		[]string{"proxy_id", "proxy_address"},
+	)
+	UpstreamProxyInMaintenance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "in_maintenance",
+		Help:      "Indicates if an upstream proxy is in one of its maintenance windows and excluded from selection (1 for in maintenance, 0 otherwise).",
+	},
+		[]string{"proxy_address"},
+	)
+	UpstreamProxyAuthFailed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "auth_failed",
+		Help:      "Indicates if an upstream proxy rejected our credentials on the last health check (1 for rejected, 0 otherwise).",
+	},
+		[]string{"proxy_address"},
+	)
+	UpstreamProxyLastError = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "last_error_info",
+		Help:      "Category of the failed health check that keeps an inactive upstream proxy down (always 1; absent while the proxy is active).",
+	},
+		[]string{"proxy_address", "category"},
+	)
+	UpstreamProxyCheckFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "check_failures_total",
+		Help:      "Total number of failed health checks of an upstream proxy by reason.",
+	},
+		[]string{"proxy_address", "reason"},
+	)
+	UpstreamProxyAuthFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "auth_failures_total",
+		Help:      "Total number of times an upstream proxy started rejecting our credentials.",
+	},
+		[]string{"proxy_address"},
+	)
 	UpstreamProxySuccessTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: "upstream_proxy",
@@ -70,21 +246,221 @@ var (
 	},
 		[]string{"proxy_address"},
 	)
+	DestinationBlacklistedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "destination_blacklisted_total",
+		Help:      "Total number of times an upstream proxy was blacklisted for a destination after repeated failures.",
+	})
 )
 
 type PrometheusExporter struct {
 	pool            *proxypool.Pool
+	pools           []*proxypool.Pool // named pools added by AddPool
 	server         *http.Server
+	listener        net.Listener
 	listenAddress   string
 	proxyMetricsMap sync.Map
+	tagMetricsMap   sync.Map // tags with per-tag pool gauges
+	lastErrorInfo   atomic.Bool
 	mu             sync.Mutex
 }
 
 func NewPrometheusExporter(pool *proxypool.Pool, listenAddress string) *PrometheusExporter {
-	return &PrometheusExporter{
+	pe := &PrometheusExporter{
 		pool:          pool,
 		listenAddress: listenAddress,
 	}
+	pool.AddEventHandler(pe.handlePoolEvent)
+	pool.SetCheckFailureObserver(func(address string, reason proxypool.ErrorCategory) {
+		UpstreamProxyCheckFailuresTotal.WithLabelValues(ProxyLabel(address), string(reason)).Inc()
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "proxies",
+		Help:      "Number of upstream proxies in the pool.",
+	}, func() float64 {
+		return float64(pool.ProxyCount())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pool",
+		Name:      "health_check_loops",
+		Help:      "Number of running health check loops. Should equal chameleon_pool_proxies; a higher value indicates leaked loops.",
+	}, func() float64 {
+		return float64(pool.HealthLoopCount())
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "health_check",
+		Name:        "tls_handshakes_total",
+		Help:        "Total number of health check TLS handshakes by type (resumed session or full handshake).",
+		ConstLabels: prometheus.Labels{"type": "resumed"},
+	}, func() float64 {
+		resumed, _ := pool.TLSHandshakeStats()
+		return float64(resumed)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "health_check",
+		Name:        "tls_handshakes_total",
+		Help:        "Total number of health check TLS handshakes by type (resumed session or full handshake).",
+		ConstLabels: prometheus.Labels{"type": "full"},
+	}, func() float64 {
+		_, full := pool.TLSHandshakeStats()
+		return float64(full)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "upstream",
+		Name:        "prewarm_dials_total",
+		Help:        "Total number of client dials by whether a prewarmed upstream connection was used (hit) or none was ready (miss).",
+		ConstLabels: prometheus.Labels{"result": "hit"},
+	}, func() float64 {
+		hits, _ := pool.PrewarmStats()
+		return float64(hits)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "upstream",
+		Name:        "prewarm_dials_total",
+		Help:        "Total number of client dials by whether a prewarmed upstream connection was used (hit) or none was ready (miss).",
+		ConstLabels: prometheus.Labels{"result": "miss"},
+	}, func() float64 {
+		_, misses := pool.PrewarmStats()
+		return float64(misses)
+	})
+	return pe
+}
+
+// AddPool exports the proxies of the named pool name alongside those of the
+// default pool, with per-pool size gauges. It must be called before Start.
+func (pe *PrometheusExporter) AddPool(name string, pool *proxypool.Pool) {
+	pe.pools = append(pe.pools, pool)
+	pool.AddEventHandler(pe.handlePoolEvent)
+	pool.SetCheckFailureObserver(func(address string, reason proxypool.ErrorCategory) {
+		UpstreamProxyCheckFailuresTotal.WithLabelValues(ProxyLabel(address), string(reason)).Inc()
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "named_pool",
+		Name:        "proxies",
+		Help:        "Number of upstream proxies in a named pool.",
+		ConstLabels: prometheus.Labels{"pool": name},
+	}, func() float64 {
+		return float64(pool.ProxyCount())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "named_pool",
+		Name:        "active_proxies",
+		Help:        "Number of selectable upstream proxies in a named pool.",
+		ConstLabels: prometheus.Labels{"pool": name},
+	}, func() float64 {
+		return float64(pool.ActiveProxyCount())
+	})
+}
+
+// SetLastErrorMetric enables the chameleon_upstream_proxy_last_error_info series
+func (pe *PrometheusExporter) SetLastErrorMetric(enabled bool) {
+	pe.lastErrorInfo.Store(enabled)
+}
+
+// DialerStats reports the dialer's in-flight work
+type DialerStats interface {
+	PendingDials() int64
+	ActiveRelays() int64
+	HedgeWins() int64
+	BlacklistedDestinationCount() int
+}
+
+// RegisterDialerStats exposes the dialer's pending dials, relay goroutines, hedge wins
+// and blacklisted destinations
+func (pe *PrometheusExporter) RegisterDialerStats(stats DialerStats) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "pending_dials",
+		Help:      "Number of upstream dials in progress.",
+	}, func() float64 {
+		return float64(stats.PendingDials())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "relay_goroutines",
+		Help:      "Number of running relay goroutines (two per connected session).",
+	}, func() float64 {
+		return float64(stats.ActiveRelays())
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "socks",
+		Name:      "hedge_backup_wins_total",
+		Help:      "Total number of hedged dials won by the backup proxy.",
+	}, func() float64 {
+		return float64(stats.HedgeWins())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream_proxy",
+		Name:      "destinations_blacklisted",
+		Help:      "Number of (proxy, destination) pairs currently avoided after repeated failures.",
+	}, func() float64 {
+		return float64(stats.BlacklistedDestinationCount())
+	})
+}
+
+// handlePoolEvent updates event-driven metrics
+func (pe *PrometheusExporter) handlePoolEvent(ev proxypool.Event) {
+	switch ev.Type {
+	case proxypool.EventProxyAuthFailed:
+		label := ProxyLabel(ev.ProxyAddress)
+		UpstreamProxyAuthFailuresTotal.WithLabelValues(label).Inc()
+		UpstreamProxyAuthFailed.WithLabelValues(label).Set(1)
+	case proxypool.EventProxyRemoved:
+		pe.deleteProxySeries(ProxyLabel(ev.ProxyAddress))
+	}
+}
+
+// deleteProxySeries drops every series labelled with a proxy that has left the pool
+func (pe *PrometheusExporter) deleteProxySeries(label string) {
+	pe.proxyMetricsMap.Delete(label)
+	UpstreamProxyActive.DeleteLabelValues(label)
+	UpstreamProxyResponseTime.DeleteLabelValues(label)
+	UpstreamProxyLatencyEWMA.DeleteLabelValues(label)
+	UpstreamProxyLatencyJitter.DeleteLabelValues(label)
+	UpstreamProxyThroughput.DeleteLabelValues(label)
+	UpstreamProxyInMaintenance.DeleteLabelValues(label)
+	UpstreamProxyAuthFailed.DeleteLabelValues(label)
+	UpstreamProxyAuthFailuresTotal.DeleteLabelValues(label)
+	UpstreamProxySuccessTotal.DeleteLabelValues(label)
+	UpstreamProxyFailTotal.DeleteLabelValues(label)
+	UpstreamProxyEstimatedSpendTotal.DeleteLabelValues(label)
+	UpstreamProxyBytesTotal.DeletePartialMatch(prometheus.Labels{"proxy_address": label})
+	UpstreamProxyInfo.DeletePartialMatch(prometheus.Labels{"proxy_address": label})
+	UpstreamProxyLastError.DeletePartialMatch(prometheus.Labels{"proxy_address": label})
+	UpstreamProxyCheckFailuresTotal.DeletePartialMatch(prometheus.Labels{"proxy_address": label})
+}
+
+// Listen opens the metrics listener, adopting the previous process's socket
+// after an upgrade. Start calls it unless it was called before.
+func (pe *PrometheusExporter) Listen() error {
+	if pe.listenAddress == "" {
+		return nil
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if pe.listener != nil {
+		return nil
+	}
+	l, err := upgrade.Listen("tcp", pe.listenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to start Prometheus metrics server: %w", err)
+	}
+	pe.listener = l
+	return nil
 }
 
 // Start starts the Prometheus metrics HTTP server and returns an error if the server fails to start.
@@ -94,25 +470,31 @@ func (pe *PrometheusExporter) Start() error {
 		log.Println("Prometheus metrics endpoint is disabled (no listen address specified).")
 		return nil
 	}
+	if err := pe.Listen(); err != nil {
+		return err
+	}
 
 	pe.mu.Lock()
-	defer pe.mu.Unlock()
-
 	if pe.server != nil {
+		pe.mu.Unlock()
 		log.Println("Prometheus metrics server is already running")
 		return nil
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
 
 	pe.server = &http.Server{
 		Addr:    pe.listenAddress,
 		Handler: mux,
 	}
 
+	srv, l := pe.server, pe.listener
+	pe.mu.Unlock()
+
 	log.Printf("Starting Prometheus metrics HTTP server on %s/metrics", pe.listenAddress)
-	if err := pe.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start Prometheus metrics server: %w", err)
 	}
 
@@ -134,23 +516,76 @@ func (pe *PrometheusExporter) Stop() error {
 
 	err := pe.server.Shutdown(ctx)
 	pe.server = nil
+	pe.listener = nil
 	return err
 }
 
+// UpdateProxyMetrics refreshes the per-proxy gauges of all pools and garbage-collects
+// series of proxies that are no longer in any pool
 func (pe *PrometheusExporter) UpdateProxyMetrics() {
 	proxies := pe.pool.GetProxiesSnapshot()
+	for _, pool := range pe.pools {
+		proxies = append(proxies, pool.GetProxiesSnapshot()...)
+	}
+	seen := make(map[string]struct{}, len(proxies))
+	tags := make(map[string]*tagStats)
 	for _, p := range proxies {
-		p.Mu.RLock() 
-		addr := p.Address
+		id := p.ID
+		addr := ProxyLabel(p.Address)
 		isActive := p.IsActive
+		authFailed := p.AuthFailed
 		responseTime := p.ResponseTime.Seconds()
-		p.Mu.RUnlock()
+		for _, tag := range tagLabels(p.Tags) {
+			s := tags[tag]
+			if s == nil {
+				s = &tagStats{}
+				tags[tag] = s
+			}
+			if p.IsActive {
+				s.active++
+				s.responseTime += p.ResponseTime
+			} else {
+				s.inactive++
+			}
+		}
 
 		if isActive {
 			UpstreamProxyActive.WithLabelValues(addr).Set(1)
 		} else {
 			UpstreamProxyActive.WithLabelValues(addr).Set(0)
 		}
+		if authFailed {
+			UpstreamProxyAuthFailed.WithLabelValues(addr).Set(1)
+		} else {
+			UpstreamProxyAuthFailed.WithLabelValues(addr).Set(0)
+		}
 		UpstreamProxyResponseTime.WithLabelValues(addr).Set(responseTime)
+		UpstreamProxyLatencyEWMA.WithLabelValues(addr).Set(p.LatencyEWMA.Seconds())
+		UpstreamProxyLatencyJitter.WithLabelValues(addr).Set(p.LatencyJitter.Seconds())
+		UpstreamProxyThroughput.WithLabelValues(addr).Set(p.Throughput)
+		if p.InMaintenance {
+			UpstreamProxyInMaintenance.WithLabelValues(addr).Set(1)
+		} else {
+			UpstreamProxyInMaintenance.WithLabelValues(addr).Set(0)
+		}
+		if id != "" {
+			UpstreamProxyInfo.WithLabelValues(id, addr).Set(1)
+		}
+		if pe.lastErrorInfo.Load() {
+			UpstreamProxyLastError.DeletePartialMatch(prometheus.Labels{"proxy_address": addr})
+			if !isActive && p.LastError != nil {
+				UpstreamProxyLastError.WithLabelValues(addr, string(p.LastError.Category)).Set(1)
+			}
+		}
+		seen[addr] = struct{}{}
+		pe.proxyMetricsMap.Store(addr, struct{}{})
 	}
+
+	pe.proxyMetricsMap.Range(func(key, _ any) bool {
+		if _, ok := seen[key.(string)]; !ok {
+			pe.deleteProxySeries(key.(string))
+		}
+		return true
+	})
+	pe.updateTagMetrics(tags)
 }
\ No newline at end of file
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// untaggedLabel is the tag label of proxies without tags
+const untaggedLabel = "untagged"
+
+// Per-tag aggregates. A proxy with several tags counts towards each of them.
+var (
+	TagDialsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "tag",
+		Name:      "dials_total",
+		Help:      "Total number of client dials through upstream proxies carrying a tag, by result.",
+	},
+		[]string{"tag", "result"},
+	)
+	TagDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "tag",
+		Name:      "dial_duration_seconds",
+		Help:      "Time to connect a client through an upstream proxy carrying a tag.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12), // 10ms to ~20s,
+	},
+		[]string{"tag"},
+	)
+	TagBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "tag",
+		Name:      "bytes_total",
+		Help:      "Total bytes relayed through upstream proxies carrying a tag, by direction (up: client to destination).",
+	},
+		[]string{"tag", "direction"},
+	)
+	TagProxies = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "tag",
+		Name:      "proxies",
+		Help:      "Number of upstream proxies carrying a tag, by state (active or inactive).",
+	},
+		[]string{"tag", "state"},
+	)
+	TagResponseTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "tag",
+		Name:      "response_time_seconds",
+		Help:      "Average health check response time of the active upstream proxies carrying a tag.",
+	},
+		[]string{"tag"},
+	)
+)
+
+// tagLabels returns the tag label values for a proxy's tags
+func tagLabels(tags []string) []string {
+	if len(tags) == 0 {
+		return []string{untaggedLabel}
+	}
+	return tags
+}
+
+// ObserveTagDial records the outcome and duration of a dial through a proxy with
+// tags for the session sessionID (empty if unknown)
+func ObserveTagDial(tags []string, success bool, duration time.Duration, sessionID string) {
+	result := "fail"
+	if success {
+		result = "success"
+	}
+	for _, tag := range tagLabels(tags) {
+		TagDialsTotal.WithLabelValues(tag, result).Inc()
+		if success {
+			observeWithSession(TagDialDuration.WithLabelValues(tag), duration.Seconds(), sessionID)
+		}
+	}
+}
+
+// TagTraffic counts the bytes of one session against the tags of its upstream proxy.
+// The counters are resolved once so relaying a chunk does not look up labels.
+type TagTraffic struct {
+	up, down []prometheus.Counter
+}
+
+// NewTagTraffic returns traffic counters for a session through a proxy with tags
+func NewTagTraffic(tags []string) *TagTraffic {
+	labels := tagLabels(tags)
+	t := &TagTraffic{
+		up:   make([]prometheus.Counter, len(labels)),
+		down: make([]prometheus.Counter, len(labels)),
+	}
+	for i, tag := range labels {
+		t.up[i] = TagBytesTotal.WithLabelValues(tag, "up")
+		t.down[i] = TagBytesTotal.WithLabelValues(tag, "down")
+	}
+	return t
+}
+
+// AddUp records n bytes sent from the client towards the destination
+func (t *TagTraffic) AddUp(n int) {
+	for _, c := range t.up {
+		c.Add(float64(n))
+	}
+}
+
+// AddDown records n bytes sent from the destination back to the client
+func (t *TagTraffic) AddDown(n int) {
+	for _, c := range t.down {
+		c.Add(float64(n))
+	}
+}
+
+// tagStats accumulates pool state for one tag
+type tagStats struct {
+	active, inactive int
+	responseTime     time.Duration // sum over active proxies
+}
+
+// updateTagMetrics sets the per-tag pool gauges from stats and deletes series of
+// tags no proxy carries anymore
+func (pe *PrometheusExporter) updateTagMetrics(stats map[string]*tagStats) {
+	for tag, s := range stats {
+		TagProxies.WithLabelValues(tag, "active").Set(float64(s.active))
+		TagProxies.WithLabelValues(tag, "inactive").Set(float64(s.inactive))
+		if s.active > 0 {
+			TagResponseTime.WithLabelValues(tag).Set((s.responseTime / time.Duration(s.active)).Seconds())
+		} else {
+			TagResponseTime.DeleteLabelValues(tag)
+		}
+		pe.tagMetricsMap.Store(tag, struct{}{})
+	}
+	pe.tagMetricsMap.Range(func(key, _ any) bool {
+		tag := key.(string)
+		if _, ok := stats[tag]; !ok {
+			TagProxies.DeletePartialMatch(prometheus.Labels{"tag": tag})
+			TagResponseTime.DeleteLabelValues(tag)
+			pe.tagMetricsMap.Delete(tag)
+		}
+		return true
+	})
+}
@@ -0,0 +1,226 @@
+// Package nats publishes JSON messages to a NATS subject using the plain text
+// client protocol, without the full client library.
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the NATS client port used when the URL has none
+const DefaultPort = "4222"
+
+// serverInfo is the part of the server's INFO message the publisher needs
+type serverInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// connectOptions is the CONNECT message sent after INFO
+type connectOptions struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// Publisher publishes messages to one subject. It connects on the first Send
+// and reconnects on the next Send after a failure.
+type Publisher struct {
+	url     *url.URL
+	subject string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// New creates a Publisher for the server at rawURL ("nats://[user:pass@]host[:port]",
+// or "tls://" to require TLS). A user without a password is sent as a token.
+// A zero timeout defaults to 10 seconds.
+func New(rawURL, subject string, timeout time.Duration) (*Publisher, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateSubject(subject); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Publisher{url: u, subject: subject, timeout: timeout}, nil
+}
+
+// ParseURL parses a NATS server URL
+func ParseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS URL: %w", err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported NATS URL scheme '%s', expected 'nats' or 'tls'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("NATS URL has no host")
+	}
+	return u, nil
+}
+
+// ValidateSubject checks that subject can be published to: dot-separated
+// tokens without wildcards or whitespace
+func ValidateSubject(subject string) error {
+	if subject == "" {
+		return errors.New("subject is empty")
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return fmt.Errorf("invalid subject '%s'", subject)
+		}
+	}
+	return nil
+}
+
+// Send marshals payload to JSON and publishes it to the subject. It returns
+// once the server has processed the message.
+func (p *Publisher) Send(payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal NATS message: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(p.timeout))
+	if err := p.publish(body); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// publish sends body followed by a PING and waits for the PONG, so errors of
+// the server, such as an authorization violation, are reported
+func (p *Publisher) publish(body []byte) error {
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", p.subject, len(body), body)
+	if _, err := p.conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("failed to answer NATS ping: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK and INFO updates need no answer
+	}
+}
+
+// connect dials the server, reads its INFO, upgrades to TLS if either side
+// requires it and sends CONNECT
+func (p *Publisher) connect() error {
+	port := p.url.Port()
+	if port == "" {
+		port = DefaultPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(p.url.Hostname(), port), p.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	p.conn, p.reader = conn, bufio.NewReader(conn)
+
+	err = p.handshake()
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *Publisher) handshake() error {
+	line, err := p.readLine()
+	if err != nil {
+		return err
+	}
+	verb, info, _ := strings.Cut(line, " ")
+	if verb != "INFO" {
+		return fmt.Errorf("unexpected NATS greeting %q", line)
+	}
+	var server serverInfo
+	if err := json.Unmarshal([]byte(info), &server); err != nil {
+		return fmt.Errorf("invalid NATS INFO: %w", err)
+	}
+
+	if p.url.Scheme == "tls" || server.TLSRequired {
+		tlsConn := tls.Client(p.conn, &tls.Config{ServerName: p.url.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("NATS TLS handshake failed: %w", err)
+		}
+		p.conn, p.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	opts := connectOptions{Name: "chameleon", Lang: "go"}
+	if user := p.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			opts.User, opts.Pass = user.Username(), pass
+		} else {
+			opts.AuthToken = user.Username()
+		}
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal NATS CONNECT: %w", err)
+	}
+	if _, err := p.conn.Write([]byte("CONNECT " + string(data) + "\r\n")); err != nil {
+		return fmt.Errorf("failed to send NATS CONNECT: %w", err)
+	}
+	return nil
+}
+
+// readLine reads one protocol line without its CRLF
+func (p *Publisher) readLine() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read from NATS: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Close closes the connection to the server, if any
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
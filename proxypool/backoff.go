@@ -0,0 +1,94 @@
+package proxypool
+
+import (
+	"log"
+	"maps"
+	"math"
+	"time"
+)
+
+// CheckBackoff slows down the health checks of a proxy that keeps failing for
+// the same reason: after n consecutive failures the next check waits
+// Multiplier^(n-1) check intervals, at most MaxInterval. A Multiplier of 1 or
+// less keeps checking at the check interval.
+type CheckBackoff struct {
+	Multiplier  float64
+	MaxInterval time.Duration
+}
+
+// DefaultCheckBackoff returns the default policies. Rejected credentials and
+// certificates that do not verify are not fixed by retrying, so their checks
+// back off to once every 15 minutes; other failures are retried every interval.
+func DefaultCheckBackoff() map[ErrorCategory]CheckBackoff {
+	return map[ErrorCategory]CheckBackoff{
+		ErrorAuth:      {Multiplier: 2, MaxInterval: 15 * time.Minute},
+		ErrorTLSVerify: {Multiplier: 2, MaxInterval: 15 * time.Minute},
+	}
+}
+
+// SetCheckBackoff sets the backoff policies of the given failure reasons;
+// the other reasons keep their defaults. A manual check always runs at once.
+func (p *Pool) SetCheckBackoff(policies map[ErrorCategory]CheckBackoff) {
+	merged := DefaultCheckBackoff()
+	maps.Copy(merged, policies)
+	p.backoff.Store(&merged)
+}
+
+// CheckFailureObserver is told about every failed health check
+type CheckFailureObserver func(address string, reason ErrorCategory)
+
+// SetCheckFailureObserver sets the function called with the address and the
+// classified reason of every failed health check. It must not block.
+func (p *Pool) SetCheckFailureObserver(observer CheckFailureObserver) {
+	p.checkFailureObserver.Store(&observer)
+}
+
+// observeCheckFailure reports a failed check to the observer, if any
+func (p *Pool) observeCheckFailure(address string, reason ErrorCategory) {
+	if observer := p.checkFailureObserver.Load(); observer != nil && *observer != nil {
+		(*observer)(address, reason)
+	}
+}
+
+// nextCheckDelay returns the time until the next periodic check of proxyCfg
+func (p *Pool) nextCheckDelay(proxyCfg *ProxyConfig) time.Duration {
+	proxyCfg.Mu.RLock()
+	streak, reason := proxyCfg.failStreak, proxyCfg.LastError.Category
+	proxyCfg.Mu.RUnlock()
+	if streak <= 1 {
+		return p.checkInterval
+	}
+
+	policies := p.backoff.Load()
+	if policies == nil {
+		defaults := DefaultCheckBackoff()
+		policies = &defaults
+	}
+	policy, ok := (*policies)[reason]
+	if !ok || policy.Multiplier <= 1 {
+		return p.checkInterval
+	}
+	delay := float64(p.checkInterval) * math.Pow(policy.Multiplier, float64(streak-1))
+	if limit := max(policy.MaxInterval, p.checkInterval); policy.MaxInterval > 0 && delay > float64(limit) {
+		return limit
+	}
+	return time.Duration(delay)
+}
+
+// rescheduleCheck resets ticker to the next check delay of proxyCfg and logs
+// when the proxy enters or leaves backoff. It returns the delay set.
+func (p *Pool) rescheduleCheck(ticker *time.Ticker, proxyCfg *ProxyConfig, prev time.Duration) time.Duration {
+	delay := p.nextCheckDelay(proxyCfg)
+	ticker.Reset(delay)
+	switch {
+	case delay == prev:
+	case delay > p.checkInterval:
+		proxyCfg.Mu.RLock()
+		reason := proxyCfg.LastError.Category
+		proxyCfg.Mu.RUnlock()
+		log.Printf("Proxy %s keeps failing (%s), next health check in %v", proxyCfg.Address, reason, delay)
+	case prev > p.checkInterval:
+		log.Printf("Proxy %s: health checks back to every %v", proxyCfg.Address, delay)
+	}
+	return delay
+}
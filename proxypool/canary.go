@@ -0,0 +1,137 @@
+package proxypool
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// EventCanaryPromoted is emitted when a canary proxy passed its evaluation and
+// joined full rotation
+const EventCanaryPromoted EventType = "canary_promoted"
+
+// Canary makes proxies added to the pool after it started serve only
+// TrafficPercent of the selections until MinRequests client dials through them
+// succeeded at SuccessRate or better. Evaluation runs in rounds of MinRequests
+// dials, so a canary that fails a round keeps its small share and is judged
+// again on the next one.
+type Canary struct {
+	// TrafficPercent is the percentage of selections offered to a canary, 0-100;
+	// 0 disables canaries
+	TrafficPercent float64
+	MinRequests    uint32
+	// SuccessRate is the fraction of a round's dials that must succeed, 0-1
+	SuccessRate float64
+}
+
+// canaryRound is the evaluation round of a canary proxy. Its counts are the
+// proxy's SuccessCount and FailCount when the round started.
+type canaryRound struct {
+	success, fail uint32
+}
+
+// SetCanary puts proxies added from now on in the canary state as configured by
+// c. A zero TrafficPercent disables canaries and promotes the current ones.
+func (p *Pool) SetCanary(c Canary) {
+	if c.TrafficPercent > 0 {
+		p.canary.Store(&c)
+		return
+	}
+	if p.canary.Swap(nil) == nil {
+		return
+	}
+	promoted := 0
+	for _, proxyCfg := range p.proxyList() {
+		proxyCfg.Mu.Lock()
+		if proxyCfg.Canary {
+			proxyCfg.Canary = false
+			promoted++
+		}
+		proxyCfg.Mu.Unlock()
+	}
+	if promoted > 0 {
+		log.Printf("Canary evaluation disabled, %d canary proxies joined full rotation", promoted)
+		p.rebuildActive()
+	}
+}
+
+// newCanary reports whether a proxy added now starts as a canary
+func (p *Pool) newCanary() bool {
+	return p.canary.Load() != nil
+}
+
+// pickCanary returns a random canary proxy carrying one of tags (nil means
+// any) and not avoided for TrafficPercent of the calls, or for every call if
+// always is set, when an avoided canary is still better than none. It returns
+// nil if no canary was picked.
+func (p *Pool) pickCanary(tags []string, avoid func(*ProxyConfig) bool, always bool) *ProxyConfig {
+	c := p.canary.Load()
+	set := p.active.Load()
+	if c == nil || set == nil || len(set.canaries) == 0 {
+		return nil
+	}
+	if !always && rand.Float64()*100 >= c.TrafficPercent {
+		return nil
+	}
+	var candidates []*ProxyConfig
+	for i, proxyCfg := range set.canaries {
+		if (tags == nil || HasAnyTag(set.canaryTags[i], tags)) && (avoid == nil || !avoid(proxyCfg)) {
+			candidates = append(candidates, proxyCfg)
+		}
+	}
+	if len(candidates) == 0 {
+		if always && avoid != nil {
+			return p.pickCanary(tags, nil, true)
+		}
+		return nil
+	}
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// evaluateCanary promotes proxyCfg to full rotation if it is a canary whose
+// current round of client dials is complete and succeeded often enough
+func (p *Pool) evaluateCanary(proxyCfg *ProxyConfig) {
+	c := p.canary.Load()
+	if c == nil {
+		return
+	}
+	success, fail := atomic.LoadUint32(&proxyCfg.SuccessCount), atomic.LoadUint32(&proxyCfg.FailCount)
+
+	proxyCfg.Mu.Lock()
+	if !proxyCfg.Canary {
+		proxyCfg.Mu.Unlock()
+		return
+	}
+	round := proxyCfg.canaryRound
+	succeeded, failed := success-round.success, fail-round.fail
+	if succeeded+failed < c.MinRequests {
+		proxyCfg.Mu.Unlock()
+		return
+	}
+	rate := float64(succeeded) / float64(succeeded+failed)
+	promote := rate >= c.SuccessRate
+	if promote {
+		proxyCfg.Canary = false
+	} else {
+		proxyCfg.canaryRound = canaryRound{success: success, fail: fail}
+	}
+	addr := proxyCfg.Address
+	proxyCfg.Mu.Unlock()
+
+	if !promote {
+		log.Printf("Canary proxy %s succeeded on %.1f%% of %d dials, below %.1f%%; starting another round",
+			addr, rate*100, succeeded+failed, c.SuccessRate*100)
+		return
+	}
+	p.rebuildActive()
+	msg := fmt.Sprintf("Canary proxy %s promoted to full rotation after %d of %d dials succeeded", addr, succeeded, succeeded+failed)
+	log.Print(msg)
+	p.events.emit(Event{
+		Type:         EventCanaryPromoted,
+		Severity:     SeverityInfo,
+		ProxyAddress: addr,
+		Message:      msg,
+		Time:         p.now(),
+	})
+}
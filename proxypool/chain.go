@@ -0,0 +1,154 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+)
+
+// Chain reaches the proxies carrying ExitTag through an active proxy carrying
+// EntryTag, for example a corporate gateway all egress has to pass before the
+// rotating exits. Entry proxies are only used as first hops: they are never
+// selected for client traffic themselves.
+type Chain struct {
+	EntryTag string
+	// ExitTag selects the exits; empty means every proxy that is not an entry
+	ExitTag string
+}
+
+// ErrNoEntryProxy is returned when an exit is dialed while none of its entry proxies is active
+var ErrNoEntryProxy = errors.New("no active entry proxy")
+
+// SetChains routes the connections to exit proxies through entry proxies as
+// described by chains. The first chain whose ExitTag a proxy carries applies to
+// it. Call it once after New; an empty list disables chaining.
+func (p *Pool) SetChains(chains []Chain) {
+	if len(chains) == 0 {
+		return
+	}
+	chains = slices.Clone(chains)
+	if !p.chains.CompareAndSwap(nil, &chains) {
+		return
+	}
+	p.rebuildActive()
+	for _, c := range chains {
+		exits := "every other proxy"
+		if c.ExitTag != "" {
+			exits = fmt.Sprintf("proxies tagged '%s'", c.ExitTag)
+		}
+		log.Printf("Chaining %s through an entry proxy tagged '%s'", exits, c.EntryTag)
+	}
+}
+
+// isEntry reports whether a proxy with tags is an entry proxy of a chain
+func (p *Pool) isEntry(tags []string) bool {
+	chains := p.chains.Load()
+	if chains == nil {
+		return false
+	}
+	for _, c := range *chains {
+		if slices.Contains(tags, c.EntryTag) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryTagFor returns the tag of the entry proxies pc is reached through, or
+// "" if pc is dialed directly
+func (p *Pool) entryTagFor(pc *ProxyConfig) string {
+	if p == nil {
+		return ""
+	}
+	chains := p.chains.Load()
+	if chains == nil {
+		return ""
+	}
+	pc.Mu.RLock()
+	tags := pc.Tags
+	pc.Mu.RUnlock()
+	if p.isEntry(tags) {
+		return ""
+	}
+	for _, c := range *chains {
+		if c.ExitTag == "" || slices.Contains(tags, c.ExitTag) {
+			return c.EntryTag
+		}
+	}
+	return ""
+}
+
+// entryUp rechecks the inactive exits reached through entry right after it
+// became active, so they do not stay down until their next check because no
+// entry was active when they were last checked
+func (p *Pool) entryUp(entry *ProxyConfig) {
+	if p.chains.Load() == nil {
+		return
+	}
+	entry.Mu.RLock()
+	tags := entry.Tags
+	entry.Mu.RUnlock()
+	if !p.isEntry(tags) {
+		return
+	}
+	for _, proxy := range p.proxyList() {
+		if tag := p.entryTagFor(proxy); tag != "" && slices.Contains(tags, tag) && proxy.State() != StateActive {
+			proxy.triggerCheck()
+		}
+	}
+}
+
+// activeEntries returns the active entry proxies carrying tag in random order
+func (p *Pool) activeEntries(tag string) []*ProxyConfig {
+	set := p.active.Load()
+	if set == nil {
+		return nil
+	}
+	entries := slices.Clone(set.entries[tag])
+	rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	return entries
+}
+
+// chainForward dials the connection to an exit proxy, through one of its
+// entry proxies if a chain applies to it when dialing
+type chainForward struct {
+	exit *ProxyConfig
+}
+
+func (f chainForward) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamForward.Timeout)
+	defer cancel()
+	return f.DialContext(ctx, network, address)
+}
+
+// DialContext tries the active entry proxies in random order until one
+// connects to address
+func (f chainForward) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tag := f.exit.pool.entryTagFor(f.exit)
+	if tag == "" {
+		return upstreamForward.DialContext(ctx, network, address)
+	}
+	entries := f.exit.pool.activeEntries(tag)
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w tagged '%s'", ErrNoEntryProxy, tag)
+	}
+	var errs []error
+	for _, entry := range entries {
+		dialer, err := entry.UpstreamDialer("tcp")
+		if err == nil {
+			var conn net.Conn
+			if conn, err = DialContext(ctx, dialer, network, address); err == nil {
+				return conn, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("via entry proxy %s: %w", entry.Address, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"log"
 	"net"
-	"strings"
 	"time"
 
-	px "golang.org/x/net/proxy"
+	"github.com/sequring/chameleon/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TLSCheckConfig holds configuration for TLS certificate verification during health checks
@@ -36,6 +38,121 @@ func DefaultTLSCheckConfig() *TLSCheckConfig {
 	}
 }
 
+const (
+	// tlsSessionCacheSize is the number of TLS sessions cached per proxy
+	tlsSessionCacheSize = 4
+	// sessionTicketWait bounds how long a check waits for TLS 1.3 session tickets
+	sessionTicketWait = 100 * time.Millisecond
+)
+
+// Health check log modes
+const (
+	// HealthLogAll logs the outcome of every single health check.
+	HealthLogAll = "all"
+	// HealthLogChanges logs only state transitions (active <-> inactive)
+	// plus every Nth consecutive successful check.
+	HealthLogChanges = "changes"
+)
+
+// HealthLogConfig controls how verbose health check logging is
+type HealthLogConfig struct {
+	// Mode is either HealthLogAll or HealthLogChanges.
+	Mode string
+
+	// SuccessEvery logs every Nth consecutive successful check in
+	// HealthLogChanges mode. Zero disables periodic success lines.
+	SuccessEvery uint64
+}
+
+// DefaultHealthLogConfig returns the default health check logging configuration
+func DefaultHealthLogConfig() *HealthLogConfig {
+	return &HealthLogConfig{
+		Mode:         HealthLogChanges,
+		SuccessEvery: 100,
+	}
+}
+
+// healthLog returns the current health check logging configuration
+func (p *Pool) healthLog() *HealthLogConfig {
+	cfg, _ := p.healthLogConfig.Load().(*HealthLogConfig)
+	if cfg == nil {
+		return DefaultHealthLogConfig()
+	}
+	return cfg
+}
+
+// checkFailed marks the proxy inactive, records err on the check's span and logs
+// the failure if the current logging mode asks for it.
+func (p *Pool) checkFailed(ctx context.Context, proxyCfg *ProxyConfig, err error, format string, args ...any) {
+	telemetry.RecordError(trace.SpanFromContext(ctx), err)
+	wasActive := proxyCfg.State() == StateActive
+	changed := proxyCfg.markInactiveAt(p.now(), err)
+	p.observeCheckFailure(proxyCfg.Address, categorize(err))
+	if proxyCfg.inMaintenance() {
+		// expected downtime, out of selection already: no events and no outage alarm
+		if changed || p.healthLog().Mode == HealthLogAll {
+			log.Printf(format+" (in maintenance window)", args...)
+		}
+		return
+	}
+	if wasActive {
+		p.rebuildActive()
+		p.events.emit(Event{
+			Type:         EventProxyDown,
+			Severity:     SeverityInfo,
+			ProxyAddress: proxyCfg.Address,
+			Message:      fmt.Sprintf(format, args...),
+			Time:         p.now(),
+		})
+		p.noteProxyDown()
+	}
+	if changed && IsAuthError(err) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("CRITICAL: %s (upstream rejected credentials)", msg)
+		p.events.emit(Event{
+			Type:         EventProxyAuthFailed,
+			Severity:     SeverityCritical,
+			ProxyAddress: proxyCfg.Address,
+			Message:      msg,
+			Time:         p.now(),
+		})
+		return
+	}
+	if changed || p.healthLog().Mode == HealthLogAll {
+		log.Printf(format, args...)
+	}
+}
+
+// checkSucceeded marks the proxy active and logs the success if the current
+// logging mode asks for it.
+func (p *Pool) checkSucceeded(proxyCfg *ProxyConfig, addr string, responseTime time.Duration) {
+	changed, streak := proxyCfg.markActiveAt(p.now(), responseTime)
+	if changed {
+		p.rebuildActive()
+		if !proxyCfg.inMaintenance() {
+			p.events.emit(Event{
+				Type:         EventProxyUp,
+				Severity:     SeverityInfo,
+				ProxyAddress: proxyCfg.Address,
+				Message:      fmt.Sprintf("response time: %v", responseTime),
+				Time:         p.now(),
+			})
+		}
+		p.noteProxyUp(addr)
+		p.entryUp(proxyCfg)
+	}
+	p.evaluateCanary(proxyCfg)
+	cfg := p.healthLog()
+	switch {
+	case cfg.Mode == HealthLogAll:
+		log.Printf("Proxy %s is active, response time: %v", addr, responseTime)
+	case changed:
+		log.Printf("Proxy %s is now active, response time: %v", addr, responseTime)
+	case cfg.SuccessEvery > 0 && streak%cfg.SuccessEvery == 0:
+		log.Printf("Proxy %s still active after %d consecutive checks, response time: %v", addr, streak, responseTime)
+	}
+}
+
 // checkAllProxies - этот метод в текущей архитектуре с healthCheckLoopForProxy
 // практически не нужен для регулярных проверок. Первоначальные запуски проверок
 // происходят при создании ProxyConfig в reloadAndReconcileProxies.
@@ -50,47 +167,79 @@ func (p *Pool) checkAllProxies() {
 }
 */
 
+// HealthChecker decides whether a proxy is usable. Check runs within ctx,
+// which carries the check timeout; a nil error marks the proxy active.
+type HealthChecker interface {
+	Check(ctx context.Context, proxyCfg *ProxyConfig) error
+}
+
+// HealthCheckFunc adapts a function to a HealthChecker
+type HealthCheckFunc func(ctx context.Context, proxyCfg *ProxyConfig) error
+
+// Check calls f(ctx, proxyCfg)
+func (f HealthCheckFunc) Check(ctx context.Context, proxyCfg *ProxyConfig) error {
+	return f(ctx, proxyCfg)
+}
+
+// SetHealthChecker replaces the SOCKS5/TLS health check with checker, e.g. to
+// take proxy health from an external source or to run the pool without network
+// access in tests. A nil checker restores the default.
+func (p *Pool) SetHealthChecker(checker HealthChecker) {
+	if checker == nil {
+		p.healthChecker.Store(nil)
+		return
+	}
+	p.healthChecker.Store(&checker)
+}
+
+// SetHealthCheck is SetHealthChecker for a plain function
+func (p *Pool) SetHealthCheck(check HealthCheckFunc) {
+	if check == nil {
+		p.SetHealthChecker(nil)
+		return
+	}
+	p.SetHealthChecker(check)
+}
+
 // checkProxy выполняет одну проверку работоспособности для указанного ProxyConfig.
 // Этот метод вызывается из healthCheckLoopForProxy.
 // `ctx` - это контекст горутины healthCheckLoopForProxy, который может быть отменен.
 func (p *Pool) checkProxy(ctx context.Context, proxyCfg *ProxyConfig) { // Ресивер p *Pool
-	start := time.Now()
-	checkCtx, cancel := context.WithTimeout(ctx, p.timeout) // Используем p.timeout
-	defer cancel()
-
-	var auth *px.Auth
+	start := p.now()
 	proxyCfg.Mu.RLock()
 	addrToCheck := proxyCfg.Address // Копируем, чтобы не держать мьютекс на время диала
-	username := proxyCfg.Username
-	password := proxyCfg.Password
 	proxyCfg.Mu.RUnlock()
+	targetHost := p.checkTarget()
 
-	if username != "" {
-		auth = &px.Auth{User: username, Password: password}
+	ctx, span := telemetry.Tracer().Start(ctx, "proxypool.health_check", trace.WithAttributes(
+		attribute.String("proxy.address", addrToCheck),
+		attribute.String("health_check.target", targetHost),
+	))
+	defer span.End()
+	checkCtx, cancel := context.WithTimeout(ctx, p.timeout) // Используем p.timeout
+	defer cancel()
+
+	if checker := p.healthChecker.Load(); checker != nil {
+		if err := (*checker).Check(checkCtx, proxyCfg); err != nil {
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s: health check failed: %v", addrToCheck, err)
+			return
+		}
+		p.checkSucceeded(proxyCfg, addrToCheck, p.now().Sub(start))
+		return
 	}
 
-	dialer, err := px.SOCKS5("tcp", addrToCheck, auth, px.Direct)
+	dialer, err := proxyCfg.UpstreamDialer("tcp")
 	if err != nil {
-		log.Printf("Proxy %s: failed to create SOCKS5 dialer: %v", addrToCheck, err)
-		proxyCfg.MarkInactive(err)
+		p.checkFailed(ctx, proxyCfg, err, "Proxy %s: failed to create SOCKS5 dialer: %v", addrToCheck, err)
 		return
 	}
 
-	targetHost := p.testURL // Используем p.testURL
-	hostNameForTLS := targetHost
-	if strings.Contains(targetHost, ":") {
-		var port string
-		hostNameForTLS, port, err = net.SplitHostPort(targetHost)
-		if err != nil {
-			log.Printf("Proxy %s: invalid testURL format '%s' for SplitHostPort: %v", addrToCheck, targetHost, err)
-			proxyCfg.MarkInactive(err)
-			return
-		}
-		if port == "" { // Если SplitHostPort вернул хост, но порт был ожидаем (например, из-за ошибки в testURL)
-			 // это может быть проблемой, если targetHost для dialContext должен содержать порт
-			log.Printf("Warning: Proxy %s: port not found in testURL '%s' after SplitHostPort, using original targetHost for dialing.", addrToCheck, targetHost)
-		}
-
+	// The target is always host:port; SplitHostPort also unbrackets IPv6 literals
+	// ("[2001:db8::1]:443"), which must not reach the SNI with brackets.
+	hostNameForTLS, _, err := net.SplitHostPort(targetHost)
+	if err != nil {
+		p.checkFailed(ctx, proxyCfg, err, "Proxy %s: invalid health check target '%s': %v", addrToCheck, targetHost, err)
+		return
 	}
 
 	conn, err := DialContext(checkCtx, dialer, "tcp", targetHost) // DialContext из common.go
@@ -98,19 +247,31 @@ func (p *Pool) checkProxy(ctx context.Context, proxyCfg *ProxyConfig) { // Ре
 	if err != nil {
 		select {
 		case <-checkCtx.Done():
-			log.Printf("Proxy %s check for '%s' timed out or cancelled: %v (underlying dial error: %v)", addrToCheck, targetHost, checkCtx.Err(), err)
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s check for '%s' timed out or cancelled: %v (underlying dial error: %v)", addrToCheck, targetHost, checkCtx.Err(), err)
 		default:
-			log.Printf("Proxy %s: failed to dial test URL '%s': %v", addrToCheck, targetHost, err)
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s: failed to dial test URL '%s': %v", addrToCheck, targetHost, err)
 		}
-		proxyCfg.MarkInactive(err)
 		return
 	}
 	defer conn.Close()
 
-	// Get the current TLS config atomically
-	tlsConfig, _ := p.tlsCheckConfig.Load().(*TLSCheckConfig)
-	if tlsConfig == nil {
-		tlsConfig = DefaultTLSCheckConfig()
+	httpCheck := p.httpCheck.Load()
+	if httpCheck != nil && httpCheck.Plain {
+		if dl, ok := checkCtx.Deadline(); ok {
+			conn.SetDeadline(dl)
+		}
+		if err := httpCheck.do(checkCtx, conn, targetHost); err != nil {
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s: HTTP check of '%s' failed: %v", addrToCheck, targetHost, err)
+			return
+		}
+		p.checkSucceeded(proxyCfg, addrToCheck, p.now().Sub(start))
+		return
+	}
+
+	// Get the TLS config of this proxy atomically
+	tlsConfig := p.tlsCheckConfigFor(proxyCfg)
+	if tlsConfig.ServerName != "" {
+		hostNameForTLS = tlsConfig.ServerName
 	}
 
 	// Create a secure TLS configuration for health checks
@@ -124,13 +285,13 @@ func (p *Pool) checkProxy(ctx context.Context, proxyCfg *ProxyConfig) { // Ре
 	// Set up the VerifyConnection callback
 	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
 		// Get fresh config in case it was updated
-		currentTLSConfig, _ := p.tlsCheckConfig.Load().(*TLSCheckConfig)
-		if currentTLSConfig == nil {
-			currentTLSConfig = DefaultTLSCheckConfig()
-		}
+		currentTLSConfig := p.tlsCheckConfigFor(proxyCfg)
 
-		// If verification is disabled, just log a warning and return
+		// If verification is disabled, just return (logging a warning in verbose mode)
 		if currentTLSConfig.SkipVerify {
+			if p.healthLog().Mode != HealthLogAll {
+				return nil
+			}
 			log.Printf("WARNING: TLS certificate verification is disabled for proxy %s. This is not recommended for production use.", addrToCheck)
 			return nil
 		}
@@ -156,6 +317,7 @@ func (p *Pool) checkProxy(ctx context.Context, proxyCfg *ProxyConfig) { // Ре
 		// Only return the error, don't log successful verifications
 		return err
 	}
+	tlsCfg.ClientSessionCache = proxyCfg.tlsSessions
 	tlsConn := tls.Client(conn, tlsCfg)
 
 	if dl, ok := checkCtx.Deadline(); ok {
@@ -164,18 +326,59 @@ func (p *Pool) checkProxy(ctx context.Context, proxyCfg *ProxyConfig) { // Ре
 		}
 	}
 
-	if err := tlsConn.HandshakeContext(checkCtx); err != nil {
+	_, tlsSpan := telemetry.Tracer().Start(ctx, "proxypool.tls_handshake", trace.WithAttributes(
+		attribute.String("tls.server_name", hostNameForTLS),
+	))
+	err = tlsConn.HandshakeContext(checkCtx)
+	if err == nil {
+		tlsSpan.SetAttributes(attribute.Bool("tls.resumed", tlsConn.ConnectionState().DidResume))
+	}
+	telemetry.EndSpan(tlsSpan, err)
+	if err != nil {
 		select {
 		case <-checkCtx.Done():
-			log.Printf("Proxy %s: TLS handshake to '%s' (SNI: %s) timed out or cancelled: %v (underlying handshake error: %v)", addrToCheck, targetHost, hostNameForTLS, checkCtx.Err(), err)
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s: TLS handshake to '%s' (SNI: %s) timed out or cancelled: %v (underlying handshake error: %v)", addrToCheck, targetHost, hostNameForTLS, checkCtx.Err(), err)
 		default:
-			log.Printf("Proxy %s: TLS handshake to '%s' (SNI: %s) failed: %v", addrToCheck, targetHost, hostNameForTLS, err)
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s: TLS handshake to '%s' (SNI: %s) failed: %v", addrToCheck, targetHost, hostNameForTLS, err)
 		}
-		proxyCfg.MarkInactive(err)
 		return
 	}
 
-	responseTime := time.Since(start)
-	proxyCfg.MarkActive(responseTime)
-	log.Printf("Proxy %s is active, response time: %v", addrToCheck, responseTime)
+	if httpCheck != nil {
+		if err := httpCheck.do(checkCtx, tlsConn, targetHost); err != nil {
+			p.checkFailed(ctx, proxyCfg, err, "Proxy %s: HTTP check of '%s' failed: %v", addrToCheck, targetHost, err)
+			return
+		}
+	}
+
+	responseTime := p.now().Sub(start)
+	p.recordTLSHandshake(tlsConn, httpCheck == nil)
+	if proxyCfg.PreferIPv6 {
+		p.checkAddressFamilies(checkCtx, proxyCfg, dialer, targetHost)
+	}
+	p.checkSucceeded(proxyCfg, addrToCheck, responseTime)
+}
+
+// recordTLSHandshake counts a completed health check handshake as resumed or full.
+// TLS 1.3 servers deliver session tickets after the handshake, so unless the
+// connection was already read from, they are read here (outside the measured
+// response time) to make the next check resumable.
+func (p *Pool) recordTLSHandshake(tlsConn *tls.Conn, readTickets bool) {
+	state := tlsConn.ConnectionState()
+	if state.DidResume {
+		p.tlsResumed.Add(1)
+	} else {
+		p.tlsFull.Add(1)
+	}
+	if readTickets && state.Version == tls.VersionTLS13 {
+		_ = tlsConn.SetReadDeadline(time.Now().Add(sessionTicketWait))
+		var buf [1]byte
+		_, _ = tlsConn.Read(buf[:])
+	}
+}
+
+// TLSHandshakeStats returns how many health check TLS handshakes resumed a cached
+// session and how many performed a full handshake since the pool was created
+func (p *Pool) TLSHandshakeStats() (resumed, full uint64) {
+	return p.tlsResumed.Load(), p.tlsFull.Load()
 }
\ No newline at end of file
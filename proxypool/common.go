@@ -3,28 +3,77 @@ package proxypool
 import (
 	"context"
 	"net"
+	"strings"
+	"time"
+
 	px "golang.org/x/net/proxy"
 )
 
-// DialContext используется как ProxyPool, так и Dialer.
-// Он экспортируемый, так как Dialer из другого пакета будет его использовать.
+// authErrorMarkers are the messages golang.org/x/net/proxy uses when an
+// upstream SOCKS5 server refuses our credentials or auth method.
+var authErrorMarkers = []string{
+	"username/password authentication failed",
+	"no acceptable authentication methods",
+	"invalid username/password",
+}
+
+// IsAuthError reports whether err means the upstream proxy rejected our credentials,
+// as opposed to being unreachable.
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, marker := range authErrorMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamForward dials the TCP connection to an upstream proxy. Being a
+// net.Dialer it honours the context of DialContext during the connect, and
+// the timeout bounds dials made without a deadline.
+var upstreamForward = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// DialContext dials address through dialer and gives up when ctx is done. It is
+// used by both the pool and the SOCKS dialer.
+//
+// Dialers implementing px.ContextDialer (all SOCKS5 dialers built by this package)
+// are cancelled directly, so no goroutine or half-open connection outlives ctx.
+// Other dialers cannot be interrupted: their dial keeps running in the background
+// and a connection it establishes after cancellation is closed.
 func DialContext(ctx context.Context, dialer px.Dialer, network, address string) (net.Conn, error) {
-	var conn net.Conn
-	var err error
+	if cd, ok := dialer.(px.ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	done := make(chan struct{})
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
 	go func() {
-		conn, err = dialer.Dial(network, address)
-		close(done)
+		conn, err := dialer.Dial(network, address)
+		done <- result{conn: conn, err: err}
 	}()
 
 	select {
 	case <-ctx.Done():
-		if conn != nil {
-			conn.Close()
-		}
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
 		return nil, ctx.Err()
-	case <-done:
-		return conn, err
+	case r := <-done:
+		return r.conn, r.err
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,480 @@
+package proxypool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+
+	px "golang.org/x/net/proxy"
+)
+
+// blockingDialer is a plain px.Dialer whose Dial blocks until release is closed
+// and then returns one end of a pipe
+type blockingDialer struct {
+	started chan struct{}
+	release chan struct{}
+	conn    *trackedConn
+}
+
+func (d *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	close(d.started)
+	<-d.release
+	return d.conn, nil
+}
+
+// trackedConn records whether it was closed
+type trackedConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *trackedConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+// contextDialer is a px.ContextDialer that blocks until its context is done
+type contextDialer struct {
+	plainCalls atomic.Int32
+}
+
+func (d *contextDialer) Dial(network, addr string) (net.Conn, error) {
+	d.plainCalls.Add(1)
+	return nil, errors.New("Dial must not be used when DialContext is available")
+}
+
+func (d *contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDialContextUsesContextDialer(t *testing.T) {
+	d := &contextDialer{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := DialContext(ctx, d, "tcp", "example.com:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if n := d.plainCalls.Load(); n != 0 {
+		t.Fatalf("plain Dial called %d times", n)
+	}
+}
+
+func TestDialContextClosesLateConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	d := &blockingDialer{started: make(chan struct{}), release: make(chan struct{}), conn: &trackedConn{Conn: client}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := DialContext(ctx, d, "tcp", "example.com:443")
+		errCh <- err
+	}()
+	<-d.started
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DialContext did not return after cancellation")
+	}
+
+	// the dial completes after the caller gave up; its connection must be closed
+	close(d.release)
+	deadline := time.Now().Add(time.Second)
+	for !d.conn.closed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection established after cancellation was not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDialContextAlreadyCancelled(t *testing.T) {
+	d := &blockingDialer{started: make(chan struct{}), release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := DialContext(ctx, d, "tcp", "example.com:443"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+}
+
+// TestDialContextCancelsStalledHandshake dials through an upstream that accepts
+// TCP connections but never answers the SOCKS5 greeting. Cancellation must abort
+// the handshake and close the upstream connection rather than leave it half-open.
+func TestDialContextCancelsStalledHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	upstreamClosed := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// swallow the greeting and wait for the client to hang up
+		io.Copy(io.Discard, conn)
+		close(upstreamClosed)
+	}()
+
+	proxyCfg := &ProxyConfig{Address: l.Addr().String()}
+	dialer, err := proxyCfg.UpstreamDialer("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := DialContext(ctx, dialer, "tcp", "example.com:443"); err == nil {
+		t.Fatal("expected the stalled handshake to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("DialContext returned after %v, want close to the 100ms deadline", elapsed)
+	}
+
+	select {
+	case <-upstreamClosed:
+	case <-time.After(time.Second):
+		t.Fatal("upstream connection left open after cancellation")
+	}
+}
+
+// fakeSocks5Upstream serves one SOCKS5 client on conn: it expects user/pass,
+// records the CONNECT request and answers it with reply
+func fakeSocks5Upstream(t *testing.T, conn net.Conn, reply byte) <-chan []byte {
+	requests := make(chan []byte, 1)
+	go func() {
+		defer conn.Close()
+		greeting := make([]byte, 4)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			t.Errorf("read greeting: %v", err)
+			return
+		}
+		conn.Write([]byte{5, 2})
+		creds := make([]byte, 2+len("user")+1+len("pass"))
+		if _, err := io.ReadFull(conn, creds); err != nil {
+			t.Errorf("read credentials: %v", err)
+			return
+		}
+		status := byte(0)
+		if !bytes.Equal(creds, []byte("\x01\x04user\x04pass")) {
+			status = 1
+		}
+		conn.Write([]byte{1, status})
+		if status != 0 {
+			return
+		}
+		request := make([]byte, 5+len("example.com")+2)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			t.Errorf("read request: %v", err)
+			return
+		}
+		requests <- request
+		conn.Write([]byte{5, reply, 0, 1, 10, 0, 0, 1, 0x1f, 0x90})
+	}()
+	return requests
+}
+
+func TestSocks5WarmHandshakeAndConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	requests := fakeSocks5Upstream(t, server, 0)
+
+	if err := socks5Authenticate(client, &px.Auth{User: "user", Password: "pass"}); err != nil {
+		t.Fatalf("socks5Authenticate: %v", err)
+	}
+	if err := socks5Connect(context.Background(), client, "example.com:443"); err != nil {
+		t.Fatalf("socks5Connect: %v", err)
+	}
+	want := append([]byte{5, 1, 0, 3, byte(len("example.com"))}, "example.com\x01\xbb"...)
+	if got := <-requests; !bytes.Equal(got, want) {
+		t.Errorf("CONNECT request = %v, want %v", got, want)
+	}
+}
+
+func TestSocks5WarmRejectedCredentials(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	fakeSocks5Upstream(t, server, 0)
+
+	err := socks5Authenticate(client, &px.Auth{User: "user", Password: "nope"})
+	if !IsAuthError(err) {
+		t.Fatalf("socks5Authenticate = %v, want an auth error", err)
+	}
+}
+
+func TestSocks5WarmConnectRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	fakeSocks5Upstream(t, server, 5)
+
+	if err := socks5Authenticate(client, &px.Auth{User: "user", Password: "pass"}); err != nil {
+		t.Fatalf("socks5Authenticate: %v", err)
+	}
+	err := socks5Connect(context.Background(), client, "example.com:443")
+	var refused *connectRefusedError
+	if !errors.As(err, &refused) || err.Error() != "unknown error connection refused" {
+		t.Fatalf("socks5Connect = %v, want a connection refused reply", err)
+	}
+}
+
+func TestDialTimed(t *testing.T) {
+	for _, tc := range []struct {
+		reply   byte
+		wantErr bool
+	}{{reply: 0}, {reply: 5, wantErr: true}} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				fakeSocks5Upstream(t, conn, tc.reply)
+			}
+		}()
+
+		pc := &ProxyConfig{Address: ln.Addr().String(), Username: "user", Password: "pass"}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, timing, err := pc.DialTimed(ctx, nil, "example.com:443")
+		cancel()
+		if tc.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "connection refused") {
+				t.Errorf("DialTimed = %v, want a connection refused reply", err)
+			}
+			if timing.Handshake <= 0 || timing.Connect != 0 {
+				t.Errorf("timing = %+v, want only the handshake", timing)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("DialTimed: %v", err)
+		}
+		conn.Close()
+		if timing.Handshake <= 0 || timing.Connect <= 0 {
+			t.Errorf("timing = %+v, want both phases", timing)
+		}
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		check    HTTPCheck
+		response string
+		wantErr  bool
+	}{
+		{"status ok", HTTPCheck{Path: "/ok"}, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", false},
+		{"unexpected status", HTTPCheck{Path: "/ok"}, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", true},
+		{"expected status list", HTTPCheck{Path: "/ok", ExpectStatus: []int{204}}, "HTTP/1.1 204 No Content\r\n\r\n", false},
+		{"body matches", HTTPCheck{Path: "/ok", ExpectBody: "welcome"}, "HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\nwelcome", false},
+		{"block page", HTTPCheck{Path: "/ok", ExpectBody: "welcome"}, "HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\nblocked", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				req, err := http.ReadRequest(bufio.NewReader(server))
+				if err != nil {
+					t.Errorf("read request: %v", err)
+					return
+				}
+				if req.Host != "example.com" || req.URL.Path != "/ok" {
+					t.Errorf("request for %s%s, want example.com/ok", req.Host, req.URL.Path)
+				}
+				io.WriteString(server, tc.response)
+			}()
+
+			err := tc.check.do(context.Background(), client, "example.com:443")
+			var httpErr *HTTPCheckError
+			if tc.wantErr != errors.As(err, &httpErr) {
+				t.Fatalf("do = %v, want an HTTPCheckError: %v", err, tc.wantErr)
+			}
+			if tc.wantErr && categorize(err) != ErrorHTTPCheck {
+				t.Errorf("categorize = %s, want %s", categorize(err), ErrorHTTPCheck)
+			}
+		})
+	}
+}
+
+// tlsSocks5Upstream starts a TLS listener with a self-signed certificate for
+// 127.0.0.1 that serves one SOCKS5 client with fakeSocks5Upstream. It returns the
+// listener address, the certificate as a PEM file and its public key hash.
+func tlsSocks5Upstream(t *testing.T) (addr, caFile, pin string, requests <-chan []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	reqCh := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		reqCh <- <-fakeSocks5Upstream(t, conn, 0)
+	}()
+	return ln.Addr().String(), caFile, hex.EncodeToString(sum[:]), reqCh
+}
+
+func TestUpstreamTLSDial(t *testing.T) {
+	addr, caFile, pin, requests := tlsSocks5Upstream(t)
+	def := config.ProxyDefinition{Address: addr, Username: "user", Password: "pass",
+		TLS: true, TLSCAFile: caFile, TLSPinSHA256: []string{pin}}
+	tlsConfig, err := def.UpstreamTLSConfig()
+	if err != nil {
+		t.Fatalf("UpstreamTLSConfig: %v", err)
+	}
+	pc := &ProxyConfig{Address: addr, Username: "user", Password: "pass", upstreamTLS: tlsConfig}
+	dialer, err := pc.UpstreamDialer("tcp")
+	if err != nil {
+		t.Fatalf("UpstreamDialer: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, dialer, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dial through TLS proxy: %v", err)
+	}
+	conn.Close()
+	if got := <-requests; !bytes.Equal(got[4:5+len("example.com")], []byte("\x0bexample.com")) {
+		t.Errorf("CONNECT request = %v", got)
+	}
+}
+
+func TestUpstreamTLSPinMismatch(t *testing.T) {
+	addr, caFile, _, _ := tlsSocks5Upstream(t)
+	def := config.ProxyDefinition{Address: addr, TLS: true, TLSCAFile: caFile,
+		TLSPinSHA256: []string{hex.EncodeToString(make([]byte, sha256.Size))}}
+	tlsConfig, err := def.UpstreamTLSConfig()
+	if err != nil {
+		t.Fatalf("UpstreamTLSConfig: %v", err)
+	}
+	pc := &ProxyConfig{Address: addr, upstreamTLS: tlsConfig}
+	forward, err := pc.forward()
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if conn, err := forward.DialContext(ctx, "tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("TLS handshake succeeded with a mismatching pin")
+	}
+}
+
+// familyDialer is a px.ContextDialer that connects only to IPv4 literals,
+// like a proxy whose exit has no IPv6
+type familyDialer struct{}
+
+func (familyDialer) Dial(network, addr string) (net.Conn, error) {
+	return familyDialer{}.DialContext(context.Background(), network, addr)
+}
+
+func (familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return nil, errors.New("network unreachable")
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestCheckAddressFamilies(t *testing.T) {
+	orig := lookupIP
+	t.Cleanup(func() { lookupIP = orig })
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if network == "ip4" {
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		}
+		return []net.IP{net.ParseIP("2001:db8::1")}, nil
+	}
+
+	p := &Pool{}
+	pc := &ProxyConfig{Address: "proxy:1080", PreferIPv6: true}
+	p.checkAddressFamilies(context.Background(), pc, familyDialer{}, "example.com:443")
+	snap := pc.Snapshot()
+	if snap.IPv4Reachable == nil || !*snap.IPv4Reachable {
+		t.Errorf("IPv4Reachable = %v, want true", snap.IPv4Reachable)
+	}
+	if snap.IPv6Reachable == nil || *snap.IPv6Reachable || pc.IPv6Reachable() {
+		t.Errorf("IPv6Reachable = %v, want false", snap.IPv6Reachable)
+	}
+
+	// an IPv6 literal target only tells about IPv6
+	pc = &ProxyConfig{Address: "proxy:1080", PreferIPv6: true}
+	p.checkAddressFamilies(context.Background(), pc, familyDialer{}, "[2001:db8::1]:443")
+	if snap := pc.Snapshot(); snap.IPv4Reachable != nil || !pc.IPv6Reachable() {
+		t.Errorf("IPv4Reachable = %v, IPv6Reachable = %v, want unknown and true", snap.IPv4Reachable, pc.IPv6Reachable())
+	}
+}
@@ -2,49 +2,339 @@ package proxypool
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sequring/chameleon/config"
+	px "golang.org/x/net/proxy"
+)
+
+// ProxyState is the health state of an upstream proxy
+type ProxyState string
+
+const (
+	StateActive     ProxyState = "active"
+	StateInactive   ProxyState = "inactive"
+	StateAuthFailed ProxyState = "auth_failed"
 )
 
 type ProxyConfig struct {
+	ID           string // stable identifier from the definitions file
 	Address      string
 	Username     string
 	Password     string
 	Tags         []string 
 	Description  string   
 	IsActive     bool
+	Disabled     bool // administratively drained: health-checked but never selected
+	Passthrough  bool // client dials present the SOCKS client's credentials instead of Username/Password
+	TLS          bool // the connection to the proxy is wrapped in TLS
+	PreferIPv6   bool // dial hostname destinations as IPv6 literals when IPv6 is reachable
+	AuthFailed   bool // last check failed because the proxy rejected our credentials
+	Canary       bool // added while canaries are enabled and not yet promoted (see Pool.SetCanary)
+	CostPerGB    float64 // provider price per GB relayed, 0 if unknown
+	// MaintenanceWindows are the time windows of scheduled downtime (see
+	// config.TimeWindow); InMaintenance is set while one of them is current,
+	// which keeps the proxy out of selection and its check failures quiet
+	MaintenanceWindows []string
+	InMaintenance      bool
 	LastCheck    time.Time
+	LastError    LastError // most recent failed check, zero if none
 	ResponseTime time.Duration
-	SuccessCount uint32
-	FailCount    uint32
-	Mu           sync.RWMutex
+	// LatencyEWMA and LatencyJitter are the exponentially weighted moving average
+	// and standard deviation of the response times since the proxy became active
+	LatencyEWMA   time.Duration
+	LatencyJitter time.Duration
+	// Throughput is the moving average of the speed test transfer rates in
+	// bytes per second, 0 until a speed test succeeded (see SetSpeedTest)
+	Throughput    float64
+	SuccessCount  uint32
+	FailCount     uint32
+	Mu            sync.RWMutex
+
+	// latencyVariance is the EWMA variance of the response times in ns² (guarded by Mu)
+	latencyVariance float64
+
+	// canaryRound is the current evaluation round of a canary (guarded by Mu)
+	canaryRound canaryRound
 
 	healthCheckCancelFunc context.CancelFunc 
 	hcMu                  sync.Mutex         
+
+	// checkStreak counts consecutive successful health checks (guarded by Mu)
+	checkStreak uint64
+	// failStreak counts consecutive failed health checks with the same
+	// LastError category (guarded by Mu)
+	failStreak uint64
+
+	// checkNowCh wakes the health check loop for an immediate out-of-band check
+	checkNowCh chan struct{}
+
+	// tlsSessions caches TLS sessions to the health check target seen through
+	// this proxy, so repeated checks can resume instead of doing a full handshake.
+	// Sessions are per proxy because each proxy reaches the target from its own exit IP.
+	tlsSessions tls.ClientSessionCache
+
+	// upstreamDialer is the SOCKS5 dialer for this proxy, built once on first use.
+	// Credentials never change for a ProxyConfig; the pool replaces it instead.
+	upstreamOnce   sync.Once
+	upstreamDialer px.Dialer
+	upstreamErr    error
+
+	// warm holds connections authenticated ahead of client dials (see SetPrewarm)
+	warm warmSet
+
+	// upstreamTLS is the TLS config for the connection to the proxy, nil for
+	// cleartext; upstreamTLSErr fails every dial if it could not be built.
+	// tlsDef is the definition it was built from, so reconciliation spots changes.
+	upstreamTLS    *tls.Config
+	upstreamTLSErr error
+	tlsDef         upstreamTLSDef
+
+	// pool is the pool the proxy belongs to, which decides whether it is
+	// reached through an entry proxy (see SetChains); nil dials it directly
+	pool *Pool
+
+	// ipv4 and ipv6 are the address families the dual-stack health check
+	// reached the check target with through this proxy (guarded by Mu)
+	ipv4, ipv6 reachability
 }
 
-func (pc *ProxyConfig) MarkActive(responseTime time.Duration) {
+// UpstreamDialer returns a SOCKS5 dialer for this proxy. For TCP the dialer
+// (and its auth struct) is built once and reused by every connection.
+func (pc *ProxyConfig) UpstreamDialer(network string) (px.Dialer, error) {
+	forward, err := pc.forward()
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		return px.SOCKS5(network, pc.Address, pc.auth(), forward)
+	}
+	pc.upstreamOnce.Do(func() {
+		pc.upstreamDialer, pc.upstreamErr = px.SOCKS5("tcp", pc.Address, pc.auth(), forward)
+	})
+	return pc.upstreamDialer, pc.upstreamErr
+}
+
+// UpstreamDialerWithAuth returns a SOCKS5 dialer for this proxy presenting creds.
+// A nil creds returns the shared dialer using the proxy's own credentials.
+func (pc *ProxyConfig) UpstreamDialerWithAuth(network string, creds *px.Auth) (px.Dialer, error) {
+	if creds == nil {
+		return pc.UpstreamDialer(network)
+	}
+	forward, err := pc.forward()
+	if err != nil {
+		return nil, err
+	}
+	return px.SOCKS5(network, pc.Address, creds, forward)
+}
+
+// auth returns the SOCKS5 credentials for this proxy, or nil if it needs none.
+// A templated username is rendered without a client, so {user} and {country}
+// are empty and the shared dialer keeps one session for its lifetime.
+func (pc *ProxyConfig) auth() *px.Auth {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	if pc.Username == "" {
+		return nil
+	}
+	return &px.Auth{User: config.RenderUsername(pc.Username, config.UsernameVars{}), Password: pc.Password}
+}
+
+// MarkActive records a successful health check. It reports whether the proxy
+// changed state (including its very first check) and the length of the
+// current success streak.
+func (pc *ProxyConfig) MarkActive(responseTime time.Duration) (changed bool, streak uint64) {
+	return pc.markActiveAt(time.Now(), responseTime)
+}
+
+// markActiveAt is MarkActive with the check time given by the pool's clock
+func (pc *ProxyConfig) markActiveAt(now time.Time, responseTime time.Duration) (changed bool, streak uint64) {
 	pc.Mu.Lock()
 	defer pc.Mu.Unlock()
+	changed = !pc.IsActive || pc.LastCheck.IsZero()
+	pc.observeLatencyLocked(responseTime, !pc.IsActive)
 	pc.IsActive = true
-	pc.LastCheck = time.Now()
+	pc.AuthFailed = false
+	pc.LastCheck = now
+	pc.failStreak = 0
 	pc.ResponseTime = responseTime
+	pc.checkStreak++
+	return changed, pc.checkStreak
+}
+
+// latencyEWMAAlpha is the weight of a new response time in the moving averages
+const latencyEWMAAlpha = 0.3
+
+// observeLatencyLocked folds a response time into LatencyEWMA and LatencyJitter.
+// With restart, the averages start over from sample, because samples from before
+// the proxy went inactive no longer describe it. The caller must hold Mu.
+func (pc *ProxyConfig) observeLatencyLocked(sample time.Duration, restart bool) {
+	if restart {
+		pc.LatencyEWMA, pc.LatencyJitter, pc.latencyVariance = sample, 0, 0
+		return
+	}
+	diff := float64(sample - pc.LatencyEWMA)
+	increment := latencyEWMAAlpha * diff
+	pc.LatencyEWMA += time.Duration(increment)
+	pc.latencyVariance = (1 - latencyEWMAAlpha) * (pc.latencyVariance + diff*increment)
+	pc.LatencyJitter = time.Duration(math.Sqrt(pc.latencyVariance))
+}
+
+// ExpectedLatency is the latency the least-latency selection ranks proxies by:
+// the average response time plus one standard deviation, so a proxy with
+// erratic response times ranks behind a steady one with the same average
+func (pc *ProxyConfig) ExpectedLatency() time.Duration {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.LatencyEWMA + pc.LatencyJitter
+}
+
+// Cost returns the provider price per GB relayed through the proxy
+func (pc *ProxyConfig) Cost() float64 {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.CostPerGB
+}
+
+// State returns the current health state of the proxy
+func (pc *ProxyConfig) State() ProxyState {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.stateLocked()
+}
+
+// ProxySnapshot is a point-in-time copy of a proxy's definition and health, safe
+// to use without locking. The password is never included.
+type ProxySnapshot struct {
+	ID            string        `json:"id,omitempty"`
+	Address       string        `json:"address"`
+	Username      string        `json:"username,omitempty"`
+	Tags          []string      `json:"tags,omitempty"`
+	Description   string        `json:"description,omitempty"`
+	State         ProxyState    `json:"state"`
+	IsActive      bool          `json:"active"`
+	Disabled      bool          `json:"disabled"`
+	Passthrough   bool          `json:"passthrough,omitempty"`
+	TLS           bool          `json:"tls,omitempty"`
+	PreferIPv6    bool          `json:"prefer_ipv6,omitempty"`
+	IPv4Reachable *bool         `json:"ipv4_reachable,omitempty"` // nil until a dual-stack check ran
+	IPv6Reachable *bool         `json:"ipv6_reachable,omitempty"`
+	AuthFailed    bool          `json:"auth_failed"`
+	Canary        bool          `json:"canary,omitempty"`
+	CostPerGB     float64       `json:"cost_per_gb,omitempty"`
+	MaintenanceWindows []string `json:"maintenance_windows,omitempty"`
+	InMaintenance bool          `json:"in_maintenance,omitempty"`
+	LastCheck     time.Time     `json:"last_check"`
+	LastError     *LastError    `json:"last_error,omitempty"` // nil until a check failed
+	ResponseTime  time.Duration `json:"response_time_ns"`
+	LatencyEWMA   time.Duration `json:"latency_ewma_ns"`
+	LatencyJitter time.Duration `json:"latency_jitter_ns"`
+	Throughput    float64       `json:"throughput_bytes_per_second,omitempty"`
+	SuccessCount  uint32        `json:"success_count"`
+	FailCount     uint32        `json:"fail_count"`
+}
+
+// Snapshot copies the proxy's current definition and health under its lock
+func (pc *ProxyConfig) Snapshot() ProxySnapshot {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	var lastErr *LastError
+	if !pc.LastError.Time.IsZero() {
+		e := pc.LastError
+		lastErr = &e
+	}
+	return ProxySnapshot{
+		ID:            pc.ID,
+		Address:       pc.Address,
+		Username:      pc.Username,
+		Tags:          slices.Clone(pc.Tags),
+		Description:   pc.Description,
+		State:         pc.stateLocked(),
+		IsActive:      pc.IsActive,
+		Disabled:      pc.Disabled,
+		Passthrough:   pc.Passthrough,
+		TLS:           pc.TLS,
+		PreferIPv6:    pc.PreferIPv6,
+		IPv4Reachable: pc.ipv4.known(),
+		IPv6Reachable: pc.ipv6.known(),
+		AuthFailed:    pc.AuthFailed,
+		Canary:        pc.Canary,
+		CostPerGB:     pc.CostPerGB,
+		MaintenanceWindows: slices.Clone(pc.MaintenanceWindows),
+		InMaintenance: pc.InMaintenance,
+		LastCheck:     pc.LastCheck,
+		LastError:     lastErr,
+		ResponseTime:  pc.ResponseTime,
+		LatencyEWMA:   pc.LatencyEWMA,
+		LatencyJitter: pc.LatencyJitter,
+		Throughput:    pc.Throughput,
+		SuccessCount:  atomic.LoadUint32(&pc.SuccessCount),
+		FailCount:     atomic.LoadUint32(&pc.FailCount),
+	}
+}
+
+// stateLocked returns the health state; the caller must hold Mu
+func (pc *ProxyConfig) stateLocked() ProxyState {
+	switch {
+	case pc.IsActive:
+		return StateActive
+	case pc.AuthFailed:
+		return StateAuthFailed
+	default:
+		return StateInactive
+	}
 }
 
 // String returns a string representation of the ProxyConfig
 func (pc *ProxyConfig) String() string {
 	pc.Mu.RLock()
 	defer pc.Mu.RUnlock()
-	return fmt.Sprintf("ProxyConfig{Address: %s, User: %s, Active: %v, LastCheck: %v, ResponseTime: %v}",
-		pc.Address, pc.Username, pc.IsActive, pc.LastCheck, pc.ResponseTime)
+	return fmt.Sprintf("ProxyConfig{Address: %s, User: %s, State: %s, LastCheck: %v, ResponseTime: %v}",
+		pc.Address, pc.Username, pc.stateLocked(), pc.LastCheck, pc.ResponseTime)
+}
+
+// MarkInactive records a failed health check and reports whether the proxy
+// changed state (including its very first check). Credential rejections are
+// tracked separately from connectivity failures via AuthFailed; checkErr is
+// kept as LastError.
+func (pc *ProxyConfig) MarkInactive(checkErr error) (changed bool) {
+	return pc.markInactiveAt(time.Now(), checkErr)
 }
 
-func (pc *ProxyConfig) MarkInactive(checkErr error) { 
+// markInactiveAt is MarkInactive with the check time given by the pool's clock
+func (pc *ProxyConfig) markInactiveAt(now time.Time, checkErr error) (changed bool) {
+	authFailed := IsAuthError(checkErr)
 	pc.Mu.Lock()
 	defer pc.Mu.Unlock()
+	changed = pc.IsActive || pc.LastCheck.IsZero() || pc.AuthFailed != authFailed
 	pc.IsActive = false
-	pc.LastCheck = time.Now()
+	pc.AuthFailed = authFailed
+	pc.LastCheck = now
+	if checkErr != nil {
+		category := categorize(checkErr)
+		if category != pc.LastError.Category {
+			pc.failStreak = 0
+		}
+		pc.failStreak++
+		pc.LastError = LastError{Message: checkErr.Error(), Category: category, Time: now}
+	}
+	pc.checkStreak = 0
+	return changed
+}
+
+// triggerCheck asks the health check loop to run a check immediately.
+// It never blocks; if a trigger is already pending it is a no-op.
+func (pc *ProxyConfig) triggerCheck() {
+	select {
+	case pc.checkNowCh <- struct{}{}:
+	default:
+	}
 }
 
 func (pc *ProxyConfig) setHealthCheckCancelFunc(cancel context.CancelFunc) {
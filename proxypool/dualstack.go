@@ -0,0 +1,93 @@
+package proxypool
+
+import (
+	"context"
+	"log"
+	"net"
+
+	px "golang.org/x/net/proxy"
+)
+
+// reachability is what the dual-stack health check found for one address family
+type reachability int8
+
+const (
+	reachUnknown reachability = iota // not checked, or the target has no address of the family
+	reachOK
+	reachFailed
+)
+
+// known returns the reachability for snapshots: nil when unknown
+func (r reachability) known() *bool {
+	if r == reachUnknown {
+		return nil
+	}
+	ok := r == reachOK
+	return &ok
+}
+
+// lookupIP resolves the health check target for the dual-stack check; replaced in tests
+var lookupIP = net.DefaultResolver.LookupIP
+
+// IPv6Reachable reports whether the last dual-stack health check reached the
+// check target over IPv6 through the proxy
+func (pc *ProxyConfig) IPv6Reachable() bool {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.ipv6 == reachOK
+}
+
+// checkAddressFamilies runs the dual-stack part of the health check for proxies
+// with prefer_ipv6: it connects through dialer to an IPv4 and an IPv6 address
+// of target and records which family the proxy reaches. An IP literal target
+// only tells about its own family.
+func (p *Pool) checkAddressFamilies(ctx context.Context, proxyCfg *ProxyConfig, dialer px.Dialer, target string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return
+	}
+	ipv4, ipv6 := reachUnknown, reachUnknown
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			ipv4 = reachOK
+		} else {
+			ipv6 = reachOK
+		}
+	} else {
+		ipv4 = reachFamily(ctx, dialer, "ip4", host, port)
+		ipv6 = reachFamily(ctx, dialer, "ip6", host, port)
+	}
+
+	proxyCfg.Mu.Lock()
+	prev := proxyCfg.ipv6
+	proxyCfg.ipv4, proxyCfg.ipv6 = ipv4, ipv6
+	addr := proxyCfg.Address
+	proxyCfg.Mu.Unlock()
+
+	if ipv6 != prev {
+		switch ipv6 {
+		case reachOK:
+			log.Printf("Proxy %s reaches IPv6 destinations, preferring IPv6.", addr)
+		case reachFailed:
+			log.Printf("Proxy %s does not reach IPv6 destinations, falling back to hostnames.", addr)
+		}
+	}
+	if ipv4 == reachFailed {
+		log.Printf("Warning: Proxy %s does not reach the IPv4 address of %s", addr, host)
+	}
+}
+
+// reachFamily dials the first address of host in network ("ip4" or "ip6")
+// through dialer
+func reachFamily(ctx context.Context, dialer px.Dialer, network, host, port string) reachability {
+	ips, err := lookupIP(ctx, network, host)
+	if err != nil || len(ips) == 0 {
+		return reachUnknown
+	}
+	conn, err := DialContext(ctx, dialer, "tcp", net.JoinHostPort(ips[0].String(), port))
+	if err != nil {
+		return reachFailed
+	}
+	conn.Close()
+	return reachOK
+}
@@ -0,0 +1,101 @@
+package proxypool
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of pool event
+type EventType string
+
+const (
+	// EventProxyAuthFailed is emitted when an upstream proxy starts rejecting our credentials
+	EventProxyAuthFailed EventType = "proxy_auth_failed"
+	// EventProxyRemoved is emitted when a proxy is dropped from the pool
+	EventProxyRemoved EventType = "proxy_removed"
+	// EventProxyUp is emitted when a health check brings a proxy into rotation
+	EventProxyUp EventType = "proxy_up"
+	// EventProxyDown is emitted when a health check takes an active proxy out of rotation
+	EventProxyDown EventType = "proxy_down"
+)
+
+// Severity describes how urgent an event is
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// Event is a structured notification about something that happened in the pool
+type Event struct {
+	Type         EventType `json:"type"`
+	Severity     Severity  `json:"severity"`
+	ProxyAddress string    `json:"proxy_address,omitempty"`
+	Message      string    `json:"message"`
+	Time         time.Time `json:"time"`
+}
+
+// eventBus fans pool events out to registered handlers
+type eventBus struct {
+	mu       sync.RWMutex
+	nextID   uint64
+	handlers map[uint64]func(Event)
+}
+
+func (b *eventBus) add(h func(Event)) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[uint64]func(Event))
+	}
+	b.nextID++
+	b.handlers[b.nextID] = h
+	return b.nextID
+}
+
+func (b *eventBus) remove(id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, id)
+}
+
+func (b *eventBus) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, h := range b.handlers {
+		h(ev)
+	}
+}
+
+// AddEventHandler registers h to be called for every pool event.
+// Handlers are called synchronously from health check goroutines and must not block.
+func (p *Pool) AddEventHandler(h func(Event)) {
+	p.events.add(h)
+}
+
+// SubscribeEvents returns a channel receiving pool events and a function that
+// cancels the subscription. Events are dropped if the subscriber falls more than
+// buffer events behind, so slow consumers never stall health checks.
+func (p *Pool) SubscribeEvents(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	id := p.events.add(func(ev Event) {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			// after remove returns no emit can still be running the handler
+			p.events.remove(id)
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
@@ -0,0 +1,136 @@
+package proxypool
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// healthAlertInterval is how often the fraction of active proxies is evaluated
+const healthAlertInterval = 5 * time.Second
+
+const (
+	// EventPoolDegraded is emitted when the fraction of active proxies has stayed
+	// below the HealthAlert threshold for its duration
+	EventPoolDegraded EventType = "pool_degraded"
+	// EventPoolHealthRestored is emitted when the fraction of active proxies is
+	// back at the threshold after EventPoolDegraded
+	EventPoolHealthRestored EventType = "pool_health_restored"
+)
+
+// HealthAlert raises EventPoolDegraded when fewer than Threshold of the enabled
+// proxies have been active for longer than For. Unlike the per-proxy events it
+// fires once per degradation, so paging rules need not count proxies.
+type HealthAlert struct {
+	// Threshold is a fraction between 0 and 1; 0 disables the alert
+	Threshold float64
+	For       time.Duration
+}
+
+// healthAlertState tracks an ongoing degradation
+type healthAlertState struct {
+	mu       sync.Mutex
+	since    time.Time // when the fraction dropped below the threshold; zero while it is not
+	alerting bool      // EventPoolDegraded was emitted and not yet followed by EventPoolHealthRestored
+}
+
+// SetHealthAlert enables the pool-wide health alert. A zero threshold disables it.
+func (p *Pool) SetHealthAlert(alert HealthAlert) {
+	if alert.Threshold <= 0 {
+		p.healthAlert.Store(nil)
+		return
+	}
+	p.healthAlert.Store(&alert)
+	p.healthAlertOnce.Do(func() {
+		p.wg.Add(1)
+		go p.watchHealthAlert()
+	})
+}
+
+// watchHealthAlert evaluates the health alert until the pool stops
+func (p *Pool) watchHealthAlert() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(healthAlertInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.evaluateHealthAlert()
+		case <-p.overallShutdownCtx.Done():
+			return
+		}
+	}
+}
+
+// enabledCounts returns how many enabled proxies outside their maintenance
+// windows there are and how many of them are active
+func (p *Pool) enabledCounts() (active, enabled int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, proxy := range p.proxies {
+		proxy.Mu.RLock()
+		if !proxy.Disabled && !proxy.InMaintenance {
+			enabled++
+			if proxy.IsActive {
+				active++
+			}
+		}
+		proxy.Mu.RUnlock()
+	}
+	return active, enabled
+}
+
+// evaluateHealthAlert emits EventPoolDegraded or EventPoolHealthRestored when
+// the fraction of active proxies crosses the threshold. A pool without enabled
+// proxies is not considered degraded.
+func (p *Pool) evaluateHealthAlert() {
+	alert := p.healthAlert.Load()
+	if alert == nil {
+		return
+	}
+	active, enabled := p.enabledCounts()
+	below := enabled > 0 && float64(active) < alert.Threshold*float64(enabled)
+	now := p.now()
+
+	s := &p.healthAlertState
+	s.mu.Lock()
+	var ev *Event
+	if !below {
+		s.since = time.Time{}
+		if s.alerting {
+			s.alerting = false
+			// a warning rather than info, so the webhook delivers the all-clear too
+			ev = &Event{
+				Type:     EventPoolHealthRestored,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("%d of %d proxies are active again, at or above the %.0f%% threshold", active, enabled, alert.Threshold*100),
+			}
+		}
+	} else {
+		if s.since.IsZero() {
+			s.since = now
+		}
+		if !s.alerting && now.Sub(s.since) >= alert.For {
+			s.alerting = true
+			ev = &Event{
+				Type:     EventPoolDegraded,
+				Severity: SeverityCritical,
+				Message: fmt.Sprintf("only %d of %d proxies have been active for %v, below the %.0f%% threshold",
+					active, enabled, now.Sub(s.since).Round(time.Second), alert.Threshold*100),
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if ev == nil {
+		return
+	}
+	ev.Time = now
+	if ev.Type == EventPoolDegraded {
+		log.Printf("CRITICAL: %s", ev.Message)
+	} else {
+		log.Printf("Pool health restored: %s", ev.Message)
+	}
+	p.events.emit(*ev)
+}
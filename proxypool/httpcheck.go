@@ -0,0 +1,94 @@
+package proxypool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// httpCheckBodyLimit is how much of the response body is searched for ExpectBody
+const httpCheckBodyLimit = 64 << 10
+
+// HTTPCheck makes health checks send an HTTP/1.1 GET to the check target after
+// connecting, catching upstreams that complete handshakes but answer real
+// traffic with block pages
+type HTTPCheck struct {
+	// Path is the request path, e.g. "/generate_204"
+	Path string
+	// ExpectStatus lists the accepted status codes; empty accepts 200
+	ExpectStatus []int
+	// ExpectBody, when set, must occur in the first 64 KiB of the body
+	ExpectBody string
+	// Plain sends the request over TCP instead of TLS
+	Plain bool
+}
+
+// HTTPCheckError is returned when the check target answers the HTTP check
+// with an unexpected status or body
+type HTTPCheckError struct {
+	Status int
+	Reason string
+}
+
+func (e *HTTPCheckError) Error() string {
+	return fmt.Sprintf("HTTP check got status %d: %s", e.Status, e.Reason)
+}
+
+// SetHTTPCheck makes health checks send an HTTP GET as configured by check. A
+// nil check restores the TLS handshake check.
+func (p *Pool) SetHTTPCheck(check *HTTPCheck) {
+	p.httpCheck.Store(check)
+}
+
+// do sends the GET to host over conn and validates the response
+func (c *HTTPCheck) do(ctx context.Context, conn net.Conn, host string) error {
+	scheme, defaultPort := "https", "443"
+	if c.Plain {
+		scheme, defaultPort = "http", "80"
+	}
+	// the Host header leaves out the scheme's default port
+	if hostname, port, err := net.SplitHostPort(host); err == nil && port == defaultPort {
+		host = hostname
+		if strings.Contains(hostname, ":") {
+			host = "[" + hostname + "]"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+host+c.Path, nil)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP check request: %w", err)
+	}
+	req.Close = true
+	req.Header.Set("User-Agent", "chameleon-health-check")
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("failed to send HTTP check request: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP check response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	expected := c.ExpectStatus
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+	if !slices.Contains(expected, resp.StatusCode) {
+		return &HTTPCheckError{Status: resp.StatusCode, Reason: fmt.Sprintf("expected %v", expected)}
+	}
+	if c.ExpectBody == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpCheckBodyLimit))
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP check response body: %w", err)
+	}
+	if !strings.Contains(string(body), c.ExpectBody) {
+		return &HTTPCheckError{Status: resp.StatusCode, Reason: fmt.Sprintf("body does not contain %q", c.ExpectBody)}
+	}
+	return nil
+}
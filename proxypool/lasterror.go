@@ -0,0 +1,70 @@
+package proxypool
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrorCategory classifies why a health check failed
+type ErrorCategory string
+
+const (
+	ErrorAuth          ErrorCategory = "auth"            // the proxy rejected our credentials
+	ErrorTimeout       ErrorCategory = "timeout"         // the check did not finish in time
+	ErrorRefused       ErrorCategory = "connect_refused" // the proxy refused the TCP connection
+	ErrorDNS           ErrorCategory = "dns"             // a host name could not be resolved
+	ErrorUpstreamReply ErrorCategory = "upstream_reply"  // the proxy refused to connect to the check target
+	ErrorTLSVerify     ErrorCategory = "tls_verify"      // the check target's certificate did not verify
+	ErrorTLS           ErrorCategory = "tls"             // the TLS handshake with the check target failed otherwise
+	ErrorHTTPCheck     ErrorCategory = "http_check"      // the check target answered the HTTP check unexpectedly
+	ErrorOther         ErrorCategory = "other"
+)
+
+// LastError is the most recent failed health check of a proxy. It is kept after
+// the proxy recovers; compare Time with LastCheck to tell.
+type LastError struct {
+	Message  string        `json:"message"`
+	Category ErrorCategory `json:"category"`
+	Time     time.Time     `json:"time"`
+}
+
+// categorize returns the ErrorCategory of a health check error
+func categorize(err error) ErrorCategory {
+	var (
+		netErr       net.Error
+		dnsErr       *net.DNSError
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		httpErr      *HTTPCheckError
+	)
+	switch {
+	case IsAuthError(err):
+		return ErrorAuth
+	case errors.As(err, &httpErr):
+		return ErrorHTTPCheck
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorRefused
+	case errors.As(err, &verifyErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorTLSVerify
+	case errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return ErrorTLS
+	case strings.Contains(err.Error(), "unknown error "):
+		// golang.org/x/net/proxy reports the SOCKS reply of a refused CONNECT this way
+		return ErrorUpstreamReply
+	}
+	return ErrorOther
+}
@@ -0,0 +1,93 @@
+package proxypool
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// inMaintenanceWindow reports whether now falls into one of windows
+func inMaintenanceWindow(windows []string, now time.Time) bool {
+	for _, window := range windows {
+		if config.InTimeWindow(window, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchMaintenance starts the loop that moves proxies in and out of their
+// maintenance windows, once the first proxy with windows is added
+func (p *Pool) watchMaintenance() {
+	p.maintenanceOnce.Do(func() {
+		p.wg.Add(1)
+		go p.maintenanceLoop()
+	})
+}
+
+// maintenanceLoop updates InMaintenance of every proxy at the start of each
+// minute, the resolution of time windows, and rebuilds the selection set when
+// a window begins or ends
+func (p *Pool) maintenanceLoop() {
+	defer p.wg.Done()
+	for {
+		now := p.now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-timer.C:
+		case <-p.overallShutdownCtx.Done():
+			timer.Stop()
+			return
+		}
+		if p.updateMaintenance(p.now()) {
+			p.rebuildActive()
+		}
+	}
+}
+
+// updateMaintenance sets InMaintenance of every proxy for now and reports
+// whether any proxy entered or left maintenance. A proxy still down when its
+// window ends raises the EventProxyDown its failed checks kept quiet.
+func (p *Pool) updateMaintenance(now time.Time) bool {
+	changed := false
+	var stillDown []*ProxyConfig
+	for _, proxy := range p.proxyList() {
+		proxy.Mu.Lock()
+		in := inMaintenanceWindow(proxy.MaintenanceWindows, now)
+		if in != proxy.InMaintenance {
+			proxy.InMaintenance = in
+			changed = true
+			if in {
+				log.Printf("Proxy %s entered its maintenance window, removing it from selection.", proxy.Address)
+			} else {
+				log.Printf("Proxy %s left its maintenance window, returning it to selection.", proxy.Address)
+				if !proxy.IsActive {
+					stillDown = append(stillDown, proxy)
+				}
+			}
+		}
+		proxy.Mu.Unlock()
+	}
+	for _, proxy := range stillDown {
+		p.events.emit(Event{
+			Type:         EventProxyDown,
+			Severity:     SeverityInfo,
+			ProxyAddress: proxy.Address,
+			Message:      fmt.Sprintf("Proxy %s is still down after its maintenance window", proxy.Address),
+			Time:         now,
+		})
+	}
+	if len(stillDown) > 0 {
+		p.noteProxyDown()
+	}
+	return changed
+}
+
+// inMaintenance reports whether the proxy is in one of its maintenance windows
+func (pc *ProxyConfig) inMaintenance() bool {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.InMaintenance
+}
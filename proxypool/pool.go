@@ -2,10 +2,13 @@ package proxypool
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"log"
-	"math/rand"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,9 +16,16 @@ import (
 	"github.com/sequring/chameleon/config"
 )
 
+// DefinitionsSource provides the proxy definitions the pool reconciles with and
+// signals when they change. *config.ProxyDefinitionsManager implements it.
+type DefinitionsSource interface {
+	GetDefinitions() []config.ProxyDefinition
+	Subscribe() <-chan struct{}
+}
+
 // Pool manages a collection of proxy connections and their health checks
 type Pool struct {
-	definitionsManager *config.ProxyDefinitionsManager
+	definitionsManager DefinitionsSource
 	proxies           map[string]*ProxyConfig
 	mu                sync.RWMutex
 	checkInterval     time.Duration
@@ -25,11 +35,43 @@ type Pool struct {
 	overallShutdownCtx    context.Context
 	overallShutdownCancel context.CancelFunc
 	tlsCheckConfig    atomic.Value // *TLSCheckConfig
+	tlsOverrides      atomic.Pointer[[]TLSCheckOverride] // set by SetTLSCheckOverrides
+	httpCheck         atomic.Pointer[HTTPCheck] // set by SetHTTPCheck; nil means the TLS handshake check
+	checkTargets      atomic.Pointer[checkTargets] // set by SetHealthCheckTargets; nil means testURL
+	healthLogConfig   atomic.Value // *HealthLogConfig
+	events            eventBus
+	outage            atomic.Bool // true while every proxy is down after at least one was up
+	healthAlert       atomic.Pointer[HealthAlert] // set by SetHealthAlert; nil disables the alert
+	healthAlertOnce   sync.Once                   // starts watchHealthAlert
+	maintenanceOnce   sync.Once                   // starts maintenanceLoop
+	healthAlertState  healthAlertState
+	canary            atomic.Pointer[Canary] // set by SetCanary; nil means new proxies join full rotation right away
+	tlsResumed        atomic.Uint64 // health check TLS handshakes that resumed a cached session
+	tlsFull           atomic.Uint64 // health check TLS handshakes that did a full exchange
+	active            atomic.Pointer[activeSet] // snapshot of active proxies used for selection
+	activeMu          sync.Mutex                // serializes rebuilds of the active snapshot
+	healthLoops       atomic.Int64              // running health check loops, should equal the number of proxies
+	definitionsChanged chan struct{}            // signalled by NotifyDefinitionsChanged
+	clock             atomic.Pointer[func() time.Time] // time source set by SetClock; nil means time.Now
+	healthChecker     atomic.Pointer[HealthChecker]    // set by SetHealthChecker; nil means the SOCKS5/TLS check
+	startup           *startupTracker                  // bounds and tracks the first check of each proxy
+	prewarm           atomic.Pointer[PrewarmConfig]    // set by SetPrewarm; nil disables prewarming
+	prewarmHits       atomic.Uint64                    // client dials that used a prewarmed connection
+	prewarmMisses     atomic.Uint64                    // client dials that found no prewarmed connection
+	exits             exitRings                        // recently used proxies of rotating clients
+	rotationWindows   atomic.Pointer[[]RotationWindow] // set by SetRotationWindows; nil disables scheduled rotation
+	chains            atomic.Pointer[[]Chain]          // set by SetChains; nil dials every proxy directly
+	speedTest         atomic.Pointer[SpeedTest]        // set by SetSpeedTest; nil disables throughput probes
+	backoff           atomic.Pointer[map[ErrorCategory]CheckBackoff] // set by SetCheckBackoff; nil means DefaultCheckBackoff
+	checkFailureObserver atomic.Pointer[CheckFailureObserver] // set by SetCheckFailureObserver
+	strategy          atomic.Pointer[Strategy]         // set by SetStrategy; nil means StrategyRandom
+	roundRobin        atomic.Uint64                    // turn of StrategyRoundRobin
+	costTolerance     atomic.Int64                     // latency tolerance of StrategyCheapest in ns, set by SetCostLatencyTolerance
 }
 
 // New creates and initializes a new ProxyPool with secure defaults
 func New(
-	definitionsMgr *config.ProxyDefinitionsManager,
+	definitionsMgr DefinitionsSource,
 	checkInterval, timeout time.Duration,
 	testURL string,
 ) *Pool {
@@ -42,12 +84,19 @@ func New(
 		testURL:           testURL,
 		overallShutdownCtx:    overallCtx,
 		overallShutdownCancel: overallCancel,
+		definitionsChanged:    make(chan struct{}, 1),
+		startup:               newStartupTracker(DefaultStartupCheckConcurrency),
 	}
 	pool.tlsCheckConfig.Store(DefaultTLSCheckConfig())
+	pool.healthLogConfig.Store(DefaultHealthLogConfig())
 
+	// subscribe before the initial load, so no change after it is missed
+	updates := definitionsMgr.Subscribe()
 	if err := pool.reloadAndReconcileProxies(); err != nil {
 		log.Printf("Error during initial proxy load: %v. Pool might be empty or outdated.", err)
 	}
+	pool.wg.Add(1)
+	go pool.watchDefinitions(updates)
 
 	return pool
 }
@@ -73,6 +122,25 @@ func equalStringSlices(a, b []string) bool {
     return true
 }
 
+// HasAnyTag reports whether proxyTags satisfies at least one of wanted. Entries
+// of wanted may be tag expressions (see config.TagExpr).
+func HasAnyTag(proxyTags, wanted []string) bool {
+	for _, w := range wanted {
+		if !config.IsPlainTag(w) {
+			if config.MatchTagExpr(w, proxyTags) {
+				return true
+			}
+			continue
+		}
+		for _, t := range proxyTags {
+			if t == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (p *Pool) reloadAndReconcileProxies() error {
 	log.Println("Reloading and reconciling proxies...")
 	newDefinitions := p.definitionsManager.GetDefinitions()
@@ -88,6 +156,11 @@ func (p *Pool) reloadAndReconcileProxies() error {
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	// Stop cancels under mu, so no health check starts once it waits for them
+	if p.overallShutdownCtx.Err() != nil {
+		log.Println("Proxy pool is stopping, skipping reconciliation")
+		return nil
+	}
 
 	log.Printf("Current active proxies before reconciliation: %d", len(p.proxies))
 
@@ -103,36 +176,76 @@ func (p *Pool) reloadAndReconcileProxies() error {
 			log.Printf("Proxy %s removed from configuration, stopping its health check.", addr)
 			existingProxyCfg.shutdownHealthCheck()
 			delete(p.proxies, addr)
+			p.events.emit(Event{
+				Type:         EventProxyRemoved,
+				Severity:     SeverityInfo,
+				ProxyAddress: addr,
+				Message:      fmt.Sprintf("Proxy %s removed from configuration", addr),
+				Time:         p.now(),
+			})
 		}
 	}
 
 	// Add or update proxies
 	for addr, newDef := range newProxiesMap {
 		if existingProxyCfg, exists := p.proxies[addr]; exists {
+			existingProxyCfg.Mu.Lock()
 			needsRestart := false
-			if existingProxyCfg.Username != newDef.Username || existingProxyCfg.Password != newDef.Password {
+			if existingProxyCfg.Username != newDef.Username || existingProxyCfg.Password != newDef.Password ||
+				existingProxyCfg.Passthrough != (newDef.CredentialMode == config.CredentialModePassthrough) {
 				log.Printf("Proxy %s credentials changed.", addr)
 				needsRestart = true
 			}
+			if !existingProxyCfg.tlsDef.equal(upstreamTLSDefOf(newDef)) {
+				log.Printf("Proxy %s TLS settings changed.", addr)
+				needsRestart = true
+			}
+			if existingProxyCfg.PreferIPv6 != newDef.PreferIPv6 {
+				log.Printf("Proxy %s prefer_ipv6 changed.", addr)
+				needsRestart = true
+			}
 			// Update tags and description
-			existingProxyCfg.Mu.Lock()
 			tagsChanged := !equalStringSlices(existingProxyCfg.Tags, newDef.Tags)
 			descChanged := existingProxyCfg.Description != newDef.Description
+			existingProxyCfg.ID = newDef.ID
 			existingProxyCfg.Tags = newDef.Tags
 			existingProxyCfg.Description = newDef.Description
+			existingProxyCfg.CostPerGB = newDef.CostPerGB
+			existingProxyCfg.MaintenanceWindows = newDef.MaintenanceWindows
+			existingProxyCfg.InMaintenance = inMaintenanceWindow(newDef.MaintenanceWindows, p.now())
+			if len(newDef.MaintenanceWindows) > 0 {
+				p.watchMaintenance()
+			}
+			if disabled := !newDef.IsEnabled(); disabled != existingProxyCfg.Disabled {
+				// takes effect through rebuildActiveLocked below, no health check restart needed
+				if disabled {
+					log.Printf("Proxy %s disabled, draining it from selection.", addr)
+				} else {
+					log.Printf("Proxy %s enabled, returning it to selection.", addr)
+				}
+				existingProxyCfg.Disabled = disabled
+			}
 			existingProxyCfg.Mu.Unlock()
 
 			if needsRestart || tagsChanged || descChanged {
 				log.Printf("Restarting health check for proxy %s due to config changes.", addr)
 				existingProxyCfg.shutdownHealthCheck()
-				p.proxies[addr] = p.createAndStartProxyConfig(newDef)
+				// a restarted proxy keeps its canary state
+				p.proxies[addr] = p.createAndStartProxyConfig(newDef, existingProxyCfg.Canary)
 			}
 		} else {
-			log.Printf("New proxy %s added, starting its health check.", addr)
-			p.proxies[addr] = p.createAndStartProxyConfig(newDef)
+			canary := p.newCanary()
+			if canary {
+				log.Printf("New proxy %s added as a canary, starting its health check.", addr)
+			} else {
+				log.Printf("New proxy %s added, starting its health check.", addr)
+			}
+			p.proxies[addr] = p.createAndStartProxyConfig(newDef, canary)
 		}
 	}
 
+	p.rebuildActiveLocked()
+
 	activeCount := 0
 	for _, proxy := range p.proxies {
 		proxy.Mu.RLock()
@@ -147,31 +260,93 @@ func (p *Pool) reloadAndReconcileProxies() error {
 	return nil
 }
 
+// Reconcile re-reads definitions from the definitions manager and reconciles the pool
+// with them, starting and stopping health checks as needed.
+func (p *Pool) Reconcile() error {
+	return p.reloadAndReconcileProxies()
+}
+
+// NotifyDefinitionsChanged asks the pool to reconcile with the definitions manager.
+// It never blocks: reconciliation runs in the background, and notifications that
+// arrive while one is pending are coalesced into it. Use Reconcile instead when
+// the caller needs the pool to be up to date before it continues.
+func (p *Pool) NotifyDefinitionsChanged() {
+	select {
+	case p.definitionsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// watchDefinitions reconciles the pool whenever the definitions source signals
+// a change on updates or NotifyDefinitionsChanged is called, until the pool is stopped
+func (p *Pool) watchDefinitions(updates <-chan struct{}) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-updates:
+		case <-p.definitionsChanged:
+		case <-p.overallShutdownCtx.Done():
+			return
+		}
+		if err := p.reloadAndReconcileProxies(); err != nil {
+			log.Printf("Error reconciling proxies after definitions change: %v", err)
+		}
+	}
+}
+
 // createAndStartProxyConfig создает ProxyConfig и запускает его health check.
-func (p *Pool) createAndStartProxyConfig(def *config.ProxyDefinition) *ProxyConfig {
+func (p *Pool) createAndStartProxyConfig(def *config.ProxyDefinition, canary bool) *ProxyConfig {
 	proxyCfg := &ProxyConfig{
+		ID:          def.ID,
 		Address:     def.Address,
 		Username:    def.Username,
 		Password:    def.Password,
 		Tags:        def.Tags,
 		Description: def.Description,
 		IsActive:    false,
+		Disabled:    !def.IsEnabled(),
+		Canary:      canary,
+		Passthrough: def.CredentialMode == config.CredentialModePassthrough,
+		checkNowCh:  make(chan struct{}, 1),
+		tlsSessions: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+		TLS:         def.TLS,
+		tlsDef:      upstreamTLSDefOf(def),
+		PreferIPv6:  def.PreferIPv6,
+		CostPerGB:   def.CostPerGB,
+		MaintenanceWindows: def.MaintenanceWindows,
+		InMaintenance:      inMaintenanceWindow(def.MaintenanceWindows, p.now()),
+		pool:        p,
+	}
+	if len(def.MaintenanceWindows) > 0 {
+		p.watchMaintenance()
 	}
+	proxyCfg.upstreamTLS, proxyCfg.upstreamTLSErr = def.UpstreamTLSConfig()
+	if proxyCfg.upstreamTLSErr != nil {
+		log.Printf("Proxy %s: %v", def.Address, proxyCfg.upstreamTLSErr)
+	} else if proxyCfg.upstreamTLS != nil {
+		// resume TLS sessions with the proxy across dials
+		proxyCfg.upstreamTLS.ClientSessionCache = tls.NewLRUClientSessionCache(tlsSessionCacheSize)
+	}
+	// the cancel func is registered before the loop starts, so a reconciliation
+	// that replaces the proxy right away still stops its loop
+	ctx, cancel := context.WithCancel(p.overallShutdownCtx)
+	proxyCfg.setHealthCheckCancelFunc(cancel)
 	p.wg.Add(1)
-	go p.healthCheckLoopForProxy(proxyCfg)
+	p.startup.add()
+	go p.healthCheckLoopForProxy(ctx, proxyCfg)
 	return proxyCfg
 }
 
 // healthCheckLoopForProxy - цикл проверки для одного ProxyConfig.
-func (p *Pool) healthCheckLoopForProxy(proxyCfg *ProxyConfig) {
+func (p *Pool) healthCheckLoopForProxy(ctx context.Context, proxyCfg *ProxyConfig) {
 	defer p.wg.Done()
-
-	ctx, cancel := context.WithCancel(p.overallShutdownCtx) // Контекст для этой горутины
-	defer cancel()
-	proxyCfg.setHealthCheckCancelFunc(cancel) // Сохраняем для возможности отмены снаружи
+	p.healthLoops.Add(1)
+	defer p.healthLoops.Add(-1)
+	defer proxyCfg.shutdownHealthCheck()
+	defer proxyCfg.warm.close()
 
 	log.Printf("Health check loop started for proxy %s", proxyCfg.Address)
-	p.checkProxy(ctx, proxyCfg) // Первоначальная проверка с новым контекстом
+	p.initialCheck(ctx, proxyCfg) // Первоначальная проверка, ограниченная SetStartupCheckConcurrency
 
 	// Используем p.checkInterval из структуры Pool
 	// Если checkInterval очень мал, это может привести к частым проверкам.
@@ -179,17 +354,28 @@ func (p *Pool) healthCheckLoopForProxy(proxyCfg *ProxyConfig) {
 	if p.checkInterval <= 0 {
 		log.Printf("Warning: Invalid check_interval (%v) for proxy %s. Health check loop will not run periodically.", p.checkInterval, proxyCfg.Address)
 		// Просто ждем отмены, если интервал некорректен
-		<-ctx.Done()
-		log.Printf("Health check loop for proxy %s stopping (invalid interval)...", proxyCfg.Address)
-		return
+		for {
+			select {
+			case <-proxyCfg.checkNowCh:
+				p.checkProxy(ctx, proxyCfg)
+			case <-ctx.Done():
+				log.Printf("Health check loop for proxy %s stopping (invalid interval)...", proxyCfg.Address)
+				return
+			}
+		}
 	}
-	ticker := time.NewTicker(p.checkInterval)
+	delay := p.nextCheckDelay(proxyCfg)
+	ticker := time.NewTicker(delay)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			p.checkProxy(ctx, proxyCfg)
+			delay = p.rescheduleCheck(ticker, proxyCfg, delay)
+		case <-proxyCfg.checkNowCh:
+			p.checkProxy(ctx, proxyCfg)
+			delay = p.rescheduleCheck(ticker, proxyCfg, delay)
 		case <-ctx.Done():
 			log.Printf("Health check loop for proxy %s stopping...", proxyCfg.Address)
 			return
@@ -198,26 +384,59 @@ func (p *Pool) healthCheckLoopForProxy(proxyCfg *ProxyConfig) {
 }
 
 
-// GetActiveProxy теперь работает с map
-func (p *Pool) GetActiveProxy() (*ProxyConfig, error) {
+// ErrProxyNotFound is returned when an operation references a proxy address that is not in the pool
+var ErrProxyNotFound = errors.New("proxy not found in pool")
+
+// FindProxy returns the proxy whose address or stable ID equals ref
+func (p *Pool) FindProxy(ref string) (*ProxyConfig, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-
-	activeProxies := make([]*ProxyConfig, 0, len(p.proxies))
-	for _, proxy := range p.proxies {
-		proxy.Mu.RLock()
-		isActive := proxy.IsActive
-		proxy.Mu.RUnlock()
-		if isActive {
-			activeProxies = append(activeProxies, proxy)
+	if proxyCfg, ok := p.proxies[ref]; ok {
+		return proxyCfg, nil
+	}
+	for _, proxyCfg := range p.proxies {
+		proxyCfg.Mu.RLock()
+		id := proxyCfg.ID
+		proxyCfg.Mu.RUnlock()
+		if id != "" && id == ref {
+			return proxyCfg, nil
 		}
 	}
+	return nil, ErrProxyNotFound
+}
 
-	if len(activeProxies) == 0 {
-		return nil, errors.New("no active proxies available")
+// CheckNow runs an immediate out-of-band health check for the proxy identified by
+// address (or stable ID) and returns its resulting state. It blocks until the check completes.
+func (p *Pool) CheckNow(address string) (ProxyState, error) {
+	proxyCfg, err := p.FindProxy(address)
+	if err != nil {
+		return "", err
 	}
-	// rand.Seed(time.Now().UnixNano()) // Не нужно для Go 1.20+
-	return activeProxies[rand.Intn(len(activeProxies))], nil
+	p.checkProxy(p.overallShutdownCtx, proxyCfg)
+	return proxyCfg.State(), nil
+}
+
+// CheckAllNow asks every proxy's health check loop to run a check immediately.
+// It does not wait for the checks to complete and returns the number of proxies triggered.
+func (p *Pool) CheckAllNow() int {
+	proxies := p.proxyList()
+	for _, proxy := range proxies {
+		proxy.triggerCheck()
+	}
+	return len(proxies)
+}
+
+// HealthLoopCount returns the number of running health check loops. It should match
+// ProxyCount; a larger value means loops leaked during reconciliation.
+func (p *Pool) HealthLoopCount() int64 {
+	return p.healthLoops.Load()
+}
+
+// ProxyCount returns the number of proxies in the pool
+func (p *Pool) ProxyCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.proxies)
 }
 
 // ConfigureTLS sets the TLS verification options for proxy health checks.
@@ -239,21 +458,68 @@ func (p *Pool) ConfigureTLS(skipVerify bool, rootCAs *x509.CertPool, serverName
 	}
 }
 
+// ConfigureHealthLogging sets how verbosely health check results are logged.
+// mode: HealthLogAll or HealthLogChanges (unknown values fall back to HealthLogChanges).
+// successEvery: in HealthLogChanges mode, log every Nth consecutive success (0 disables).
+func (p *Pool) ConfigureHealthLogging(mode string, successEvery uint64) {
+	newConfig := DefaultHealthLogConfig()
+	if mode == HealthLogAll {
+		newConfig.Mode = HealthLogAll
+	}
+	newConfig.SuccessEvery = successEvery
+	p.healthLogConfig.Store(newConfig)
+}
+
+// SetClock replaces the time source used for health check timestamps, response
+// times and events, so tests can control time. A nil now restores time.Now.
+func (p *Pool) SetClock(now func() time.Time) {
+	if now == nil {
+		p.clock.Store(nil)
+		return
+	}
+	p.clock.Store(&now)
+}
+
+// now returns the current time of the pool's clock
+func (p *Pool) now() time.Time {
+	if now := p.clock.Load(); now != nil {
+		return (*now)()
+	}
+	return time.Now()
+}
+
 // Stop stops all health checks and cleans up resources
 func (p *Pool) Stop() {
 	log.Println("ProxyPool stopping all operations...")
+	// cancelling under mu lets a running reconciliation finish adding its
+	// health checks to wg first; later ones see the cancellation and skip
+	p.mu.Lock()
 	p.overallShutdownCancel() // Signal all health check goroutines to stop
+	p.mu.Unlock()
 	p.wg.Wait()
 	log.Println("ProxyPool stopped.")
 }
 
-// GetProxiesSnapshot теперь работает с map
-func (p *Pool) GetProxiesSnapshot() []*ProxyConfig {
-    p.mu.RLock()
-    defer p.mu.RUnlock()
-    snapshot := make([]*ProxyConfig, 0, len(p.proxies))
-    for _, proxy := range p.proxies {
-        snapshot = append(snapshot, proxy)
-    }
-    return snapshot
-}
\ No newline at end of file
+// GetProxiesSnapshot returns a copy of every proxy in the pool, ordered by address
+func (p *Pool) GetProxiesSnapshot() []ProxySnapshot {
+	proxies := p.proxyList()
+	snapshot := make([]ProxySnapshot, 0, len(proxies))
+	for _, proxy := range proxies {
+		snapshot = append(snapshot, proxy.Snapshot())
+	}
+	slices.SortFunc(snapshot, func(a, b ProxySnapshot) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return snapshot
+}
+
+// proxyList returns the live proxies of the pool. Their fields must be read under Mu.
+func (p *Pool) proxyList() []*ProxyConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	proxies := make([]*ProxyConfig, 0, len(p.proxies))
+	for _, proxy := range p.proxies {
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
@@ -0,0 +1,1333 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// fakeDefinitions is a DefinitionsSource whose definitions are set by the test
+type fakeDefinitions struct {
+	mu     sync.Mutex
+	defs   []config.ProxyDefinition
+	reload chan struct{}
+}
+
+func newFakeDefinitions() *fakeDefinitions {
+	return &fakeDefinitions{reload: make(chan struct{}, 1)}
+}
+
+func (f *fakeDefinitions) GetDefinitions() []config.ProxyDefinition {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.defs)
+}
+
+func (f *fakeDefinitions) Subscribe() <-chan struct{} {
+	return f.reload
+}
+
+// Set replaces the definitions without notifying the pool
+func (f *fakeDefinitions) Set(defs ...config.ProxyDefinition) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defs = defs
+}
+
+// Notify signals a reload like ProxyDefinitionsManager does after loading the file
+func (f *fakeDefinitions) Notify() {
+	select {
+	case f.reload <- struct{}{}:
+	default:
+	}
+}
+
+// fakeClock is a manually advanced time source
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// checkLatency is how far every fake health check advances the clock
+const checkLatency = 25 * time.Millisecond
+
+// fakeHealth is a HealthChecker that fails the addresses the test chose and
+// counts the checks per address
+type fakeHealth struct {
+	clock   *fakeClock
+	mu      sync.Mutex
+	failing map[string]error
+	checks  map[string]int
+}
+
+func newFakeHealth(clock *fakeClock) *fakeHealth {
+	return &fakeHealth{clock: clock, failing: make(map[string]error), checks: make(map[string]int)}
+}
+
+func (h *fakeHealth) Check(ctx context.Context, proxyCfg *ProxyConfig) error {
+	h.clock.Advance(checkLatency)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[proxyCfg.Address]++
+	return h.failing[proxyCfg.Address]
+}
+
+func (h *fakeHealth) fail(addr string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		delete(h.failing, addr)
+		return
+	}
+	h.failing[addr] = err
+}
+
+func (h *fakeHealth) count(addr string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.checks[addr]
+}
+
+// testPool is a pool wired to fakes. Health checks only run when a proxy is
+// created and when the test triggers them, since the check interval is an hour.
+type testPool struct {
+	*Pool
+	defs   *fakeDefinitions
+	clock  *fakeClock
+	health *fakeHealth
+}
+
+// newTestPool creates a pool with the hooks installed before any proxy is
+// added, then reconciles it with defs
+func newTestPool(t *testing.T, defs ...config.ProxyDefinition) *testPool {
+	t.Helper()
+	src := newFakeDefinitions()
+	p := New(src, time.Hour, time.Second, "health.invalid:443")
+	t.Cleanup(p.Stop)
+	clock := newFakeClock()
+	health := newFakeHealth(clock)
+	p.SetClock(clock.Now)
+	p.SetHealthChecker(health)
+
+	tp := &testPool{Pool: p, defs: src, clock: clock, health: health}
+	tp.reconcile(t, defs...)
+	return tp
+}
+
+// reconcile sets the definitions and reconciles synchronously
+func (tp *testPool) reconcile(t *testing.T, defs ...config.ProxyDefinition) {
+	t.Helper()
+	tp.defs.Set(defs...)
+	if err := tp.Reconcile(); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+}
+
+// waitSettled waits until every proxy has a health check loop that finished
+// its first check and selection reflects the results
+func (tp *testPool) waitSettled(t *testing.T) {
+	t.Helper()
+	waitFor(t, "health check loops to settle", func() bool {
+		if tp.HealthLoopCount() != int64(tp.ProxyCount()) {
+			return false
+		}
+		selectable := 0
+		for _, proxy := range tp.GetProxiesSnapshot() {
+			if proxy.LastCheck.IsZero() {
+				return false
+			}
+			if proxy.IsActive && !proxy.Disabled && !proxy.InMaintenance {
+				selectable++
+			}
+		}
+		// the selection snapshot is rebuilt right after a proxy changes state
+		return tp.ActiveProxyCount() == selectable
+	})
+}
+
+// mustFind returns the proxy at addr or fails the test
+func (tp *testPool) mustFind(t *testing.T, addr string) *ProxyConfig {
+	t.Helper()
+	proxy, err := tp.FindProxy(addr)
+	if err != nil {
+		t.Fatalf("FindProxy(%s): %v", addr, err)
+	}
+	return proxy
+}
+
+// waitFor polls cond until it holds or a generous deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func def(addr string, tags ...string) config.ProxyDefinition {
+	return config.ProxyDefinition{Address: addr, Username: "user", Password: "pass", Tags: tags}
+}
+
+func TestReconcileAddsProxies(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"), def("10.0.0.2:1080", "slow"))
+	tp.waitSettled(t)
+
+	if n := tp.ProxyCount(); n != 2 {
+		t.Fatalf("ProxyCount = %d, want 2", n)
+	}
+	if n := tp.ActiveProxyCount(); n != 2 {
+		t.Fatalf("ActiveProxyCount = %d, want 2", n)
+	}
+	proxy, err := tp.GetActiveProxyWithTags([]string{"fast"})
+	if err != nil {
+		t.Fatalf("GetActiveProxyWithTags(fast): %v", err)
+	}
+	if proxy.Address != "10.0.0.1:1080" {
+		t.Fatalf("selected %s for tag fast, want 10.0.0.1:1080", proxy.Address)
+	}
+}
+
+func TestReconcileRemovesProxy(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"), def("10.0.0.2:1080", "slow"))
+	tp.waitSettled(t)
+	events, cancel := tp.SubscribeEvents(8)
+	defer cancel()
+
+	tp.reconcile(t, def("10.0.0.1:1080", "fast"))
+
+	if _, err := tp.FindProxy("10.0.0.2:1080"); !errors.Is(err, ErrProxyNotFound) {
+		t.Fatalf("FindProxy of removed proxy: err = %v, want ErrProxyNotFound", err)
+	}
+	if _, err := tp.GetActiveProxyWithTags([]string{"slow"}); !errors.Is(err, ErrNoActiveProxies) {
+		t.Fatalf("selecting removed proxy's tag: err = %v, want ErrNoActiveProxies", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != EventProxyRemoved || ev.ProxyAddress != "10.0.0.2:1080" {
+			t.Fatalf("event = %+v, want %s for 10.0.0.2:1080", ev, EventProxyRemoved)
+		}
+		if !ev.Time.Equal(tp.clock.Now()) {
+			t.Fatalf("event time = %v, want the pool clock's %v", ev.Time, tp.clock.Now())
+		}
+	default:
+		t.Fatal("no event emitted for the removed proxy")
+	}
+	waitFor(t, "the removed proxy's health check loop to stop", func() bool {
+		return tp.HealthLoopCount() == 1
+	})
+}
+
+func TestReconcileCredentialChangeReplacesProxy(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"))
+	tp.waitSettled(t)
+	old := tp.mustFind(t, "10.0.0.1:1080")
+
+	changed := def("10.0.0.1:1080", "fast")
+	changed.Password = "rotated"
+	tp.reconcile(t, changed)
+
+	replaced := tp.mustFind(t, "10.0.0.1:1080")
+	if replaced == old {
+		t.Fatal("credential change kept the old ProxyConfig")
+	}
+	replaced.Mu.RLock()
+	password := replaced.Password
+	replaced.Mu.RUnlock()
+	if password != "rotated" {
+		t.Fatalf("password = %q, want rotated", password)
+	}
+	tp.waitSettled(t)
+	if n := tp.health.count("10.0.0.1:1080"); n != 2 {
+		t.Fatalf("health checks = %d, want 2 (one per ProxyConfig)", n)
+	}
+	if _, err := tp.GetActiveProxyWithTags([]string{"fast"}); err != nil {
+		t.Fatalf("replaced proxy not selectable after its check: %v", err)
+	}
+
+	passthrough := changed
+	passthrough.CredentialMode = config.CredentialModePassthrough
+	tp.reconcile(t, passthrough)
+	if tp.mustFind(t, "10.0.0.1:1080") == replaced {
+		t.Fatal("credential mode change kept the old ProxyConfig")
+	}
+	tp.waitSettled(t)
+}
+
+func TestReconcileTagChangeUpdatesSelection(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"))
+	tp.waitSettled(t)
+
+	tp.reconcile(t, def("10.0.0.1:1080", "premium"))
+	tp.waitSettled(t)
+
+	if _, err := tp.GetActiveProxyWithTags([]string{"fast"}); !errors.Is(err, ErrNoActiveProxies) {
+		t.Fatalf("old tag still selectable: err = %v", err)
+	}
+	if _, err := tp.GetActiveProxyWithTags([]string{"premium"}); err != nil {
+		t.Fatalf("new tag not selectable: %v", err)
+	}
+}
+
+func TestSelectionByTagExpression(t *testing.T) {
+	tp := newTestPool(t,
+		def("10.0.0.1:1080", "dc-eu-1", "country:de"),
+		def("10.0.0.2:1080", "dc-eu-2", "country:fr", "flaky"),
+		def("10.0.0.3:1080", "dc-us-1", "country:us"),
+	)
+	tp.waitSettled(t)
+
+	cases := []struct {
+		expr string
+		want []string
+	}{
+		{"dc-eu-*", []string{"10.0.0.1:1080", "10.0.0.2:1080"}},
+		{"dc-eu-* AND NOT flaky", []string{"10.0.0.1:1080"}},
+		{"/^country:(fr|us)$/", []string{"10.0.0.2:1080", "10.0.0.3:1080"}},
+		{"country:us OR (dc-eu-* AND flaky)", []string{"10.0.0.2:1080", "10.0.0.3:1080"}},
+		{"country:jp*", nil},
+	}
+	for _, c := range cases {
+		seen := make(map[string]bool)
+		for range 100 {
+			proxy, err := tp.GetActiveProxyWithTags([]string{c.expr})
+			if err != nil {
+				if c.want != nil {
+					t.Fatalf("%q: %v", c.expr, err)
+				}
+				break
+			}
+			seen[proxy.Address] = true
+		}
+		if len(seen) != len(c.want) {
+			t.Errorf("%q selected %v, want %v", c.expr, seen, c.want)
+		}
+		for _, addr := range c.want {
+			if !seen[addr] {
+				t.Errorf("%q never selected %s", c.expr, addr)
+			}
+		}
+	}
+}
+
+func TestRotatingProxyAvoidsRecentExits(t *testing.T) {
+	tp := newTestPool(t,
+		def("10.0.0.1:1080", "scrape"),
+		def("10.0.0.2:1080", "scrape"),
+		def("10.0.0.3:1080", "scrape"),
+		def("10.0.0.4:1080", "other"),
+	)
+	tp.waitSettled(t)
+
+	// every window of three picks covers all three eligible proxies
+	var picks []string
+	for range 30 {
+		proxy, err := tp.GetRotatingProxy("alice", []string{"scrape"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks = append(picks, proxy.Address)
+	}
+	for i := 2; i < len(picks); i++ {
+		if picks[i] == picks[i-1] || picks[i] == picks[i-2] {
+			t.Fatalf("pick %d reused a recent exit: %v", i, picks[i-2:i+1])
+		}
+	}
+	if picks[0] == "10.0.0.4:1080" {
+		t.Errorf("picked a proxy without the tag")
+	}
+
+	// rings are per client
+	first, _ := tp.GetRotatingProxy("bob", []string{"other"}, nil)
+	again, _ := tp.GetRotatingProxy("bob", []string{"other"}, nil)
+	if first != again {
+		t.Errorf("single eligible proxy not reused: %s, %s", first.Address, again.Address)
+	}
+}
+
+func TestRotationWindowsRestProxies(t *testing.T) {
+	tp := newTestPool(t,
+		def("10.0.0.1:1080", "res"),
+		def("10.0.0.2:1080", "res"),
+		def("10.0.0.3:1080", "res"),
+		def("10.0.0.4:1080", "res"),
+		def("10.0.0.5:1080", "other"),
+	)
+	tp.waitSettled(t)
+	tp.SetRotationWindows([]RotationWindow{{Tag: "res", Fraction: 0.5, Period: time.Hour}})
+
+	selectable := func() map[string]bool {
+		seen := make(map[string]bool)
+		for range 200 {
+			proxy, err := tp.GetActiveProxyWithTags([]string{"res"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[proxy.Address] = true
+		}
+		return seen
+	}
+	first := selectable()
+	if len(first) != 2 {
+		t.Fatalf("selected %v, want 2 of 4 proxies", first)
+	}
+	if _, err := tp.GetActiveProxyWithTags([]string{"other"}); err != nil {
+		t.Errorf("proxy without a rotating tag not selectable: %v", err)
+	}
+
+	tp.clock.Advance(time.Hour)
+	tp.rebuildActive()
+	second := selectable()
+	if len(second) != 2 {
+		t.Fatalf("selected %v after rotation, want 2 of 4 proxies", second)
+	}
+	for addr := range second {
+		if first[addr] {
+			t.Errorf("%s eligible in consecutive windows", addr)
+		}
+	}
+	status := tp.RotationStatus()
+	if len(status) != 1 || status[0].Groups != 2 || len(status[0].Resting) != 2 {
+		t.Errorf("RotationStatus = %+v", status)
+	}
+}
+
+func TestReconcileDisableDrainsWithoutRestart(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"))
+	tp.waitSettled(t)
+	proxy := tp.mustFind(t, "10.0.0.1:1080")
+
+	disabled := def("10.0.0.1:1080", "fast")
+	disabled.Enabled = new(bool)
+	tp.reconcile(t, disabled)
+
+	if tp.mustFind(t, "10.0.0.1:1080") != proxy {
+		t.Fatal("disabling replaced the ProxyConfig")
+	}
+	if _, err := tp.GetActiveProxy(); !errors.Is(err, ErrNoActiveProxies) {
+		t.Fatalf("disabled proxy still selectable: err = %v", err)
+	}
+
+	tp.reconcile(t, def("10.0.0.1:1080", "fast"))
+	if _, err := tp.GetActiveProxy(); err != nil {
+		t.Fatalf("re-enabled proxy not selectable: %v", err)
+	}
+	if n := tp.health.count("10.0.0.1:1080"); n != 1 {
+		t.Fatalf("health checks = %d, want 1: disabling must not restart the check", n)
+	}
+	if n := tp.HealthLoopCount(); n != 1 {
+		t.Fatalf("HealthLoopCount = %d, want 1", n)
+	}
+}
+
+func TestReconcileUnchangedKeepsProxy(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast", "general"))
+	tp.waitSettled(t)
+	proxy := tp.mustFind(t, "10.0.0.1:1080")
+
+	// same tags in a different order
+	tp.reconcile(t, def("10.0.0.1:1080", "general", "fast"))
+
+	if tp.mustFind(t, "10.0.0.1:1080") != proxy {
+		t.Fatal("reconciling unchanged definitions replaced the ProxyConfig")
+	}
+	if n := tp.health.count("10.0.0.1:1080"); n != 1 {
+		t.Fatalf("health checks = %d, want 1", n)
+	}
+}
+
+func TestGetActiveProxyAvoidingFallsBack(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"), def("10.0.0.2:1080", "fast"), def("10.0.0.3:1080", "slow"))
+	tp.waitSettled(t)
+
+	avoidFirst := func(proxy *ProxyConfig) bool { return proxy.Address == "10.0.0.1:1080" }
+	for i := 0; i < 20; i++ {
+		if proxy, err := tp.GetActiveProxyAvoiding([]string{"fast"}, avoidFirst); err != nil || proxy.Address != "10.0.0.2:1080" {
+			t.Fatalf("GetActiveProxyAvoiding = %v, %v; want the only proxy not avoided", proxy, err)
+		}
+	}
+
+	// every fast proxy avoided: an avoided one is still better than none
+	avoidAll := func(*ProxyConfig) bool { return true }
+	proxy, err := tp.GetActiveProxyAvoiding([]string{"fast"}, avoidAll)
+	if err != nil || !slices.Contains(proxy.Tags, "fast") {
+		t.Fatalf("GetActiveProxyAvoiding with every candidate avoided = %v, %v; want a fast proxy", proxy, err)
+	}
+	if _, err := tp.GetActiveProxyAvoiding([]string{"missing"}, avoidAll); !errors.Is(err, ErrNoActiveProxies) {
+		t.Fatalf("GetActiveProxyAvoiding for an unknown tag = %v, want ErrNoActiveProxies", err)
+	}
+}
+
+func TestReconcileSkippedAfterStop(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080"))
+	tp.waitSettled(t)
+
+	// a reconciliation racing Stop must not start health checks it waits for
+	tp.defs.Set(def("10.0.0.1:1080"), def("10.0.0.2:1080"))
+	tp.NotifyDefinitionsChanged()
+	tp.Stop()
+
+	tp.defs.Set(def("10.0.0.1:1080"), def("10.0.0.2:1080"), def("10.0.0.3:1080"))
+	if err := tp.Reconcile(); err != nil {
+		t.Fatalf("Reconcile after Stop: %v", err)
+	}
+	if n := tp.ProxyCount(); n > 2 {
+		t.Fatalf("ProxyCount = %d after Stop, want the reconciliation skipped", n)
+	}
+	if n := tp.HealthLoopCount(); n != 0 {
+		t.Fatalf("HealthLoopCount = %d after Stop, want 0", n)
+	}
+}
+
+func TestHealthCheckUsesClock(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"))
+	tp.waitSettled(t)
+
+	tp.clock.Advance(time.Minute)
+	checkedAt := tp.clock.Now().Add(checkLatency)
+	state, err := tp.CheckNow("10.0.0.1:1080")
+	if err != nil {
+		t.Fatalf("CheckNow: %v", err)
+	}
+	if state != StateActive {
+		t.Fatalf("state = %s, want %s", state, StateActive)
+	}
+	proxy := tp.mustFind(t, "10.0.0.1:1080")
+	proxy.Mu.RLock()
+	lastCheck, responseTime := proxy.LastCheck, proxy.ResponseTime
+	proxy.Mu.RUnlock()
+	if !lastCheck.Equal(checkedAt) {
+		t.Fatalf("LastCheck = %v, want %v", lastCheck, checkedAt)
+	}
+	if responseTime != checkLatency {
+		t.Fatalf("ResponseTime = %v, want %v", responseTime, checkLatency)
+	}
+}
+
+func TestFailedHealthCheckExcludesProxy(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"), def("10.0.0.2:1080", "fast"))
+	tp.waitSettled(t)
+
+	tp.health.fail("10.0.0.1:1080", errors.New("connection refused"))
+	if state, _ := tp.CheckNow("10.0.0.1:1080"); state != StateInactive {
+		t.Fatalf("state = %s, want %s", state, StateInactive)
+	}
+	for i := 0; i < 50; i++ {
+		proxy, err := tp.GetActiveProxyWithTags([]string{"fast"})
+		if err != nil {
+			t.Fatalf("GetActiveProxyWithTags: %v", err)
+		}
+		if proxy.Address != "10.0.0.2:1080" {
+			t.Fatalf("selected failing proxy %s", proxy.Address)
+		}
+	}
+
+	tp.health.fail("10.0.0.1:1080", nil)
+	if state, _ := tp.CheckNow("10.0.0.1:1080"); state != StateActive {
+		t.Fatalf("state after recovery = %s, want %s", state, StateActive)
+	}
+	if n := tp.ActiveProxyCount(); n != 2 {
+		t.Fatalf("ActiveProxyCount = %d, want 2", n)
+	}
+}
+
+func TestWatchDefinitionsReconciles(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"))
+	tp.waitSettled(t)
+
+	tp.defs.Set(def("10.0.0.1:1080", "fast"), def("10.0.0.2:1080", "fast"))
+	tp.defs.Notify()
+	waitFor(t, "a reload notification to add the proxy", func() bool {
+		return tp.ProxyCount() == 2
+	})
+
+	tp.defs.Set(def("10.0.0.2:1080", "fast"))
+	tp.NotifyDefinitionsChanged()
+	waitFor(t, "NotifyDefinitionsChanged to remove the proxy", func() bool {
+		_, err := tp.FindProxy("10.0.0.1:1080")
+		return errors.Is(err, ErrProxyNotFound)
+	})
+	tp.waitSettled(t)
+}
+
+// TestConcurrentReconcileAndSelection exercises reconciliation against the
+// selection and inspection paths; run with -race
+func TestConcurrentReconcileAndSelection(t *testing.T) {
+	base := []config.ProxyDefinition{
+		def("10.0.0.1:1080", "fast"),
+		def("10.0.0.2:1080", "fast", "premium"),
+		def("10.0.0.3:1080", "slow"),
+	}
+	tp := newTestPool(t, base...)
+	tp.waitSettled(t)
+
+	disabled := def("10.0.0.2:1080", "fast", "premium")
+	disabled.Enabled = new(bool)
+	rotated := def("10.0.0.1:1080", "fast")
+	rotated.Password = "rotated"
+	variants := [][]config.ProxyDefinition{
+		base,
+		{base[0], base[1]},          // remove
+		{rotated, base[1], base[2]}, // credential change
+		{base[0], def("10.0.0.2:1080", "slow"), base[2]},             // tag change
+		{base[0], disabled, base[2]},                                 // disable
+		{base[0], base[1], base[2], def("10.0.0.4:1080", "premium")}, // add
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	reader := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				if err := fn(); err != nil {
+					report(err)
+					return
+				}
+			}
+		}()
+	}
+	selectErr := func(proxy *ProxyConfig, err error) error {
+		if err != nil && !errors.Is(err, ErrNoActiveProxies) {
+			return err
+		}
+		if proxy != nil {
+			_ = proxy.String()
+		}
+		return nil
+	}
+
+	reader(func() error { return selectErr(tp.GetActiveProxy()) })
+	reader(func() error { return selectErr(tp.GetActiveProxyWithTags([]string{"fast", "premium"})) })
+	reader(func() error {
+		return selectErr(tp.GetActiveProxyAvoiding([]string{"fast"}, func(proxy *ProxyConfig) bool {
+			return proxy.Address == "10.0.0.1:1080"
+		}))
+	})
+	reader(func() error {
+		proxies, err := tp.GetFastestActiveProxies([]string{"fast"}, 2)
+		for _, proxy := range proxies {
+			_ = proxy.State()
+		}
+		return selectErr(nil, err)
+	})
+	reader(func() error {
+		for _, proxy := range tp.GetProxiesSnapshot() {
+			_ = fmt.Sprint(proxy.Tags, proxy.Disabled, proxy.IsActive, proxy.Username)
+		}
+		if _, err := tp.FindProxy("10.0.0.3:1080"); err != nil && !errors.Is(err, ErrProxyNotFound) {
+			return err
+		}
+		return nil
+	})
+	reader(func() error {
+		tp.CheckAllNow()
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+
+	for i := 0; i < 200; i++ {
+		tp.defs.Set(variants[i%len(variants)]...)
+		if i%3 == 0 {
+			tp.NotifyDefinitionsChanged()
+			continue
+		}
+		if err := tp.Reconcile(); err != nil {
+			t.Fatalf("Reconcile: %v", err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent reader: %v", err)
+	}
+
+	tp.reconcile(t, base...)
+	tp.waitSettled(t)
+	if n := tp.ProxyCount(); n != len(base) {
+		t.Fatalf("ProxyCount = %d, want %d", n, len(base))
+	}
+	if n := tp.ActiveProxyCount(); n != len(base) {
+		t.Fatalf("ActiveProxyCount = %d, want %d", n, len(base))
+	}
+}
+
+func TestLatencyEWMAAndJitter(t *testing.T) {
+	proxy := &ProxyConfig{Address: "10.0.0.1:1080"}
+	for _, sample := range []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond} {
+		proxy.MarkActive(sample)
+	}
+	// 100 + 0.3*100; variance 0.7*(100*30) ms²
+	if want := 130 * time.Millisecond; proxy.LatencyEWMA != want {
+		t.Fatalf("LatencyEWMA = %v, want %v", proxy.LatencyEWMA, want)
+	}
+	if got, want := proxy.LatencyJitter.Seconds()*1000, math.Sqrt(2100); math.Abs(got-want) > 0.01 {
+		t.Fatalf("LatencyJitter = %.3fms, want %.3fms", got, want)
+	}
+
+	// samples from before an outage are forgotten
+	proxy.MarkInactive(errors.New("down"))
+	proxy.MarkActive(50 * time.Millisecond)
+	if proxy.LatencyEWMA != 50*time.Millisecond || proxy.LatencyJitter != 0 {
+		t.Fatalf("after recovery LatencyEWMA = %v, LatencyJitter = %v, want 50ms and 0", proxy.LatencyEWMA, proxy.LatencyJitter)
+	}
+}
+
+func TestMarkInactiveRecordsLastError(t *testing.T) {
+	proxy := &ProxyConfig{Address: "10.0.0.1:1080"}
+	if proxy.Snapshot().LastError != nil {
+		t.Fatal("LastError set before any check")
+	}
+	for _, tc := range []struct {
+		err  error
+		want ErrorCategory
+	}{
+		{errors.New("socks connect tcp: username/password authentication failed"), ErrorAuth},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), ErrorTimeout},
+		{errors.New("socks connect tcp 10.0.0.1:1080->example.com:443: unknown error host unreachable"), ErrorUpstreamReply},
+		{errors.New("boom"), ErrorOther},
+	} {
+		proxy.MarkInactive(tc.err)
+		got := proxy.Snapshot().LastError
+		if got == nil || got.Category != tc.want || got.Message != tc.err.Error() || got.Time.IsZero() {
+			t.Fatalf("LastError after %q = %+v, want category %s", tc.err, got, tc.want)
+		}
+	}
+
+	// the last error outlives the recovery
+	proxy.MarkActive(10 * time.Millisecond)
+	if got := proxy.Snapshot().LastError; got == nil || got.Message != "boom" {
+		t.Fatalf("LastError after recovery = %+v, want the last failure", got)
+	}
+}
+
+func TestCheckBackoffByFailureReason(t *testing.T) {
+	p := &Pool{checkInterval: time.Minute}
+	proxy := &ProxyConfig{Address: "10.0.0.1:1080"}
+	authErr := errors.New("socks connect tcp: username/password authentication failed")
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 15 * time.Minute, 15 * time.Minute} {
+		proxy.MarkInactive(authErr)
+		if got := p.nextCheckDelay(proxy); got != want {
+			t.Fatalf("after %d auth failures delay = %v, want %v", i+1, got, want)
+		}
+	}
+
+	// another reason starts over, and timeouts are retried at the interval by default
+	for range 3 {
+		proxy.MarkInactive(context.DeadlineExceeded)
+	}
+	if got := p.nextCheckDelay(proxy); got != time.Minute {
+		t.Fatalf("after timeouts delay = %v, want the check interval", got)
+	}
+
+	p.SetCheckBackoff(map[ErrorCategory]CheckBackoff{ErrorTimeout: {Multiplier: 3, MaxInterval: 5 * time.Minute}})
+	if got := p.nextCheckDelay(proxy); got != 5*time.Minute {
+		t.Fatalf("after 3 timeouts with backoff delay = %v, want 5m", got)
+	}
+
+	proxy.MarkActive(10 * time.Millisecond)
+	if got := p.nextCheckDelay(proxy); got != time.Minute {
+		t.Fatalf("after recovery delay = %v, want the check interval", got)
+	}
+}
+
+func TestFastestRanksByExpectedLatency(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "fast"), def("10.0.0.2:1080", "fast"))
+	tp.waitSettled(t)
+
+	observe := func(addr string, samples ...time.Duration) {
+		proxy := tp.mustFind(t, addr)
+		proxy.MarkInactive(errors.New("restart the averages"))
+		for _, sample := range samples {
+			proxy.MarkActive(sample)
+		}
+	}
+	observe("10.0.0.1:1080", 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+	// the last sample is the fastest of all, but the proxy is erratic
+	observe("10.0.0.2:1080", 20*time.Millisecond, 200*time.Millisecond, 20*time.Millisecond)
+	tp.rebuildActive()
+
+	proxies, err := tp.GetFastestActiveProxies([]string{"fast"}, 2)
+	if err != nil {
+		t.Fatalf("GetFastestActiveProxies: %v", err)
+	}
+	if len(proxies) != 2 || proxies[0].Address != "10.0.0.1:1080" {
+		t.Fatalf("fastest = %v, want the steady proxy 10.0.0.1:1080 first", proxies)
+	}
+}
+
+func TestSelectProxyStrategies(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "dc"), def("10.0.0.2:1080", "dc"), def("10.0.0.3:1080", "dc"))
+	tp.waitSettled(t)
+	for _, addr := range []string{"10.0.0.1:1080", "10.0.0.2:1080", "10.0.0.3:1080"} {
+		latency := 100 * time.Millisecond
+		if addr == "10.0.0.2:1080" {
+			latency = 10 * time.Millisecond
+		}
+		proxy := tp.mustFind(t, addr)
+		proxy.MarkInactive(errors.New("restart the averages"))
+		proxy.MarkActive(latency)
+	}
+	tp.rebuildActive()
+
+	tp.SetStrategy(StrategyRoundRobin)
+	var order []string
+	for range 6 {
+		proxy, err := tp.SelectProxy([]string{"dc"}, nil)
+		if err != nil {
+			t.Fatalf("SelectProxy: %v", err)
+		}
+		order = append(order, proxy.Address)
+	}
+	for i := 3; i < 6; i++ {
+		if order[i] != order[i-3] || order[i] == order[i-1] {
+			t.Fatalf("round robin order = %v, want each proxy in turn", order)
+		}
+	}
+	avoidFirst := func(p *ProxyConfig) bool { return p.Address == "10.0.0.1:1080" }
+	for range 4 {
+		if proxy, _ := tp.SelectProxy(nil, avoidFirst); proxy.Address == "10.0.0.1:1080" {
+			t.Fatalf("round robin selected the avoided proxy")
+		}
+	}
+
+	tp.SetStrategy(StrategyFastest)
+	for range 3 {
+		proxy, err := tp.SelectProxy([]string{"dc"}, nil)
+		if err != nil {
+			t.Fatalf("SelectProxy: %v", err)
+		}
+		if proxy.Address != "10.0.0.2:1080" {
+			t.Fatalf("fastest selected %s, want 10.0.0.2:1080", proxy.Address)
+		}
+	}
+	if _, err := tp.SelectProxy([]string{"residential"}, nil); !errors.Is(err, ErrNoActiveProxies) {
+		t.Fatalf("SelectProxy with an unknown tag: err = %v, want ErrNoActiveProxies", err)
+	}
+}
+
+func TestCheapestStrategy(t *testing.T) {
+	priced := func(addr string, cost float64) config.ProxyDefinition {
+		d := def(addr, "dc")
+		d.CostPerGB = cost
+		return d
+	}
+	// 10.0.0.1 is the fastest, 10.0.0.2 cheaper and a little slower, 10.0.0.3
+	// the cheapest but far slower
+	tp := newTestPool(t, priced("10.0.0.1:1080", 5), priced("10.0.0.2:1080", 2), priced("10.0.0.3:1080", 0.5))
+	tp.waitSettled(t)
+	latencies := map[string]time.Duration{
+		"10.0.0.1:1080": 20 * time.Millisecond,
+		"10.0.0.2:1080": 60 * time.Millisecond,
+		"10.0.0.3:1080": 400 * time.Millisecond,
+	}
+	for addr, latency := range latencies {
+		proxy := tp.mustFind(t, addr)
+		proxy.MarkInactive(errors.New("restart the averages"))
+		proxy.MarkActive(latency)
+	}
+	tp.rebuildActive()
+	tp.SetStrategy(StrategyCheapest)
+
+	selected := func() string {
+		t.Helper()
+		proxy, err := tp.SelectProxy([]string{"dc"}, nil)
+		if err != nil {
+			t.Fatalf("SelectProxy: %v", err)
+		}
+		return proxy.Address
+	}
+	if addr := selected(); addr != "10.0.0.2:1080" {
+		t.Fatalf("cheapest selected %s, want 10.0.0.2:1080 within the default tolerance", addr)
+	}
+	tp.SetCostLatencyTolerance(time.Second)
+	if addr := selected(); addr != "10.0.0.3:1080" {
+		t.Fatalf("cheapest selected %s with a 1s tolerance, want 10.0.0.3:1080", addr)
+	}
+	tp.SetCostLatencyTolerance(10 * time.Millisecond)
+	if addr := selected(); addr != "10.0.0.1:1080" {
+		t.Fatalf("cheapest selected %s with a 10ms tolerance, want the fastest 10.0.0.1:1080", addr)
+	}
+	avoidFastest := func(p *ProxyConfig) bool { return p.Address == "10.0.0.1:1080" }
+	if proxy, _ := tp.SelectProxy(nil, avoidFastest); proxy.Address != "10.0.0.2:1080" {
+		t.Fatalf("cheapest avoiding 10.0.0.1:1080 selected %s, want 10.0.0.2:1080", proxy.Address)
+	}
+}
+
+func TestStartupChecksAreBoundedAndAwaited(t *testing.T) {
+	tp := newTestPool(t)
+	tp.SetStartupCheckConcurrency(2)
+
+	release := make(chan struct{})
+	var running, maxRunning atomic.Int64
+	tp.SetHealthCheck(func(ctx context.Context, proxyCfg *ProxyConfig) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		<-release
+		return tp.health.Check(ctx, proxyCfg)
+	})
+
+	var defs []config.ProxyDefinition
+	for i := 1; i <= 6; i++ {
+		defs = append(defs, def(fmt.Sprintf("10.0.0.%d:1080", i)))
+	}
+	tp.reconcile(t, defs...)
+	waitFor(t, "two startup checks to run", func() bool { return running.Load() == 2 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if pending, total := tp.WaitInitialChecks(ctx); pending != 6 || total != 6 {
+		t.Fatalf("WaitInitialChecks before release = %d pending of %d, want 6 of 6", pending, total)
+	}
+
+	close(release)
+	if pending, total := tp.WaitInitialChecks(context.Background()); pending != 0 || total != 6 {
+		t.Fatalf("WaitInitialChecks = %d pending of %d, want 0 of 6", pending, total)
+	}
+	if got := maxRunning.Load(); got != 2 {
+		t.Errorf("max concurrent startup checks = %d, want 2", got)
+	}
+	if got := tp.ActiveProxyCount(); got != 6 {
+		t.Errorf("ActiveProxyCount = %d, want 6", got)
+	}
+}
+
+func TestHealthCheckTargets(t *testing.T) {
+	p := &Pool{testURL: "default.test:443"}
+	if got := p.checkTarget(); got != "default.test:443" {
+		t.Fatalf("checkTarget without targets = %s, want the target passed to New", got)
+	}
+
+	targets := []string{"a.test:443", "b.test:443", "c.test:443"}
+	p.SetHealthCheckTargets(targets, TargetOrderRoundRobin)
+	for i := range 6 {
+		if got := p.checkTarget(); got != targets[i%3] {
+			t.Fatalf("round robin check %d went to %s, want %s", i, got, targets[i%3])
+		}
+	}
+
+	p.SetHealthCheckTargets(targets, TargetOrderRandom)
+	for range 20 {
+		if got := p.checkTarget(); !slices.Contains(targets, got) {
+			t.Fatalf("random check went to %s, which is not a target", got)
+		}
+	}
+
+	p.SetHealthCheckTargets(nil, TargetOrderRandom)
+	if got := p.checkTarget(); got != "default.test:443" {
+		t.Fatalf("checkTarget after clearing the targets = %s, want the target passed to New", got)
+	}
+}
+
+func TestHealthAlertFiresOncePerDegradation(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080"), def("10.0.0.2:1080"), def("10.0.0.3:1080"), def("10.0.0.4:1080"))
+	tp.waitSettled(t)
+	events, cancel := tp.SubscribeEvents(16)
+	defer cancel()
+	tp.SetHealthAlert(HealthAlert{Threshold: 0.5, For: 2 * time.Minute})
+	nextAlert := func() EventType {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == EventPoolDegraded || ev.Type == EventPoolHealthRestored {
+					return ev.Type
+				}
+			default:
+				return ""
+			}
+		}
+	}
+
+	for _, addr := range []string{"10.0.0.1:1080", "10.0.0.2:1080", "10.0.0.3:1080"} {
+		tp.health.fail(addr, errors.New("connection refused"))
+		tp.CheckNow(addr)
+	}
+	tp.evaluateHealthAlert()
+	tp.clock.Advance(time.Minute)
+	tp.evaluateHealthAlert()
+	if ev := nextAlert(); ev != "" {
+		t.Fatalf("got %s before the degradation lasted 2 minutes", ev)
+	}
+
+	tp.clock.Advance(time.Minute)
+	tp.evaluateHealthAlert()
+	tp.evaluateHealthAlert()
+	if ev := nextAlert(); ev != EventPoolDegraded {
+		t.Fatalf("alert = %q, want %s", ev, EventPoolDegraded)
+	}
+	if ev := nextAlert(); ev != "" {
+		t.Fatalf("got a second alert %s for the same degradation", ev)
+	}
+
+	tp.health.fail("10.0.0.1:1080", nil)
+	tp.CheckNow("10.0.0.1:1080")
+	tp.evaluateHealthAlert()
+	if ev := nextAlert(); ev != EventPoolHealthRestored {
+		t.Fatalf("alert after recovery = %q, want %s", ev, EventPoolHealthRestored)
+	}
+}
+
+func TestTLSCheckOverrides(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080", "internal"), def("10.0.0.2:1080", "internal"), def("10.0.0.3:1080", "public"))
+	tp.waitSettled(t)
+	tp.ConfigureTLS(false, nil, "")
+	tp.SetTLSCheckOverrides([]TLSCheckOverride{
+		{Tag: "internal", TLSCheckConfig: TLSCheckConfig{ServerName: "by-tag.internal"}},
+		{Address: "10.0.0.2:1080", TLSCheckConfig: TLSCheckConfig{ServerName: "by-address.internal"}},
+	})
+
+	for addr, want := range map[string]string{
+		"10.0.0.1:1080": "by-tag.internal",
+		"10.0.0.2:1080": "by-address.internal",
+		"10.0.0.3:1080": "",
+	} {
+		if got := tp.tlsCheckConfigFor(tp.mustFind(t, addr)).ServerName; got != want {
+			t.Fatalf("server name for %s = %q, want %q", addr, got, want)
+		}
+	}
+
+	tp.SetTLSCheckOverrides(nil)
+	if got := tp.tlsCheckConfigFor(tp.mustFind(t, "10.0.0.2:1080")).ServerName; got != "" {
+		t.Fatalf("server name after clearing the overrides = %q, want the pool-wide one", got)
+	}
+}
+
+func TestCanaryPromotion(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080"))
+	tp.waitSettled(t)
+	events, cancel := tp.SubscribeEvents(16)
+	defer cancel()
+	tp.SetCanary(Canary{TrafficPercent: 0.001, MinRequests: 10, SuccessRate: 0.9})
+	tp.reconcile(t, def("10.0.0.1:1080"), def("10.0.0.2:1080"))
+	tp.waitSettled(t)
+
+	canary := tp.mustFind(t, "10.0.0.2:1080")
+	if !canary.Snapshot().Canary || tp.mustFind(t, "10.0.0.1:1080").Snapshot().Canary {
+		t.Fatal("only the proxy added after SetCanary should be a canary")
+	}
+	for range 100 {
+		if proxy, err := tp.SelectProxy(nil, nil); err != nil || proxy == canary {
+			t.Fatalf("SelectProxy = %v, %v; want the proxy in full rotation", proxy, err)
+		}
+	}
+
+	// with the other proxy down the canary serves every selection
+	tp.health.fail("10.0.0.1:1080", errors.New("connection refused"))
+	tp.CheckNow("10.0.0.1:1080")
+	if proxy, err := tp.SelectProxy(nil, nil); err != nil || proxy != canary {
+		t.Fatalf("SelectProxy = %v, %v; want the canary as the last resort", proxy, err)
+	}
+
+	// a round below the success rate keeps it a canary
+	atomic.AddUint32(&canary.SuccessCount, 8)
+	atomic.AddUint32(&canary.FailCount, 2)
+	tp.CheckNow("10.0.0.2:1080")
+	atomic.AddUint32(&canary.SuccessCount, 5)
+	tp.CheckNow("10.0.0.2:1080")
+	if !canary.Snapshot().Canary {
+		t.Fatal("canary promoted before a round reached the success rate")
+	}
+
+	atomic.AddUint32(&canary.SuccessCount, 5)
+	tp.CheckNow("10.0.0.2:1080")
+	if canary.Snapshot().Canary {
+		t.Fatal("canary not promoted after a successful round")
+	}
+	var promoted bool
+	for len(events) > 0 {
+		promoted = promoted || (<-events).Type == EventCanaryPromoted
+	}
+	if !promoted {
+		t.Errorf("no %s event", EventCanaryPromoted)
+	}
+	if proxy, err := tp.SelectProxy(nil, nil); err != nil || proxy != canary {
+		t.Fatalf("SelectProxy = %v, %v; want the promoted proxy", proxy, err)
+	}
+}
+
+func TestProxyUpAndDownEvents(t *testing.T) {
+	tp := newTestPool(t, def("10.0.0.1:1080"), def("10.0.0.2:1080"))
+	tp.waitSettled(t)
+	events, cancel := tp.SubscribeEvents(16)
+	defer cancel()
+	next := func() Event {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == EventProxyUp || ev.Type == EventProxyDown {
+					return ev
+				}
+			default:
+				return Event{}
+			}
+		}
+	}
+
+	tp.health.fail("10.0.0.1:1080", errors.New("connection refused"))
+	tp.CheckNow("10.0.0.1:1080")
+	if ev := next(); ev.Type != EventProxyDown || ev.ProxyAddress != "10.0.0.1:1080" {
+		t.Fatalf("event after a failed check = %+v, want %s for 10.0.0.1:1080", ev, EventProxyDown)
+	}
+	tp.CheckNow("10.0.0.1:1080")
+	if ev := next(); ev.Type != "" {
+		t.Fatalf("got %s for a proxy that was already down", ev.Type)
+	}
+
+	tp.health.fail("10.0.0.1:1080", nil)
+	tp.CheckNow("10.0.0.1:1080")
+	if ev := next(); ev.Type != EventProxyUp || ev.ProxyAddress != "10.0.0.1:1080" {
+		t.Fatalf("event after recovery = %+v, want %s for 10.0.0.1:1080", ev, EventProxyUp)
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	// the fake clock starts at 12:00 UTC
+	nightly := def("10.0.0.1:1080")
+	nightly.MaintenanceWindows = []string{"11:30-12:30"}
+	tp := newTestPool(t, nightly, def("10.0.0.2:1080"))
+	tp.waitSettled(t)
+	events, cancel := tp.SubscribeEvents(16)
+	defer cancel()
+	next := func() Event {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == EventProxyUp || ev.Type == EventProxyDown {
+					return ev
+				}
+			default:
+				return Event{}
+			}
+		}
+	}
+
+	if !tp.mustFind(t, "10.0.0.1:1080").Snapshot().InMaintenance {
+		t.Fatal("proxy not in maintenance inside its window")
+	}
+	for i := 0; i < 10; i++ {
+		if proxy, err := tp.SelectProxy(nil, nil); err != nil || proxy.Address != "10.0.0.2:1080" {
+			t.Fatalf("SelectProxy = %v, %v; want 10.0.0.2:1080 while 10.0.0.1:1080 is in maintenance", proxy, err)
+		}
+	}
+
+	tp.health.fail("10.0.0.1:1080", errors.New("connection refused"))
+	tp.CheckNow("10.0.0.1:1080")
+	if ev := next(); ev.Type != "" {
+		t.Fatalf("got %s for a failure inside the maintenance window", ev.Type)
+	}
+
+	tp.clock.Advance(time.Hour)
+	if !tp.updateMaintenance(tp.clock.Now()) {
+		t.Fatal("updateMaintenance reported no change after the window ended")
+	}
+	tp.rebuildActive()
+	if ev := next(); ev.Type != EventProxyDown || ev.ProxyAddress != "10.0.0.1:1080" {
+		t.Fatalf("event after the window ended = %+v, want %s for the proxy still down", ev, EventProxyDown)
+	}
+
+	tp.health.fail("10.0.0.1:1080", nil)
+	tp.CheckNow("10.0.0.1:1080")
+	if ev := next(); ev.Type != EventProxyUp {
+		t.Fatalf("event after recovery = %+v, want %s", ev, EventProxyUp)
+	}
+	if n := tp.ActiveProxyCount(); n != 2 {
+		t.Fatalf("ActiveProxyCount = %d, want 2 after the window", n)
+	}
+}
+
+// socks5Relay serves SOCKS5 clients presenting user/pass on a local listener,
+// connecting them to the requested address, and returns its address and the
+// addresses it was asked for
+func socks5Relay(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	targets := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				// greeting, user/pass (fixed lengths of "user" and "pass"), request header
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 2})
+				if _, err := io.ReadFull(conn, buf[:11]); err != nil {
+					return
+				}
+				conn.Write([]byte{1, 0})
+				if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[3] != 1 {
+					return
+				}
+				if _, err := io.ReadFull(conn, buf[:6]); err != nil {
+					return
+				}
+				target := net.JoinHostPort(net.IP(buf[:4]).String(), fmt.Sprint(int(buf[4])<<8|int(buf[5])))
+				targets <- target
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String(), targets
+}
+
+func TestChainReachesExitsThroughEntry(t *testing.T) {
+	entryAddr, targets := socks5Relay(t)
+	exit, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exit.Close()
+	go func() {
+		if conn, err := exit.Accept(); err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	tp := newTestPool(t, def(entryAddr, "gateway"), def(exit.Addr().String(), "rotating"))
+	tp.SetChains([]Chain{{EntryTag: "gateway", ExitTag: "rotating"}})
+	// the entry is active but not selectable, so waitSettled does not apply
+	waitFor(t, "the entry and the exit to become active", func() bool {
+		return tp.ActiveProxyCount() == 1 && len(tp.activeEntries("gateway")) == 1
+	})
+
+	for range 20 {
+		if proxy, err := tp.SelectProxy(nil, nil); err != nil || proxy.Address == entryAddr {
+			t.Fatalf("SelectProxy = %v, %v; want the exit, never the entry", proxy, err)
+		}
+	}
+
+	forward, err := tp.mustFind(t, exit.Addr().String()).forward()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := forward.DialContext(ctx, "tcp", exit.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing the exit: %v", err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != exit.Addr().String() {
+		t.Fatalf("entry was asked for %s, want the exit %s", target, exit.Addr())
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read = %q, %v; want the echo through the entry", buf, err)
+	}
+
+	tp.health.fail(entryAddr, errors.New("connection refused"))
+	tp.CheckNow(entryAddr)
+	if _, err := forward.DialContext(ctx, "tcp", exit.Addr().String()); !errors.Is(err, ErrNoEntryProxy) {
+		t.Fatalf("dial with the entry down = %v, want ErrNoEntryProxy", err)
+	}
+}
+
+func TestSpeedTestScoresFastestThroughput(t *testing.T) {
+	relayAddr, _ := socks5Relay(t)
+	body := make([]byte, 64<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	tp := newTestPool(t, def(relayAddr, "dc"), def("10.0.0.2:1080", "dc"), def("10.0.0.3:1080", "dc"))
+	tp.waitSettled(t)
+	tp.SetStrategy(StrategyFastestThroughput)
+	// without scores the lowest expected latency wins
+	for addr, latency := range map[string]time.Duration{relayAddr: 50 * time.Millisecond, "10.0.0.2:1080": 50 * time.Millisecond, "10.0.0.3:1080": 10 * time.Millisecond} {
+		proxy := tp.mustFind(t, addr)
+		proxy.MarkInactive(errors.New("restart the averages"))
+		proxy.MarkActive(latency)
+	}
+	tp.rebuildActive()
+	if proxy, err := tp.SelectProxy(nil, nil); err != nil || proxy.Address != "10.0.0.3:1080" {
+		t.Fatalf("SelectProxy without scores = %v, %v; want the fastest 10.0.0.3:1080", proxy, err)
+	}
+
+	relay := tp.mustFind(t, relayAddr)
+	bps, err := tp.measureThroughput(relay, &SpeedTest{URL: srv.URL, Bytes: 16 << 10, Timeout: 5 * time.Second})
+	if err != nil || bps <= 0 {
+		t.Fatalf("measureThroughput = %v, %v; want a positive rate", bps, err)
+	}
+	relay.recordThroughput(bps)
+	tp.mustFind(t, "10.0.0.2:1080").recordThroughput(bps / 2)
+	if proxy, err := tp.SelectProxy([]string{"dc"}, nil); err != nil || proxy.Address != relayAddr {
+		t.Fatalf("SelectProxy = %v, %v; want the highest throughput %s", proxy, err, relayAddr)
+	}
+	avoidRelay := func(p *ProxyConfig) bool { return p.Address == relayAddr }
+	if proxy, _ := tp.SelectProxy(nil, avoidRelay); proxy.Address != "10.0.0.2:1080" {
+		t.Fatalf("SelectProxy avoiding %s = %s, want 10.0.0.2:1080", relayAddr, proxy.Address)
+	}
+	if got := relay.Snapshot().Throughput; got != bps {
+		t.Fatalf("snapshot throughput = %v, want %v", got, bps)
+	}
+}
@@ -0,0 +1,119 @@
+package proxypool
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// ProbeResult is the outcome of a one-shot check of a single proxy
+type ProbeResult struct {
+	Alive   bool
+	Latency time.Duration
+	ExitIP  string // empty if the lookup was disabled or failed
+	Err     error  // why the proxy is not alive, or why the exit IP lookup failed
+}
+
+// ProbeOptions configures a one-shot proxy check
+type ProbeOptions struct {
+	// Target is the host:port a TLS handshake is performed against through the proxy
+	Target string
+	// Timeout bounds the whole probe including the exit IP lookup
+	Timeout time.Duration
+	// TLS controls certificate verification; nil means DefaultTLSCheckConfig
+	TLS *TLSCheckConfig
+	// ExitIPURL, if set, is fetched through the proxy and its body reported as the exit IP
+	ExitIPURL string
+}
+
+// Probe checks def once, outside of any pool: it connects to opts.Target through the
+// proxy, completes a TLS handshake and optionally looks up the proxy's exit IP.
+func Probe(ctx context.Context, def config.ProxyDefinition, opts ProbeOptions) ProbeResult {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	proxyCfg := &ProxyConfig{Address: def.Address, Username: def.Username, Password: def.Password}
+	dialer, err := proxyCfg.UpstreamDialer("tcp")
+	if err != nil {
+		return ProbeResult{Err: fmt.Errorf("failed to create SOCKS5 dialer: %w", err)}
+	}
+
+	tlsConfig := opts.TLS
+	if tlsConfig == nil {
+		tlsConfig = DefaultTLSCheckConfig()
+	}
+	serverName := tlsConfig.ServerName
+	if serverName == "" {
+		serverName = opts.Target
+		if host, _, err := net.SplitHostPort(opts.Target); err == nil {
+			serverName = host
+		}
+	}
+
+	start := time.Now()
+	conn, err := DialContext(ctx, dialer, "tcp", opts.Target)
+	if err != nil {
+		return ProbeResult{Err: fmt.Errorf("failed to dial '%s': %w", opts.Target, err)}
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: tlsConfig.SkipVerify,
+		RootCAs:            tlsConfig.RootCAs,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return ProbeResult{Err: fmt.Errorf("TLS handshake to '%s' failed: %w", opts.Target, err)}
+	}
+	result := ProbeResult{Alive: true, Latency: time.Since(start)}
+
+	if opts.ExitIPURL != "" {
+		ip, err := lookupExitIP(ctx, proxyCfg, opts.ExitIPURL)
+		if err != nil {
+			result.Err = fmt.Errorf("exit IP lookup failed: %w", err)
+		}
+		result.ExitIP = ip
+	}
+	return result
+}
+
+// lookupExitIP fetches url through the proxy and returns the trimmed response body
+func lookupExitIP(ctx context.Context, proxyCfg *ProxyConfig, url string) (string, error) {
+	dialer, err := proxyCfg.UpstreamDialer("tcp")
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialContext(ctx, dialer, network, addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,108 @@
+package proxypool
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// recoveryProbeInterval is how often the local uplink is probed during a pool-wide outage
+const recoveryProbeInterval = 5 * time.Second
+
+const (
+	// EventPoolOutage is emitted when the last active proxy goes down
+	EventPoolOutage EventType = "pool_outage"
+	// EventNetworkRecovered is emitted when connectivity returns after a pool-wide outage
+	EventNetworkRecovered EventType = "network_recovered"
+)
+
+// activeCount returns how many proxies are currently active
+func (p *Pool) activeCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	count := 0
+	for _, proxy := range p.proxies {
+		proxy.Mu.RLock()
+		if proxy.IsActive {
+			count++
+		}
+		proxy.Mu.RUnlock()
+	}
+	return count
+}
+
+// noteProxyDown is called after an active proxy transitions to inactive. If it was the
+// last active proxy the pool enters outage mode and starts probing the local
+// network so that recovery can be detected without waiting a full interval.
+func (p *Pool) noteProxyDown() {
+	if p.activeCount() > 0 || !p.outage.CompareAndSwap(false, true) {
+		return
+	}
+	log.Println("CRITICAL: all upstream proxies are down; watching for network recovery")
+	p.events.emit(Event{
+		Type:     EventPoolOutage,
+		Severity: SeverityCritical,
+		Message:  "all upstream proxies are down",
+		Time:     p.now(),
+	})
+	p.wg.Add(1)
+	go p.watchNetworkRecovery()
+}
+
+// noteProxyUp is called after a proxy transitions to active. The first proxy
+// to recover from a pool-wide outage triggers a burst re-check of the pool.
+func (p *Pool) noteProxyUp(addr string) {
+	if p.outage.Load() {
+		p.recoverFromOutage("proxy " + addr + " recovered")
+	}
+}
+
+// recoverFromOutage clears outage mode and immediately re-checks every inactive proxy
+func (p *Pool) recoverFromOutage(reason string) {
+	if !p.outage.CompareAndSwap(true, false) {
+		return
+	}
+	triggered := 0
+	for _, proxy := range p.proxyList() {
+		proxy.Mu.RLock()
+		isActive := proxy.IsActive
+		proxy.Mu.RUnlock()
+		if !isActive {
+			proxy.triggerCheck()
+			triggered++
+		}
+	}
+	log.Printf("Network recovery detected (%s); re-checking %d inactive proxies immediately", reason, triggered)
+	p.events.emit(Event{
+		Type:     EventNetworkRecovered,
+		Severity: SeverityInfo,
+		Message:  "network recovered: " + reason,
+		Time:     p.now(),
+	})
+}
+
+// watchNetworkRecovery probes the health check target directly (without any
+// upstream proxy) while the pool is in outage mode.
+func (p *Pool) watchNetworkRecovery() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(recoveryProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !p.outage.Load() {
+				return
+			}
+			conn, err := net.DialTimeout("tcp", p.checkTarget(), p.timeout)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			p.recoverFromOutage("local uplink reachable again")
+			return
+		case <-p.overallShutdownCtx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxypool
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+)
+
+// rotationRingSize is how many recently used proxies a rotating client avoids
+const rotationRingSize = 32
+
+// exitRings holds the recently used proxies of each rotating client
+type exitRings struct {
+	mu    sync.Mutex
+	rings map[string][]string // key -> proxy addresses, most recently used last
+}
+
+// GetRotatingProxy picks an active proxy carrying at least one of tags (nil
+// means any) for the client identified by key, avoiding the proxies key used
+// recently: a proxy outside the client's ring of the last rotationRingSize
+// picks if possible, otherwise the least recently used one. Consecutive
+// connections of a client therefore never share an exit while more than one
+// proxy is eligible. Proxies for which avoid returns true are skipped unless
+// that leaves none.
+func (p *Pool) GetRotatingProxy(key string, tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+	var candidates []*ProxyConfig
+	for i, proxy := range set.proxies {
+		if (tags == nil || HasAnyTag(set.tags[i], tags)) && (avoid == nil || !avoid(proxy)) {
+			candidates = append(candidates, proxy)
+		}
+	}
+	if len(candidates) == 0 {
+		if avoid != nil {
+			return p.GetRotatingProxy(key, tags, nil)
+		}
+		if tags != nil {
+			return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+		}
+		return nil, ErrNoActiveProxies
+	}
+
+	p.exits.mu.Lock()
+	defer p.exits.mu.Unlock()
+	ring := p.exits.rings[key]
+	var fresh []*ProxyConfig
+	var lru *ProxyConfig
+	lruPos := len(ring)
+	for _, proxy := range candidates {
+		pos := slices.Index(ring, proxy.Address)
+		if pos < 0 {
+			fresh = append(fresh, proxy)
+		} else if pos < lruPos {
+			lru, lruPos = proxy, pos
+		}
+	}
+	chosen := lru
+	if len(fresh) > 0 {
+		chosen = fresh[rand.IntN(len(fresh))]
+	}
+
+	if pos := slices.Index(ring, chosen.Address); pos >= 0 {
+		ring = slices.Delete(ring, pos, pos+1)
+	}
+	ring = append(ring, chosen.Address)
+	if len(ring) > rotationRingSize {
+		ring = slices.Delete(ring, 0, len(ring)-rotationRingSize)
+	}
+	if p.exits.rings == nil {
+		p.exits.rings = make(map[string][]string)
+	}
+	p.exits.rings[key] = ring
+	return chosen, nil
+}
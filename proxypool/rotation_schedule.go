@@ -0,0 +1,181 @@
+package proxypool
+
+import (
+	"cmp"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// RotationWindow makes only Fraction of the proxies carrying Tag eligible for
+// selection at a time. Every Period the next group of proxies takes over, so
+// each IP rests most of the time and traffic is spread over the whole tag.
+type RotationWindow struct {
+	Tag      string
+	Fraction float64 // share of the tag's proxies eligible at once, in (0, 1]
+	Period   time.Duration
+}
+
+// groups returns how many groups the tag's proxies are split into
+func (w RotationWindow) groups() int {
+	return max(1, int(math.Ceil(1/w.Fraction-1e-9)))
+}
+
+// window returns the number of the period now falls into. Periods are aligned
+// to the Unix epoch so every instance rotates in step, also across restarts.
+func (w RotationWindow) window(now time.Time) int64 {
+	return now.UnixNano() / int64(w.Period)
+}
+
+// RotationWindowStatus is the current state of a rotation window
+type RotationWindowStatus struct {
+	Tag           string    `json:"tag"`
+	Fraction      float64   `json:"fraction"`
+	PeriodSeconds int64     `json:"period_seconds"`
+	Group         int       `json:"group"`  // the eligible group, 0-based
+	Groups        int       `json:"groups"` // number of groups the tag's proxies are split into
+	NextRotation  time.Time `json:"next_rotation"`
+	Eligible      []string  `json:"eligible"`
+	Resting       []string  `json:"resting"`
+	// Fallback is set while no proxy of the eligible group is active: the whole
+	// tag is eligible until one is
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// rotationState is a rotation window evaluated against the current pool
+type rotationState struct {
+	RotationWindowStatus
+	resting []*ProxyConfig
+}
+
+// SetRotationWindows enables scheduled rotation for the given tags. Call it
+// once after New; an empty list leaves rotation disabled.
+func (p *Pool) SetRotationWindows(windows []RotationWindow) {
+	if len(windows) == 0 {
+		return
+	}
+	windows = slices.Clone(windows)
+	if !p.rotationWindows.CompareAndSwap(nil, &windows) {
+		return
+	}
+	p.rebuildActive()
+	for _, st := range p.RotationStatus() {
+		log.Printf("Rotation window for tag '%s': group %d of %d eligible (%d proxies), next rotation at %s",
+			st.Tag, st.Group+1, st.Groups, len(st.Eligible), st.NextRotation.Format(time.RFC3339))
+	}
+	go p.rotationLoop(windows)
+}
+
+// RotationStatus reports the current group of every rotation window
+func (p *Pool) RotationStatus() []RotationWindowStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	states := p.rotationStatesLocked(p.now())
+	status := make([]RotationWindowStatus, len(states))
+	for i, st := range states {
+		status[i] = st.RotationWindowStatus
+	}
+	return status
+}
+
+// rotationStatesLocked splits the proxies of every rotating tag into groups and
+// finds the ones resting at now. The caller must hold p.mu. Groups are formed
+// by position in ID order, so they only change when proxies are added or removed.
+func (p *Pool) rotationStatesLocked(now time.Time) []rotationState {
+	windows := p.rotationWindows.Load()
+	if windows == nil {
+		return nil
+	}
+	states := make([]rotationState, 0, len(*windows))
+	for _, w := range *windows {
+		var members []*ProxyConfig
+		for _, proxy := range p.proxies {
+			proxy.Mu.RLock()
+			if slices.Contains(proxy.Tags, w.Tag) {
+				members = append(members, proxy)
+			}
+			proxy.Mu.RUnlock()
+		}
+		slices.SortFunc(members, func(a, b *ProxyConfig) int {
+			return cmp.Or(cmp.Compare(a.ID, b.ID), cmp.Compare(a.Address, b.Address))
+		})
+
+		n := w.window(now)
+		st := rotationState{RotationWindowStatus: RotationWindowStatus{
+			Tag:           w.Tag,
+			Fraction:      w.Fraction,
+			PeriodSeconds: int64(w.Period / time.Second),
+			Groups:        w.groups(),
+			NextRotation:  time.Unix(0, (n+1)*int64(w.Period)),
+			Eligible:      []string{},
+			Resting:       []string{},
+		}}
+		st.Group = int(n % int64(st.Groups))
+		usable := 0
+		for i, proxy := range members {
+			if i%st.Groups != st.Group {
+				st.resting = append(st.resting, proxy)
+				st.Resting = append(st.Resting, proxy.Address)
+				continue
+			}
+			st.Eligible = append(st.Eligible, proxy.Address)
+			proxy.Mu.RLock()
+			if proxy.IsActive && !proxy.Disabled && !proxy.InMaintenance {
+				usable++
+			}
+			proxy.Mu.RUnlock()
+		}
+		if usable == 0 && len(members) > 0 {
+			st.Fallback = true
+			st.resting = nil
+		}
+		states = append(states, st)
+	}
+	return states
+}
+
+// restingLocked returns the proxies rotation windows keep out of selection at
+// now, nil if there are none. The caller must hold p.mu.
+func (p *Pool) restingLocked(now time.Time) map[*ProxyConfig]bool {
+	var resting map[*ProxyConfig]bool
+	for _, st := range p.rotationStatesLocked(now) {
+		for _, proxy := range st.resting {
+			if resting == nil {
+				resting = make(map[*ProxyConfig]bool)
+			}
+			resting[proxy] = true
+		}
+	}
+	return resting
+}
+
+// rotationLoop rebuilds the selection set whenever a rotation window moves on
+func (p *Pool) rotationLoop(windows []RotationWindow) {
+	for {
+		now := p.now()
+		next := time.Time{}
+		for _, w := range windows {
+			at := time.Unix(0, (w.window(now)+1)*int64(w.Period))
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+		case <-p.overallShutdownCtx.Done():
+			timer.Stop()
+			return
+		}
+		p.rebuildActive()
+		status := p.RotationStatus()
+		for i, w := range windows {
+			if next.UnixNano()%int64(w.Period) != 0 {
+				continue // this window did not rotate now
+			}
+			st := status[i]
+			log.Printf("Rotation window for tag '%s': group %d of %d now eligible (%d proxies)", st.Tag, st.Group+1, st.Groups, len(st.Eligible))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package proxypool
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkPool builds a pool of n proxies without starting health checks.
+// Every other proxy is active and every fourth carries the "premium" tag.
+func benchmarkPool(n int) *Pool {
+	p := &Pool{proxies: make(map[string]*ProxyConfig, n)}
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:1080", i/256, i%256)
+		tags := []string{"general"}
+		if i%4 == 0 {
+			tags = append(tags, "premium")
+		}
+		p.proxies[addr] = &ProxyConfig{
+			Address:  addr,
+			Username: "user",
+			Password: "pass",
+			Tags:     tags,
+			IsActive: i%2 == 0,
+		}
+	}
+	p.rebuildActiveLocked()
+	return p
+}
+
+func BenchmarkGetActiveProxy(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		p := benchmarkPool(n)
+		b.Run(fmt.Sprintf("proxies=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.GetActiveProxy(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetActiveProxyWithTags(b *testing.B) {
+	p := benchmarkPool(1000)
+	tags := []string{"premium"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.GetActiveProxyWithTags(tags); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetActiveProxyWithAnyOfTags(b *testing.B) {
+	p := benchmarkPool(1000)
+	tags := []string{"premium", "residential"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.GetActiveProxyWithTags(tags); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetActiveProxyParallel(b *testing.B) {
+	p := benchmarkPool(100)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := p.GetActiveProxy(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package proxypool
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+)
+
+// ErrNoActiveProxies is returned when no active proxy matches a selection
+var ErrNoActiveProxies = errors.New("no active proxies available")
+
+// activeSet is an immutable snapshot of the active, enabled proxies used for selection
+type activeSet struct {
+	proxies []*ProxyConfig
+	tags    [][]string                // tags[i] are the tags of proxies[i] when the set was built
+	byTag   map[string][]*ProxyConfig // active proxies carrying each tag
+	// canaries are the active canary proxies, which are not in proxies, and
+	// canaryTags their tags
+	canaries   []*ProxyConfig
+	canaryTags [][]string
+	// entries are the active entry proxies of chains by tag, which are not in
+	// proxies (see SetChains)
+	entries map[string][]*ProxyConfig
+}
+
+// rebuildActive recomputes the active proxy set after a proxy changed state
+func (p *Pool) rebuildActive() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.rebuildActiveLocked()
+}
+
+// rebuildActiveLocked recomputes the set of active proxies used for selection,
+// leaving out proxies resting in a rotation window.
+// The caller must hold p.mu (read or write). Selection then works on an
+// immutable snapshot and never takes the pool or per-proxy locks.
+func (p *Pool) rebuildActiveLocked() {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+
+	set := &activeSet{byTag: make(map[string][]*ProxyConfig), entries: make(map[string][]*ProxyConfig)}
+	resting := p.restingLocked(p.now())
+	for _, proxy := range p.proxies {
+		proxy.Mu.RLock()
+		if proxy.IsActive && !proxy.Disabled && !proxy.InMaintenance && !resting[proxy] {
+			if p.isEntry(proxy.Tags) {
+				for _, tag := range proxy.Tags {
+					set.entries[tag] = append(set.entries[tag], proxy)
+				}
+			} else if proxy.Canary {
+				set.canaries = append(set.canaries, proxy)
+				set.canaryTags = append(set.canaryTags, proxy.Tags)
+			} else {
+				set.proxies = append(set.proxies, proxy)
+			}
+		}
+		proxy.Mu.RUnlock()
+	}
+	// Keep the order stable so selection does not depend on map iteration order
+	sort.Slice(set.proxies, func(i, j int) bool {
+		return set.proxies[i].Address < set.proxies[j].Address
+	})
+	set.tags = make([][]string, len(set.proxies))
+	for i, proxy := range set.proxies {
+		proxy.Mu.RLock()
+		set.tags[i] = proxy.Tags
+		proxy.Mu.RUnlock()
+		for _, tag := range set.tags[i] {
+			set.byTag[tag] = append(set.byTag[tag], proxy)
+		}
+	}
+	p.active.Store(set)
+}
+
+// ActiveProxyCount returns how many active, enabled proxies are available for
+// selection, canaries included
+func (p *Pool) ActiveProxyCount() int {
+	set := p.active.Load()
+	if set == nil {
+		return 0
+	}
+	return len(set.proxies) + len(set.canaries)
+}
+
+// GetActiveProxy returns a random active proxy
+func (p *Pool) GetActiveProxy() (*ProxyConfig, error) {
+	return p.GetActiveProxyWithTags(nil)
+}
+
+// GetActiveProxyWithTags returns a random active proxy matching at least one of tags,
+// which may be tag expressions (see config.TagExpr). A nil tags slice means any
+// active proxy is eligible. It does not allocate on success.
+func (p *Pool) GetActiveProxyWithTags(tags []string) (*ProxyConfig, error) {
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+
+	var candidates []*ProxyConfig
+	switch len(tags) {
+	case 0:
+		if tags == nil {
+			candidates = set.proxies
+		}
+	case 1:
+		if !config.IsPlainTag(tags[0]) {
+			return set.pickAnyTag(tags)
+		}
+		candidates = set.byTag[tags[0]]
+	default:
+		return set.pickAnyTag(tags)
+	}
+	if len(candidates) == 0 {
+		if tags != nil {
+			return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+		}
+		return nil, ErrNoActiveProxies
+	}
+	return candidates[rand.IntN(len(candidates))], nil
+}
+
+// GetActiveProxyAvoiding is like GetActiveProxyWithTags but skips proxies for which
+// avoid returns true. When every eligible proxy is avoided it falls back to
+// GetActiveProxyWithTags: an avoided proxy is still better than none.
+func (p *Pool) GetActiveProxyAvoiding(tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	if avoid == nil {
+		return p.GetActiveProxyWithTags(tags)
+	}
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+	var candidates []*ProxyConfig
+	for i, proxy := range set.proxies {
+		if (tags == nil || HasAnyTag(set.tags[i], tags)) && !avoid(proxy) {
+			candidates = append(candidates, proxy)
+		}
+	}
+	if len(candidates) == 0 {
+		return p.GetActiveProxyWithTags(tags)
+	}
+	return candidates[rand.IntN(len(candidates))], nil
+}
+
+// pickAnyTag picks a random proxy carrying at least one of several tags. The set is
+// immutable, so it counts the eligible proxies and then walks to a random one.
+func (set *activeSet) pickAnyTag(tags []string) (*ProxyConfig, error) {
+	eligible := 0
+	for i := range set.proxies {
+		if HasAnyTag(set.tags[i], tags) {
+			eligible++
+		}
+	}
+	if eligible == 0 {
+		return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+	}
+	n := rand.IntN(eligible)
+	for i := range set.proxies {
+		if !HasAnyTag(set.tags[i], tags) {
+			continue
+		}
+		if n == 0 {
+			return set.proxies[i], nil
+		}
+		n--
+	}
+	return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+}
+
+// GetFastestActiveProxies returns up to n active proxies carrying at least one of
+// tags (nil means any), ordered by their expected latency (see ExpectedLatency).
+func (p *Pool) GetFastestActiveProxies(tags []string, n int) ([]*ProxyConfig, error) {
+	return p.GetFastestActiveProxiesAvoiding(tags, n, nil)
+}
+
+// GetFastestActiveProxiesAvoiding is like GetFastestActiveProxies but skips proxies
+// for which avoid returns true, unless that leaves no proxy at all.
+func (p *Pool) GetFastestActiveProxiesAvoiding(tags []string, n int, avoid func(*ProxyConfig) bool) ([]*ProxyConfig, error) {
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+
+	type ranked struct {
+		proxy   *ProxyConfig
+		latency time.Duration
+	}
+	var best []ranked
+	for i, proxy := range set.proxies {
+		if tags != nil && !HasAnyTag(set.tags[i], tags) {
+			continue
+		}
+		if avoid != nil && avoid(proxy) {
+			continue
+		}
+		r := ranked{proxy: proxy, latency: proxy.ExpectedLatency()}
+		// n is small, so keep the best n with an insertion step instead of sorting everything
+		pos := sort.Search(len(best), func(j int) bool { return best[j].latency > r.latency })
+		if pos >= n {
+			continue
+		}
+		if len(best) < n {
+			best = append(best, ranked{})
+		}
+		copy(best[pos+1:], best[pos:])
+		best[pos] = r
+	}
+	if len(best) == 0 {
+		if avoid != nil {
+			return p.GetFastestActiveProxiesAvoiding(tags, n, nil)
+		}
+		if tags != nil {
+			return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+		}
+		return nil, ErrNoActiveProxies
+	}
+	proxies := make([]*ProxyConfig, len(best))
+	for i, r := range best {
+		proxies[i] = r.proxy
+	}
+	return proxies, nil
+}
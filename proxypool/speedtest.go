@@ -0,0 +1,132 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// SpeedTest periodically downloads Bytes from URL through every active proxy
+// and scores the proxy by the transfer rate (see StrategyFastestThroughput)
+type SpeedTest struct {
+	URL      string
+	Bytes    int64
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// speedTestStartDelay gives the first health checks time to finish before the
+// first round of speed tests
+const speedTestStartDelay = 30 * time.Second
+
+// SetSpeedTest enables periodic throughput probes. Call it once after New; an
+// empty URL leaves them disabled.
+func (p *Pool) SetSpeedTest(cfg SpeedTest) {
+	if cfg.URL == "" || cfg.Bytes <= 0 || cfg.Interval <= 0 {
+		return
+	}
+	if !p.speedTest.CompareAndSwap(nil, &cfg) {
+		return
+	}
+	go p.speedTestLoop(&cfg)
+}
+
+// speedTestLoop runs a round of speed tests every cfg.Interval
+func (p *Pool) speedTestLoop(cfg *SpeedTest) {
+	timer := time.NewTimer(speedTestStartDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-p.overallShutdownCtx.Done():
+			return
+		}
+		p.speedTestRound(cfg)
+		timer.Reset(cfg.Interval)
+	}
+}
+
+// speedTestRound measures the active proxies one after another, so the probes
+// neither compete for bandwidth nor load the test URL in bursts
+func (p *Pool) speedTestRound(cfg *SpeedTest) {
+	for _, proxy := range p.proxyList() {
+		if p.overallShutdownCtx.Err() != nil {
+			return
+		}
+		proxy.Mu.RLock()
+		skip := !proxy.IsActive || p.isEntry(proxy.Tags)
+		proxy.Mu.RUnlock()
+		if skip {
+			continue
+		}
+		bps, err := p.measureThroughput(proxy, cfg)
+		if err != nil {
+			log.Printf("Proxy %s: speed test failed: %v", proxy.Address, err)
+			continue
+		}
+		proxy.recordThroughput(bps)
+	}
+}
+
+// measureThroughput downloads up to cfg.Bytes of cfg.URL through proxy and
+// returns the transfer rate of the body in bytes per second
+func (p *Pool) measureThroughput(proxy *ProxyConfig, cfg *SpeedTest) (float64, error) {
+	ctx, cancel := context.WithTimeout(p.overallShutdownCtx, cfg.Timeout)
+	defer cancel()
+	dialer, err := proxy.UpstreamDialer("tcp")
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialContext(ctx, dialer, network, addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", cfg.Bytes-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, cfg.Bytes))
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, errors.New("empty response body")
+	}
+	return float64(n) / max(elapsed.Seconds(), 1e-6), nil
+}
+
+// recordThroughput folds a speed test result in bytes per second into Throughput
+func (pc *ProxyConfig) recordThroughput(bps float64) {
+	pc.Mu.Lock()
+	defer pc.Mu.Unlock()
+	if pc.Throughput == 0 {
+		pc.Throughput = bps
+		return
+	}
+	pc.Throughput += latencyEWMAAlpha * (bps - pc.Throughput)
+}
+
+// throughput returns the proxy's bandwidth score, 0 until a speed test succeeded
+func (pc *ProxyConfig) throughput() float64 {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.Throughput
+}
@@ -0,0 +1,121 @@
+package proxypool
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultStartupCheckConcurrency bounds how many first health checks run at once
+const DefaultStartupCheckConcurrency = 50
+
+// startupTracker bounds the first health checks of new proxies and counts those
+// still pending, so startup can wait for a warm pool
+type startupTracker struct {
+	mu      sync.Mutex
+	limit   int           // first checks allowed to run at once
+	running int           // first checks running
+	freed   chan struct{} // closed and replaced when a slot frees up or limit changes
+	pending int
+	total   int           // proxies whose first check is or was pending since the last idle period
+	idle    chan struct{} // closed while no first check is pending
+}
+
+func newStartupTracker(limit int) *startupTracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &startupTracker{limit: limit, freed: make(chan struct{}), idle: idle}
+}
+
+// acquire waits for a slot to run a first check. It returns false if ctx is done first.
+func (t *startupTracker) acquire(ctx context.Context) bool {
+	for {
+		t.mu.Lock()
+		if t.running < t.limit {
+			t.running++
+			t.mu.Unlock()
+			return true
+		}
+		freed := t.freed
+		t.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release frees a slot taken by acquire
+func (t *startupTracker) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	t.wakeLocked()
+}
+
+// wakeLocked lets waiting acquires retry. The caller must hold t.mu.
+func (t *startupTracker) wakeLocked() {
+	close(t.freed)
+	t.freed = make(chan struct{})
+}
+
+// add registers a proxy whose first check is pending
+func (t *startupTracker) add() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == 0 {
+		t.idle = make(chan struct{})
+		t.total = 0
+	}
+	t.pending++
+	t.total++
+}
+
+// done records that a first check completed or will not run
+func (t *startupTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending--
+	if t.pending == 0 {
+		close(t.idle)
+	}
+}
+
+// SetStartupCheckConcurrency bounds how many first health checks of new proxies
+// run at once (DefaultStartupCheckConcurrency unless set). It also applies to
+// checks already waiting, so it can be called right after New.
+func (p *Pool) SetStartupCheckConcurrency(n int) {
+	if n <= 0 {
+		n = DefaultStartupCheckConcurrency
+	}
+	p.startup.mu.Lock()
+	defer p.startup.mu.Unlock()
+	p.startup.limit = n
+	p.startup.wakeLocked()
+}
+
+// initialCheck runs the first health check of proxyCfg once a startup slot is free
+func (p *Pool) initialCheck(ctx context.Context, proxyCfg *ProxyConfig) {
+	defer p.startup.done()
+	if !p.startup.acquire(ctx) {
+		return
+	}
+	defer p.startup.release()
+	p.checkProxy(ctx, proxyCfg)
+}
+
+// WaitInitialChecks blocks until every proxy in the pool completed its first
+// health check, or ctx is done. It returns how many first checks are still
+// pending and how many there were in total since the pool was last settled.
+func (p *Pool) WaitInitialChecks(ctx context.Context) (pending, total int) {
+	p.startup.mu.Lock()
+	idle := p.startup.idle
+	p.startup.mu.Unlock()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+	p.startup.mu.Lock()
+	defer p.startup.mu.Unlock()
+	return p.startup.pending, p.startup.total
+}
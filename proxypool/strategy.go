@@ -0,0 +1,194 @@
+package proxypool
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Strategy decides which of the eligible active proxies SelectProxy picks
+type Strategy string
+
+const (
+	StrategyRandom     Strategy = "random"      // a random eligible proxy
+	StrategyFastest    Strategy = "fastest"     // the proxy with the lowest expected latency
+	StrategyRoundRobin Strategy = "round_robin" // the eligible proxies in turn
+	StrategyCheapest   Strategy = "cheapest"    // the lowest cost per GB among the proxies almost as fast as the fastest
+	// StrategyFastestThroughput picks the proxy with the highest speed test
+	// throughput; proxies not measured yet rank behind, by expected latency
+	StrategyFastestThroughput Strategy = "fastest_throughput"
+)
+
+// DefaultCostLatencyTolerance is the latency tolerance of StrategyCheapest
+// until SetCostLatencyTolerance is called
+const DefaultCostLatencyTolerance = 100 * time.Millisecond
+
+// SetStrategy sets how SelectProxy picks among the eligible proxies
+func (p *Pool) SetStrategy(s Strategy) {
+	p.strategy.Store(&s)
+}
+
+// SetCostLatencyTolerance sets how much higher than the lowest expected latency
+// among the eligible proxies the expected latency of a proxy may be for
+// StrategyCheapest to pick it for its lower cost
+func (p *Pool) SetCostLatencyTolerance(d time.Duration) {
+	p.costTolerance.Store(int64(d))
+}
+
+// costLatencyTolerance returns the latency tolerance of StrategyCheapest
+func (p *Pool) costLatencyTolerance() time.Duration {
+	if d := p.costTolerance.Load(); d > 0 {
+		return time.Duration(d)
+	}
+	return DefaultCostLatencyTolerance
+}
+
+// Strategy returns the selection strategy of the pool
+func (p *Pool) Strategy() Strategy {
+	if s := p.strategy.Load(); s != nil {
+		return *s
+	}
+	return StrategyRandom
+}
+
+// SelectProxy picks an active proxy carrying at least one of tags (nil means
+// any) by the pool's strategy, skipping proxies for which avoid returns true
+// unless that leaves no proxy at all. Canary proxies get their share of the
+// selections first and serve all of them while no other proxy is eligible.
+func (p *Pool) SelectProxy(tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	if proxyCfg := p.pickCanary(tags, avoid, false); proxyCfg != nil {
+		return proxyCfg, nil
+	}
+	proxyCfg, err := p.selectByStrategy(tags, avoid)
+	if errors.Is(err, ErrNoActiveProxies) {
+		if canary := p.pickCanary(tags, avoid, true); canary != nil {
+			return canary, nil
+		}
+	}
+	return proxyCfg, err
+}
+
+// selectByStrategy picks among the eligible proxies in full rotation by the pool's strategy
+func (p *Pool) selectByStrategy(tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	switch p.Strategy() {
+	case StrategyFastest:
+		proxies, err := p.GetFastestActiveProxiesAvoiding(tags, 1, avoid)
+		if err != nil {
+			return nil, err
+		}
+		return proxies[0], nil
+	case StrategyRoundRobin:
+		return p.nextRoundRobin(tags, avoid)
+	case StrategyCheapest:
+		return p.selectCheapest(tags, avoid)
+	case StrategyFastestThroughput:
+		return p.selectHighestThroughput(tags, avoid)
+	}
+	return p.GetActiveProxyAvoiding(tags, avoid)
+}
+
+// nextRoundRobin returns the next eligible proxy in address order. The turn is
+// shared by all selections, so selections with different tags interleave.
+func (p *Pool) nextRoundRobin(tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+	var candidates []*ProxyConfig
+	for i, proxy := range set.proxies {
+		if (tags == nil || HasAnyTag(set.tags[i], tags)) && (avoid == nil || !avoid(proxy)) {
+			candidates = append(candidates, proxy)
+		}
+	}
+	if len(candidates) == 0 {
+		if avoid != nil {
+			return p.nextRoundRobin(tags, nil)
+		}
+		if tags != nil {
+			return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+		}
+		return nil, ErrNoActiveProxies
+	}
+	n := p.roundRobin.Add(1) - 1
+	return candidates[n%uint64(len(candidates))], nil
+}
+
+// selectCheapest returns the eligible proxy with the lowest cost per GB among
+// those whose expected latency is within the cost latency tolerance of the
+// fastest one. Of equally cheap proxies the fastest wins.
+func (p *Pool) selectCheapest(tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+	type priced struct {
+		proxy   *ProxyConfig
+		latency time.Duration
+		cost    float64
+	}
+	var candidates []priced
+	fastest := time.Duration(-1)
+	for i, proxy := range set.proxies {
+		if (tags != nil && !HasAnyTag(set.tags[i], tags)) || (avoid != nil && avoid(proxy)) {
+			continue
+		}
+		c := priced{proxy: proxy, latency: proxy.ExpectedLatency(), cost: proxy.Cost()}
+		if fastest < 0 || c.latency < fastest {
+			fastest = c.latency
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		if avoid != nil {
+			return p.selectCheapest(tags, nil)
+		}
+		if tags != nil {
+			return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+		}
+		return nil, ErrNoActiveProxies
+	}
+	limit := fastest + p.costLatencyTolerance()
+	var best *priced
+	for i := range candidates {
+		c := &candidates[i]
+		if c.latency > limit {
+			continue
+		}
+		if best == nil || c.cost < best.cost || (c.cost == best.cost && c.latency < best.latency) {
+			best = c
+		}
+	}
+	return best.proxy, nil
+}
+
+// selectHighestThroughput returns the eligible proxy with the highest
+// throughput. Of equal throughput, including proxies without a speed test
+// result, the one with the lowest expected latency wins.
+func (p *Pool) selectHighestThroughput(tags []string, avoid func(*ProxyConfig) bool) (*ProxyConfig, error) {
+	set := p.active.Load()
+	if set == nil {
+		set = &activeSet{}
+	}
+	var best *ProxyConfig
+	var bestThroughput float64
+	var bestLatency time.Duration
+	for i, proxy := range set.proxies {
+		if (tags != nil && !HasAnyTag(set.tags[i], tags)) || (avoid != nil && avoid(proxy)) {
+			continue
+		}
+		throughput, latency := proxy.throughput(), proxy.ExpectedLatency()
+		if best == nil || throughput > bestThroughput || (throughput == bestThroughput && latency < bestLatency) {
+			best, bestThroughput, bestLatency = proxy, throughput, latency
+		}
+	}
+	if best == nil {
+		if avoid != nil {
+			return p.selectHighestThroughput(tags, nil)
+		}
+		if tags != nil {
+			return nil, fmt.Errorf("%w with tags %v", ErrNoActiveProxies, tags)
+		}
+		return nil, ErrNoActiveProxies
+	}
+	return best, nil
+}
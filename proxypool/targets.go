@@ -0,0 +1,45 @@
+package proxypool
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Orders in which health checks go through their targets
+const (
+	TargetOrderRandom     = "random"
+	TargetOrderRoundRobin = "round_robin"
+)
+
+// checkTargets are the health check targets set by SetHealthCheckTargets
+type checkTargets struct {
+	targets    []string
+	roundRobin bool
+	next       atomic.Uint64
+}
+
+// SetHealthCheckTargets makes each health check pick one of targets, at random
+// or in turn with TargetOrderRoundRobin, so checks neither depend on a single
+// site nor get rate-limited by it. An empty list restores the target passed to New.
+func (p *Pool) SetHealthCheckTargets(targets []string, order string) {
+	if len(targets) == 0 {
+		p.checkTargets.Store(nil)
+		return
+	}
+	p.checkTargets.Store(&checkTargets{
+		targets:    append([]string(nil), targets...),
+		roundRobin: order == TargetOrderRoundRobin,
+	})
+}
+
+// checkTarget returns the host:port the next health check connects to
+func (p *Pool) checkTarget() string {
+	t := p.checkTargets.Load()
+	if t == nil {
+		return p.testURL
+	}
+	if t.roundRobin {
+		return t.targets[(t.next.Add(1)-1)%uint64(len(t.targets))]
+	}
+	return t.targets[rand.IntN(len(t.targets))]
+}
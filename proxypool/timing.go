@@ -0,0 +1,71 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	px "golang.org/x/net/proxy"
+)
+
+// DialTiming is how long the phases of a dial through an upstream proxy took.
+// A phase that did not complete is zero.
+type DialTiming struct {
+	// Handshake covers connecting to the proxy (including TLS to the proxy) and
+	// the SOCKS5 greeting and authentication
+	Handshake time.Duration
+	// Connect is the CONNECT request to the destination until the proxy replied
+	Connect time.Duration
+}
+
+// DialTimed connects to addr through the proxy over TCP like its SOCKS5 dialer,
+// presenting auth, or the proxy's own credentials if auth is nil, and reports
+// how long each phase took. Errors match those of golang.org/x/net/proxy.
+func (pc *ProxyConfig) DialTimed(ctx context.Context, auth *px.Auth, addr string) (net.Conn, DialTiming, error) {
+	var timing DialTiming
+	if auth == nil {
+		auth = pc.auth()
+	}
+	forward, err := pc.forward()
+	if err != nil {
+		return nil, timing, err
+	}
+	opErr := func(err error) error {
+		return &net.OpError{Op: "socks connect", Net: "tcp", Source: proxyAddr(pc.Address), Addr: proxyAddr(addr), Err: err}
+	}
+
+	start := time.Now()
+	conn, err := forward.DialContext(ctx, "tcp", pc.Address)
+	if err != nil {
+		return nil, timing, opErr(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = socks5Authenticate(conn, auth)
+	if !stop() {
+		// ctx ended during the exchange and poisoned the deadline
+		err = errors.Join(ctx.Err(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, timing, opErr(err)
+	}
+	timing.Handshake = time.Since(start)
+
+	start = time.Now()
+	if err := socks5Connect(ctx, conn, addr); err != nil {
+		conn.Close()
+		return nil, timing, opErr(err)
+	}
+	timing.Connect = time.Since(start)
+	return conn, timing, nil
+}
+
+// proxyAddr is the net.Addr of a host:port string in dial errors
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "tcp" }
+func (a proxyAddr) String() string  { return string(a) }
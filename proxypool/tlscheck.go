@@ -0,0 +1,66 @@
+package proxypool
+
+import (
+	"log"
+	"slices"
+)
+
+// TLSCheckOverride replaces the TLS check settings set by ConfigureTLS for the
+// proxy at Address, or for the proxies carrying Tag, e.g. to trust the private
+// CA of an internal fleet while public proxies stay strictly verified
+type TLSCheckOverride struct {
+	// Address selects one proxy; when set, Tag is ignored
+	Address string
+	Tag     string
+	TLSCheckConfig
+}
+
+// SetTLSCheckOverrides sets the per-proxy and per-tag TLS check settings. An
+// override for a proxy's address wins over tag overrides, and among tag
+// overrides the first one matching a tag of the proxy applies.
+func (p *Pool) SetTLSCheckOverrides(overrides []TLSCheckOverride) {
+	if len(overrides) == 0 {
+		p.tlsOverrides.Store(nil)
+		return
+	}
+	overrides = slices.Clone(overrides)
+	for _, o := range overrides {
+		if o.SkipVerify {
+			selector := "tag " + o.Tag
+			if o.Address != "" {
+				selector = "proxy " + o.Address
+			}
+			log.Printf("WARNING: TLS certificate verification is disabled for the health checks of %s", selector)
+		}
+	}
+	p.tlsOverrides.Store(&overrides)
+}
+
+// tlsCheckConfigFor returns the TLS check settings that apply to proxyCfg
+func (p *Pool) tlsCheckConfigFor(proxyCfg *ProxyConfig) *TLSCheckConfig {
+	if overrides := p.tlsOverrides.Load(); overrides != nil {
+		proxyCfg.Mu.RLock()
+		addr, tags := proxyCfg.Address, proxyCfg.Tags
+		proxyCfg.Mu.RUnlock()
+		var byTag *TLSCheckConfig
+		for i := range *overrides {
+			o := &(*overrides)[i]
+			if o.Address != "" {
+				if o.Address == addr {
+					return &o.TLSCheckConfig
+				}
+				continue
+			}
+			if byTag == nil && slices.Contains(tags, o.Tag) {
+				byTag = &o.TLSCheckConfig
+			}
+		}
+		if byTag != nil {
+			return byTag
+		}
+	}
+	if cfg, _ := p.tlsCheckConfig.Load().(*TLSCheckConfig); cfg != nil {
+		return cfg
+	}
+	return DefaultTLSCheckConfig()
+}
@@ -0,0 +1,77 @@
+package proxypool
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/sequring/chameleon/config"
+	px "golang.org/x/net/proxy"
+)
+
+// forwardDialer dials the connection to an upstream proxy itself
+type forwardDialer interface {
+	px.Dialer
+	px.ContextDialer
+}
+
+// tlsForward dials the connection to a proxy that expects TLS before SOCKS5,
+// such as a proxy fronted by stunnel
+type tlsForward struct {
+	config *tls.Config
+	base   forwardDialer // carries the TLS connection
+}
+
+func (f tlsForward) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamForward.Timeout)
+	defer cancel()
+	return f.DialContext(ctx, network, address)
+}
+
+func (f tlsForward) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := f.base.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, f.config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", address, err)
+	}
+	return tlsConn, nil
+}
+
+// forward returns the dialer for the connection to the proxy: plain TCP, or TLS
+// for proxies defined with "tls": true, through an entry proxy if the pool
+// chains the proxy
+func (pc *ProxyConfig) forward() (forwardDialer, error) {
+	if pc.upstreamTLSErr != nil {
+		return nil, fmt.Errorf("proxy %s: %w", pc.Address, pc.upstreamTLSErr)
+	}
+	var base forwardDialer = upstreamForward
+	if pc.pool != nil {
+		base = chainForward{exit: pc}
+	}
+	if pc.upstreamTLS == nil {
+		return base, nil
+	}
+	return tlsForward{config: pc.upstreamTLS, base: base}, nil
+}
+
+// upstreamTLSDef is the TLS part of a proxy definition
+type upstreamTLSDef struct {
+	enabled    bool
+	serverName string
+	caFile     string
+	pins       []string
+}
+
+func upstreamTLSDefOf(def *config.ProxyDefinition) upstreamTLSDef {
+	return upstreamTLSDef{enabled: def.TLS, serverName: def.TLSServerName, caFile: def.TLSCAFile, pins: def.TLSPinSHA256}
+}
+
+func (d upstreamTLSDef) equal(o upstreamTLSDef) bool {
+	return d.enabled == o.enabled && d.serverName == o.serverName && d.caFile == o.caFile && slices.Equal(d.pins, o.pins)
+}
@@ -0,0 +1,405 @@
+package proxypool
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sequring/chameleon/config"
+	px "golang.org/x/net/proxy"
+)
+
+// PrewarmConfig keeps SOCKS5 connections to hot upstream proxies open with the
+// greeting and authentication already done, so a client dial only has to send
+// the CONNECT request. A SOCKS5 connection carries a single CONNECT, so warm
+// connections are used once and replaced in the background.
+type PrewarmConfig struct {
+	// PerProxy is the number of ready connections kept per hot proxy; 0 disables prewarming
+	PerProxy int
+	// IdleTimeout closes ready connections unused for this long, before the
+	// upstream drops them itself
+	IdleTimeout time.Duration
+	// HotWindow is how long after its last client dial a proxy is kept warm
+	HotWindow time.Duration
+}
+
+// Default prewarm timings
+const (
+	DefaultPrewarmIdleTimeout = 20 * time.Second
+	DefaultPrewarmHotWindow   = time.Minute
+)
+
+// warmConn is an authenticated SOCKS5 connection waiting for its CONNECT
+type warmConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// warmSet holds the ready connections of one proxy
+type warmSet struct {
+	mu       sync.Mutex
+	conns    []warmConn
+	filling  int       // handshakes in progress
+	lastUsed time.Time // last client dial through the proxy
+	closed   bool      // the proxy left the pool; no more connections are kept
+}
+
+// take removes and returns the newest ready connection younger than maxAge and
+// closes older ones
+func (w *warmSet) take(now time.Time, maxAge time.Duration) net.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastUsed = now
+	for len(w.conns) > 0 {
+		last := w.conns[len(w.conns)-1]
+		w.conns = w.conns[:len(w.conns)-1]
+		if now.Sub(last.created) < maxAge {
+			return last.conn
+		}
+		last.conn.Close()
+	}
+	return nil
+}
+
+// evict closes ready connections older than maxAge, or all of them if cold
+func (w *warmSet) evict(now time.Time, maxAge time.Duration, cold bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	kept := w.conns[:0]
+	for _, wc := range w.conns {
+		if cold || now.Sub(wc.created) >= maxAge {
+			wc.conn.Close()
+			continue
+		}
+		kept = append(kept, wc)
+	}
+	clear(w.conns[len(kept):])
+	w.conns = kept
+}
+
+// close closes the ready connections and stops keeping new ones
+func (w *warmSet) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	for _, wc := range w.conns {
+		wc.conn.Close()
+	}
+	w.conns = nil
+}
+
+// SetPrewarm enables keeping ready connections to hot proxies. Call it once
+// after New; a PerProxy of 0 leaves prewarming disabled.
+func (p *Pool) SetPrewarm(cfg PrewarmConfig) {
+	if cfg.PerProxy <= 0 {
+		return
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultPrewarmIdleTimeout
+	}
+	if cfg.HotWindow <= 0 {
+		cfg.HotWindow = DefaultPrewarmHotWindow
+	}
+	if !p.prewarm.CompareAndSwap(nil, &cfg) {
+		return
+	}
+	go p.prewarmLoop(&cfg)
+}
+
+// prewarmLoop periodically drops stale connections, cools down proxies without
+// recent dials and tops up the hot ones
+func (p *Pool) prewarmLoop(cfg *PrewarmConfig) {
+	interval := max(cfg.IdleTimeout/2, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.overallShutdownCtx.Done():
+			return
+		}
+		now := time.Now()
+		for _, proxy := range p.proxyList() {
+			proxy.warm.mu.Lock()
+			hot := !proxy.warm.lastUsed.IsZero() && now.Sub(proxy.warm.lastUsed) < cfg.HotWindow
+			proxy.warm.mu.Unlock()
+			proxy.warm.evict(now, cfg.IdleTimeout, !hot || !proxy.selectable())
+			if hot {
+				p.fillWarm(proxy, cfg)
+			}
+		}
+	}
+}
+
+// selectable reports whether the proxy may currently serve clients
+func (pc *ProxyConfig) selectable() bool {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return pc.IsActive && !pc.Disabled
+}
+
+// warmable reports whether connections can be authenticated ahead of the
+// client: only proxies using their own fixed credentials qualify, since
+// passthrough and templated usernames depend on the client
+func (pc *ProxyConfig) warmable() bool {
+	pc.Mu.RLock()
+	defer pc.Mu.RUnlock()
+	return !pc.Passthrough && !config.IsUsernameTemplate(pc.Username)
+}
+
+// fillWarm starts handshakes until proxy has cfg.PerProxy ready connections
+func (p *Pool) fillWarm(proxy *ProxyConfig, cfg *PrewarmConfig) {
+	if !proxy.selectable() || !proxy.warmable() {
+		return
+	}
+	proxy.warm.mu.Lock()
+	missing := cfg.PerProxy - len(proxy.warm.conns) - proxy.warm.filling
+	if proxy.warm.closed || missing <= 0 {
+		proxy.warm.mu.Unlock()
+		return
+	}
+	proxy.warm.filling += missing
+	proxy.warm.mu.Unlock()
+
+	for range missing {
+		go func() {
+			conn, err := p.warmUp(proxy)
+			proxy.warm.mu.Lock()
+			defer proxy.warm.mu.Unlock()
+			proxy.warm.filling--
+			if err != nil {
+				log.Printf("Proxy %s: failed to prewarm connection: %v", proxy.Address, err)
+				return
+			}
+			if proxy.warm.closed || len(proxy.warm.conns) >= cfg.PerProxy {
+				conn.Close()
+				return
+			}
+			proxy.warm.conns = append(proxy.warm.conns, warmConn{conn: conn, created: time.Now()})
+		}()
+	}
+}
+
+// warmUp connects to proxy and completes the SOCKS5 greeting and authentication
+func (p *Pool) warmUp(proxy *ProxyConfig) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(p.overallShutdownCtx, p.timeout)
+	defer cancel()
+	forward, err := proxy.forward()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := forward.DialContext(ctx, "tcp", proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := socks5Authenticate(conn, proxy.auth()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// DialWarm connects to addr over a ready connection of proxyCfg, if prewarming
+// is enabled and one is available. ok is false when no ready connection could
+// be used and the caller should dial normally; with ok true, err is the
+// upstream's refusal of the CONNECT. Every call marks the proxy as hot.
+func (p *Pool) DialWarm(ctx context.Context, proxyCfg *ProxyConfig, addr string) (conn net.Conn, ok bool, err error) {
+	cfg := p.prewarm.Load()
+	if cfg == nil {
+		return nil, false, nil
+	}
+	defer p.fillWarm(proxyCfg, cfg)
+	for {
+		conn := proxyCfg.warm.take(time.Now(), cfg.IdleTimeout)
+		if conn == nil {
+			p.prewarmMisses.Add(1)
+			return nil, false, nil
+		}
+		err := socks5Connect(ctx, conn, addr)
+		var refused *connectRefusedError
+		switch {
+		case err == nil:
+			p.prewarmHits.Add(1)
+			return conn, true, nil
+		case errors.As(err, &refused):
+			p.prewarmHits.Add(1)
+			conn.Close()
+			return nil, true, &net.OpError{Op: "socks connect", Net: "tcp", Addr: conn.RemoteAddr(), Err: err}
+		case ctx.Err() != nil:
+			conn.Close()
+			return nil, true, ctx.Err()
+		}
+		// the upstream dropped the idle connection; try the next one
+		conn.Close()
+	}
+}
+
+// PrewarmStats returns how many client dials used a prewarmed connection and
+// how many found none and dialed normally since the pool was created
+func (p *Pool) PrewarmStats() (hits, misses uint64) {
+	return p.prewarmHits.Load(), p.prewarmMisses.Load()
+}
+
+// WarmConnCount returns the number of ready connections kept for proxyCfg
+func (p *Pool) WarmConnCount(proxyCfg *ProxyConfig) int {
+	proxyCfg.warm.mu.Lock()
+	defer proxyCfg.warm.mu.Unlock()
+	return len(proxyCfg.warm.conns)
+}
+
+// connectRefusedError is an upstream's negative reply to a CONNECT. Its message
+// matches golang.org/x/net/proxy so callers map both the same way.
+type connectRefusedError struct {
+	code byte
+}
+
+// socks5ReplyNames are the reply texts of golang.org/x/net/proxy
+var socks5ReplyNames = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (e *connectRefusedError) Error() string {
+	name, ok := socks5ReplyNames[e.code]
+	if !ok {
+		name = "unknown code: " + strconv.Itoa(int(e.code))
+	}
+	return "unknown error " + name
+}
+
+// socks5Authenticate performs the SOCKS5 greeting and, with auth, the
+// username/password subnegotiation. Its errors match golang.org/x/net/proxy,
+// so IsAuthError recognizes rejected credentials.
+func socks5Authenticate(conn net.Conn, auth *px.Auth) error {
+	greeting := []byte{5, 1, 0}
+	if auth != nil {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0:
+		return nil
+	case 2:
+		if auth == nil {
+			break
+		}
+		if len(auth.User) == 0 || len(auth.User) > 255 || len(auth.Password) > 255 {
+			return errors.New("invalid username/password")
+		}
+		req := []byte{1, byte(len(auth.User))}
+		req = append(req, auth.User...)
+		req = append(req, byte(len(auth.Password)))
+		req = append(req, auth.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("username/password authentication failed")
+		}
+		return nil
+	}
+	return errors.New("no acceptable authentication methods")
+}
+
+// socks5Connect sends a CONNECT for addr on an authenticated connection and
+// reads the reply, giving up when ctx is done
+func socks5Connect(ctx context.Context, conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port '%s'", portStr)
+	}
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("FQDN too long")
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = socks5ReadConnectReply(conn, req)
+	if !stop() {
+		// ctx ended during the exchange and poisoned the deadline
+		return errors.Join(ctx.Err(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+// socks5ReadConnectReply writes the CONNECT request req and reads the reply
+func socks5ReadConnectReply(conn net.Conn, req []byte) error {
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != 5 {
+		return fmt.Errorf("unexpected protocol version %d", header[0])
+	}
+	if header[1] != 0 {
+		return &connectRefusedError{code: header[1]}
+	}
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	// bound address and port
+	_, err := io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sequring/chameleon/auth"
+	"github.com/sequring/chameleon/config"
+	"github.com/sequring/chameleon/secrets"
+)
+
+// runSecret implements the secret subcommand: generating a key, encrypting a
+// single value and encrypting the passwords of existing proxies and users files
+func runSecret(args []string) int {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s secret <command> [flags]
+
+Commands:
+  keygen          Print a new random secret key (base64)
+  encrypt         Encrypt a value read from stdin for use in a configuration file
+  encrypt-files   Encrypt the passwords in existing proxies and users files in place
+
+The key is read from %s, or from the file named by %s.
+`, os.Args[0], secrets.KeyEnv, secrets.KeyFileEnv)
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "keygen":
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	case "encrypt":
+		box, ok := requireSecretKey()
+		if !ok {
+			return 1
+		}
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "Failed to read value from stdin: %v\n", err)
+			return 1
+		}
+		encrypted, err := box.Encrypt(strings.TrimRight(value, "\r\n"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(encrypted)
+		return 0
+	case "encrypt-files":
+		return runEncryptFiles(args[1:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown secret command '%s'\n\n", args[0])
+	usage()
+	return 2
+}
+
+// runEncryptFiles rewrites proxies and users files with their passwords encrypted
+func runEncryptFiles(args []string) int {
+	fs := flag.NewFlagSet("secret encrypt-files", flag.ContinueOnError)
+	proxiesPath := fs.String("proxies", "", "Path to the proxy definitions file (plain-text lists are converted to JSON)")
+	usersPath := fs.String("users", "", "Path to the users file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *proxiesPath == "" && *usersPath == "" {
+		fmt.Fprintln(os.Stderr, "Nothing to do: set -proxies and/or -users")
+		return 2
+	}
+	if _, ok := requireSecretKey(); !ok {
+		return 1
+	}
+
+	if *proxiesPath != "" {
+		defs, err := config.ReadDefinitionsFile(*proxiesPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read proxy definitions from '%s': %v\n", *proxiesPath, err)
+			return 1
+		}
+		if err := config.WriteDefinitionsFile(*proxiesPath, defs); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write '%s': %v\n", *proxiesPath, err)
+			return 1
+		}
+		fmt.Printf("Encrypted passwords of %d proxies in %s\n", len(defs), *proxiesPath)
+	}
+	if *usersPath != "" {
+		users, err := auth.LoadUsersFromFile(*usersPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read users from '%s': %v\n", *usersPath, err)
+			return 1
+		}
+		if err := auth.SaveUsersToFile(*usersPath, users); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write '%s': %v\n", *usersPath, err)
+			return 1
+		}
+		fmt.Printf("Encrypted passwords of %d users in %s\n", len(users), *usersPath)
+	}
+	return 0
+}
+
+// requireSecretKey returns the configured secret key, reporting an error if there is none
+func requireSecretKey() (*secrets.Box, bool) {
+	box, err := secrets.Default()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid secret key: %v\n", err)
+		return nil, false
+	}
+	if box == nil {
+		fmt.Fprintf(os.Stderr, "No secret key configured: set %s or %s (generate one with 'secret keygen')\n", secrets.KeyEnv, secrets.KeyFileEnv)
+		return nil, false
+	}
+	return box, true
+}
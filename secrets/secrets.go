@@ -0,0 +1,244 @@
+// Package secrets encrypts credentials stored in configuration files with
+// AES-256-GCM. Encrypted values look like "enc:v1:<base64 nonce+ciphertext>"
+// and are decrypted at load time; plaintext values are still accepted.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefix marks an encrypted value
+const Prefix = "enc:v1:"
+
+// Environment variables holding the key: the base64 key itself, or the path of
+// a file containing it (e.g. a secret mounted by Kubernetes or a KMS agent)
+const (
+	KeyEnv     = "CHAMELEON_SECRET_KEY"
+	KeyFileEnv = "CHAMELEON_SECRET_KEY_FILE"
+)
+
+// KeySize is the length of an AES-256 key in bytes
+const KeySize = 32
+
+// ErrNoKey is returned when an encrypted value is found but no key is configured
+var ErrNoKey = fmt.Errorf("encrypted value found but no secret key is configured (set %s or %s)", KeyEnv, KeyFileEnv)
+
+// ErrPrefixedPlaintext is returned when a plaintext value starting with Prefix
+// is to be written without a configured key. Stored as is, it would be taken
+// for an encrypted value and the file would no longer load.
+var ErrPrefixedPlaintext = fmt.Errorf("value must not start with %q unless a secret key is configured (set %s or %s)", Prefix, KeyEnv, KeyFileEnv)
+
+// Box encrypts and decrypts values with one key
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox creates a Box for a KeySize-byte key
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Encrypt returns plaintext encrypted with a random nonce, prefixed with Prefix
+func (b *Box) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return Prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of an encrypted value. Values without Prefix are
+// returned unchanged.
+func (b *Box) Decrypt(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, Prefix)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	if len(sealed) < b.aead.NonceSize() {
+		return "", errors.New("invalid encrypted value: too short")
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt value: wrong key or corrupted data")
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted reports whether value is an encrypted value
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// GenerateKey returns a new random key, base64 encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseKey decodes a base64 key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("secret key is not valid base64: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+var (
+	defaultOnce sync.Once
+	defaultBox  *Box
+	defaultErr  error
+)
+
+// Default returns the Box for the key configured in the environment, loaded on
+// first use. It returns nil and no error when no key is configured.
+func Default() (*Box, error) {
+	defaultOnce.Do(func() {
+		encoded := os.Getenv(KeyEnv)
+		if path := os.Getenv(KeyFileEnv); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				defaultErr = fmt.Errorf("failed to read %s: %w", KeyFileEnv, err)
+				return
+			}
+			encoded = string(data)
+		}
+		if encoded == "" {
+			return
+		}
+		key, err := ParseKey(encoded)
+		if err != nil {
+			defaultErr = err
+			return
+		}
+		defaultBox, defaultErr = NewBox(key)
+	})
+	return defaultBox, defaultErr
+}
+
+// Decrypt decrypts value with the default key. Plaintext values are returned
+// unchanged; encrypted values fail with ErrNoKey if no key is configured.
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	box, err := Default()
+	if err != nil {
+		return "", err
+	}
+	if box == nil {
+		return "", ErrNoKey
+	}
+	return box.Decrypt(value)
+}
+
+// Encrypt encrypts value with the default key for writing to disk. Empty values
+// are kept empty, and without a configured key value is returned unchanged.
+// Values read from disk are decrypted at load time, so value is plaintext even
+// if it starts with Prefix and is encrypted like any other.
+func Encrypt(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	if err := CheckPlaintext(value); err != nil {
+		return "", err
+	}
+	box, err := Default()
+	if err != nil || box == nil {
+		return value, err
+	}
+	return box.Encrypt(value)
+}
+
+// CheckPlaintext returns ErrPrefixedPlaintext if the plaintext value could not
+// be written to disk by Encrypt, for validating values before they are applied
+func CheckPlaintext(value string) error {
+	if !IsEncrypted(value) {
+		return nil
+	}
+	box, err := Default()
+	if err != nil {
+		return err
+	}
+	if box == nil {
+		return ErrPrefixedPlaintext
+	}
+	return nil
+}
+
+// DecryptFields decrypts each field in place, stopping at the first error
+func DecryptFields(fields ...*string) error {
+	for _, field := range fields {
+		plaintext, err := Decrypt(*field)
+		if err != nil {
+			return err
+		}
+		*field = plaintext
+	}
+	return nil
+}
+
+// ErrValueAndFile is returned when a secret is given both inline and as a file
+var ErrValueAndFile = errors.New("both the value and its file are set")
+
+// ReadFile returns the secret in the file at path, e.g. a Docker or Kubernetes
+// secret mounted under /run/secrets, without trailing line breaks
+func ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// LoadFile sets *value to the secret in the file at path unless path is empty.
+// It fails with ErrValueAndFile if *value is already set.
+func LoadFile(value *string, path string) error {
+	if path == "" {
+		return nil
+	}
+	if *value != "" {
+		return ErrValueAndFile
+	}
+	secret, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	*value = secret
+	return nil
+}
@@ -0,0 +1,155 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestBox returns a Box for a key of repeated b
+func newTestBox(t *testing.T, b byte) *Box {
+	t.Helper()
+	box, err := NewBox([]byte(strings.Repeat(string(b), KeySize)))
+	if err != nil {
+		t.Fatalf("NewBox: %v", err)
+	}
+	return box
+}
+
+// withDefaultBox makes box the Box returned by Default for the rest of the
+// test; nil behaves as if no key were configured
+func withDefaultBox(t *testing.T, box *Box) {
+	defaultOnce = sync.Once{}
+	defaultOnce.Do(func() {})
+	defaultBox, defaultErr = box, nil
+	t.Cleanup(func() {
+		defaultOnce = sync.Once{}
+		defaultBox, defaultErr = nil, nil
+	})
+}
+
+func TestBoxRoundTrip(t *testing.T) {
+	box := newTestBox(t, 'k')
+	for _, plaintext := range []string{"", "secret", "pässwörd ✓", Prefix + "looks encrypted"} {
+		encrypted, err := box.Encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt(%q): %v", plaintext, err)
+		}
+		if !IsEncrypted(encrypted) {
+			t.Errorf("Encrypt(%q) = %q, want the %s prefix", plaintext, encrypted, Prefix)
+		}
+		again, _ := box.Encrypt(plaintext)
+		if again == encrypted {
+			t.Errorf("Encrypt(%q) twice gave the same value, want a fresh nonce", plaintext)
+		}
+		decrypted, err := box.Decrypt(encrypted)
+		if err != nil || decrypted != plaintext {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", plaintext, decrypted, err)
+		}
+	}
+}
+
+func TestBoxRejectsWrongKeyAndCorruptedValues(t *testing.T) {
+	box := newTestBox(t, 'k')
+	encrypted, err := box.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, Prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string { return Prefix + base64.StdEncoding.EncodeToString(b) }
+	garbled := append([]byte(nil), sealed...)
+	garbled[len(garbled)-1] ^= 0xff
+
+	for _, tc := range []struct {
+		name, value, wantErr string
+		box                  *Box
+	}{
+		{"wrong key", encrypted, "wrong key", newTestBox(t, 'o')},
+		{"not base64", Prefix + "!!!", "invalid encrypted value", box},
+		{"shorter than the nonce", encode(sealed[:4]), "too short", box},
+		{"truncated", encode(sealed[:len(sealed)-3]), "wrong key or corrupted data", box},
+		{"garbled", encode(garbled), "wrong key or corrupted data", box},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext, err := tc.box.Decrypt(tc.value)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Decrypt = %q, %v; want an error containing %q", plaintext, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", KeySize)))
+	for _, tc := range []struct {
+		name, encoded, wantErr string
+	}{
+		{"valid", valid, ""},
+		{"surrounding whitespace", " " + valid + "\n", ""},
+		{"too short", base64.StdEncoding.EncodeToString(make([]byte, KeySize-1)), "must be 32 bytes, got 31"},
+		{"too long", base64.StdEncoding.EncodeToString(make([]byte, KeySize+1)), "must be 32 bytes, got 33"},
+		{"not base64", "not a key!", "not valid base64"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := ParseKey(tc.encoded)
+			if tc.wantErr == "" {
+				if err != nil || len(key) != KeySize {
+					t.Fatalf("ParseKey = %d bytes, %v; want a %d byte key", len(key), err, KeySize)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("ParseKey = %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+	if _, err := NewBox(make([]byte, 16)); err == nil {
+		t.Error("NewBox accepted a 16 byte key")
+	}
+}
+
+func TestPlaintextPassthrough(t *testing.T) {
+	withDefaultBox(t, nil)
+	if got, err := Decrypt("secret"); err != nil || got != "secret" {
+		t.Errorf("Decrypt without a key = %q, %v; want the plaintext", got, err)
+	}
+	if got, err := Encrypt("secret"); err != nil || got != "secret" {
+		t.Errorf("Encrypt without a key = %q, %v; want the plaintext", got, err)
+	}
+	if got, err := newTestBox(t, 'k').Decrypt("secret"); err != nil || got != "secret" {
+		t.Errorf("Box.Decrypt of a plaintext = %q, %v; want it unchanged", got, err)
+	}
+	encrypted, _ := newTestBox(t, 'k').Encrypt("secret")
+	if _, err := Decrypt(encrypted); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Decrypt of an encrypted value without a key = %v, want ErrNoKey", err)
+	}
+}
+
+func TestEncryptPrefixedPlaintext(t *testing.T) {
+	const plaintext = Prefix + "not really encrypted"
+
+	withDefaultBox(t, nil)
+	if got, err := Encrypt(plaintext); !errors.Is(err, ErrPrefixedPlaintext) {
+		t.Errorf("Encrypt without a key = %q, %v; want ErrPrefixedPlaintext", got, err)
+	}
+	if err := CheckPlaintext(plaintext); !errors.Is(err, ErrPrefixedPlaintext) {
+		t.Errorf("CheckPlaintext without a key = %v, want ErrPrefixedPlaintext", err)
+	}
+
+	withDefaultBox(t, newTestBox(t, 'k'))
+	if err := CheckPlaintext(plaintext); err != nil {
+		t.Errorf("CheckPlaintext with a key = %v", err)
+	}
+	encrypted, err := Encrypt(plaintext)
+	if err != nil || encrypted == plaintext {
+		t.Fatalf("Encrypt with a key = %q, %v; want the value encrypted", encrypted, err)
+	}
+	if got, err := Decrypt(encrypted); err != nil || got != plaintext {
+		t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", plaintext, got, err)
+	}
+}
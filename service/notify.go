@@ -0,0 +1,105 @@
+// Package service integrates chameleon with process supervisors. Under systemd
+// it implements the sd_notify protocol, so a Type=notify unit is only started
+// once the listeners are serving and a WatchdogSec= unit gets its keep-alive
+// pings. On Windows it runs the process as a service of the Service Control
+// Manager and installs, removes, starts and stops that service.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables systemd sets for the services it supervises
+const (
+	envNotifySocket   = "NOTIFY_SOCKET"
+	envWatchdogUsec   = "WATCHDOG_USEC"
+	envWatchdogPID    = "WATCHDOG_PID"
+	minWatchdogPeriod = 100 * time.Millisecond
+)
+
+// sdNotify sends state to the socket in NOTIFY_SOCKET. Without that variable the
+// process is not supervised by systemd and it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv(envNotifySocket)
+	if socket == "" {
+		return nil
+	}
+	// A leading '@' denotes a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to the notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify the service manager: %w", err)
+	}
+	return nil
+}
+
+// Ready reports that the process is serving. MAINPID is always sent so that a
+// process started by a zero-downtime upgrade becomes the unit's main process
+// (which requires NotifyAccess=all in the unit).
+func Ready() error {
+	reportRunning()
+	return sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()))
+}
+
+// Status publishes a one-line status shown by systemctl status
+func Status(status string) error {
+	return sdNotify("STATUS=" + status)
+}
+
+// Stopping reports that the process began its graceful shutdown
+func Stopping() error {
+	reportStopping()
+	return sdNotify("STOPPING=1")
+}
+
+// watchdogPeriod returns the interval the service manager expects keep-alive
+// pings at, or zero if the watchdog is disabled for this process
+func watchdogPeriod() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(envWatchdogUsec), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// WATCHDOG_PID names the main process the pings are expected from. A
+	// process started by an upgrade inherits its parent's value and takes
+	// over the pings, so the parent's PID is accepted too.
+	if pid, err := strconv.Atoi(os.Getenv(envWatchdogPID)); err == nil && pid != os.Getpid() && pid != os.Getppid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog sends keep-alive pings at half the interval set by WatchdogSec= until
+// ctx is done. It returns immediately if the watchdog is not enabled.
+func Watchdog(ctx context.Context) {
+	period := watchdogPeriod()
+	if period == 0 {
+		return
+	}
+	interval := max(period/2, minWatchdogPeriod)
+	log.Printf("Service: sending watchdog pings every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Service: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
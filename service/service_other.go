@@ -0,0 +1,39 @@
+//go:build !windows
+
+package service
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// errUnsupported is returned by the Windows service commands on other systems
+var errUnsupported = errors.New("Windows services are not supported on this system")
+
+// IsWindowsService is always false outside Windows
+func IsWindowsService() bool { return false }
+
+// Run does nothing outside Windows
+func Run(name string) error { return nil }
+
+// Notify does nothing outside Windows; console signals reach signal.Notify
+func Notify(c chan<- os.Signal) {}
+
+// Exit does nothing outside Windows
+func Exit() {}
+
+func reportRunning()  {}
+func reportStopping() {}
+
+// Install is only supported on Windows
+func Install(name, exe string, args []string) error { return errUnsupported }
+
+// Uninstall is only supported on Windows
+func Uninstall(name string) error { return errUnsupported }
+
+// Start is only supported on Windows
+func Start(name string, timeout time.Duration) error { return errUnsupported }
+
+// Stop is only supported on Windows
+func Stop(name string, timeout time.Duration) error { return errUnsupported }
@@ -0,0 +1,261 @@
+//go:build windows
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// exitTimeout bounds how long Exit waits for the Service Control Manager to
+// acknowledge that the service stopped
+const exitTimeout = 5 * time.Second
+
+// handler relays the state of the process to the Service Control Manager and
+// its stop requests to the process
+type handler struct {
+	mu            sync.Mutex
+	changes       chan<- svc.Status // nil until Execute runs
+	state         svc.State
+	signals       chan<- os.Signal // registered by Notify
+	stopRequested bool             // a stop arrived before Notify
+	exit          chan struct{}    // closed by Exit
+	done          chan struct{}    // closed when Execute returned
+}
+
+var current *handler
+
+// IsWindowsService reports whether the process was started by the Service
+// Control Manager
+func IsWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// Run connects the process to the Service Control Manager if it was started as
+// a service; otherwise it does nothing. The service reports start pending
+// until Ready is called.
+func Run(name string) error {
+	if !IsWindowsService() {
+		return nil
+	}
+	h := &handler{state: svc.StartPending, exit: make(chan struct{}), done: make(chan struct{})}
+	current = h
+	go func() {
+		defer close(h.done)
+		if err := svc.Run(name, h); err != nil {
+			log.Printf("Service: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Notify delivers stop and shutdown requests of the Service Control Manager to
+// c as SIGTERM, like signal.Notify does for console signals
+func Notify(c chan<- os.Signal) {
+	h := current
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.signals = c
+	if h.stopRequested {
+		h.deliverLocked()
+	}
+}
+
+// Exit reports the service as stopped. It is called right before the process
+// exits so the Service Control Manager does not see a crash.
+func Exit() {
+	h := current
+	if h == nil {
+		return
+	}
+	h.setState(svc.StopPending)
+	close(h.exit)
+	select {
+	case <-h.done:
+	case <-time.After(exitTimeout):
+	}
+}
+
+func reportRunning() {
+	if current != nil {
+		current.setState(svc.Running)
+	}
+}
+
+func reportStopping() {
+	if current != nil {
+		current.setState(svc.StopPending)
+	}
+}
+
+// setState records state and reports it if Execute is running
+func (h *handler) setState(state svc.State) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = state
+	h.reportLocked()
+}
+
+func (h *handler) reportLocked() {
+	if h.changes == nil {
+		return
+	}
+	status := svc.Status{State: h.state}
+	if h.state == svc.Running {
+		status.Accepts = svc.AcceptStop | svc.AcceptShutdown
+	}
+	h.changes <- status
+}
+
+// deliverLocked passes a stop request on to the registered channel
+func (h *handler) deliverLocked() {
+	select {
+	case h.signals <- syscall.SIGTERM:
+	default:
+	}
+	h.stopRequested = false
+}
+
+// Execute implements svc.Handler
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	h.mu.Lock()
+	h.changes = changes
+	h.reportLocked()
+	h.mu.Unlock()
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				h.mu.Lock()
+				h.reportLocked()
+				h.mu.Unlock()
+			case svc.Stop, svc.Shutdown:
+				h.mu.Lock()
+				h.state = svc.StopPending
+				h.reportLocked()
+				h.stopRequested = true
+				if h.signals != nil {
+					h.deliverLocked()
+				}
+				h.mu.Unlock()
+			}
+		case <-h.exit:
+			h.mu.Lock()
+			h.changes = nil
+			h.mu.Unlock()
+			return false, 0
+		}
+	}
+}
+
+// Install registers exe, started with args, as the automatically started
+// service name
+func Install(name, exe string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service '%s' already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "Chameleon SOCKS5 proxy",
+		Description: "SOCKS5 server relaying through a pool of upstream proxies",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service '%s': %w", name, err)
+	}
+	defer s.Close()
+	return nil
+}
+
+// Uninstall removes the service name
+func Uninstall(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service '%s' is not installed: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to remove service '%s': %w", name, err)
+	}
+	return nil
+}
+
+// Start starts the service name and waits up to timeout for it to run
+func Start(name string, timeout time.Duration) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service '%s' is not installed: %w", name, err)
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service '%s': %w", name, err)
+	}
+	return waitState(s, svc.Running, timeout)
+}
+
+// Stop stops the service name and waits up to timeout for it to exit
+func Stop(name string, timeout time.Duration) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service '%s' is not installed: %w", name, err)
+	}
+	defer s.Close()
+	if _, err := s.Control(svc.Stop); err != nil {
+		return fmt.Errorf("failed to stop service '%s': %w", name, err)
+	}
+	return waitState(s, svc.Stopped, timeout)
+}
+
+// waitState polls s until it reaches want or timeout expires
+func waitState(s *mgr.Service, want svc.State, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return fmt.Errorf("failed to query service state: %w", err)
+		}
+		if status.State == want {
+			return nil
+		}
+		if status.State == svc.Stopped {
+			return errors.New("service stopped")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service did not reach the expected state within %v", timeout)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sequring/chameleon/service"
+)
+
+// defaultServiceName is the name chameleon registers with the Windows Service
+// Control Manager
+const defaultServiceName = "chameleon"
+
+// serviceControlTimeout bounds how long service start and stop wait for the
+// service to change state
+const serviceControlTimeout = 30 * time.Second
+
+// runService implements the service subcommand, which manages chameleon as a
+// Windows service
+func runService(args []string) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	name := fs.String("name", defaultServiceName, "Name of the Windows service")
+	configPath := fs.String("config", "config.yml", "Path to the configuration file the service runs with (install only)")
+	strictConfig := fs.Bool("strict", false, "Run the service with -strict (install only)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: %s service [flags] <command>
+
+Commands:
+  install    Register chameleon as an automatically started Windows service
+  uninstall  Remove the Windows service
+  start      Start the Windows service and wait until it is serving
+  stop       Stop the Windows service and wait until it exited
+
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	switch fs.Arg(0) {
+	case "install":
+		err = installService(*name, *configPath, *strictConfig)
+	case "uninstall":
+		err = service.Uninstall(*name)
+	case "start":
+		err = service.Start(*name, serviceControlTimeout)
+	case "stop":
+		err = service.Stop(*name, serviceControlTimeout)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// installService registers this executable as the service name. Services start
+// in the system directory, so the configuration path is made absolute.
+func installService(name, configPath string, strict bool) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the executable: %w", err)
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the configuration path: %w", err)
+	}
+	args := []string{"-config", absConfig}
+	if strict {
+		args = append(args, "-strict")
+	}
+	if err := service.Install(name, exe, args); err != nil {
+		return err
+	}
+	fmt.Printf("Installed service '%s' running %s %v\n", name, exe, args)
+	return nil
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session ID is not in the registry
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is an active relayed SOCKS connection
+type Session struct {
+	ID          string
+	Username    string
+	ClientAddr  string
+	Destination string
+	Upstream    string
+	StartedAt   time.Time
+
+	bytesUp   atomic.Uint64 // client -> destination
+	bytesDown atomic.Uint64 // destination -> client
+	// lastActivity is when bytes last moved in either direction (unix nanoseconds)
+	lastActivity atomic.Int64
+
+	client   net.Conn
+	upstream net.Conn
+	closeOne sync.Once
+}
+
+// New creates a session for the given connection pair. It is not registered until Registry.Add is called.
+func New(id, username string, client, upstream net.Conn, destination, upstreamAddr string) *Session {
+	clientAddr := ""
+	if client != nil && client.RemoteAddr() != nil {
+		clientAddr = client.RemoteAddr().String()
+	}
+	s := &Session{
+		ID:          id,
+		Username:    username,
+		ClientAddr:  clientAddr,
+		Destination: destination,
+		Upstream:    upstreamAddr,
+		StartedAt:   time.Now(),
+		client:      client,
+		upstream:    upstream,
+	}
+	s.lastActivity.Store(s.StartedAt.UnixNano())
+	return s
+}
+
+// AddBytesUp records bytes sent from the client towards the destination
+func (s *Session) AddBytesUp(n int) {
+	s.bytesUp.Add(uint64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// AddBytesDown records bytes sent from the destination back to the client
+func (s *Session) AddBytesDown(n int) {
+	s.bytesDown.Add(uint64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LastActivity returns when bytes last moved in either direction, or the start time if none have
+func (s *Session) LastActivity() time.Time { return time.Unix(0, s.lastActivity.Load()) }
+
+// BytesUp returns bytes sent from the client towards the destination
+func (s *Session) BytesUp() uint64 { return s.bytesUp.Load() }
+
+// BytesDown returns bytes sent from the destination back to the client
+func (s *Session) BytesDown() uint64 { return s.bytesDown.Load() }
+
+// Close terminates the session by closing both connection ends
+func (s *Session) Close() {
+	s.closeOne.Do(func() {
+		if s.client != nil {
+			s.client.Close()
+		}
+		if s.upstream != nil {
+			s.upstream.Close()
+		}
+	})
+}
+
+// Info is a point-in-time, JSON-friendly copy of a session
+type Info struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	ClientAddr   string    `json:"client_addr"`
+	Destination  string    `json:"destination"`
+	Upstream     string    `json:"upstream"`
+	BytesUp      uint64    `json:"bytes_up"`
+	BytesDown    uint64    `json:"bytes_down"`
+	StartedAt    time.Time `json:"started_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Info returns a snapshot of the session
+func (s *Session) Info() Info {
+	return Info{
+		ID:           s.ID,
+		Username:     s.Username,
+		ClientAddr:   s.ClientAddr,
+		Destination:  s.Destination,
+		Upstream:     s.Upstream,
+		BytesUp:      s.BytesUp(),
+		BytesDown:    s.BytesDown(),
+		StartedAt:    s.StartedAt,
+		LastActivity: s.LastActivity(),
+	}
+}
+
+// Registry tracks all active sessions
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+// NewRegistry creates an empty session registry
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Add registers an active session
+func (r *Registry) Add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.ID] = s
+}
+
+// Remove unregisters a session once it has finished
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// Get returns the session with the given ID
+func (r *Registry) Get(id string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// Count returns the number of active sessions
+func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// CountUser returns the number of active sessions of username
+func (r *Registry) CountUser(username string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, s := range r.sessions {
+		if s.Username == username {
+			n++
+		}
+	}
+	return n
+}
+
+// List returns snapshots of all active sessions, oldest first
+func (r *Registry) List() []Info {
+	r.mu.RLock()
+	infos := make([]Info, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.Info())
+	}
+	r.mu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos
+}
+
+// Kill forcibly terminates the session with the given ID, closing both connection ends
+func (r *Registry) Kill(id string) error {
+	s, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	s.Close()
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatsSignal relays SIGUSR1, which dumps a stats snapshot, to c
+func notifyStatsSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyUpgradeSignal relays SIGUSR2, which starts a zero-downtime upgrade, to c
+func notifyUpgradeSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
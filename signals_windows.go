@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// notifyStatsSignal does nothing: Windows has no SIGUSR1
+func notifyStatsSignal(c chan<- os.Signal) {}
+
+// notifyUpgradeSignal does nothing: Windows has no SIGUSR2
+func notifyUpgradeSignal(c chan<- os.Signal) {}
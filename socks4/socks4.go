@@ -0,0 +1,283 @@
+// Package socks4 serves SOCKS4 and SOCKS4a CONNECT requests for legacy clients
+// that cannot speak SOCKS5. SOCKS4 has no authentication: clients are admitted
+// by source address and run as a configured pseudo-user, chosen by the USERID
+// field of the request.
+package socks4
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Version is the protocol version byte of SOCKS4 requests
+const Version = 4
+
+// Commands
+const (
+	CommandConnect = 1
+	CommandBind    = 2
+)
+
+// Reply codes
+const (
+	RepGranted  = 90
+	RepRejected = 91
+)
+
+// maxFieldLen bounds the USERID and hostname fields, which are NUL-terminated
+const maxFieldLen = 255
+
+var (
+	// ErrNotSocks4 is returned by ReadRequest when the request is not SOCKS4
+	ErrNotSocks4 = errors.New("not a SOCKS4 request")
+	// ErrFieldTooLong is returned when the USERID or hostname exceeds 255 bytes
+	ErrFieldTooLong = errors.New("SOCKS4 request field too long")
+)
+
+// Request is a SOCKS4 or SOCKS4a request
+type Request struct {
+	Command byte
+	Port    uint16
+	IP      net.IP
+	UserID  string
+	// Host is the destination domain of a SOCKS4a request; empty for SOCKS4
+	Host string
+	// Username is the SOCKS user the request is served as, set by Server
+	Username string
+}
+
+// DestAddr returns the "host:port" destination of the request
+func (r *Request) DestAddr() string {
+	host := r.Host
+	if host == "" {
+		host = r.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+}
+
+// ReadRequest reads a SOCKS4 or SOCKS4a request, including its version byte
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read SOCKS4 request: %w", err)
+	}
+	if header[0] != Version {
+		return nil, ErrNotSocks4
+	}
+	req := &Request{
+		Command: header[1],
+		Port:    binary.BigEndian.Uint16(header[2:4]),
+		IP:      net.IPv4(header[4], header[5], header[6], header[7]).To4(),
+	}
+	userID, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	req.UserID = userID
+	// SOCKS4a: an IP of 0.0.0.x with x != 0 means a hostname follows
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		host, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			return nil, errors.New("SOCKS4a request without hostname")
+		}
+		req.Host = host
+	}
+	return req, nil
+}
+
+// readString reads a NUL-terminated field
+func readString(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("failed to read SOCKS4 request: %w", err)
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) == maxFieldLen {
+			return "", ErrFieldTooLong
+		}
+		buf = append(buf, b)
+	}
+}
+
+// SendReply writes a reply with code. bind is reported only if it is an IPv4 TCP address.
+func SendReply(w io.Writer, code byte, bind net.Addr) error {
+	reply := [8]byte{0, code}
+	if tcp, ok := bind.(*net.TCPAddr); ok {
+		if ip4 := tcp.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(tcp.Port))
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := w.Write(reply[:])
+	return err
+}
+
+// Handler serves an admitted CONNECT request of conn. reader yields what the
+// client sends after the request and must be used instead of reading conn.
+// The handler sends the reply.
+type Handler func(ctx context.Context, conn net.Conn, reader io.Reader, req *Request) error
+
+// Config configures which SOCKS4 clients are admitted and as which user
+type Config struct {
+	// AllowedCIDRs lists the client networks admitted
+	AllowedCIDRs []string
+	// User is the pseudo-user of requests whose USERID is not in UserMap
+	User string
+	// UserMap maps the USERID of a request to the pseudo-user it is served as
+	UserMap map[string]string
+}
+
+// Server admits SOCKS4 clients and passes their CONNECT requests to a Handler
+type Server struct {
+	handler Handler
+	allowed []netip.Prefix
+	user    string
+	userMap map[string]string
+	admit   func(username, addr string, sourceAllowed bool) bool
+	ctx     context.Context
+}
+
+// New creates a Server passing admitted requests to handler
+func New(cfg Config, handler Handler) (*Server, error) {
+	s := &Server{handler: handler, user: cfg.User, userMap: cfg.UserMap, ctx: context.Background()}
+	for _, cidr := range cfg.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+		}
+		s.allowed = append(s.allowed, prefix.Masked())
+	}
+	return s, nil
+}
+
+// SetAdmit sets the final admission check of requests. It is called with the
+// user a request maps to, the client address and whether that address is in
+// AllowedCIDRs, and may reject users that are unknown or disabled. Without it
+// every client from AllowedCIDRs is admitted.
+func (s *Server) SetAdmit(admit func(username, addr string, sourceAllowed bool) bool) {
+	s.admit = admit
+}
+
+// SetContext sets the context requests are handled with. Cancelling it, on
+// shutdown, ends what waits on it, like connection limits and tarpits.
+func (s *Server) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+// Serve accepts connections on l and dispatches each by its first byte: SOCKS4
+// requests are served by s, everything else is passed to next (the SOCKS5
+// server). It returns when l is closed.
+func (s *Server) Serve(l net.Listener, next func(net.Conn) error) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			reader := bufio.NewReader(conn)
+			first, err := reader.Peek(1)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if first[0] == Version {
+				if err := s.ServeConn(conn, reader); err != nil {
+					log.Printf("SOCKS4 client %s: %v", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			// the SOCKS5 server reports its errors itself
+			_ = next(&peekedConn{Conn: conn, reader: reader})
+		}()
+	}
+}
+
+// ServeConn serves a SOCKS4 request from conn, read through reader, and closes conn
+func (s *Server) ServeConn(conn net.Conn, reader *bufio.Reader) error {
+	defer conn.Close()
+	req, err := ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	if req.Command != CommandConnect {
+		SendReply(conn, RepRejected, nil)
+		return fmt.Errorf("unsupported command %d", req.Command)
+	}
+	username := s.userFor(req.UserID)
+	ok := s.sourceAllowed(conn.RemoteAddr())
+	if s.admit != nil {
+		ok = s.admit(username, conn.RemoteAddr().String(), ok)
+	} else {
+		ok = ok && username != ""
+	}
+	if !ok {
+		SendReply(conn, RepRejected, nil)
+		return fmt.Errorf("rejected request of user '%s' for %s", username, req.DestAddr())
+	}
+	req.Username = username
+	return s.handler(s.ctx, conn, reader, req)
+}
+
+// userFor returns the user a request with userID is served as
+func (s *Server) userFor(userID string) string {
+	if username, ok := s.userMap[userID]; ok {
+		return username
+	}
+	return s.user
+}
+
+// sourceAllowed reports whether addr is in one of the allowed networks
+func (s *Server) sourceAllowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, _ := netip.AddrFromSlice(tcp.IP)
+	ip = ip.Unmap()
+	for _, prefix := range s.allowed {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peekedConn is a connection whose first bytes were buffered by reader
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NetConn returns the underlying connection
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite half-closes the connection if the underlying one supports it, so
+// relays can signal the end of the upload
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
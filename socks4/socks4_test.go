@@ -0,0 +1,229 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request encodes a SOCKS4 request; host makes it a SOCKS4a one
+func request(command byte, ip net.IP, port uint16, userID, host string) []byte {
+	b := []byte{Version, command, byte(port >> 8), byte(port)}
+	b = append(b, ip.To4()...)
+	b = append(b, userID...)
+	b = append(b, 0)
+	if host != "" {
+		b = append(b, host...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestReadRequest(t *testing.T) {
+	long := strings.Repeat("a", maxFieldLen)
+	socks4a := net.IPv4(0, 0, 0, 1)
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		wantDest string
+		wantUser string
+		wantErr  error
+	}{
+		{"SOCKS4", request(CommandConnect, net.IPv4(1, 2, 3, 4), 80, "alice", ""), "1.2.3.4:80", "alice", nil},
+		{"SOCKS4a hostname", request(CommandConnect, socks4a, 443, "", "example.com"), "example.com:443", "", nil},
+		{"0.0.0.0 is not SOCKS4a", request(CommandConnect, net.IPv4(0, 0, 0, 0), 80, "", ""), "0.0.0.0:80", "", nil},
+		{"255 byte fields", request(CommandConnect, socks4a, 80, long, long), net.JoinHostPort(long, "80"), long, nil},
+		{"USERID too long", request(CommandConnect, net.IPv4(1, 2, 3, 4), 80, long+"a", ""), "", "", ErrFieldTooLong},
+		{"hostname too long", request(CommandConnect, socks4a, 80, "", long+"a"), "", "", ErrFieldTooLong},
+		{"SOCKS5", []byte{5, 1, 0, 0, 0, 0, 0, 0}, "", "", ErrNotSocks4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := ReadRequest(bufio.NewReader(bytes.NewReader(tc.data)))
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("ReadRequest = %+v, %v; want %v", req, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadRequest: %v", err)
+			}
+			if req.DestAddr() != tc.wantDest || req.UserID != tc.wantUser {
+				t.Fatalf("ReadRequest = %s as '%s', want %s as '%s'", req.DestAddr(), req.UserID, tc.wantDest, tc.wantUser)
+			}
+		})
+	}
+
+	if _, err := ReadRequest(bufio.NewReader(bytes.NewReader(request(CommandConnect, socks4a, 80, "", "")))); err == nil {
+		t.Error("ReadRequest accepted a SOCKS4a request without hostname")
+	}
+}
+
+// contextKey marks the context a Server is given
+type contextKey struct{}
+
+// startServer serves s on a local listener and returns its address and the
+// requests passed to its handler, which grants them
+func startServer(t *testing.T, cfg Config, admit func(username, addr string, sourceAllowed bool) bool, next func(net.Conn) error) (string, <-chan *Request) {
+	t.Helper()
+	handled := make(chan *Request, 1)
+	s, err := New(cfg, func(ctx context.Context, conn net.Conn, reader io.Reader, req *Request) error {
+		if ctx.Value(contextKey{}) == nil {
+			t.Error("handler called without the server context")
+		}
+		handled <- req
+		return SendReply(conn, RepGranted, nil)
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if admit != nil {
+		s.SetAdmit(admit)
+	}
+	s.SetContext(context.WithValue(context.Background(), contextKey{}, true))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	if next == nil {
+		next = func(conn net.Conn) error {
+			t.Error("SOCKS4 request passed to the SOCKS5 server")
+			return conn.Close()
+		}
+	}
+	go s.Serve(l, next)
+	return l.Addr().String(), handled
+}
+
+// exchange sends data to addr and returns the reply code
+func exchange(t *testing.T, addr string, data []byte) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	var reply [8]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestServeConn(t *testing.T) {
+	local := []string{"127.0.0.0/8"}
+	connect := func(userID string) []byte {
+		return request(CommandConnect, net.IPv4(1, 2, 3, 4), 80, userID, "")
+	}
+	for _, tc := range []struct {
+		name      string
+		cfg       Config
+		admit     func(username, addr string, sourceAllowed bool) bool
+		data      []byte
+		wantReply byte
+		wantUser  string
+	}{
+		{
+			name:      "default user",
+			cfg:       Config{AllowedCIDRs: local, User: "legacy"},
+			data:      connect("anything"),
+			wantReply: RepGranted,
+			wantUser:  "legacy",
+		},
+		{
+			name:      "mapped USERID",
+			cfg:       Config{AllowedCIDRs: local, User: "legacy", UserMap: map[string]string{"cam": "cameras"}},
+			data:      connect("cam"),
+			wantReply: RepGranted,
+			wantUser:  "cameras",
+		},
+		{
+			name:      "unmapped USERID without default user",
+			cfg:       Config{AllowedCIDRs: local, UserMap: map[string]string{"cam": "cameras"}},
+			data:      connect("printer"),
+			wantReply: RepRejected,
+		},
+		{
+			name:      "source outside the allowed networks",
+			cfg:       Config{AllowedCIDRs: []string{"10.0.0.0/8"}, User: "legacy"},
+			data:      connect(""),
+			wantReply: RepRejected,
+		},
+		{
+			name:      "user rejected by admit",
+			cfg:       Config{AllowedCIDRs: local, UserMap: map[string]string{"cam": "cameras"}},
+			admit:     func(username, addr string, sourceAllowed bool) bool { return sourceAllowed && username != "cameras" },
+			data:      connect("cam"),
+			wantReply: RepRejected,
+		},
+		{
+			name:      "BIND",
+			cfg:       Config{AllowedCIDRs: local, User: "legacy"},
+			data:      request(CommandBind, net.IPv4(1, 2, 3, 4), 80, "", ""),
+			wantReply: RepRejected,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, handled := startServer(t, tc.cfg, tc.admit, nil)
+			if reply := exchange(t, addr, tc.data); reply != tc.wantReply {
+				t.Fatalf("reply = %d, want %d", reply, tc.wantReply)
+			}
+			if tc.wantReply != RepGranted {
+				select {
+				case req := <-handled:
+					t.Fatalf("rejected request %+v passed to the handler", req)
+				default:
+				}
+				return
+			}
+			if req := <-handled; req.Username != tc.wantUser {
+				t.Fatalf("request served as '%s', want '%s'", req.Username, tc.wantUser)
+			}
+		})
+	}
+}
+
+func TestServePassesOtherProtocolsOn(t *testing.T) {
+	greeting := []byte{5, 1, 0}
+	received := make(chan []byte, 1)
+	addr, _ := startServer(t, Config{AllowedCIDRs: []string{"127.0.0.0/8"}, User: "legacy"}, nil, func(conn net.Conn) error {
+		defer conn.Close()
+		buf := make([]byte, len(greeting))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Errorf("reading the SOCKS5 greeting: %v", err)
+		}
+		if _, ok := conn.(*peekedConn); !ok {
+			t.Errorf("next got a %T, want a *peekedConn", conn)
+		}
+		received <- buf
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(greeting); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, greeting) {
+			t.Fatalf("SOCKS5 server read %v, want %v", got, greeting)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not passed to the SOCKS5 server")
+	}
+}
@@ -0,0 +1,206 @@
+// Package tap mirrors metadata and, optionally, the first bytes of selected
+// SOCKS sessions to a JSON lines file for debugging protocol issues through
+// specific upstreams.
+package tap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sequring/chameleon/session"
+)
+
+// Direction of captured traffic
+const (
+	DirectionUp   = "up"   // client -> destination
+	DirectionDown = "down" // destination -> client
+)
+
+// Filter selects the sessions to tap. A session matches if its username is in
+// Users or its destination matches one of Destinations. Destination patterns
+// use path.Match syntax and are matched against both "host:port" and "host".
+type Filter struct {
+	Users        []string
+	Destinations []string
+}
+
+// Validate checks that the filter selects something and its patterns are well formed
+func (f Filter) Validate() error {
+	if len(f.Users) == 0 && len(f.Destinations) == 0 {
+		return fmt.Errorf("filter must list at least one user or destination")
+	}
+	for _, pattern := range f.Destinations {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid destination pattern '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Record is one line of the tap file
+type Record struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"` // "open", "data" or "close"
+	SessionID   string    `json:"session_id"`
+	Username    string    `json:"username,omitempty"`
+	ClientAddr  string    `json:"client_addr,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Upstream    string    `json:"upstream,omitempty"`
+	Direction   string    `json:"direction,omitempty"`
+	Offset      int       `json:"offset,omitempty"`
+	Data        []byte    `json:"data,omitempty"` // base64 in JSON
+	BytesUp     uint64    `json:"bytes_up,omitempty"`
+	BytesDown   uint64    `json:"bytes_down,omitempty"`
+	DurationMs  int64     `json:"duration_ms,omitempty"`
+}
+
+// Tap writes records for sessions matching its filter
+type Tap struct {
+	filter       Filter
+	users        map[string]struct{}
+	captureBytes int
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+// Open creates a tap appending to the file at filePath. captureBytes is how many
+// bytes to capture per direction of each tapped session; 0 records metadata only.
+func Open(filePath string, filter Filter, captureBytes int) (*Tap, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tap file: %w", err)
+	}
+	users := make(map[string]struct{}, len(filter.Users))
+	for _, u := range filter.Users {
+		users[u] = struct{}{}
+	}
+	return &Tap{
+		filter:       filter,
+		users:        users,
+		captureBytes: captureBytes,
+		out:          f,
+		enc:          json.NewEncoder(f),
+	}, nil
+}
+
+// Match reports whether a session of username to destination should be tapped.
+// A nil tap matches nothing.
+func (t *Tap) Match(username, destination string) bool {
+	if t == nil {
+		return false
+	}
+	if _, ok := t.users[username]; ok && username != "" {
+		return true
+	}
+	host := destination
+	if h, _, err := net.SplitHostPort(destination); err == nil {
+		host = h
+	}
+	for _, pattern := range t.filter.Destinations {
+		if ok, _ := path.Match(pattern, destination); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Start writes the open record for s and returns a recorder for its traffic
+func (t *Tap) Start(s session.Info) *Recorder {
+	t.write(Record{
+		Event:       "open",
+		SessionID:   s.ID,
+		Username:    s.Username,
+		ClientAddr:  s.ClientAddr,
+		Destination: s.Destination,
+		Upstream:    s.Upstream,
+	})
+	return &Recorder{tap: t, sessionID: s.ID, startedAt: s.StartedAt}
+}
+
+// Close closes the tap file
+func (t *Tap) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.out.Close()
+}
+
+func (t *Tap) write(r Record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(r); err != nil {
+		log.Printf("Tap: failed to write record for session %s: %v", r.SessionID, err)
+	}
+}
+
+// Recorder captures the traffic of one tapped session
+type Recorder struct {
+	tap       *Tap
+	sessionID string
+	startedAt time.Time
+	closed    atomic.Bool
+}
+
+// Reader wraps src so that the first bytes read from it are recorded for direction
+func (r *Recorder) Reader(direction string, src io.Reader) io.Reader {
+	if r.tap.captureBytes <= 0 {
+		return src
+	}
+	return &captureReader{rec: r, direction: direction, src: src}
+}
+
+// Close writes the close record with the session's final byte counts
+func (r *Recorder) Close(s session.Info) {
+	if !r.closed.CompareAndSwap(false, true) {
+		return
+	}
+	r.tap.write(Record{
+		Event:      "close",
+		SessionID:  r.sessionID,
+		BytesUp:    s.BytesUp,
+		BytesDown:  s.BytesDown,
+		DurationMs: time.Since(r.startedAt).Milliseconds(),
+	})
+}
+
+// captureReader records up to the tap's capture budget of the bytes read through it
+type captureReader struct {
+	rec       *Recorder
+	direction string
+	src       io.Reader
+	offset    int
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.src.Read(p)
+	if remaining := c.rec.tap.captureBytes - c.offset; n > 0 && remaining > 0 && !c.rec.closed.Load() {
+		chunk := p[:min(n, remaining)]
+		c.rec.tap.write(Record{
+			Event:     "data",
+			SessionID: c.rec.sessionID,
+			Direction: c.direction,
+			Offset:    c.offset,
+			Data:      append([]byte(nil), chunk...),
+		})
+		c.offset += len(chunk)
+	}
+	return n, err
+}
@@ -0,0 +1,120 @@
+// Package telemetry exports OpenTelemetry traces of SOCKS requests and proxy
+// health checks via OTLP. Until Setup is called the global tracer provider is
+// a no-op, so instrumented code costs next to nothing when tracing is disabled.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracer used by all chameleon packages
+const InstrumentationName = "github.com/sequring/chameleon"
+
+// OTLP transports (Config.Protocol)
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+// Config configures the OTLP trace exporter
+type Config struct {
+	// Endpoint is the collector's host:port
+	Endpoint string
+	// Protocol is ProtocolGRPC or ProtocolHTTP
+	Protocol string
+	// Insecure disables TLS towards the collector
+	Insecure bool
+	// Headers are sent with every export request, e.g. for collector authentication
+	Headers map[string]string
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string
+	// ServiceVersion is reported as the service.version resource attribute
+	ServiceVersion string
+	// SampleRatio is the fraction of new traces that are recorded (0..1)
+	SampleRatio float64
+}
+
+// Tracer returns the tracer used to instrument chameleon
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Setup installs a global tracer provider exporting spans to cfg.Endpoint. The
+// returned function flushes pending spans and stops the exporter.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	var client otlptrace.Client
+	switch cfg.Protocol {
+	case ProtocolGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint), otlptracegrpc.WithHeaders(cfg.Headers)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	case ProtocolHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint), otlptracehttp.WithHeaders(cfg.Headers)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol '%s', expected '%s' or '%s'", cfg.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+		attribute.String("service.version", cfg.ServiceVersion),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// LogSuffix returns " trace_id=<id>" for the span in ctx, or "" if ctx carries
+// no sampled span, so log lines can be correlated with traces
+func LogSuffix(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return ""
+	}
+	return " trace_id=" + sc.TraceID().String()
+}
+
+// RecordError marks span as failed with err. A nil err is ignored.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// EndSpan records err (if any) on span and ends it
+func EndSpan(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}
@@ -0,0 +1,80 @@
+package upgrade
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables systemd sets for socket-activated services
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	// listenFDsStart is the first descriptor passed by systemd
+	listenFDsStart = 3
+)
+
+// activatedListener is a listening socket passed in by systemd
+type activatedListener struct {
+	name string // FileDescriptorName= of the socket unit
+	l    net.Listener
+}
+
+// adoptActivated takes over the listening sockets systemd passed to this
+// process. Sockets that are not stream listeners are closed and skipped.
+func adoptActivated() []activatedListener {
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	count, countErr := strconv.Atoi(os.Getenv(envListenFDs))
+	var names []string
+	if v := os.Getenv(envListenFDNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+	// the variables must not leak into processes started later, e.g. by Upgrade
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+	if err != nil || countErr != nil || pid != os.Getpid() || count <= 0 {
+		return nil
+	}
+
+	var activated []activatedListener
+	for i := range count {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Socket activation: ignoring descriptor %d (%s): %v", listenFDsStart+i, name, err)
+			continue
+		}
+		log.Printf("Socket activation: received %s listener %s (%s)", l.Addr().Network(), l.Addr(), name)
+		activated = append(activated, activatedListener{name: name, l: l})
+	}
+	return activated
+}
+
+// matchesAddr reports whether the socket bound to actual serves the configured
+// addr: same port, and the same IP unless both are wildcard addresses
+func matchesAddr(network, addr string, actual net.Addr) bool {
+	if network != actual.Network() {
+		return false
+	}
+	tcpAddr, ok := actual.(*net.TCPAddr)
+	if !ok {
+		return addr == actual.String()
+	}
+	want, err := net.ResolveTCPAddr(network, addr)
+	if err != nil || want.Port != tcpAddr.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return tcpAddr.IP.IsUnspecified()
+	}
+	return want.IP.Equal(tcpAddr.IP)
+}
@@ -0,0 +1,289 @@
+// Package upgrade replaces the running chameleon binary without dropping
+// connections. On Upgrade the process starts a copy of its (possibly new)
+// executable and hands over its listening sockets as inherited file
+// descriptors. The new process serves on the same sockets, reports readiness
+// through a pipe, and the old process stops accepting and drains its sessions.
+//
+// Listeners can also come from systemd socket activation (LISTEN_FDS): Listen
+// adopts a passed socket bound to the requested address instead of binding one,
+// so privileged ports need no root and systemd keeps them open across restarts.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables used to pass state to the new process
+const (
+	// envListeners lists the inherited listeners as "network:addr=fd" pairs separated by ","
+	envListeners = "CHAMELEON_UPGRADE_LISTENERS"
+	// envReadyFD is the descriptor the new process writes to once it is serving
+	envReadyFD = "CHAMELEON_UPGRADE_READY_FD"
+)
+
+// DefaultReadyTimeout bounds how long Upgrade waits for the new process
+const DefaultReadyTimeout = 60 * time.Second
+
+// ErrUpgradeInProgress is returned by Upgrade while another upgrade is running
+var ErrUpgradeInProgress = errors.New("an upgrade is already in progress")
+
+// filer is implemented by listeners whose socket can be handed over
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrader tracks the listeners of the process so they can be passed on
+type Upgrader struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File     // listeners handed over by the parent, by key
+	activated []activatedListener     // listeners passed by systemd and not adopted yet
+	listeners map[string]net.Listener // listeners opened or adopted by this process, by key
+	readyFile *os.File                // pipe to the parent; nil if not started by Upgrade
+	upgrading bool
+}
+
+var (
+	defaultOnce     sync.Once
+	defaultUpgrader *Upgrader
+)
+
+// Default returns the process-wide Upgrader, initialized from the environment
+func Default() *Upgrader {
+	defaultOnce.Do(func() {
+		defaultUpgrader = newFromEnv()
+	})
+	return defaultUpgrader
+}
+
+// Listen is Default().Listen
+func Listen(network, addr string) (net.Listener, error) {
+	return Default().Listen(network, addr)
+}
+
+// newFromEnv adopts the descriptors a parent process passed down, if any
+func newFromEnv() *Upgrader {
+	u := &Upgrader{
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]net.Listener),
+		activated: adoptActivated(),
+	}
+	if spec := os.Getenv(envListeners); spec != "" {
+		for _, entry := range strings.Split(spec, ",") {
+			key, fdStr, ok := strings.Cut(entry, "=")
+			fd, err := strconv.Atoi(fdStr)
+			if !ok || err != nil {
+				log.Printf("Upgrade: ignoring malformed inherited listener '%s'", entry)
+				continue
+			}
+			u.inherited[key] = os.NewFile(uintptr(fd), key)
+		}
+	}
+	if fdStr := os.Getenv(envReadyFD); fdStr != "" {
+		if fd, err := strconv.Atoi(fdStr); err == nil {
+			u.readyFile = os.NewFile(uintptr(fd), "upgrade-ready")
+		}
+	}
+	// the variables must not leak into processes started later
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReadyFD)
+	return u
+}
+
+// listenerKey identifies a listening socket across processes
+func listenerKey(network, addr string) string {
+	return network + ":" + addr
+}
+
+// IsUpgrade reports whether this process was started by Upgrade
+func (u *Upgrader) IsUpgrade() bool {
+	return u.readyFile != nil
+}
+
+// Listen returns the listener the parent process passed down for network and
+// addr, or opens a new one. Either way the listener is handed over on the next Upgrade.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	key := listenerKey(network, addr)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if f, ok := u.inherited[key]; ok {
+		delete(u.inherited, key)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to adopt inherited listener %s: %w", key, err)
+		}
+		log.Printf("Upgrade: adopted listener %s from the previous process", key)
+		u.listeners[key] = l
+		return l, nil
+	}
+	for i, a := range u.activated {
+		if !matchesAddr(network, addr, a.l.Addr()) {
+			continue
+		}
+		u.activated = append(u.activated[:i], u.activated[i+1:]...)
+		log.Printf("Socket activation: serving %s on the socket passed by systemd (%s)", key, a.name)
+		u.listeners[key] = a.l
+		return a.l, nil
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	u.listeners[key] = l
+	return l, nil
+}
+
+// Ready tells the parent process that this process is serving, so it can stop
+// accepting and drain. Inherited listeners that were not adopted (because the
+// configuration changed) are closed, as are sockets passed by systemd that no
+// configured listener uses. Without a parent it does nothing else.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, f := range u.inherited {
+		log.Printf("Upgrade: closing unused inherited listener %s", key)
+		f.Close()
+		delete(u.inherited, key)
+	}
+	for _, a := range u.activated {
+		log.Printf("Warning: socket %s (%s) passed by systemd matches no configured listen address", a.l.Addr(), a.name)
+		a.l.Close()
+	}
+	u.activated = nil
+	if u.readyFile == nil {
+		return nil
+	}
+	defer func() {
+		u.readyFile.Close()
+		u.readyFile = nil
+	}()
+	if _, err := u.readyFile.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to notify the previous process: %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts a new instance of the executable with the same arguments and
+// hands it all listeners. It returns the new process's PID once that process
+// called Ready, or an error (after killing it) if it exited or did not become
+// ready within timeout. The caller then stops accepting and drains.
+func (u *Upgrader) Upgrade(timeout time.Duration) (int, error) {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return 0, ErrUpgradeInProgress
+	}
+	u.upgrading = true
+	files, spec, err := u.listenerFilesLocked()
+	u.mu.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate executable: %w", err)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	// ExtraFiles[i] becomes descriptor 3+i in the new process
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+spec,
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start %s: %w", executable, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+		// the pipe closed without a byte: the process exited or closed it early
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process %d did not report readiness: %v", cmd.Process.Pid, err)
+	case err := <-exited:
+		return 0, fmt.Errorf("new process exited before becoming ready: %v", err)
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new process %d did not become ready within %v", cmd.Process.Pid, timeout)
+	}
+}
+
+// listenerFilesLocked duplicates the descriptors of all listeners for the new process
+func (u *Upgrader) listenerFilesLocked() ([]*os.File, string, error) {
+	var files []*os.File
+	var spec []string
+	for key, l := range u.listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return files, "", fmt.Errorf("listener %s cannot be handed over", key)
+		}
+		f, err := fl.File()
+		if errors.Is(err, net.ErrClosed) {
+			delete(u.listeners, key) // shut down by this process, nothing to hand over
+			continue
+		}
+		if err != nil {
+			return files, "", fmt.Errorf("failed to duplicate listener %s: %w", key, err)
+		}
+		spec = append(spec, key+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	return files, strings.Join(spec, ","), nil
+}
+
+// WritePIDFile writes the PID of this process to path
+func WritePIDFile(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write PID file: %w", err)
+	}
+	return nil
+}
+
+// RemovePIDFile removes path if it still holds the PID of this process, so a
+// process that was upgraded away leaves its successor's PID file alone
+func RemovePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(path)
+}
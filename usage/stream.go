@@ -0,0 +1,211 @@
+package usage
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventTypeUsage is the type of the periodic usage events
+const EventTypeUsage = "usage"
+
+// Publisher delivers usage events to an external sink, such as a webhook or a
+// message bus subject
+type Publisher interface {
+	Send(payload any) error
+}
+
+// Traffic is what a user or proxy relayed during the period of an event
+type Traffic struct {
+	BytesUp   uint64 `json:"bytes_up"`   // client -> destination
+	BytesDown uint64 `json:"bytes_down"` // destination -> client
+	// SessionsStarted counts the sessions opened during the period and
+	// SessionsActive those still open at its end
+	SessionsStarted uint64 `json:"sessions_started"`
+	SessionsActive  int    `json:"sessions_active"`
+}
+
+// UserTraffic is the traffic of one user in an event
+type UserTraffic struct {
+	Username string `json:"username"`
+	Traffic
+}
+
+// ProxyTraffic is the traffic through one upstream proxy in an event
+type ProxyTraffic struct {
+	ProxyID      string `json:"proxy_id,omitempty"`
+	ProxyAddress string `json:"proxy_address"`
+	Traffic
+}
+
+// Event is the traffic of every user and upstream proxy since the previous event
+type Event struct {
+	Type    string         `json:"type"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Users   []UserTraffic  `json:"users"`
+	Proxies []ProxyTraffic `json:"proxies"`
+}
+
+// proxyKey identifies an upstream proxy in a Collector
+type proxyKey struct {
+	id      string
+	address string
+}
+
+// Collector accumulates the traffic of users and upstream proxies between
+// events. Unlike Store it keeps nothing once an event has been taken.
+type Collector struct {
+	mu      sync.Mutex
+	start   time.Time
+	users   map[string]*Traffic
+	proxies map[proxyKey]*Traffic
+	tallies map[*Tally]struct{}
+}
+
+// NewCollector returns an empty collector whose first period starts now
+func NewCollector() *Collector {
+	return &Collector{
+		start:   time.Now(),
+		users:   make(map[string]*Traffic),
+		proxies: make(map[proxyKey]*Traffic),
+		tallies: make(map[*Tally]struct{}),
+	}
+}
+
+// Tally counts the traffic of one session until it is taken by an event
+type Tally struct {
+	collector *Collector
+	username  string
+	proxy     proxyKey
+	up        atomic.Uint64
+	down      atomic.Uint64
+}
+
+// Tally starts counting a session of username through the given proxy. A nil
+// collector returns a nil Tally, which records nothing.
+func (c *Collector) Tally(username, proxyID, proxyAddress string) *Tally {
+	if c == nil {
+		return nil
+	}
+	t := &Tally{collector: c, username: username, proxy: proxyKey{id: proxyID, address: proxyAddress}}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tallies[t] = struct{}{}
+	c.userLocked(username).SessionsStarted++
+	c.proxyLocked(t.proxy).SessionsStarted++
+	return t
+}
+
+// AddUp records n bytes sent from the client towards the destination
+func (t *Tally) AddUp(n int) {
+	if t != nil {
+		t.up.Add(uint64(n))
+	}
+}
+
+// AddDown records n bytes sent from the destination back to the client
+func (t *Tally) AddDown(n int) {
+	if t != nil {
+		t.down.Add(uint64(n))
+	}
+}
+
+// Close adds the remaining traffic to the collector and stops counting
+func (t *Tally) Close() {
+	if t == nil {
+		return
+	}
+	c := t.collector
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tallies, t)
+	c.collectLocked(t)
+}
+
+// collectLocked moves the traffic counted by t into the collector. The caller must hold c.mu.
+func (c *Collector) collectLocked(t *Tally) {
+	up, down := t.up.Swap(0), t.down.Swap(0)
+	user, proxy := c.userLocked(t.username), c.proxyLocked(t.proxy)
+	user.BytesUp += up
+	user.BytesDown += down
+	proxy.BytesUp += up
+	proxy.BytesDown += down
+}
+
+func (c *Collector) userLocked(username string) *Traffic {
+	traffic, ok := c.users[username]
+	if !ok {
+		traffic = &Traffic{}
+		c.users[username] = traffic
+	}
+	return traffic
+}
+
+func (c *Collector) proxyLocked(key proxyKey) *Traffic {
+	traffic, ok := c.proxies[key]
+	if !ok {
+		traffic = &Traffic{}
+		c.proxies[key] = traffic
+	}
+	return traffic
+}
+
+// Take returns the traffic since the previous call and starts a new period.
+// Users and proxies without traffic or open sessions are left out.
+func (c *Collector) Take() Event {
+	c.mu.Lock()
+	for t := range c.tallies {
+		c.collectLocked(t)
+		c.userLocked(t.username).SessionsActive++
+		c.proxyLocked(t.proxy).SessionsActive++
+	}
+	users, proxies := c.users, c.proxies
+	event := Event{Type: EventTypeUsage, Start: c.start, End: time.Now(), Users: []UserTraffic{}, Proxies: []ProxyTraffic{}}
+	c.start = event.End
+	c.users = make(map[string]*Traffic)
+	c.proxies = make(map[proxyKey]*Traffic)
+	c.mu.Unlock()
+
+	for username, traffic := range users {
+		event.Users = append(event.Users, UserTraffic{Username: username, Traffic: *traffic})
+	}
+	for key, traffic := range proxies {
+		event.Proxies = append(event.Proxies, ProxyTraffic{ProxyID: key.id, ProxyAddress: key.address, Traffic: *traffic})
+	}
+	slices.SortFunc(event.Users, func(a, b UserTraffic) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	slices.SortFunc(event.Proxies, func(a, b ProxyTraffic) int {
+		return strings.Compare(a.ProxyAddress, b.ProxyAddress)
+	})
+	return event
+}
+
+// Stream publishes an event to every publisher each interval until stop is
+// closed. Periods without traffic or open sessions are skipped. An event that
+// a publisher fails to take is not retried; the monthly Store stays the
+// authoritative record for billing.
+func (c *Collector) Stream(interval time.Duration, publishers map[string]Publisher, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			event := c.Take()
+			if len(event.Users) == 0 {
+				continue
+			}
+			for name, publisher := range publishers {
+				if err := publisher.Send(event); err != nil {
+					log.Printf("Failed to publish usage event to %s: %v", name, err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
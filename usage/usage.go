@@ -0,0 +1,367 @@
+// Package usage accumulates the bytes each SOCKS user relays per calendar month
+// (UTC) and persists the counters to a JSON file, so usage can be exported for
+// billing after restarts.
+package usage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MonthLayout is the format of month keys, e.g. "2024-06"
+const MonthLayout = "2006-01"
+
+// DefaultRetentionMonths is how many months of counters are kept, including the current one
+const DefaultRetentionMonths = 24
+
+// meterFlushBytes is how much traffic a Meter buffers before adding it to the store
+const meterFlushBytes = 1 << 20
+
+// Counter is the usage of one user in one month
+type Counter struct {
+	BytesUp   uint64 `json:"bytes_up"`   // client -> destination
+	BytesDown uint64 `json:"bytes_down"` // destination -> client
+	Sessions  uint64 `json:"sessions"`
+}
+
+// UserUsage is the usage of one user in a report
+type UserUsage struct {
+	Username string `json:"username"`
+	Counter
+	BytesTotal uint64 `json:"bytes_total"`
+}
+
+// Report is the usage of every user in a month
+type Report struct {
+	Month string      `json:"month"`
+	Users []UserUsage `json:"users"`
+}
+
+// months maps a month to the counters of its users
+type months map[string]map[string]*Counter
+
+// add adds c to the counter of username in month
+func (m months) add(month, username string, c Counter) {
+	users, ok := m[month]
+	if !ok {
+		users = make(map[string]*Counter)
+		m[month] = users
+	}
+	counter, ok := users[username]
+	if !ok {
+		counter = &Counter{}
+		users[username] = counter
+	}
+	counter.BytesUp += c.BytesUp
+	counter.BytesDown += c.BytesDown
+	counter.Sessions += c.Sessions
+}
+
+// Store holds the monthly counters. Traffic is buffered in memory and merged
+// into the file on Flush, so the old and the new process of an upgrade can
+// share the file without overwriting each other's counts.
+type Store struct {
+	filePath  string
+	retention int
+	now       func() time.Time
+
+	flushMu sync.Mutex // orders flushes within the process
+	mu      sync.Mutex
+	saved   months // the file as of the last load or flush
+	pending months // traffic not yet merged into the file
+	meters  map[*Meter]struct{}
+}
+
+// Open loads the counters from filePath, which may not exist yet. retention is
+// how many months are kept; older months are dropped on Flush.
+func Open(filePath string, retention int) (*Store, error) {
+	if retention <= 0 {
+		retention = DefaultRetentionMonths
+	}
+	saved, err := readFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		filePath:  filePath,
+		retention: retention,
+		now:       time.Now,
+		saved:     saved,
+		pending:   make(months),
+		meters:    make(map[*Meter]struct{}),
+	}, nil
+}
+
+// readFile loads the counters of filePath; a missing file has none
+func readFile(filePath string) (months, error) {
+	m := make(months)
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse usage file %q: %w", filePath, err)
+	}
+	for month, users := range m {
+		if _, err := time.Parse(MonthLayout, month); err != nil || users == nil {
+			return nil, fmt.Errorf("invalid month '%s' in usage file %q", month, filePath)
+		}
+	}
+	return m, nil
+}
+
+// Add adds traffic of username to the current month
+func (s *Store) Add(username string, up, down, sessions uint64) {
+	if up == 0 && down == 0 && sessions == 0 {
+		return
+	}
+	month := s.CurrentMonth()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.add(month, username, Counter{BytesUp: up, BytesDown: down, Sessions: sessions})
+}
+
+// Report returns the usage of month ("2006-01"), ordered by username. A month
+// without traffic has no users.
+func (s *Store) Report(month string) Report {
+	merged := make(months)
+	s.mu.Lock()
+	for username, counter := range s.saved[month] {
+		merged.add(month, username, *counter)
+	}
+	for username, counter := range s.pending[month] {
+		merged.add(month, username, *counter)
+	}
+	s.mu.Unlock()
+
+	report := Report{Month: month, Users: []UserUsage{}}
+	for username, counter := range merged[month] {
+		report.Users = append(report.Users, UserUsage{
+			Username:   username,
+			Counter:    *counter,
+			BytesTotal: counter.BytesUp + counter.BytesDown,
+		})
+	}
+	slices.SortFunc(report.Users, func(a, b UserUsage) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return report
+}
+
+// CurrentMonth returns the key of the month traffic is currently added to
+func (s *Store) CurrentMonth() string {
+	return s.now().UTC().Format(MonthLayout)
+}
+
+// Flush merges the buffered traffic into the file, dropping months past the
+// retention. The file is locked while it is read and atomically replaced.
+func (s *Store) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	meters := make([]*Meter, 0, len(s.meters))
+	for m := range s.meters {
+		meters = append(meters, m)
+	}
+	s.mu.Unlock()
+	// collect what long-running sessions buffered, so they are billed in the month the traffic flowed
+	for _, m := range meters {
+		m.flush()
+	}
+
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(months)
+	s.mu.Unlock()
+
+	saved, err := s.merge(pending)
+	if err != nil {
+		// keep the traffic for the next flush
+		s.mu.Lock()
+		for month, users := range pending {
+			for username, counter := range users {
+				s.pending.add(month, username, *counter)
+			}
+		}
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	s.saved = saved
+	s.mu.Unlock()
+	return nil
+}
+
+// merge adds pending to the counters in the file and writes the result
+func (s *Store) merge(pending months) (months, error) {
+	lock, err := os.OpenFile(s.filePath+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage lock file: %w", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return nil, fmt.Errorf("failed to lock usage file: %w", err)
+	}
+	defer unlockFile(lock)
+
+	saved, err := readFile(s.filePath)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for month, users := range pending {
+		for username, counter := range users {
+			saved.add(month, username, *counter)
+			changed = true
+		}
+	}
+	oldest := s.now().UTC().AddDate(0, -(s.retention - 1), 0).Format(MonthLayout)
+	for month := range saved {
+		if month < oldest {
+			delete(saved, month)
+			changed = true
+		}
+	}
+	if !changed {
+		return saved, nil
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal usage JSON: %w", err)
+	}
+	if err := writeFile(s.filePath, append(data, '\n')); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// Run flushes the store every interval until stop is closed
+func (s *Store) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("Failed to save usage: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writeFile atomically replaces filePath with data
+func writeFile(filePath string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp usage file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp usage file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp usage file: %w", err)
+	}
+	if err := os.Rename(tmpName, filePath); err != nil {
+		return fmt.Errorf("failed to replace usage file %q: %w", filePath, err)
+	}
+	return nil
+}
+
+// WriteCSV writes report as CSV with a header line
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "username", "bytes_up", "bytes_down", "bytes_total", "sessions"})
+	for _, u := range r.Users {
+		cw.Write([]string{
+			r.Month,
+			u.Username,
+			strconv.FormatUint(u.BytesUp, 10),
+			strconv.FormatUint(u.BytesDown, 10),
+			strconv.FormatUint(u.BytesTotal, 10),
+			strconv.FormatUint(u.Sessions, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Meter buffers the traffic of one session and adds it to the store in chunks
+// and on every Flush, so relays don't contend on the store lock for every read
+type Meter struct {
+	store    *Store
+	username string
+	up       atomic.Uint64
+	down     atomic.Uint64
+}
+
+// Meter starts metering a session of username and counts it. A nil store
+// returns a nil Meter, which records nothing.
+func (s *Store) Meter(username string) *Meter {
+	if s == nil {
+		return nil
+	}
+	m := &Meter{store: s, username: username}
+	s.Add(username, 0, 0, 1)
+	s.mu.Lock()
+	s.meters[m] = struct{}{}
+	s.mu.Unlock()
+	return m
+}
+
+// AddUp records n bytes sent from the client towards the destination
+func (m *Meter) AddUp(n int) {
+	if m == nil {
+		return
+	}
+	if m.up.Add(uint64(n)) >= meterFlushBytes {
+		m.store.Add(m.username, m.up.Swap(0), 0, 0)
+	}
+}
+
+// AddDown records n bytes sent from the destination back to the client
+func (m *Meter) AddDown(n int) {
+	if m == nil {
+		return
+	}
+	if m.down.Add(uint64(n)) >= meterFlushBytes {
+		m.store.Add(m.username, 0, m.down.Swap(0), 0)
+	}
+}
+
+// flush adds the buffered traffic to the store
+func (m *Meter) flush() {
+	m.store.Add(m.username, m.up.Swap(0), m.down.Swap(0), 0)
+}
+
+// Close adds the buffered traffic to the store and stops metering
+func (m *Meter) Close() {
+	if m == nil {
+		return
+	}
+	m.store.mu.Lock()
+	delete(m.store.meters, m)
+	m.store.mu.Unlock()
+	m.flush()
+}
@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Notifier POSTs JSON payloads to a configured webhook URL
+type Notifier struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// New creates a Notifier for url. A zero timeout defaults to 10 seconds.
+func New(url string, timeout time.Duration) *Notifier {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Notifier{
+		url:     url,
+		timeout: timeout,
+		client:  &http.Client{},
+	}
+}
+
+// Send marshals payload to JSON and POSTs it to the webhook URL
+func (n *Notifier) Send(payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned unexpected status %s", resp.Status)
+	}
+	return nil
+}